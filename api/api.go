@@ -0,0 +1,409 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	mse "github.com/strugglebak/goMule/mse"
+	peerId "github.com/strugglebak/goMule/peer_id"
+	session "github.com/strugglebak/goMule/session"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// daemon 模式下的 HTTP JSON API，所有请求和响应的 body 都是 JSON
+//
+//   GET    /api/torrents                      列出所有种子
+//   POST   /api/torrents                      加入种子，multipart 的 torrent 字段上传文件，或者 JSON {"url": ...}
+//   GET    /api/torrents/<info hash>          一个种子的详细状态，包括正在连接的 peer
+//   POST   /api/torrents/<info hash>/pause    暂停
+//   POST   /api/torrents/<info hash>/resume   恢复
+//   DELETE /api/torrents/<info hash>          移除，?delete_data=true 时同时删除数据
+//   GET    /api/settings                      当前设置
+//   PUT    /api/settings                      修改设置，没有出现的字段保持不变
+//
+// 每个请求都要在 X-GoMule-Token 头中带上 token，否则返回 401
+// 网页里的跨域请求不能设置这个头，所以其他网站无法通过浏览器操作 API (CSRF)
+// 带 JSON body 的请求必须是 Content-Type: application/json，否则返回 415
+//
+// 出错时返回 {"error": "..."}
+
+const (
+	TokenHeader = "X-GoMule-Token"
+
+	// 上传或者下载的 .torrent 文件大小上限
+	maxTorrentSize = 10 << 20
+	fetchTimeout   = 30 * time.Second
+)
+
+type handler struct {
+	session *session.Session
+	token   string
+	client  *http.Client // 通过 URL 加种子时用来下载 .torrent 文件
+}
+
+// token 不能为空，客户端必须在 TokenHeader 中带上它
+func NewHandler(s *session.Session, token string) http.Handler {
+	if token == "" {
+		panic("api: empty token")
+	}
+	return &handler{
+		session: s,
+		token:   token,
+		client:  &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+type peerJSON struct {
+	Address    string `json:"address"`
+	Client     string `json:"client"` // 从 peer ID 认出的客户端
+	Downloaded int64  `json:"downloaded"`
+}
+
+type torrentJSON struct {
+	InfoHash     string     `json:"info_hash"`
+	Name         string     `json:"name"`
+	State        string     `json:"state"`
+	Length       int        `json:"length"`
+	Progress     float64    `json:"progress"` // 0 到 1 之间，只算需要下载的 piece
+	PiecesDone   int        `json:"pieces_done"`
+	PiecesWanted int        `json:"pieces_wanted"`
+	Downloaded   int64      `json:"downloaded"`
+	Uploaded     int64      `json:"uploaded"`
+	DownloadRate int64      `json:"download_rate"`
+	UploadRate   int64      `json:"upload_rate"`
+	ETA          int64      `json:"eta"` // 剩余的秒数，不知道时为 -1
+	PeerCount    int        `json:"peer_count"`
+	Peers        []peerJSON `json:"peers,omitempty"` // 只在单个种子的详情中出现
+	Error        *string    `json:"error"`
+	AddedAt      time.Time  `json:"added_at"`
+}
+
+type settingsJSON struct {
+	DownloadRate       *int    `json:"download_rate,omitempty"`
+	UploadRate         *int    `json:"upload_rate,omitempty"`
+	MaxPeers           *int    `json:"max_peers,omitempty"`
+	MaxActiveDownloads *int    `json:"max_active_downloads,omitempty"`
+	MaxActiveSeeds     *int    `json:"max_active_seeds,omitempty"`
+	Encryption         *string `json:"encryption,omitempty"`
+}
+
+type addRequest struct {
+	URL    string `json:"url"`
+	Paused bool   `json:"paused"`
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(TokenHeader)), []byte(h.token)) != 1 {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid %s header", TokenHeader))
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || parts[0] != "api" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "torrents":
+		switch r.Method {
+		case http.MethodGet:
+			h.listTorrents(w)
+		case http.MethodPost:
+			h.addTorrent(w, r)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	case len(parts) == 3 && parts[1] == "torrents":
+		t, ok := h.lookup(w, parts[2])
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, toJSON(t.Status(), true))
+		case http.MethodDelete:
+			deleteData := r.URL.Query().Get("delete_data") == "true"
+			if err := h.session.Remove(t.File.InfoHash, deleteData); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+	case len(parts) == 4 && parts[1] == "torrents" && (parts[3] == "pause" || parts[3] == "resume"):
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		t, ok := h.lookup(w, parts[2])
+		if !ok {
+			return
+		}
+		action := h.session.Pause
+		if parts[3] == "resume" {
+			action = h.session.Resume
+		}
+		if err := action(t.File.InfoHash); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toJSON(t.Status(), false))
+	case len(parts) == 2 && parts[1] == "settings":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, settingsToJSON(h.session.Settings()))
+		case http.MethodPut, http.MethodPatch:
+			h.updateSettings(w, r)
+		default:
+			methodNotAllowed(w, "GET, PUT, PATCH")
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	}
+}
+
+func (h *handler) listTorrents(w http.ResponseWriter) {
+	torrents := []torrentJSON{}
+	for _, t := range h.session.Torrents() {
+		torrents = append(torrents, toJSON(t.Status(), false))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"torrents": torrents})
+}
+
+func (h *handler) addTorrent(w http.ResponseWriter, r *http.Request) {
+	var buffer []byte
+	var paused bool
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err := r.ParseMultipartForm(maxTorrentSize)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		file, _, err := r.FormFile("torrent")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("missing torrent file: %w", err))
+			return
+		}
+		defer file.Close()
+		buffer, err = readLimited(file)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		paused = r.FormValue("paused") == "true"
+	} else {
+		if !isJSON(r) {
+			writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("expected multipart/form-data or application/json"))
+			return
+		}
+		request := addRequest{}
+		err := json.NewDecoder(io.LimitReader(r.Body, maxTorrentSize)).Decode(&request)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+		if request.URL == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("expected a torrent file or url"))
+			return
+		}
+		// 从 magnet 链接拿到 info 字典需要 BEP 9 (ut_metadata)，goMule 还没有实现
+		// 这部分单独列在 README 的 Roadmaps 中，实现之后这里改成先下载 info 字典再加种子
+		if strings.HasPrefix(request.URL, "magnet:") {
+			writeError(w, http.StatusNotImplemented, fmt.Errorf("adding magnet links is not supported yet, fetching metadata from peers (BEP 9) is not implemented"))
+			return
+		}
+		buffer, err = h.fetch(request.URL)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		paused = request.Paused
+	}
+
+	tf, err := torrentFile.Parse(buffer)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := h.session.Get(tf.InfoHash); ok {
+		writeError(w, http.StatusConflict, fmt.Errorf("torrent %x is already in the session", tf.InfoHash))
+		return
+	}
+	t, err := h.session.Add(buffer, session.AddOptions{Paused: paused})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toJSON(t.Status(), false))
+}
+
+// 下载 url 指向的 .torrent 文件
+func (h *handler) fetch(url string) ([]byte, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("unsupported url %q", url)
+	}
+	response, err := h.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, response.Status)
+	}
+	return readLimited(response.Body)
+}
+
+// 表单和 text/plain 的 POST 不需要 CORS 预检，只接受 application/json 的 body
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+func readLimited(reader io.Reader) ([]byte, error) {
+	buffer, err := ioutil.ReadAll(io.LimitReader(reader, maxTorrentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buffer) > maxTorrentSize {
+		return nil, fmt.Errorf("torrent file is larger than %d bytes", maxTorrentSize)
+	}
+	return buffer, nil
+}
+
+func (h *handler) updateSettings(w http.ResponseWriter, r *http.Request) {
+	if !isJSON(r) {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("expected application/json"))
+		return
+	}
+	request := settingsJSON{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	settings := h.session.Settings()
+	for _, field := range []struct {
+		value  *int
+		target *int
+	}{
+		{request.DownloadRate, &settings.DownloadRate},
+		{request.UploadRate, &settings.UploadRate},
+		{request.MaxPeers, &settings.MaxPeers},
+		{request.MaxActiveDownloads, &settings.MaxActiveDownloads},
+		{request.MaxActiveSeeds, &settings.MaxActiveSeeds},
+	} {
+		if field.value != nil {
+			*field.target = *field.value
+		}
+	}
+	if request.Encryption != nil {
+		settings.Encryption, err = mse.ParsePolicy(*request.Encryption)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := h.session.SetSettings(settings); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, settingsToJSON(h.session.Settings()))
+}
+
+// 根据 URL 中十六进制的 info hash 找到种子，找不到时直接写错误
+func (h *handler) lookup(w http.ResponseWriter, value string) (*session.Torrent, bool) {
+	var infoHash [20]byte
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) != len(infoHash) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid info hash %q", value))
+		return nil, false
+	}
+	copy(infoHash[:], decoded)
+	t, ok := h.session.Get(infoHash)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("torrent %x is not in the session", infoHash))
+		return nil, false
+	}
+	return t, true
+}
+
+func toJSON(status session.Status, withPeers bool) torrentJSON {
+	result := torrentJSON{
+		InfoHash:     hex.EncodeToString(status.InfoHash[:]),
+		Name:         status.Name,
+		State:        string(status.State),
+		Length:       status.Length,
+		PiecesDone:   status.Done,
+		PiecesWanted: status.Wanted,
+		Downloaded:   status.Downloaded,
+		Uploaded:     status.Uploaded,
+		DownloadRate: status.DownloadRate,
+		UploadRate:   status.UploadRate,
+		ETA:          eta(status),
+		PeerCount:    len(status.Peers),
+		AddedAt:      status.AddedAt,
+	}
+	if status.Wanted > 0 {
+		result.Progress = float64(status.Done) / float64(status.Wanted)
+	}
+	if status.Error != nil {
+		message := status.Error.Error()
+		result.Error = &message
+	}
+	if withPeers {
+		result.Peers = []peerJSON{}
+		for _, peer := range status.Peers {
+			result.Peers = append(result.Peers, peerJSON{Address: peer.Peer.String(), Client: peerId.Describe(peer.PeerID), Downloaded: peer.Downloaded})
+		}
+	}
+	return result
+}
+
+// 按照最近的下载速度估计剩余的秒数
+func eta(status session.Status) int64 {
+	if status.Left == 0 {
+		return 0
+	}
+	if status.DownloadRate <= 0 {
+		return -1
+	}
+	return (status.Left + status.DownloadRate - 1) / status.DownloadRate
+}
+
+func settingsToJSON(settings session.Settings) settingsJSON {
+	encryption := settings.Encryption.String()
+	return settingsJSON{
+		DownloadRate:       &settings.DownloadRate,
+		UploadRate:         &settings.UploadRate,
+		MaxPeers:           &settings.MaxPeers,
+		MaxActiveDownloads: &settings.MaxActiveDownloads,
+		MaxActiveSeeds:     &settings.MaxActiveSeeds,
+		Encryption:         &encryption,
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	session "github.com/strugglebak/goMule/session"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// 在 dir 下生成一个随机内容的文件，返回它的种子
+func createTorrent(t *testing.T, dir, name string) []byte {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(int64(len(name)))).Read(data)
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, data, 0644))
+
+	var buffer bytes.Buffer
+	_, err := torrentFile.Create(path, torrentFile.CreateOptions{PieceLength: 16384}, &buffer)
+	require.Nil(t, err)
+	return buffer.Bytes()
+}
+
+const testToken = "secret"
+
+func startServer(t *testing.T, dataDir string) (*httptest.Server, *session.Session) {
+	s, err := session.New(session.Config{DataDir: dataDir, StateDir: t.TempDir()})
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	server := httptest.NewServer(NewHandler(s, testToken))
+	t.Cleanup(server.Close)
+	return server, s
+}
+
+// 发送请求，把响应的 body 解析到 result 中，返回状态码
+func call(t *testing.T, method, url, contentType string, body []byte, result interface{}) int {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.Nil(t, err)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	request.Header.Set(TokenHeader, testToken)
+	response, err := http.DefaultClient.Do(request)
+	require.Nil(t, err)
+	defer response.Body.Close()
+	if result != nil {
+		require.Nil(t, json.NewDecoder(response.Body).Decode(result))
+	}
+	return response.StatusCode
+}
+
+func upload(t *testing.T, url string, buffer []byte, result interface{}) int {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("torrent", "upload.torrent")
+	require.Nil(t, err)
+	part.Write(buffer)
+	writer.WriteField("paused", "true")
+	require.Nil(t, writer.Close())
+	return call(t, http.MethodPost, url, writer.FormDataContentType(), body.Bytes(), result)
+}
+
+func TestAddAndList(t *testing.T) {
+	dataDir := t.TempDir()
+	server, _ := startServer(t, dataDir)
+
+	// 上传文件
+	added := torrentJSON{}
+	code := upload(t, server.URL+"/api/torrents", createTorrent(t, t.TempDir(), "uploaded"), &added)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "uploaded", added.Name)
+	assert.Equal(t, "paused", added.State)
+	assert.Nil(t, added.Error)
+
+	// 通过 URL 下载种子，数据已经在磁盘上了，校验之后开始做种
+	buffer := createTorrent(t, dataDir, "fetched")
+	torrentServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buffer)
+	}))
+	defer torrentServer.Close()
+	body, _ := json.Marshal(addRequest{URL: torrentServer.URL + "/fetched.torrent"})
+	code = call(t, http.MethodPost, server.URL+"/api/torrents", "application/json", body, &added)
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "fetched", added.Name)
+
+	// 重复添加
+	result := map[string]string{}
+	code = call(t, http.MethodPost, server.URL+"/api/torrents", "application/json", body, &result)
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Contains(t, result["error"], "already")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list := struct {
+			Torrents []torrentJSON `json:"torrents"`
+		}{}
+		require.Equal(t, http.StatusOK, call(t, http.MethodGet, server.URL+"/api/torrents", "", nil, &list))
+		require.Len(t, list.Torrents, 2)
+		assert.Equal(t, "uploaded", list.Torrents[0].Name)
+		fetched := list.Torrents[1]
+		if fetched.State == "seeding" {
+			assert.Equal(t, 1.0, fetched.Progress)
+			assert.Equal(t, 7, fetched.PiecesDone)
+			assert.Equal(t, int64(0), fetched.ETA)
+			assert.Equal(t, added.InfoHash, fetched.InfoHash)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fetched is %s, expected seeding", fetched.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAddErrors(t *testing.T) {
+	server, _ := startServer(t, t.TempDir())
+	url := server.URL + "/api/torrents"
+	result := map[string]string{}
+
+	// 还不支持 magnet 链接
+	body := []byte(`{"url": "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"}`)
+	assert.Equal(t, http.StatusNotImplemented, call(t, http.MethodPost, url, "application/json", body, &result))
+	assert.Contains(t, result["error"], "BEP 9")
+
+	assert.Equal(t, http.StatusBadRequest, call(t, http.MethodPost, url, "application/json", []byte(`{}`), &result))
+	assert.Equal(t, http.StatusBadRequest, call(t, http.MethodPost, url, "application/json", []byte(`not json`), &result))
+	assert.Equal(t, http.StatusBadRequest, upload(t, url, []byte("not a torrent"), &result))
+	assert.Equal(t, http.StatusBadGateway, call(t, http.MethodPost, url, "application/json", []byte(`{"url": "ftp://example.com/a.torrent"}`), &result))
+	assert.Equal(t, http.StatusMethodNotAllowed, call(t, http.MethodPut, url, "", nil, &result))
+	assert.Equal(t, http.StatusNotFound, call(t, http.MethodGet, server.URL+"/api/unknown", "", nil, &result))
+}
+
+func TestControlTorrent(t *testing.T) {
+	server, s := startServer(t, t.TempDir())
+	added := torrentJSON{}
+	require.Equal(t, http.StatusCreated, upload(t, server.URL+"/api/torrents", createTorrent(t, t.TempDir(), "control"), &added))
+	url := server.URL + "/api/torrents/" + added.InfoHash
+
+	detail := torrentJSON{}
+	require.Equal(t, http.StatusOK, call(t, http.MethodGet, url, "", nil, &detail))
+	assert.Equal(t, "control", detail.Name)
+	assert.Empty(t, detail.Peers)
+	assert.Equal(t, int64(-1), detail.ETA)
+
+	// 种子里没有 tracker，恢复之后下载会出错
+	require.Equal(t, http.StatusOK, call(t, http.MethodPost, url+"/resume", "", nil, &detail))
+	deadline := time.Now().Add(5 * time.Second)
+	for detail.State != "error" {
+		require.True(t, time.Now().Before(deadline), "state is %s", detail.State)
+		time.Sleep(10 * time.Millisecond)
+		call(t, http.MethodGet, url, "", nil, &detail)
+	}
+	require.NotNil(t, detail.Error)
+
+	require.Equal(t, http.StatusOK, call(t, http.MethodPost, url+"/pause", "", nil, &detail))
+	assert.Equal(t, "paused", detail.State)
+
+	require.Equal(t, http.StatusNoContent, call(t, http.MethodDelete, url+"?delete_data=true", "", nil, nil))
+	assert.Empty(t, s.Torrents())
+
+	result := map[string]string{}
+	assert.Equal(t, http.StatusNotFound, call(t, http.MethodGet, url, "", nil, &result))
+	assert.Equal(t, http.StatusBadRequest, call(t, http.MethodGet, server.URL+"/api/torrents/xyz", "", nil, &result))
+	assert.Equal(t, http.StatusMethodNotAllowed, call(t, http.MethodGet, url+"/pause", "", nil, &result))
+}
+
+func TestSettings(t *testing.T) {
+	server, s := startServer(t, t.TempDir())
+	url := server.URL + "/api/settings"
+
+	settings := map[string]interface{}{}
+	require.Equal(t, http.StatusOK, call(t, http.MethodGet, url, "", nil, &settings))
+	assert.Equal(t, map[string]interface{}{
+		"download_rate":        0.0,
+		"upload_rate":          0.0,
+		"max_peers":            0.0,
+		"max_active_downloads": 0.0,
+		"max_active_seeds":     0.0,
+		"encryption":           "disable",
+	}, settings)
+
+	// 只修改出现的字段
+	body := []byte(`{"download_rate": 1024, "encryption": "require"}`)
+	require.Equal(t, http.StatusOK, call(t, http.MethodPut, url, "application/json", body, &settings))
+	assert.Equal(t, 1024.0, settings["download_rate"])
+	assert.Equal(t, "require", settings["encryption"])
+	assert.Equal(t, 1024, s.Settings().DownloadRate)
+
+	result := map[string]string{}
+	assert.Equal(t, http.StatusBadRequest, call(t, http.MethodPatch, url, "application/json", []byte(`{"max_peers": -1}`), &result))
+	assert.Equal(t, http.StatusBadRequest, call(t, http.MethodPatch, url, "application/json", []byte(`{"encryption": "maybe"}`), &result))
+	assert.Equal(t, 1024, s.Settings().DownloadRate)
+}
+
+func TestAuth(t *testing.T) {
+	server, s := startServer(t, t.TempDir())
+	url := server.URL + "/api/torrents"
+
+	for name, token := range map[string]string{"missing": "", "wrong": "guess"} {
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		require.Nil(t, err)
+		if token != "" {
+			request.Header.Set(TokenHeader, token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		require.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode, name)
+	}
+
+	// 浏览器不经过 CORS 预检就能发出的 POST，即使带上了 token 也不接受
+	body := []byte(`{"url": "http://example.com/a.torrent"}`)
+	var result map[string]string
+	for _, contentType := range []string{"text/plain", "application/x-www-form-urlencoded", ""} {
+		assert.Equal(t, http.StatusUnsupportedMediaType, call(t, http.MethodPost, url, contentType, body, &result), contentType)
+	}
+	assert.Equal(t, http.StatusUnsupportedMediaType, call(t, http.MethodPut, server.URL+"/api/settings", "text/plain", []byte(`{"max_peers": 1}`), &result))
+	assert.Empty(t, s.Torrents())
+	assert.Equal(t, 0, s.Settings().MaxPeers)
+}
@@ -0,0 +1,277 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	listener "github.com/strugglebak/goMule/listener"
+	logging "github.com/strugglebak/goMule/logging"
+	lsd "github.com/strugglebak/goMule/lsd"
+	metrics "github.com/strugglebak/goMule/metrics"
+	mse "github.com/strugglebak/goMule/mse"
+	p2p "github.com/strugglebak/goMule/p2p"
+)
+
+// 退出码
+const (
+	ExitOK      = 0
+	ExitFailure = 1 // 命令执行失败
+	ExitUsage   = 2 // 参数错误
+	ExitInvalid = 3 // 校验发现数据和种子不一致
+)
+
+type command struct {
+	Name    string
+	Summary string
+	Run     func(args []string, stdout, stderr io.Writer) int
+}
+
+var commands = []command{
+	{"download", "download the content of a .torrent", runDownload},
+	{"seed", "seed existing data of a .torrent", runSeed},
+	{"info", "show the metadata of a .torrent", runInfo},
+	{"verify", "check existing data against a .torrent", runVerify},
+	{"create", "create a .torrent from a file or directory", runCreate},
+	{"magnet", "print the magnet link of a .torrent", runMagnet},
+	{"scrape", "ask the tracker how many peers seed and download a .torrent", runScrape},
+	{"daemon", "manage torrents in the background over HTTP and Transmission RPC", runDaemon},
+}
+
+// 执行 goMule 的子命令，args 不包括程序名，返回值作为进程的退出码
+func Run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		printUsage(stderr)
+		return ExitUsage
+	}
+
+	name := args[0]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		printUsage(stdout)
+		return ExitOK
+	}
+
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd.Run(args[1:], stdout, stderr)
+		}
+	}
+
+	fmt.Fprintf(stderr, "goMule: unknown command %q\n\n", name)
+	printUsage(stderr)
+	return ExitUsage
+}
+
+func printUsage(writer io.Writer) {
+	fmt.Fprintln(writer, "Usage: goMule <command> [flags] [arguments]")
+	fmt.Fprintln(writer)
+	fmt.Fprintln(writer, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(writer, "  %-10s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintln(writer)
+	fmt.Fprintln(writer, "Run 'goMule <command> -h' for the flags of a command.")
+}
+
+// 创建子命令的 FlagSet，错误输出到 stderr
+func newFlagSet(name, arguments string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: goMule %s [flags] %s\n\nFlags:\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// 解析参数并检查位置参数的数量
+// 返回值不为 -1 时，表示命令应该直接以这个退出码结束
+func parseFlags(flags *flag.FlagSet, args []string, nArgs int) int {
+	return parseFlagsBetween(flags, args, nArgs, nArgs)
+}
+
+// 和 parseFlags 一样，只不过位置参数的数量可以在 [minArgs, maxArgs] 之间
+func parseFlagsBetween(flags *flag.FlagSet, args []string, minArgs, maxArgs int) int {
+	err := flags.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return ExitOK
+	}
+	if err != nil {
+		return ExitUsage
+	}
+	if flags.NArg() < minArgs || flags.NArg() > maxArgs {
+		expected := strconv.Itoa(minArgs)
+		if minArgs != maxArgs {
+			expected = fmt.Sprintf("%d to %d", minArgs, maxArgs)
+		}
+		fmt.Fprintf(flags.Output(), "goMule %s: expected %s argument(s), got %d\n", flags.Name(), expected, flags.NArg())
+		flags.Usage()
+		return ExitUsage
+	}
+	return -1
+}
+
+func fail(stderr io.Writer, name string, err error) int {
+	fmt.Fprintf(stderr, "goMule %s: %v\n", name, err)
+	return ExitFailure
+}
+
+// 设置输出到 stderr 的默认 logger，标准库 log 的输出也会经过它
+// error 级别只输出出错的日志和命令最终的错误，debug 级别会输出每个 peer 的握手
+func setLogger(level, format string, stderr io.Writer) error {
+	logger, err := logging.New(stderr, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// byteSize 是一个可以带 K/M/G 后缀的 byte 数量，后缀以 1024 为单位
+type byteSize int
+
+func (size *byteSize) String() string {
+	return strconv.Itoa(int(*size))
+}
+
+func (size *byteSize) Set(value string) error {
+	value = strings.TrimSpace(strings.ToUpper(value))
+	value = strings.TrimSuffix(value, "B")
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*size = byteSize(n * multiplier)
+	return nil
+}
+
+// download 和 seed 共用的参数
+type transferFlags struct {
+	Port          int
+	OutputDir     string
+	MaxPeers      int
+	DownloadRate  byteSize
+	UploadRate    byteSize
+	Trackers      string
+	LogLevel      string
+	LogFormat     string
+	Encryption    string
+	IdleTimeout   time.Duration
+	LSD           bool
+	MetricsListen string
+}
+
+func addTransferFlags(flags *flag.FlagSet) *transferFlags {
+	options := &transferFlags{}
+	flags.IntVar(&options.Port, "port", 6881, "port to listen on and announce to trackers")
+	flags.StringVar(&options.OutputDir, "o", ".", "directory the content is saved to")
+	flags.IntVar(&options.MaxPeers, "max-peers", 0, "maximum number of connected peers, 0 means unlimited")
+	flags.Var(&options.DownloadRate, "download-rate", "download rate limit in bytes per second (K/M/G suffixes allowed), 0 means unlimited")
+	flags.Var(&options.UploadRate, "upload-rate", "upload rate limit in bytes per second (K/M/G suffixes allowed), 0 means unlimited")
+	flags.StringVar(&options.Trackers, "tracker", "", "comma separated tracker URLs overriding the ones in the .torrent")
+	flags.StringVar(&options.LogLevel, "log-level", "info", "log level: debug, info, warn or error")
+	flags.StringVar(&options.LogFormat, "log-format", "text", "log format: text (key=value) or json")
+	flags.StringVar(&options.Encryption, "encryption", "prefer", "peer connection encryption: prefer, require or disable")
+	flags.DurationVar(&options.IdleTimeout, "idle-timeout", p2p.DefaultIdleTimeout, "disconnect peers that neither send us data nor download from us for this long")
+	flags.BoolVar(&options.LSD, "lsd", true, "discover peers on the local network (BEP 14)")
+	flags.StringVar(&options.MetricsListen, "metrics-listen", "", "address to serve Prometheus metrics on at /metrics, e.g. :9100, empty means disabled")
+	return options
+}
+
+// 检查参数，并且设置日志级别
+func (options *transferFlags) apply(stderr io.Writer) error {
+	if options.Port <= 0 || options.Port > 65535 {
+		return fmt.Errorf("invalid port %d", options.Port)
+	}
+	if options.MaxPeers < 0 {
+		return fmt.Errorf("invalid max peers %d", options.MaxPeers)
+	}
+	if _, err := mse.ParsePolicy(options.Encryption); err != nil {
+		return err
+	}
+	if options.IdleTimeout <= 0 {
+		return fmt.Errorf("invalid idle timeout %s", options.IdleTimeout)
+	}
+	return setLogger(options.LogLevel, options.LogFormat, stderr)
+}
+
+func (options *transferFlags) trackers() []string {
+	return splitList(options.Trackers)
+}
+
+// apply 已经检查过，这里不会出错
+func (options *transferFlags) encryption() mse.Policy {
+	policy, _ := mse.ParsePolicy(options.Encryption)
+	return policy
+}
+
+// 开启了 --lsd 时加入局域网的多播组，失败时只打印日志，返回 nil
+func (options *transferFlags) localDiscovery() *lsd.Service {
+	if !options.LSD {
+		return nil
+	}
+	service, err := lsd.Listen(lsd.DefaultAddress, uint16(options.Port), nil)
+	if err != nil {
+		slog.Warn("could not start local service discovery", logging.Error(err))
+		return nil
+	}
+	return service
+}
+
+// 在 --port 上接受其他 peer 主动发起的连接
+func (options *transferFlags) listen() (*listener.Listener, error) {
+	return listener.Listen(fmt.Sprintf(":%d", options.Port), listener.Options{
+		Encryption: options.encryption(),
+		Logger:     slog.Default(),
+	})
+}
+
+// 设置了 --metrics-listen 时在 /metrics 上输出 collector 的指标，返回的函数用来关闭
+func (options *transferFlags) serveMetrics(collector *metrics.Collector) (stop func(), err error) {
+	if options.MetricsListen == "" {
+		return func() {}, nil
+	}
+	listener, err := net.Listen("tcp", options.MetricsListen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collector)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	slog.Info("serving metrics", slog.String("url", "http://"+listener.Addr().String()+"/metrics"))
+	return func() { server.Close() }, nil
+}
+
+// 以逗号分隔的列表，忽略空项
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
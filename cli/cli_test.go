@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func run(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := Run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunUsage(t *testing.T) {
+	tests := map[string]struct {
+		args []string
+		code int
+	}{
+		"no command":       {args: nil, code: ExitUsage},
+		"unknown command":  {args: []string{"frobnicate"}, code: ExitUsage},
+		"help":             {args: []string{"help"}, code: ExitOK},
+		"command help":     {args: []string{"download", "-h"}, code: ExitOK},
+		"missing argument": {args: []string{"download"}, code: ExitUsage},
+		"unknown flag":     {args: []string{"info", "--nope", "a.torrent"}, code: ExitUsage},
+		"bad rate":         {args: []string{"download", "--download-rate", "fast", "a.torrent"}, code: ExitUsage},
+		"bad log level":    {args: []string{"download", "--log-level", "loud", "a.torrent"}, code: ExitFailure},
+		"bad log format":   {args: []string{"download", "--log-format", "xml", "a.torrent"}, code: ExitFailure},
+		"bad encryption":   {args: []string{"seed", "--encryption", "maybe", "a.torrent"}, code: ExitFailure},
+		"bad progress":     {args: []string{"download", "--progress", "xml", "a.torrent"}, code: ExitFailure},
+		"tui without tty":  {args: []string{"download", "--progress", "tui", "a.torrent"}, code: ExitFailure},
+		"missing torrent":  {args: []string{"info", "does-not-exist.torrent"}, code: ExitFailure},
+	}
+
+	for name, test := range tests {
+		code, _, _ := run(test.args...)
+		assert.Equal(t, test.code, code, name)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output byteSize
+		fails  bool
+	}{
+		"plain":     {input: "1500", output: 1500},
+		"kilobytes": {input: "16K", output: 16 << 10},
+		"megabytes": {input: "2MB", output: 2 << 20},
+		"gigabytes": {input: "1g", output: 1 << 30},
+		"invalid":   {input: "fast", fails: true},
+		"negative":  {input: "-1", fails: true},
+	}
+
+	for _, test := range tests {
+		var size byteSize
+		err := size.Set(test.input)
+		if test.fails {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, test.output, size)
+		}
+	}
+}
+
+func TestCreateInfoVerifyMagnet(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("goMule"), 5000)
+	dataPath := filepath.Join(dir, "artifact.bin")
+	require.Nil(t, ioutil.WriteFile(dataPath, content, 0644))
+	torrentPath := filepath.Join(dir, "artifact.torrent")
+
+	code, stdout, _ := run("create", "-o", torrentPath, "-tracker", "http://tracker/announce", dataPath)
+	require.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "info hash:")
+
+	// 目标文件已经存在时不覆盖
+	code, _, _ = run("create", "-o", torrentPath, dataPath)
+	assert.Equal(t, ExitFailure, code)
+
+	code, stdout, _ = run("info", torrentPath)
+	require.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "artifact.bin")
+	assert.Contains(t, stdout, "http://tracker/announce")
+
+	code, stdout, _ = run("magnet", torrentPath)
+	require.Equal(t, ExitOK, code)
+	assert.True(t, strings.HasPrefix(stdout, "magnet:?xt=urn:btih:"))
+
+	code, _, _ = run("verify", "-o", dir, torrentPath)
+	assert.Equal(t, ExitOK, code)
+
+	content[0] = 'G'
+	require.Nil(t, ioutil.WriteFile(dataPath, content, 0644))
+	code, _, _ = run("verify", "-o", dir, torrentPath)
+	assert.Equal(t, ExitInvalid, code)
+}
+
+func TestLoadAPIToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-token")
+
+	token, err := loadAPIToken("", path)
+	require.Nil(t, err)
+	assert.NotEmpty(t, token)
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// 重启之后沿用保存下来的 token
+	again, err := loadAPIToken("", path)
+	require.Nil(t, err)
+	assert.Equal(t, token, again)
+
+	// 指定的 token 优先，也不会覆盖保存的 token
+	given, err := loadAPIToken("given", path)
+	require.Nil(t, err)
+	assert.Equal(t, "given", given)
+	again, err = loadAPIToken("", path)
+	require.Nil(t, err)
+	assert.Equal(t, token, again)
+}
@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// goMule create [flags] <file or directory>
+func runCreate(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("create", "<file or directory>", stderr)
+	outPath := flags.String("o", "", "output .torrent path (default <name>.torrent)")
+	trackers := flags.String("tracker", "", "comma separated tracker URLs, the first one is used as announce")
+	comment := flags.String("comment", "", "comment")
+	private := flags.Bool("private", false, "set the private flag")
+	webSeeds := flags.String("web-seed", "", "comma separated web seed URLs (url-list)")
+	var pieceLength byteSize
+	flags.Var(&pieceLength, "piece-length", "piece length in bytes (K/M suffixes allowed), a power of two of at least 16K, 0 chooses automatically")
+	if code := parseFlags(flags, args, 1); code != -1 {
+		return code
+	}
+	rootPath := flags.Arg(0)
+
+	options := torrentFile.CreateOptions{
+		Comment:      *comment,
+		CreationDate: time.Now(),
+		Private:      *private,
+		URLList:      splitList(*webSeeds),
+		PieceLength:  int(pieceLength),
+	}
+	if list := splitList(*trackers); len(list) > 0 {
+		options.Announce = list[0]
+		if len(list) > 1 {
+			for _, tracker := range list {
+				options.AnnounceList = append(options.AnnounceList, []string{tracker})
+			}
+		}
+	}
+
+	if *outPath == "" {
+		// 和种子的名字一样，rootPath 是 . 时用当前目录的名字
+		absPath, err := filepath.Abs(rootPath)
+		if err != nil {
+			return fail(stderr, "create", err)
+		}
+		*outPath = filepath.Base(absPath) + ".torrent"
+	}
+	if _, err := os.Stat(*outPath); err == nil {
+		return fail(stderr, "create", fmt.Errorf("%s already exists", *outPath))
+	}
+
+	tf, err := torrentFile.CreateFile(rootPath, *outPath, options)
+	if err != nil {
+		return fail(stderr, "create", err)
+	}
+
+	fmt.Fprintf(stdout, "created %s\n", *outPath)
+	fmt.Fprintf(stdout, "info hash: %x\n", tf.InfoHash)
+	fmt.Fprintf(stdout, "pieces:    %d x %d bytes\n", len(tf.PieceHashes), tf.PieceLength)
+	return ExitOK
+}
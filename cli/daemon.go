@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	api "github.com/strugglebak/goMule/api"
+	metrics "github.com/strugglebak/goMule/metrics"
+	session "github.com/strugglebak/goMule/session"
+	transmission "github.com/strugglebak/goMule/transmission"
+)
+
+// goMule daemon [flags]
+func runDaemon(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("daemon", "", stderr)
+	options := addTransferFlags(flags)
+	listen := flags.String("listen", "127.0.0.1:9091", "address the HTTP API listens on")
+	stateDir := flags.String("state-dir", "", "directory the session state is saved to (default <o>/.goMule)")
+	maxActiveDownloads := flags.Int("max-active-downloads", 0, "maximum number of torrents downloading at the same time, 0 means unlimited")
+	apiToken := flags.String("api-token", "", "token clients must send in the "+api.TokenHeader+" header (default: generated and saved to <state-dir>/api-token)")
+	maxActiveSeeds := flags.Int("max-active-seeds", 0, "maximum number of torrents seeding at the same time, 0 means unlimited")
+	if code := parseFlags(flags, args, 0); code != -1 {
+		return code
+	}
+	if err := options.apply(stderr); err != nil {
+		return fail(stderr, "daemon", err)
+	}
+	if *maxActiveDownloads < 0 || *maxActiveSeeds < 0 {
+		return fail(stderr, "daemon", fmt.Errorf("the number of active torrents must not be negative"))
+	}
+	if *stateDir == "" {
+		*stateDir = filepath.Join(options.OutputDir, ".goMule")
+	}
+
+	s, err := session.New(session.Config{
+		DataDir:            options.OutputDir,
+		StateDir:           *stateDir,
+		Port:               uint16(options.Port),
+		MaxPeers:           options.MaxPeers,
+		DownloadRate:       int(options.DownloadRate),
+		UploadRate:         int(options.UploadRate),
+		MaxActiveDownloads: *maxActiveDownloads,
+		MaxActiveSeeds:     *maxActiveSeeds,
+		Encryption:         options.encryption(),
+		IdleTimeout:        options.IdleTimeout,
+		LocalDiscovery:     options.LSD,
+	})
+	if err != nil {
+		return fail(stderr, "daemon", err)
+	}
+	defer s.Close()
+
+	token, err := loadAPIToken(*apiToken, filepath.Join(*stateDir, "api-token"))
+	if err != nil {
+		return fail(stderr, "daemon", err)
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return fail(stderr, "daemon", err)
+	}
+	// /api/ 是 goMule 自己的 API，/transmission/rpc 兼容 Transmission 的客户端
+	mux := http.NewServeMux()
+	mux.Handle("/api/", api.NewHandler(s, token))
+	mux.Handle("/transmission/rpc", transmission.NewHandler(s))
+	// 指标也可以在 API 的地址上抓取，--metrics-listen 用来单独监听一个地址
+	collector := metrics.New()
+	defer collector.Subscribe(s.Events)()
+	collector.AddSource(metrics.SessionSource(s))
+	mux.Handle("/metrics", collector)
+	stopMetrics, err := options.serveMetrics(collector)
+	if err != nil {
+		return fail(stderr, "daemon", err)
+	}
+	defer stopMetrics()
+	server := &http.Server{Handler: mux}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	slog.Info("serving the API", slog.String("api", "http://"+listener.Addr().String()+"/api/"),
+		slog.String("transmission_rpc", "http://"+listener.Addr().String()+"/transmission/rpc"),
+		slog.String("token_file", filepath.Join(*stateDir, "api-token")))
+
+	// 收到 SIGINT 或者 SIGTERM 时保存状态退出
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case err = <-errs:
+		return fail(stderr, "daemon", err)
+	case <-signals:
+	}
+	server.Close()
+	if err := s.Close(); err != nil {
+		return fail(stderr, "daemon", err)
+	}
+	return ExitOK
+}
+
+// 没有指定 --api-token 时使用 path 中保存的 token，还没有时生成一个保存下来
+// token 文件只有当前用户可以读，重启之后客户端不用换 token
+func loadAPIToken(token, path string) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err == nil && len(bytes.TrimSpace(data)) > 0 {
+		return string(bytes.TrimSpace(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	buffer := make([]byte, 24)
+	_, err = rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(buffer)
+	return token, ioutil.WriteFile(path, []byte(token+"\n"), 0600)
+}
@@ -0,0 +1,278 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	event "github.com/strugglebak/goMule/event"
+	logging "github.com/strugglebak/goMule/logging"
+	metrics "github.com/strugglebak/goMule/metrics"
+	p2p "github.com/strugglebak/goMule/p2p"
+	session "github.com/strugglebak/goMule/session"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+	tui "github.com/strugglebak/goMule/tui"
+)
+
+// goMule download [flags] <torrent>
+func runDownload(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("download", "<torrent>", stderr)
+	options := addTransferFlags(flags)
+	sequential := flags.Bool("sequential", false, "download pieces in order instead of at random")
+	selected := flags.String("select", "", "only download these files of a multi-file torrent, e.g. 0,3-5 (indexes as printed by info)")
+	high := flags.String("high", "", "download these files first, e.g. 2,7")
+	progressMode := flags.String("progress", progressAuto, "how to show progress: auto (tui in a terminal, bar otherwise), tui (full-screen UI), bar, json (newline-delimited records on stdout) or none")
+	progressInterval := flags.Duration("progress-interval", time.Second, "how often --progress=json prints a record")
+	if code := parseFlags(flags, args, 1); code != -1 {
+		return code
+	}
+	if err := options.apply(stderr); err != nil {
+		return fail(stderr, "download", err)
+	}
+	if err := checkProgressMode(*progressMode); err != nil {
+		return fail(stderr, "download", err)
+	}
+	if *progressInterval <= 0 {
+		return fail(stderr, "download", fmt.Errorf("invalid progress interval %s", *progressInterval))
+	}
+	if *progressMode == progressAuto {
+		*progressMode = progressBar
+		if interactive(stdout) {
+			*progressMode = progressTUI
+		}
+	}
+	if *progressMode == progressTUI && !interactive(stdout) {
+		return fail(stderr, "download", fmt.Errorf("--progress=tui needs stdin and stdout to be a terminal"))
+	}
+
+	// json 模式下失败也要输出一行 error，CI 只需要解析 stdout
+	var progress *jsonProgress
+	if *progressMode == progressJSON {
+		progress = newJSONProgress(stdout, *progressInterval)
+	}
+	failed := func(err error) int {
+		if progress != nil {
+			progress.fail(err)
+		}
+		return fail(stderr, "download", err)
+	}
+
+	tf, err := torrentFile.Open(flags.Arg(0))
+	if err != nil {
+		return failed(err)
+	}
+
+	priorities, err := filePriorities(len(tf.Files), *selected, *high)
+	if err != nil {
+		return failed(err)
+	}
+
+	if *progressMode == progressTUI {
+		return downloadWithUI(flags.Arg(0), options, session.AddOptions{
+			FilePriorities: priorities,
+			Sequential:     *sequential,
+			Trackers:       options.trackers(),
+		}, stdout, stderr)
+	}
+
+	localDiscovery := options.localDiscovery()
+	if localDiscovery != nil {
+		defer localDiscovery.Close()
+	}
+
+	// 指标需要读取 p2p.Torrent 的状态，所以这里不用 DownloadAndSaveFile
+	collector := metrics.New()
+	events := &event.Bus{}
+	defer collector.Subscribe(events)()
+	stopMetrics, err := options.serveMetrics(collector)
+	if err != nil {
+		return failed(err)
+	}
+	defer stopMetrics()
+
+	// 端口被占用时仍然可以下载，只是其他 peer 连不上我们
+	inbound, err := options.listen()
+	if err != nil {
+		slog.Warn("could not listen for peer connections", slog.Int("port", options.Port), logging.Error(err))
+	} else {
+		defer inbound.Close()
+	}
+
+	downloadOptions := torrentFile.DownloadOptions{
+		Port:           uint16(options.Port),
+		MaxPeers:       options.MaxPeers,
+		DownloadRate:   int(options.DownloadRate),
+		UploadRate:     int(options.UploadRate),
+		Trackers:       options.trackers(),
+		Sequential:     *sequential,
+		Encryption:     options.encryption(),
+		IdleTimeout:    options.IdleTimeout,
+		LocalDiscovery: localDiscovery,
+		Listener:       inbound,
+		FilePriorities: priorities,
+		Events:         events,
+	}
+	torrent, err := tf.StartDownload(options.OutputDir, downloadOptions)
+	if err != nil {
+		return failed(err)
+	}
+	defer torrent.Close()
+	defer downloadOptions.Remove(torrent)
+	collector.AddSource(metrics.TorrentSource(torrent))
+
+	switch *progressMode {
+	case progressJSON:
+		err = progress.wait(torrent)
+	case progressBar:
+		err = newProgressBar(stdout, "downloading "+torrent.Name+"...").wait(torrent)
+	default:
+		err = torrent.Wait(nil)
+	}
+	if err != nil {
+		return failed(err)
+	}
+	return ExitOK
+}
+
+// 在终端中通过 session 下载，这样可以在界面里暂停、恢复和移除
+// session 的状态放在临时目录中，退出时删除
+func downloadWithUI(path string, options *transferFlags, addOptions session.AddOptions, stdout, stderr io.Writer) int {
+	stateDir, err := ioutil.TempDir("", "goMule-")
+	if err != nil {
+		return fail(stderr, "download", err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	// 界面运行时日志显示在界面里，退出之后恢复输出到 stderr
+	logs := &tui.LogBuffer{}
+	setLogger(options.LogLevel, options.LogFormat, logs)
+	defer setLogger(options.LogLevel, options.LogFormat, stderr)
+
+	s, err := session.New(session.Config{
+		DataDir:        options.OutputDir,
+		StateDir:       stateDir,
+		Port:           uint16(options.Port),
+		MaxPeers:       options.MaxPeers,
+		DownloadRate:   int(options.DownloadRate),
+		UploadRate:     int(options.UploadRate),
+		Encryption:     options.encryption(),
+		IdleTimeout:    options.IdleTimeout,
+		LocalDiscovery: options.LSD,
+	})
+	if err != nil {
+		return fail(stderr, "download", err)
+	}
+	defer s.Close()
+
+	collector := metrics.New()
+	defer collector.Subscribe(s.Events)()
+	collector.AddSource(metrics.SessionSource(s))
+	stopMetrics, err := options.serveMetrics(collector)
+	if err != nil {
+		return fail(stderr, "download", err)
+	}
+	defer stopMetrics()
+
+	ui := tui.New(s, os.Stdin, stdout)
+	ui.Log = logs
+	ui.ExitWhenDone = true
+	t, err := s.AddFile(path, addOptions)
+	if err != nil {
+		return fail(stderr, "download", err)
+	}
+	err = ui.Run()
+	if err != nil {
+		return fail(stderr, "download", err)
+	}
+
+	if _, ok := s.Get(t.File.InfoHash); !ok {
+		return fail(stderr, "download", fmt.Errorf("%s was removed before it finished", t.File.Name))
+	}
+	status := t.Status()
+	if status.Error != nil {
+		return fail(stderr, "download", status.Error)
+	}
+	finished := status.State == session.StateSeeding || status.State == session.StateQueued
+	if !finished || status.Done < status.Wanted {
+		return fail(stderr, "download", fmt.Errorf("download of %s was interrupted at %d/%d pieces", t.File.Name, status.Done, status.Wanted))
+	}
+	return ExitOK
+}
+
+// stdin 和 stdout 都是终端时才能显示界面
+func interactive(stdout io.Writer) bool {
+	return isTerminal(stdout) && term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+func isTerminal(writer io.Writer) bool {
+	file, ok := writer.(*os.File)
+	return ok && term.IsTerminal(int(file.Fd()))
+}
+
+// 根据 --select 和 --high 计算每个文件的优先级，两个都为空时返回 nil
+func filePriorities(count int, selected, high string) ([]int, error) {
+	if selected == "" && high == "" {
+		return nil, nil
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("--select and --high only apply to multi-file torrents")
+	}
+
+	priorities := make([]int, count)
+	defaultPriority := p2p.PriorityNormal
+	if selected != "" {
+		defaultPriority = p2p.PrioritySkip
+	}
+	for index := range priorities {
+		priorities[index] = defaultPriority
+	}
+
+	indexes, err := parseIndexes(selected, count)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		priorities[index] = p2p.PriorityNormal
+	}
+	indexes, err = parseIndexes(high, count)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		priorities[index] = p2p.PriorityHigh
+	}
+	return priorities, nil
+}
+
+// 解析 0,3-5 这样的下标列表，下标必须在 [0, count) 之间
+func parseIndexes(value string, count int) ([]int, error) {
+	var indexes []int
+	for _, part := range splitList(value) {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index %q", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid file index %q", part)
+			}
+		}
+		if first < 0 || last >= count || first > last {
+			return nil, fmt.Errorf("file index %q out of range [0, %d)", part, count)
+		}
+		for index := first; index <= last; index++ {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
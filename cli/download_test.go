@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	p2p "github.com/strugglebak/goMule/p2p"
+)
+
+func TestFilePriorities(t *testing.T) {
+	tests := map[string]struct {
+		count    int
+		selected string
+		high     string
+		output   []int
+		fails    bool
+	}{
+		"nothing selected": {
+			count:  3,
+			output: nil,
+		},
+		"select a range": {
+			count:    5,
+			selected: "0,2-3",
+			output:   []int{p2p.PriorityNormal, p2p.PrioritySkip, p2p.PriorityNormal, p2p.PriorityNormal, p2p.PrioritySkip},
+		},
+		"high without select": {
+			count:  3,
+			high:   "1",
+			output: []int{p2p.PriorityNormal, p2p.PriorityHigh, p2p.PriorityNormal},
+		},
+		"select and high": {
+			count:    3,
+			selected: "0",
+			high:     "2",
+			output:   []int{p2p.PriorityNormal, p2p.PrioritySkip, p2p.PriorityHigh},
+		},
+		"out of range": {
+			count:    3,
+			selected: "1-3",
+			fails:    true,
+		},
+		"not a number": {
+			count:    3,
+			selected: "a",
+			fails:    true,
+		},
+		"single file torrent": {
+			count:    0,
+			selected: "0",
+			fails:    true,
+		},
+	}
+
+	for name, test := range tests {
+		priorities, err := filePriorities(test.count, test.selected, test.high)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, priorities, name)
+		}
+	}
+}
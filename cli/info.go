@@ -0,0 +1,155 @@
+package cli
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// info --json 输出的结构，字段只增不减，数组为空时输出 []
+type infoOutput struct {
+	Name           string     `json:"name"`
+	InfoHash       string     `json:"info_hash"`
+	InfoHashBase32 string     `json:"info_hash_base32"`
+	PieceCount     int        `json:"piece_count"`
+	PieceLength    int        `json:"piece_length"`
+	TotalSize      int        `json:"total_size"`
+	Files          []infoFile `json:"files"`
+	Trackers       []string   `json:"trackers"`
+	WebSeeds       []string   `json:"web_seeds"`
+	Private        bool       `json:"private"`
+	Comment        string     `json:"comment"`
+	CreatedBy      string     `json:"created_by"`
+	CreationDate   *string    `json:"creation_date"` // RFC 3339，种子里没有时为 null
+	MetaVersion    int        `json:"meta_version"`  // v1 种子为 1，v2 和 hybrid 种子为 2
+	InfoHashV2     *string    `json:"info_hash_v2"`  // v1 种子为 null
+}
+
+type infoFile struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+	Offset int    `json:"offset"`
+}
+
+func buildInfoOutput(tf *torrentFile.TorrentFile) infoOutput {
+	output := infoOutput{
+		Name:           tf.Name,
+		InfoHash:       hex.EncodeToString(tf.InfoHash[:]),
+		InfoHashBase32: base32.StdEncoding.EncodeToString(tf.InfoHash[:]),
+		PieceCount:     tf.PieceCount(),
+		PieceLength:    tf.PieceLength,
+		TotalSize:      tf.Length,
+		Files:          []infoFile{},
+		Trackers:       tf.Trackers(),
+		WebSeeds:       tf.URLList,
+		Private:        tf.Private,
+		Comment:        tf.Comment,
+		CreatedBy:      tf.CreatedBy,
+		MetaVersion:    1,
+	}
+	if tf.IsV2() {
+		infoHashV2 := hex.EncodeToString(tf.InfoHashV2[:])
+		output.MetaVersion = tf.MetaVersion
+		output.InfoHashV2 = &infoHashV2
+	}
+
+	if len(tf.Files) == 0 {
+		output.Files = append(output.Files, infoFile{Path: tf.Name, Length: tf.Length})
+	}
+	for _, file := range tf.Files {
+		output.Files = append(output.Files, infoFile{
+			Path:   path.Join(file.Path...),
+			Length: file.Length,
+			Offset: file.Offset,
+		})
+	}
+
+	if output.Trackers == nil {
+		output.Trackers = []string{}
+	}
+	if output.WebSeeds == nil {
+		output.WebSeeds = []string{}
+	}
+	if tf.CreationDate != 0 {
+		date := time.Unix(tf.CreationDate, 0).UTC().Format(time.RFC3339)
+		output.CreationDate = &date
+	}
+	return output
+}
+
+// goMule info [--json] <torrent>
+func runInfo(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("info", "<torrent>", stderr)
+	asJSON := flags.Bool("json", false, "print the metadata as JSON")
+	if code := parseFlags(flags, args, 1); code != -1 {
+		return code
+	}
+
+	tf, err := torrentFile.Open(flags.Arg(0))
+	if err != nil {
+		return fail(stderr, "info", err)
+	}
+	output := buildInfoOutput(&tf)
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(output)
+		if err != nil {
+			return fail(stderr, "info", err)
+		}
+		return ExitOK
+	}
+
+	fmt.Fprintf(stdout, "name:          %s\n", output.Name)
+	fmt.Fprintf(stdout, "info hash:     %s\n", output.InfoHash)
+	fmt.Fprintf(stdout, "info hash b32: %s\n", output.InfoHashBase32)
+	if output.InfoHashV2 != nil {
+		fmt.Fprintf(stdout, "info hash v2:  %s\n", *output.InfoHashV2)
+	}
+	fmt.Fprintf(stdout, "size:          %s (%d bytes)\n", formatBytes(output.TotalSize), output.TotalSize)
+	fmt.Fprintf(stdout, "pieces:        %d x %s\n", output.PieceCount, formatBytes(output.PieceLength))
+	fmt.Fprintf(stdout, "private:       %t\n", output.Private)
+	if output.Comment != "" {
+		fmt.Fprintf(stdout, "comment:       %s\n", output.Comment)
+	}
+	if output.CreatedBy != "" {
+		fmt.Fprintf(stdout, "created by:    %s\n", output.CreatedBy)
+	}
+	if output.CreationDate != nil {
+		fmt.Fprintf(stdout, "creation date: %s\n", *output.CreationDate)
+	}
+	for _, tracker := range output.Trackers {
+		fmt.Fprintf(stdout, "tracker:       %s\n", tracker)
+	}
+	for _, webSeed := range output.WebSeeds {
+		fmt.Fprintf(stdout, "web seed:      %s\n", webSeed)
+	}
+	fmt.Fprintf(stdout, "files:\n")
+	for index, file := range output.Files {
+		fmt.Fprintf(stdout, "  %4d  %10s  %s\n", index, formatBytes(file.Length), file.Path)
+	}
+	return ExitOK
+}
+
+// 把 byte 数量格式化成 1.5 MiB 这样的字符串
+func formatBytes(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	suffixes := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	index := -1
+	for value >= unit && index < len(suffixes)-1 {
+		value /= unit
+		index++
+	}
+	return fmt.Sprintf("%.1f %s", value, suffixes[index])
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfoJSON(t *testing.T) {
+	code, stdout, _ := run("info", "--json", "../test_data/archlinux-2019.12.01-x86_64.iso.torrent")
+	require.Equal(t, ExitOK, code)
+
+	output := infoOutput{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), &output))
+	assert.Equal(t, "archlinux-2019.12.01-x86_64.iso", output.Name)
+	assert.Equal(t, "dee86a7fa6f286a9d74c362014616a0ff5e4843d", output.InfoHash)
+	assert.Equal(t, "33UGU75G6KDKTV2MGYQBIYLKB726JBB5", output.InfoHashBase32)
+	assert.Equal(t, 1278, output.PieceCount)
+	assert.Equal(t, 524288, output.PieceLength)
+	assert.Equal(t, 670040064, output.TotalSize)
+	assert.Equal(t, []infoFile{{Path: "archlinux-2019.12.01-x86_64.iso", Length: 670040064}}, output.Files)
+	assert.Equal(t, []string{"http://tracker.archlinux.org:6969/announce"}, output.Trackers)
+	assert.NotEmpty(t, output.WebSeeds)
+	assert.False(t, output.Private)
+	assert.Equal(t, "mktorrent 1.1", output.CreatedBy)
+	require.NotNil(t, output.CreationDate)
+	assert.Equal(t, "2019-12-01T09:08:30Z", *output.CreationDate)
+	assert.Equal(t, 1, output.MetaVersion)
+	assert.Nil(t, output.InfoHashV2)
+
+	// 字段名是对外的约定，不能随便改
+	raw := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), &raw))
+	for _, key := range []string{
+		"name", "info_hash", "info_hash_base32", "piece_count", "piece_length", "total_size",
+		"files", "trackers", "web_seeds", "private", "comment", "created_by", "creation_date",
+		"meta_version", "info_hash_v2",
+	} {
+		assert.Contains(t, raw, key)
+	}
+}
+
+func TestInfoText(t *testing.T) {
+	code, stdout, _ := run("info", "../test_data/archlinux-2019.12.01-x86_64.iso.torrent")
+	require.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "639.0 MiB")
+	assert.Contains(t, stdout, "1278 x 512.0 KiB")
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		input  int
+		output string
+	}{
+		{input: 0, output: "0 B"},
+		{input: 1023, output: "1023 B"},
+		{input: 1536, output: "1.5 KiB"},
+		{input: 5 << 30, output: "5.0 GiB"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.output, formatBytes(test.input))
+	}
+}
@@ -0,0 +1,24 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// goMule magnet <torrent>
+func runMagnet(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("magnet", "<torrent>", stderr)
+	if code := parseFlags(flags, args, 1); code != -1 {
+		return code
+	}
+
+	tf, err := torrentFile.Open(flags.Arg(0))
+	if err != nil {
+		return fail(stderr, "magnet", err)
+	}
+
+	fmt.Fprintln(stdout, tf.MagnetURI())
+	return ExitOK
+}
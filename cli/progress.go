@@ -0,0 +1,207 @@
+package cli
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	event "github.com/strugglebak/goMule/event"
+	logging "github.com/strugglebak/goMule/logging"
+	p2p "github.com/strugglebak/goMule/p2p"
+)
+
+// download 的 --progress 可以选择的输出方式
+const (
+	progressAuto = "auto" // 终端中显示全屏界面，否则显示进度条
+	progressTUI  = "tui"
+	progressBar  = "bar"
+	progressJSON = "json" // 每隔 --progress-interval 在 stdout 输出一行 JSON
+	progressNone = "none"
+)
+
+// --progress=json 时输出的一行，Type 是 progress、status 或者 error
+// status 是下载完成时的最后一行，error 是失败时的最后一行
+type progressRecord struct {
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	InfoHash     string    `json:"info_hash,omitempty"`
+	Name         string    `json:"name,omitempty"`
+	PiecesDone   int       `json:"pieces_done"`
+	PiecesWanted int       `json:"pieces_wanted"`
+	Downloaded   int64     `json:"downloaded"` // 这次下载并校验通过的 byte 数量
+	Left         int64     `json:"left"`       // 还需要下载的 byte 数量
+	DownloadRate int64     `json:"download_rate"`
+	UploadRate   int64     `json:"upload_rate"`
+	Peers        int       `json:"peers"`
+	ETA          int64     `json:"eta"` // 剩余的秒数，不知道时为 -1
+	State        string    `json:"state,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	ErrorClass   string    `json:"error_class,omitempty"`
+}
+
+// 按固定的间隔输出下载进度
+type jsonProgress struct {
+	encoder  *json.Encoder
+	interval time.Duration
+
+	torrent        *p2p.Torrent // 开始下载之前为 nil
+	sampled        time.Time
+	lastDownloaded int64
+	lastUploaded   int64
+	downloadRate   int64
+	uploadRate     int64
+}
+
+func newJSONProgress(writer io.Writer, interval time.Duration) *jsonProgress {
+	return &jsonProgress{encoder: json.NewEncoder(writer), interval: interval}
+}
+
+// 等待下载结束，期间每隔 interval 输出一行进度，完成时最后输出 status
+// 失败时的 error 由调用者通过 fail 输出
+func (progress *jsonProgress) wait(torrent *p2p.Torrent) error {
+	progress.torrent = torrent
+	progress.sampled = time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- torrent.Wait(nil)
+	}()
+
+	ticker := time.NewTicker(progress.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-result:
+			if err != nil {
+				return err
+			}
+			record := progress.sample("status")
+			record.State = "completed"
+			progress.encoder.Encode(record)
+			return nil
+		case <-ticker.C:
+			progress.encoder.Encode(progress.sample("progress"))
+		}
+	}
+}
+
+// 输出一行 error，开始下载之前失败时只有错误信息
+func (progress *jsonProgress) fail(err error) {
+	record := progressRecord{Type: "error", Time: time.Now(), ETA: -1}
+	if progress.torrent != nil {
+		record = progress.sample("error")
+	}
+	record.Error = err.Error()
+	record.ErrorClass = logging.ErrorClass(err)
+	progress.encoder.Encode(record)
+}
+
+// 根据上次采样之后的流量计算速度
+func (progress *jsonProgress) sample(recordType string) progressRecord {
+	t := progress.torrent
+	now := time.Now()
+	downloaded, uploaded := t.Downloaded(), t.Uploaded()
+	if elapsed := now.Sub(progress.sampled).Seconds(); elapsed > 0 {
+		progress.downloadRate = int64(float64(downloaded-progress.lastDownloaded) / elapsed)
+		progress.uploadRate = int64(float64(uploaded-progress.lastUploaded) / elapsed)
+	}
+	progress.sampled, progress.lastDownloaded, progress.lastUploaded = now, downloaded, uploaded
+
+	done, wanted := t.Progress()
+	// 最后一个 piece 可能比较短，所以不能超过总长度
+	left := int64(wanted-done) * int64(t.PieceLength)
+	if left > int64(t.Length) {
+		left = int64(t.Length)
+	}
+	eta := int64(-1)
+	if left == 0 {
+		eta = 0
+	} else if progress.downloadRate > 0 {
+		eta = (left + progress.downloadRate - 1) / progress.downloadRate
+	}
+	return progressRecord{
+		Type:         recordType,
+		Time:         now,
+		InfoHash:     hex.EncodeToString(t.InfoHash[:]),
+		Name:         t.Name,
+		PiecesDone:   done,
+		PiecesWanted: wanted,
+		Downloaded:   downloaded,
+		Left:         left,
+		DownloadRate: progress.downloadRate,
+		UploadRate:   progress.uploadRate,
+		Peers:        len(t.ActivePeers()),
+		ETA:          eta,
+	}
+}
+
+// 一行文字的进度条，通过订阅 PieceVerified 事件更新
+// 输出是终端时每次用 \r 覆盖上一次的内容，否则 (比如重定向到文件) 进度每增加 1% 才输出一行
+type progressBarWriter struct {
+	mutex    sync.Mutex
+	writer   io.Writer
+	terminal bool
+	prompt   string
+	start    time.Time
+	percent  int // 上次输出时的整数百分比，还没有输出过时为 -1
+}
+
+const progressBarWidth = 40
+
+func newProgressBar(writer io.Writer, prompt string) *progressBarWriter {
+	return &progressBarWriter{writer: writer, terminal: isTerminal(writer), prompt: prompt, start: time.Now(), percent: -1}
+}
+
+// 等待下载结束，期间显示进度条
+func (bar *progressBarWriter) wait(torrent *p2p.Torrent) error {
+	cancel := torrent.Events.Subscribe(func(e event.Event) {
+		if e.Type == event.PieceVerified {
+			bar.update(e.Done, e.Wanted)
+		}
+	})
+	defer cancel()
+	defer bar.finish()
+	bar.update(torrent.Progress())
+	return torrent.Wait(nil)
+}
+
+func (bar *progressBarWriter) update(done, wanted int) {
+	bar.mutex.Lock()
+	defer bar.mutex.Unlock()
+	percent := float64(100)
+	if wanted > 0 {
+		percent = float64(done) / float64(wanted) * 100
+	}
+	if !bar.terminal && int(percent) == bar.percent {
+		return
+	}
+	bar.percent = int(percent)
+	filled := int(percent / 100 * progressBarWidth)
+	line := fmt.Sprintf("%s %5.1f%% [%s%s] (%d/%d, %s)", bar.prompt, percent,
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		done, wanted, time.Since(bar.start).Round(time.Second))
+	if bar.terminal {
+		fmt.Fprint(bar.writer, "\r"+line)
+	} else {
+		fmt.Fprintln(bar.writer, line)
+	}
+}
+
+func (bar *progressBarWriter) finish() {
+	bar.mutex.Lock()
+	defer bar.mutex.Unlock()
+	if bar.terminal {
+		fmt.Fprintln(bar.writer)
+	}
+}
+
+func checkProgressMode(mode string) error {
+	switch mode {
+	case progressAuto, progressTUI, progressBar, progressJSON, progressNone:
+		return nil
+	}
+	return fmt.Errorf("unknown progress mode %q, expected auto, tui, bar, json or none", mode)
+}
@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	logging "github.com/strugglebak/goMule/logging"
+	p2p "github.com/strugglebak/goMule/p2p"
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+type discardStore struct{}
+
+func (discardStore) ReadAt(buffer []byte, offset int64) (int, error)  { return len(buffer), nil }
+func (discardStore) WriteAt(buffer []byte, offset int64) (int, error) { return len(buffer), nil }
+
+func decodeRecords(t *testing.T, output string) []progressRecord {
+	var records []progressRecord
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var record progressRecord
+		require.Nil(t, json.Unmarshal([]byte(line), &record), line)
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestJSONProgressCompleted(t *testing.T) {
+	// 所有 piece 都已经有了，Start 之后马上完成
+	torrent := &p2p.Torrent{
+		InfoHash:    [20]byte{0xab},
+		Name:        "done",
+		PieceHashes: make([][20]byte, 3),
+		PieceLength: 16384,
+		Length:      40000,
+		Store:       discardStore{},
+		Completed:   bitField.BitField{0xe0},
+	}
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+
+	var output bytes.Buffer
+	require.Nil(t, newJSONProgress(&output, 10*time.Millisecond).wait(torrent))
+	records := decodeRecords(t, output.String())
+	last := records[len(records)-1]
+	assert.Equal(t, "status", last.Type)
+	assert.Equal(t, "completed", last.State)
+	assert.Equal(t, "ab00000000000000000000000000000000000000", last.InfoHash)
+	assert.Equal(t, 3, last.PiecesDone)
+	assert.Equal(t, 3, last.PiecesWanted)
+	assert.Equal(t, int64(0), last.Left)
+	assert.Equal(t, int64(0), last.ETA)
+}
+
+func TestJSONProgressFailed(t *testing.T) {
+	// 唯一的 peer 连不上，下载失败
+	torrent := &p2p.Torrent{
+		Peers:       []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 1}},
+		Name:        "unreachable",
+		PieceHashes: make([][20]byte, 2),
+		PieceLength: 16384,
+		Length:      20000,
+		Store:       discardStore{},
+	}
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+
+	var output bytes.Buffer
+	progress := newJSONProgress(&output, time.Hour)
+	err := progress.wait(torrent)
+	require.NotNil(t, err)
+	progress.fail(err)
+	records := decodeRecords(t, output.String())
+	require.Len(t, records, 1)
+	assert.Equal(t, "error", records[0].Type)
+	assert.Equal(t, "unreachable", records[0].Name)
+	assert.Equal(t, 2, records[0].PiecesWanted)
+	assert.Equal(t, int64(20000), records[0].Left)
+	assert.Equal(t, int64(-1), records[0].ETA)
+	assert.NotEmpty(t, records[0].Error)
+}
+
+func TestDownloadJSONError(t *testing.T) {
+	// 开始下载之前失败也会输出一行 error，日志和错误信息只在 stderr
+	code, stdout, stderr := run("download", "--progress=json", "does-not-exist.torrent")
+	assert.Equal(t, ExitFailure, code)
+	records := decodeRecords(t, stdout)
+	require.Len(t, records, 1)
+	assert.Equal(t, "error", records[0].Type)
+	assert.Equal(t, logging.ClassStorage, records[0].ErrorClass)
+	assert.Contains(t, records[0].Error, "does-not-exist.torrent")
+	assert.Contains(t, stderr, "does-not-exist.torrent")
+}
+
+func TestProgressBar(t *testing.T) {
+	// 输出不是终端时每增加 1% 才输出一行，不使用 \r
+	var output bytes.Buffer
+	bar := newProgressBar(&output, "downloading test...")
+	assert.False(t, bar.terminal)
+	for done := 0; done <= 200; done++ {
+		bar.update(done, 200)
+	}
+	bar.finish()
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	assert.Len(t, lines, 101)
+	assert.NotContains(t, output.String(), "\r")
+	assert.True(t, strings.HasPrefix(lines[0], "downloading test...   0.0% ["))
+	assert.True(t, strings.HasPrefix(lines[100], "downloading test... 100.0% [========================================] (200/200"))
+
+	// 终端中覆盖同一行，结束时换行
+	output.Reset()
+	bar = newProgressBar(&output, "downloading test...")
+	bar.terminal = true
+	bar.update(1, 200)
+	bar.update(2, 200)
+	bar.finish()
+	assert.Equal(t, 2, strings.Count(output.String(), "\r"))
+	assert.Equal(t, 1, strings.Count(output.String(), "\n"))
+}
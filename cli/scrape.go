@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// scrape --json 输出的结构
+type scrapeOutput struct {
+	Tracker     string `json:"tracker"`
+	Seeders     int    `json:"seeders"`
+	Leechers    int    `json:"leechers"`    // 没有完整数据的 peer，包括不再下载的 partial seed
+	Downloaders int    `json:"downloaders"` // 真正还在下载的 peer (BEP 21)
+	Downloaded  int    `json:"downloaded"`
+}
+
+// goMule scrape [--json] [--tracker url] <torrent>
+func runScrape(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("scrape", "<torrent>", stderr)
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	tracker := flags.String("tracker", "", "tracker announce URL to scrape instead of the one in the .torrent")
+	if code := parseFlags(flags, args, 1); code != -1 {
+		return code
+	}
+
+	tf, err := torrentFile.Open(flags.Arg(0))
+	if err != nil {
+		return fail(stderr, "scrape", err)
+	}
+	if *tracker != "" {
+		tf.Announce = *tracker
+	}
+	result, err := tf.Scrape()
+	if err != nil {
+		return fail(stderr, "scrape", fmt.Errorf("%s: %w", tf.Announce, err))
+	}
+	output := scrapeOutput{
+		Tracker:     tf.Announce,
+		Seeders:     result.Complete,
+		Leechers:    result.Incomplete,
+		Downloaders: result.Downloaders,
+		Downloaded:  result.Downloaded,
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(output)
+		if err != nil {
+			return fail(stderr, "scrape", err)
+		}
+		return ExitOK
+	}
+
+	fmt.Fprintf(stdout, "tracker:     %s\n", output.Tracker)
+	fmt.Fprintf(stdout, "seeders:     %d\n", output.Seeders)
+	fmt.Fprintf(stdout, "leechers:    %d\n", output.Leechers)
+	fmt.Fprintf(stdout, "downloaders: %d\n", output.Downloaders)
+	fmt.Fprintf(stdout, "downloaded:  %d\n", output.Downloaded)
+	return ExitOK
+}
@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrape(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		infoHash := r.URL.Query().Get("info_hash")
+		w.Write([]byte("d5:filesd20:" + infoHash + "d8:completei10e10:downloadedi50e11:downloadersi3e10:incompletei7eeee"))
+	}))
+	defer ts.Close()
+
+	code, stdout, _ := run("scrape", "--json", "--tracker", ts.URL+"/announce", "../test_data/archlinux-2019.12.01-x86_64.iso.torrent")
+	require.Equal(t, ExitOK, code)
+	output := scrapeOutput{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), &output))
+	assert.Equal(t, scrapeOutput{Tracker: ts.URL + "/announce", Seeders: 10, Leechers: 7, Downloaders: 3, Downloaded: 50}, output)
+
+	code, stdout, _ = run("scrape", "--tracker", ts.URL+"/announce", "../test_data/archlinux-2019.12.01-x86_64.iso.torrent")
+	require.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "downloaders: 3")
+
+	code, _, stderr := run("scrape", "--tracker", ts.URL+"/tracker", "../test_data/archlinux-2019.12.01-x86_64.iso.torrent")
+	assert.Equal(t, ExitFailure, code)
+	assert.Contains(t, stderr, "does not support scrape")
+}
@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	event "github.com/strugglebak/goMule/event"
+	metrics "github.com/strugglebak/goMule/metrics"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// goMule seed [flags] <torrent>
+func runSeed(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("seed", "<torrent>", stderr)
+	options := addTransferFlags(flags)
+	if code := parseFlags(flags, args, 1); code != -1 {
+		return code
+	}
+	if err := options.apply(stderr); err != nil {
+		return fail(stderr, "seed", err)
+	}
+
+	tf, err := torrentFile.Open(flags.Arg(0))
+	if err != nil {
+		return fail(stderr, "seed", err)
+	}
+
+	// 只有完整的数据才能做种
+	for index, status := range tf.VerifyDir(options.OutputDir).Pieces {
+		if status != torrentFile.PieceValid {
+			return fail(stderr, "seed", fmt.Errorf("piece #%d in %s does not match the torrent", index, options.OutputDir))
+		}
+	}
+
+	// 做种只能等其他 peer 连接我们，所以监听失败时直接退出
+	inbound, err := options.listen()
+	if err != nil {
+		return fail(stderr, "seed", err)
+	}
+	defer inbound.Close()
+	localDiscovery := options.localDiscovery()
+	if localDiscovery != nil {
+		defer localDiscovery.Close()
+	}
+
+	collector := metrics.New()
+	events := &event.Bus{}
+	defer collector.Subscribe(events)()
+	stopMetrics, err := options.serveMetrics(collector)
+	if err != nil {
+		return fail(stderr, "seed", err)
+	}
+	defer stopMetrics()
+
+	seedOptions := torrentFile.DownloadOptions{
+		Port:           uint16(options.Port),
+		MaxPeers:       options.MaxPeers,
+		UploadRate:     int(options.UploadRate),
+		Trackers:       options.trackers(),
+		Encryption:     options.encryption(),
+		IdleTimeout:    options.IdleTimeout,
+		LocalDiscovery: localDiscovery,
+		Listener:       inbound,
+		Events:         events,
+	}
+	torrent, err := tf.StartSeeding(options.OutputDir, seedOptions)
+	if err != nil {
+		return fail(stderr, "seed", err)
+	}
+	defer torrent.Close()
+	defer seedOptions.Remove(torrent)
+	collector.AddSource(metrics.TorrentSource(torrent))
+	slog.Info("seeding", slog.String("torrent", tf.Name), slog.Int("port", int(inbound.Port())))
+
+	// 收到 SIGINT 或者 SIGTERM 时停止做种
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	<-signals
+	fmt.Fprintf(stdout, "uploaded %d bytes of %s\n", torrent.Uploaded(), tf.Name)
+	return ExitOK
+}
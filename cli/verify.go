@@ -0,0 +1,135 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// verify --json 输出的结构
+type verifyOutput struct {
+	InfoHash      string       `json:"info_hash"`
+	Complete      bool         `json:"complete"`
+	Percent       float64      `json:"percent"`
+	PieceCount    int          `json:"piece_count"`
+	ValidPieces   int          `json:"valid_pieces"`
+	BadPieces     []int        `json:"bad_pieces"`
+	MissingPieces []int        `json:"missing_pieces"`
+	Files         []verifyFile `json:"files"`
+}
+
+type verifyFile struct {
+	Path        string `json:"path"`
+	Length      int    `json:"length"`
+	Exists      bool   `json:"exists"`
+	Complete    bool   `json:"complete"`
+	PieceCount  int    `json:"piece_count"`
+	ValidPieces int    `json:"valid_pieces"`
+}
+
+func buildVerifyOutput(tf *torrentFile.TorrentFile, report *torrentFile.VerifyReport) verifyOutput {
+	output := verifyOutput{
+		InfoHash:      fmt.Sprintf("%x", tf.InfoHash),
+		Complete:      report.Complete(),
+		Percent:       report.Percent(),
+		PieceCount:    len(report.Pieces),
+		ValidPieces:   report.ValidPieces(),
+		BadPieces:     report.PiecesWithStatus(torrentFile.PieceMismatch),
+		MissingPieces: report.PiecesWithStatus(torrentFile.PieceMissing),
+		Files:         []verifyFile{},
+	}
+	if output.BadPieces == nil {
+		output.BadPieces = []int{}
+	}
+	if output.MissingPieces == nil {
+		output.MissingPieces = []int{}
+	}
+	for _, file := range report.Files {
+		output.Files = append(output.Files, verifyFile{
+			Path:        file.Path,
+			Length:      file.Length,
+			Exists:      file.Exists,
+			Complete:    file.Complete(),
+			PieceCount:  file.PieceCount(),
+			ValidPieces: file.ValidPieces,
+		})
+	}
+	return output
+}
+
+// goMule verify [flags] <torrent> [file or directory]
+func runVerify(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("verify", "<torrent> [file or directory]", stderr)
+	outputDir := flags.String("o", ".", "directory the content was saved to, ignored when a path is given")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if code := parseFlagsBetween(flags, args, 1, 2); code != -1 {
+		return code
+	}
+
+	tf, err := torrentFile.Open(flags.Arg(0))
+	if err != nil {
+		return fail(stderr, "verify", err)
+	}
+
+	var report *torrentFile.VerifyReport
+	if flags.NArg() == 2 {
+		report = tf.Verify(flags.Arg(1))
+	} else {
+		report = tf.VerifyDir(*outputDir)
+	}
+	output := buildVerifyOutput(&tf, report)
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(output)
+		if err != nil {
+			return fail(stderr, "verify", err)
+		}
+	} else {
+		for _, file := range output.Files {
+			status := "ok"
+			switch {
+			case !file.Exists:
+				status = "missing"
+			case !file.Complete:
+				status = "bad"
+			}
+			fmt.Fprintf(stdout, "%-8s %d/%d pieces  %s\n", status, file.ValidPieces, file.PieceCount, file.Path)
+		}
+		if len(output.BadPieces) > 0 {
+			fmt.Fprintf(stdout, "bad pieces:     %s\n", formatRanges(output.BadPieces))
+		}
+		if len(output.MissingPieces) > 0 {
+			fmt.Fprintf(stdout, "missing pieces: %s\n", formatRanges(output.MissingPieces))
+		}
+		fmt.Fprintf(stdout, "%d/%d pieces valid (%.2f%%)\n", output.ValidPieces, output.PieceCount, output.Percent)
+	}
+
+	if !output.Complete {
+		return ExitInvalid
+	}
+	return ExitOK
+}
+
+// 把有序的下标格式化成 1-3,7,9-10 这样的字符串
+func formatRanges(indexes []int) string {
+	var parts []string
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(indexes[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indexes[i], indexes[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
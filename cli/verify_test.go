@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatRanges(t *testing.T) {
+	tests := []struct {
+		input  []int
+		output string
+	}{
+		{input: nil, output: ""},
+		{input: []int{4}, output: "4"},
+		{input: []int{1, 2, 3, 7, 9, 10}, output: "1-3,7,9-10"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.output, formatRanges(test.input))
+	}
+}
+
+func TestVerifyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "mirror")
+	require.Nil(t, os.MkdirAll(root, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "a"), bytes.Repeat([]byte{1}, 40000), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "b"), bytes.Repeat([]byte{2}, 40000), 0644))
+	torrentPath := filepath.Join(dir, "mirror.torrent")
+	code, _, _ := run("create", "-o", torrentPath, "-piece-length", "16K", root)
+	require.Equal(t, ExitOK, code)
+
+	code, stdout, _ := run("verify", torrentPath, root)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "5/5 pieces valid (100.00%)")
+
+	require.Nil(t, os.Remove(filepath.Join(root, "b")))
+	code, stdout, _ = run("verify", "--json", torrentPath, root)
+	assert.Equal(t, ExitInvalid, code)
+
+	output := verifyOutput{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), &output))
+	assert.False(t, output.Complete)
+	assert.Equal(t, 2, output.ValidPieces)
+	assert.Equal(t, []int{}, output.BadPieces)
+	assert.Equal(t, []int{2, 3, 4}, output.MissingPieces)
+	require.Len(t, output.Files, 2)
+	// piece 2 跨了 a 和 b，所以 a 也不完整
+	assert.Equal(t, 2, output.Files[0].ValidPieces)
+	assert.False(t, output.Files[0].Complete)
+	assert.False(t, output.Files[1].Exists)
+}
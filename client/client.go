@@ -2,16 +2,49 @@ package client
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"time"
 
 	bitField "github.com/strugglebak/goMule/bit_field"
+	extension "github.com/strugglebak/goMule/extension"
 	handshake "github.com/strugglebak/goMule/handshake"
+	logging "github.com/strugglebak/goMule/logging"
 	message "github.com/strugglebak/goMule/message"
+	mse "github.com/strugglebak/goMule/mse"
+	peerId "github.com/strugglebak/goMule/peer_id"
 	peers "github.com/strugglebak/goMule/peers"
 )
 
+// 对方的 peer ID 和我们的一样，说明连到了自己，比如 tracker 返回了我们自己的地址
+var ErrSelfConnection = errors.New("connected to ourselves")
+
+// 已经有一个和对方 peer ID 的连接了，比如多个来源给出了同一个 peer 的不同地址
+var ErrDuplicateConnection = errors.New("already connected to this peer")
+
+// 握手时对对方 peer ID 的检查，零值只检查是不是连到了自己
+type PeerIDCheck struct {
+	Expected	[20]byte	// tracker 给出的对方的 peer ID，全 0 时不检查
+	// 其他检查都通过之后调用，返回 false 表示已经有和这个 peer ID 的连接，这时放弃 conn
+	// 为 nil 时不检查重复的连接
+	Claim			func(remotePeerID [20]byte, conn net.Conn) bool
+}
+
+// 和同一个 peer 之间有两个连接时 (比如双方同时主动连接了对方)，新的连接是否应该替换已有的连接
+// outbound 和 existingOutbound 分别表示两个连接是不是我们发起的
+// 由同一方发起的两个连接保留已有的那个，否则保留 peer ID 较小的一方发起的连接，两端会得到同样的结果
+func PreferConnection(ours, theirs [20]byte, outbound, existingOutbound bool) bool {
+	if outbound == existingOutbound {
+		return false
+	}
+	if outbound {
+		return bytes.Compare(ours[:], theirs[:]) < 0
+	}
+	return bytes.Compare(theirs[:], ours[:]) < 0
+}
+
 // Client 是一个 peer 的 TCP 连接
 type Client struct {
 	Conn			net.Conn
@@ -20,23 +53,52 @@ type Client struct {
 	Peer			peers.Peer
 	InfoHash	[20]byte
 	PeerID		[20]byte
+	Logger		*slog.Logger
+	RemotePeerID	[20]byte	// 对方在握手时发来的 peer ID
+	Interested		bool			// 对方是否对我们的数据感兴趣
+	Extensions		bool			// 对方是否支持 BEP 10 扩展协议
+	RequestQueue	int				// 对方在扩展握手中声明的 reqq，为 0 表示没有声明
+	Version				string		// 对方在扩展握手中声明的 v，比如 qBittorrent/4.2.5
+	UploadOnly		bool			// 对方在扩展握手中声明了 upload_only (BEP 21)，不会再下载
 }
 
+// 我们在扩展握手中声明的 reqq，连入的 peer 的 request 是依次处理的，不会被丢弃
+const MaxRequestQueue = 250
+
+// peer.ID 不为全 0 时检查对方的 peer ID 是不是和它一样，v2 见 CompleteHandshake
+// claim 见 PeerIDCheck.Claim，为 nil 时不检查重复的连接，logger 为 nil 时使用 slog.Default()
+// bitfield 是我们已有的 piece，握手之后马上发送，这样对方可以向我们请求，为 nil 时不发送
 func BuildClient(
 	peer peers.Peer,
 	infoHash,
 	peerID [20]byte,
+	policy mse.Policy,
+	v2 bool,
+	claim func(remotePeerID [20]byte, conn net.Conn) bool,
+	bitfield bitField.BitField,
+	logger *slog.Logger,
 ) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3 * time.Second)
+	logger = logging.OrDefault(logger)
+	check := PeerIDCheck{Expected: peer.ID, Claim: claim}
+	conn, response, err := dial(peer, infoHash, peerID, policy, v2, check)
+	// 对方的 peer ID 不对时换成明文也没有用
+	if policy == mse.PolicyPrefer && err != nil && !isPeerIDError(err) {
+		// 对方可能不支持加密，重新连接后用明文握手
+		logger.Debug("encrypted handshake failed, retrying in plaintext", logging.Peer(peer), logging.Error(err))
+		conn, response, err = dial(peer, infoHash, peerID, mse.PolicyDisable, v2, check)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// 握手
-	_, err = CompleteHandshake(conn, infoHash, peerID)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	// bitfield 只能是握手之后的第一个消息，要在扩展握手之前发送
+	if bitfield != nil {
+		msg := message.Message{ID: message.MessageBitfield, Payload: bitfield}
+		_, err = conn.Write(msg.Serialize())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
 
 	// 接收 bitField
@@ -46,14 +108,59 @@ func BuildClient(
 		return nil, err
 	}
 
-	return &Client{
+	client := &Client{
 		Conn: conn,
 		Choked: true,
 		Bitfield: bf,
 		Peer: peer,
 		InfoHash: infoHash,
 		PeerID: peerID,
-	}, nil
+		Logger: logger,
+		RemotePeerID: response.PeerID,
+		Extensions: response.SupportsExtensions(),
+	}
+	// 对方的扩展握手可能晚一点才到，由读消息的地方交给 HandleExtended
+	if client.Extensions {
+		err = client.SendExtendedHandshake(false)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// 建立 TCP 连接并完成握手，policy 不是 disable 时先完成加密握手
+// 返回连接和对方的握手
+func dial(
+	peer peers.Peer,
+	infoHash,
+	peerID [20]byte,
+	policy mse.Policy,
+	v2 bool,
+	check PeerIDCheck,
+) (net.Conn, *handshake.Handshake, error) {
+	conn, err := net.DialTimeout("tcp", peer.String(), 3 * time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if policy != mse.PolicyDisable {
+		encrypted, err := mse.Handshake(conn, infoHash, policy)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = encrypted
+	}
+
+	// 握手
+	response, err := CompleteHandshake(conn, infoHash, peerID, v2, check)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, response, nil
 }
 
 func (client *Client) Read() (*message.Message, error) {
@@ -91,10 +198,56 @@ func (client *Client) SendHave(index int) error {
 	return err
 }
 
+// 我们的扩展握手，uploadOnly 为 true 时告诉对方我们不会再下载
+func ExtendedHandshake(uploadOnly bool) *extension.Handshake {
+	h := &extension.Handshake{V: peerId.UserAgent, Reqq: MaxRequestQueue}
+	if uploadOnly {
+		h.UploadOnly = 1
+	}
+	return h
+}
+
+// 发送我们的扩展握手，对方支持扩展协议时才能发送
+// 可以发送多次，比如下载完成之后再发送一次 uploadOnly 为 true 的
+func (client *Client) SendExtendedHandshake(uploadOnly bool) error {
+	msg, err := extension.FormatHandshake(ExtendedHandshake(uploadOnly))
+	if err != nil {
+		return err
+	}
+	_, err = client.Conn.Write(msg.Serialize())
+	return err
+}
+
+// 处理对方发来的扩展消息，目前只关心扩展握手中的 reqq、v 和 upload_only，其他的扩展消息被忽略
+func (client *Client) HandleExtended(msg *message.Message) error {
+	if !extension.IsHandshake(msg) {
+		return nil
+	}
+	h, err := extension.ParseHandshake(msg)
+	if err != nil {
+		return err
+	}
+	if h.Reqq > 0 {
+		client.RequestQueue = h.Reqq
+	}
+	if h.V != "" {
+		client.Version = h.V
+	}
+	// 后来的扩展握手会更新前面的，没有 upload_only 表示对方又要下载了
+	client.UploadOnly = h.UploadOnly != 0
+	return nil
+}
+
+// 我们主动连接对方时，我们先发送握手，再读对方的回应
+// 对方的 peer ID 和我们的一样时返回 ErrSelfConnection，和 check.Expected 不一样时返回错误，
+// check.Claim 返回 false 时返回 ErrDuplicateConnection
+// v2 为 true 时在 reserved 中声明支持 v2 协议 (BEP 52)，v2 和 hybrid 种子都应该声明
 func CompleteHandshake(
 	conn net.Conn,
 	infoHash,
 	peerID [20]byte,
+	v2 bool,
+	check PeerIDCheck,
 ) (*handshake.Handshake, error) {
 	// 设置 deadline 为 3s
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
@@ -103,6 +256,10 @@ func CompleteHandshake(
 
 	// 发送请求
 	request := handshake.BuildHandshake(infoHash, peerID)
+	request.SetExtensions()
+	if v2 {
+		request.SetV2()
+	}
 	_, err := conn.Write(request.Serialize())
 	if err != nil {
 		return nil, err
@@ -119,9 +276,78 @@ func CompleteHandshake(
 		return nil, fmt.Errorf("expected infoHash %x but go %x", response.InfoHash, infoHash)
 	}
 
+	// 检查 peerID
+	if response.PeerID == peerID {
+		return nil, ErrSelfConnection
+	}
+	if check.Expected != ([20]byte{}) && response.PeerID != check.Expected {
+		return nil, &unexpectedPeerIDError{check.Expected, response.PeerID}
+	}
+	if check.Claim != nil && !check.Claim(response.PeerID, conn) {
+		return nil, ErrDuplicateConnection
+	}
+
 	return response, nil
 }
 
+// 对方主动连接我们时，对方先发送握手，我们再回应
+// known 判断对方请求的 info hash 是不是我们正在下载或者做种的种子，以及这个种子是否支持 v2 协议
+// 对方的 peer ID 和我们的一样时返回 ErrSelfConnection，这时不会回应握手
+func AcceptHandshake(
+	conn net.Conn,
+	peerID [20]byte,
+	known func(infoHash [20]byte) (ok bool, v2 bool),
+) (*handshake.Handshake, error) {
+	// 设置 deadline 为 3s
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	// 函数结束后禁止 deadline
+	defer conn.SetDeadline(time.Time{})
+
+	// 接收请求
+	request, err := handshake.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// 检查 infoHash
+	ok, v2 := known(request.InfoHash)
+	if !ok {
+		return nil, fmt.Errorf("unknown infoHash %x", request.InfoHash)
+	}
+	if request.PeerID == peerID {
+		return nil, ErrSelfConnection
+	}
+
+	// 发送回应，对方支持扩展协议时会先发送扩展握手，我们再回应 (见 p2p 包)
+	response := handshake.BuildHandshake(request.InfoHash, peerID)
+	response.SetExtensions()
+	if v2 {
+		response.SetV2()
+	}
+	_, err = conn.Write(response.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// 对方的 peer ID 和 tracker 给出的不一样
+type unexpectedPeerIDError struct {
+	expected	[20]byte
+	got				[20]byte
+}
+
+func (err *unexpectedPeerIDError) Error() string {
+	return fmt.Sprintf("expected peer ID %x but got %x", err.expected, err.got)
+}
+
+// 握手本身没问题，只是对方的 peer ID 不能用
+func isPeerIDError(err error) bool {
+	var unexpected *unexpectedPeerIDError
+	return errors.Is(err, ErrSelfConnection) || errors.Is(err, ErrDuplicateConnection) || errors.As(err, &unexpected)
+}
+
 func ReceiveBitField(conn net.Conn) (bitField.BitField, error) {
 	// 设置 deadline 为 5s
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"io"
+	"io/ioutil"
 	"net"
 	"testing"
 
@@ -8,8 +10,12 @@ import (
 	"github.com/stretchr/testify/require"
 
 	bitField "github.com/strugglebak/goMule/bit_field"
+	extension "github.com/strugglebak/goMule/extension"
 	handshake "github.com/strugglebak/goMule/handshake"
 	message "github.com/strugglebak/goMule/message"
+	mse "github.com/strugglebak/goMule/mse"
+	peerId "github.com/strugglebak/goMule/peer_id"
+	peers "github.com/strugglebak/goMule/peers"
 )
 
 func TestCompleteHandshake(t *testing.T) {
@@ -44,7 +50,7 @@ func TestCompleteHandshake(t *testing.T) {
 		clientConn, serverConn := createClientAndServer(t)
 		serverConn.Write(test.serverHandshake)
 
-		h, err := CompleteHandshake(clientConn, test.clientInfohash, test.clientPeerID)
+		h, err := CompleteHandshake(clientConn, test.clientInfohash, test.clientPeerID, false, PeerIDCheck{})
 
 		if test.fails {
 			assert.NotNil(t, err)
@@ -55,6 +61,147 @@ func TestCompleteHandshake(t *testing.T) {
 	}
 }
 
+func TestCompleteHandshakeChecksPeerID(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	ourPeerID := [20]byte{1}
+	remotePeerID := [20]byte{9}
+	tests := map[string]struct {
+		remotePeerID [20]byte
+		check        PeerIDCheck
+		err          error
+		fails        bool
+	} {
+		"no check":               {remotePeerID: remotePeerID},
+		"connected to ourselves": {remotePeerID: ourPeerID, err: ErrSelfConnection, fails: true},
+		"expected peer ID":       {remotePeerID: remotePeerID, check: PeerIDCheck{Expected: remotePeerID}},
+		"unexpected peer ID":     {remotePeerID: remotePeerID, check: PeerIDCheck{Expected: [20]byte{8}}, fails: true},
+		"claimed": {
+			remotePeerID: remotePeerID,
+			check:        PeerIDCheck{Claim: func(id [20]byte, conn net.Conn) bool { return id == remotePeerID }},
+		},
+		"duplicate": {
+			remotePeerID: remotePeerID,
+			check:        PeerIDCheck{Claim: func([20]byte, net.Conn) bool { return false }},
+			err:          ErrDuplicateConnection,
+			fails:        true,
+		},
+	}
+
+	for name, test := range tests {
+		clientConn, serverConn := createClientAndServer(t)
+		serverConn.Write(handshake.BuildHandshake(infoHash, test.remotePeerID).Serialize())
+
+		h, err := CompleteHandshake(clientConn, infoHash, ourPeerID, false, test.check)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			if test.err != nil {
+				assert.Equal(t, test.err, err, name)
+			}
+		} else {
+			require.Nil(t, err, name)
+			assert.Equal(t, test.remotePeerID, h.PeerID, name)
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func TestPreferConnection(t *testing.T) {
+	small, large := [20]byte{1}, [20]byte{2}
+	// 同一方发起的两个连接保留已有的
+	assert.False(t, PreferConnection(small, large, true, true))
+	assert.False(t, PreferConnection(small, large, false, false))
+	// 我们的 peer ID 较小时保留我们发起的连接
+	assert.True(t, PreferConnection(small, large, true, false))
+	assert.False(t, PreferConnection(small, large, false, true))
+	// 对方的 peer ID 较小时保留对方发起的连接
+	assert.False(t, PreferConnection(large, small, true, false))
+	assert.True(t, PreferConnection(large, small, false, true))
+	// 新的连接在两端看来方向相反，两端得到同样的结果
+	for _, outbound := range []bool{true, false} {
+		assert.Equal(t, PreferConnection(small, large, outbound, !outbound), PreferConnection(large, small, !outbound, outbound))
+	}
+}
+
+func TestAcceptHandshake(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	ourPeerID := [20]byte{1, 2, 3}
+	known := func(h [20]byte) (bool, bool) { return h == infoHash, false }
+
+	tests := map[string]struct {
+		remoteInfoHash [20]byte
+		remotePeerID   [20]byte
+		fails          bool
+	} {
+		"successful handshake": {
+			remoteInfoHash: infoHash,
+			remotePeerID:   [20]byte{9},
+		},
+		"unknown infohash": {
+			remoteInfoHash: [20]byte{0xde, 0xad},
+			remotePeerID:   [20]byte{9},
+			fails:          true,
+		},
+		"connected to ourselves": {
+			remoteInfoHash: infoHash,
+			remotePeerID:   ourPeerID,
+			fails:          true,
+		},
+	}
+
+	for name, test := range tests {
+		clientConn, serverConn := createClientAndServer(t)
+		clientConn.Write(handshake.BuildHandshake(test.remoteInfoHash, test.remotePeerID).Serialize())
+
+		h, err := AcceptHandshake(serverConn, ourPeerID, known)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			require.Nil(t, err, name)
+			assert.Equal(t, test.remotePeerID, h.PeerID)
+			// 对方收到的回应里是我们的 peer ID
+			response, err := handshake.Read(clientConn)
+			require.Nil(t, err)
+			assert.Equal(t, infoHash, response.InfoHash)
+			assert.Equal(t, ourPeerID, response.PeerID)
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+
+	// 对方连到自己时不应该回应握手
+	clientConn, serverConn := createClientAndServer(t)
+	clientConn.Write(handshake.BuildHandshake(infoHash, ourPeerID).Serialize())
+	_, err := AcceptHandshake(serverConn, ourPeerID, known)
+	assert.Equal(t, ErrSelfConnection, err)
+}
+
+func TestHandshakeV2(t *testing.T) {
+	infoHash := [20]byte{1}
+
+	// 主动连接时在握手中声明支持 v2
+	ours, theirs := net.Pipe()
+	go CompleteHandshake(ours, infoHash, [20]byte{1}, true, PeerIDCheck{})
+	request, err := handshake.Read(theirs)
+	require.Nil(t, err)
+	assert.True(t, request.SupportsV2())
+	assert.True(t, request.SupportsExtensions())
+	ours.Close()
+	theirs.Close()
+
+	// 回应握手时由 known 决定
+	for _, v2 := range []bool{true, false} {
+		ours, theirs := net.Pipe()
+		go theirs.Write(handshake.BuildHandshake(infoHash, [20]byte{9}).Serialize())
+		go AcceptHandshake(ours, [20]byte{1}, func([20]byte) (bool, bool) { return true, v2 })
+		response, err := handshake.Read(theirs)
+		require.Nil(t, err)
+		assert.Equal(t, v2, response.SupportsV2())
+		ours.Close()
+		theirs.Close()
+	}
+}
+
 func TestReceiveBitField(t *testing.T) {
 	tests := map[string]struct {
 		msg    []byte
@@ -193,6 +340,73 @@ func TestSendHave(t *testing.T) {
 	assert.Equal(t, expected, buf)
 }
 
+// 启动一个 peer，encryption 为 disable 时它只会明文握手
+func startPeer(t *testing.T, infoHash [20]byte, policy mse.Policy) peers.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn, err := mse.Accept(conn, policy, mse.Lookup(infoHash))
+				if err != nil {
+					return
+				}
+				request, err := handshake.Read(conn)
+				if err != nil {
+					return
+				}
+				response := handshake.BuildHandshake(request.InfoHash, [20]byte{9})
+				conn.Write(response.Serialize())
+				msg := message.Message{ID: message.MessageBitfield, Payload: []byte{0xff}}
+				conn.Write(msg.Serialize())
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestBuildClient(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	tests := map[string]struct {
+		client    mse.Policy
+		peer      mse.Policy
+		encrypted bool
+		fails     bool
+	} {
+		"both prefer":          {client: mse.PolicyPrefer, peer: mse.PolicyPrefer, encrypted: true},
+		"fallback to plain":    {client: mse.PolicyPrefer, peer: mse.PolicyDisable, encrypted: false},
+		"require":              {client: mse.PolicyRequire, peer: mse.PolicyRequire, encrypted: true},
+		"require but plain":    {client: mse.PolicyRequire, peer: mse.PolicyDisable, fails: true},
+		"disable":              {client: mse.PolicyDisable, peer: mse.PolicyPrefer, encrypted: false},
+		"disable but required": {client: mse.PolicyDisable, peer: mse.PolicyRequire, fails: true},
+	}
+
+	for name, test := range tests {
+		peer := startPeer(t, infoHash, test.peer)
+		c, err := BuildClient(peer, infoHash, [20]byte{1}, test.client, false, nil, nil, nil)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, bitField.BitField{0xff}, c.Bitfield, name)
+		assert.Equal(t, [20]byte{9}, c.RemotePeerID, name)
+		conn, ok := c.Conn.(*mse.Conn)
+		assert.Equal(t, test.encrypted, ok && conn.Encrypted(), name)
+		c.Conn.Close()
+	}
+}
+
 func createClientAndServer(t *testing.T) (clientConn, serverConn net.Conn) {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	require.Nil(t, err)
@@ -209,3 +423,66 @@ func createClientAndServer(t *testing.T) (clientConn, serverConn net.Conn) {
 
 	return clientConn, serverConn
 }
+
+func TestBuildClientExtensions(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	received := make(chan *message.Message, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := handshake.Read(conn)
+		if err != nil || !request.SupportsExtensions() {
+			close(received)
+			return
+		}
+		response := handshake.BuildHandshake(request.InfoHash, [20]byte{9})
+		response.SetExtensions()
+		conn.Write(response.Serialize())
+		conn.Write((&message.Message{ID: message.MessageBitfield, Payload: []byte{0xff}}).Serialize())
+		msg, err := message.Read(conn)
+		if err == nil {
+			received <- msg
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	c, err := BuildClient(peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, [20]byte{1}, mse.PolicyDisable, false, nil, nil, nil)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.True(t, c.Extensions)
+
+	// 对方支持扩展协议时马上发送我们的扩展握手
+	msg := <-received
+	require.NotNil(t, msg)
+	h, err := extension.ParseHandshake(msg)
+	require.Nil(t, err)
+	assert.Equal(t, peerId.UserAgent, h.V)
+	assert.Equal(t, MaxRequestQueue, h.Reqq)
+	assert.Equal(t, 0, h.UploadOnly)
+
+	// 对方的扩展握手
+	theirs, err := extension.FormatHandshake(&extension.Handshake{V: "qBittorrent/4.2.5", Reqq: 500})
+	require.Nil(t, err)
+	require.Nil(t, c.HandleExtended(theirs))
+	assert.Equal(t, 500, c.RequestQueue)
+	assert.Equal(t, "qBittorrent/4.2.5", c.Version)
+	assert.False(t, c.UploadOnly)
+
+	// 对方下载完成之后声明 upload_only
+	uploadOnly, err := extension.FormatHandshake(&extension.Handshake{UploadOnly: 1})
+	require.Nil(t, err)
+	require.Nil(t, c.HandleExtended(uploadOnly))
+	assert.True(t, c.UploadOnly)
+	assert.Equal(t, 500, c.RequestQueue)
+	// 其他的扩展消息被忽略
+	assert.Nil(t, c.HandleExtended(&message.Message{ID: message.MessageExtended, Payload: []byte{3, 'x'}}))
+	assert.NotNil(t, c.HandleExtended(&message.Message{ID: message.MessageExtended, Payload: []byte("\x00d1:m")}))
+}
@@ -0,0 +1,157 @@
+package event
+
+import (
+	"sync"
+	"time"
+
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+// 下载过程中发生的事件，嵌入 goMule 的程序可以通过 Bus 订阅，终端的进度条也只是其中一个订阅者
+
+type Type int
+
+const (
+	PeerConnected    Type = iota + 1 // 和 Peer 完成了握手
+	PeerDisconnected                 // 和 Peer 的连接断开了，Err 是断开的原因，可能为 nil
+	HandshakeFailed                  // 连接 Peer 或者和它握手失败，Err 是失败的原因
+	PieceVerified                    // Piece 下载好并且通过了校验，Done 和 Wanted 是此时的进度
+	PieceFailed                      // Piece 没有通过校验，会重新下载
+	TrackerAnnounced                 // 向 Tracker 请求到了 PeerCount 个 peer
+	TrackerErrored                   // 向 Tracker 请求失败，Err 是失败的原因
+	Completed                        // 需要的 piece 都下载好了
+	Stalled                          // 一段时间内没有完成任何 piece，有 piece 完成后会重新计时
+)
+
+var typeNames = map[Type]string{
+	PeerConnected:    "peer connected",
+	PeerDisconnected: "peer disconnected",
+	HandshakeFailed:  "handshake failed",
+	PieceVerified:    "piece verified",
+	PieceFailed:      "piece failed",
+	TrackerAnnounced: "tracker announced",
+	TrackerErrored:   "tracker errored",
+	Completed:        "completed",
+	Stalled:          "stalled",
+}
+
+func (eventType Type) String() string {
+	if name, ok := typeNames[eventType]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// 一个事件，只有和 Type 相关的字段有值
+type Event struct {
+	Type     Type
+	Time     time.Time
+	InfoHash [20]byte // 事件所属的 swarm，hybrid 种子的 v2 swarm 是截断的 SHA-256
+	Name     string   // 种子的名字
+
+	Peer      peers.Peer    // PeerConnected、PeerDisconnected、HandshakeFailed、PieceVerified 和 PieceFailed，web seed 的 piece 没有 peer
+	WebSeed   string        // 从 web seed 下载的 piece 的 URL
+	Piece     int           // PieceVerified 和 PieceFailed
+	Done      int           // PieceVerified、Completed 和 Stalled 时已经完成的 piece 数量
+	Wanted    int           // 需要下载的 piece 数量
+	Tracker   string        // TrackerAnnounced 和 TrackerErrored
+	PeerCount int           // TrackerAnnounced 时 tracker 返回的 peer 数量
+	Duration  time.Duration // TrackerAnnounced 和 TrackerErrored 时请求花的时间
+	Err       error
+}
+
+// 把事件分发给所有订阅者，零值可以直接使用，可以在多个 goroutine 中同时使用
+type Bus struct {
+	mutex       sync.Mutex
+	nextId      int
+	subscribers map[int]func(Event)
+}
+
+// 订阅事件，handler 在发出事件的 goroutine 中同步调用，不能阻塞
+// 返回的函数用来取消订阅
+func (bus *Bus) Subscribe(handler func(Event)) (cancel func()) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if bus.subscribers == nil {
+		bus.subscribers = map[int]func(Event){}
+	}
+	id := bus.nextId
+	bus.nextId++
+	bus.subscribers[id] = handler
+	return func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+		delete(bus.subscribers, id)
+	}
+}
+
+// 通过 channel 订阅事件，事件先放进一个不限长度的队列，所以慢的订阅者不会拖慢下载
+// 取消订阅之后 channel 会被关闭，还没有读取的事件会被丢弃
+func (bus *Bus) Channel() (events <-chan Event, cancel func()) {
+	channel := make(chan Event)
+	done := make(chan struct{})
+	var mutex sync.Mutex
+	var queue []Event
+	wake := make(chan struct{}, 1)
+
+	unsubscribe := bus.Subscribe(func(e Event) {
+		mutex.Lock()
+		queue = append(queue, e)
+		mutex.Unlock()
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	})
+
+	go func() {
+		defer close(channel)
+		for {
+			mutex.Lock()
+			pending := queue
+			queue = nil
+			mutex.Unlock()
+			for _, e := range pending {
+				select {
+				case channel <- e:
+				case <-done:
+					return
+				}
+			}
+			select {
+			case <-wake:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return channel, func() {
+		once.Do(func() {
+			unsubscribe()
+			close(done)
+		})
+	}
+}
+
+// 发出一个事件，Time 为零值时设置为当前时间，nil 的 Bus 会忽略事件
+func (bus *Bus) Publish(e Event) {
+	if bus == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	bus.mutex.Lock()
+	handlers := make([]func(Event), 0, len(bus.subscribers))
+	for id := 0; id < bus.nextId; id++ {
+		if handler, ok := bus.subscribers[id]; ok {
+			handlers = append(handlers, handler)
+		}
+	}
+	bus.mutex.Unlock()
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
@@ -0,0 +1,66 @@
+package event
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	bus := &Bus{}
+	var first, second []Event
+	cancelFirst := bus.Subscribe(func(e Event) { first = append(first, e) })
+	bus.Subscribe(func(e Event) { second = append(second, e) })
+
+	bus.Publish(Event{Type: PieceVerified, Piece: 3})
+	cancelFirst()
+	cancelFirst()
+	bus.Publish(Event{Type: Completed})
+
+	require.Len(t, first, 1)
+	assert.Equal(t, 3, first[0].Piece)
+	assert.False(t, first[0].Time.IsZero())
+	require.Len(t, second, 2)
+	assert.Equal(t, Completed, second[1].Type)
+
+	// nil 的 Bus 忽略事件
+	var nilBus *Bus
+	nilBus.Publish(Event{Type: Completed})
+}
+
+func TestChannel(t *testing.T) {
+	bus := &Bus{}
+	events, cancel := bus.Channel()
+
+	// 没有人读取时也不会阻塞发送者
+	for index := 0; index < 100; index++ {
+		bus.Publish(Event{Type: PieceVerified, Piece: index})
+	}
+	bus.Publish(Event{Type: TrackerErrored, Err: errors.New("timeout")})
+
+	for index := 0; index < 100; index++ {
+		e := <-events
+		assert.Equal(t, index, e.Piece)
+	}
+	e := <-events
+	assert.Equal(t, TrackerErrored, e.Type)
+	assert.EqualError(t, e.Err, "timeout")
+
+	cancel()
+	cancel()
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("channel was not closed")
+	}
+	bus.Publish(Event{Type: Completed})
+}
+
+func TestTypeString(t *testing.T) {
+	assert.Equal(t, "handshake failed", HandshakeFailed.String())
+	assert.Equal(t, "unknown", Type(0).String())
+}
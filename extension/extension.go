@@ -0,0 +1,56 @@
+package extension
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jackpal/bencode-go"
+	message "github.com/strugglebak/goMule/message"
+)
+
+// BEP 10 扩展协议
+// 双方在握手的 reserved 中都声明支持之后，可以互相发送 ID 为 20 的消息
+// payload 第一个 byte 为 0 的是扩展握手，内容是一个 bencode 编码的字典
+
+// 扩展握手在扩展消息中的 ID
+const HandshakeID = 0
+
+// 扩展握手，只列出了我们用到的字段，其他的字段解析时会被忽略
+type Handshake struct {
+	M    map[string]int `bencode:"m"`              // 支持的扩展消息和它们的 ID，目前我们没有支持的
+	V    string         `bencode:"v,omitempty"`    // 客户端的名字和版本，比如 qBittorrent/4.2.5
+	Reqq int            `bencode:"reqq,omitempty"` // 不丢弃的情况下最多能同时处理多少个 request，为 0 表示没有声明
+	// BEP 21，为 1 表示只上传、不会再下载，比如做种或者只下载了部分文件并且已经完成
+	UploadOnly int `bencode:"upload_only,omitempty"`
+}
+
+func FormatHandshake(h *Handshake) (*message.Message, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte(HandshakeID)
+	err := bencode.Marshal(&buffer, *h)
+	if err != nil {
+		return nil, err
+	}
+	return &message.Message{ID: message.MessageExtended, Payload: buffer.Bytes()}, nil
+}
+
+// 解析扩展握手，msg 不是扩展握手时返回错误
+func ParseHandshake(msg *message.Message) (*Handshake, error) {
+	if msg.ID != message.MessageExtended {
+		return nil, fmt.Errorf("expected EXTENDED (ID %d), got ID %d", message.MessageExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 || msg.Payload[0] != HandshakeID {
+		return nil, fmt.Errorf("not an extended handshake")
+	}
+	h := &Handshake{}
+	err := bencode.Unmarshal(bytes.NewReader(msg.Payload[1:]), h)
+	if err != nil {
+		return nil, fmt.Errorf("malformed extended handshake: %w", err)
+	}
+	return h, nil
+}
+
+// msg 是不是扩展握手
+func IsHandshake(msg *message.Message) bool {
+	return msg != nil && msg.ID == message.MessageExtended && len(msg.Payload) > 0 && msg.Payload[0] == HandshakeID
+}
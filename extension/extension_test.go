@@ -0,0 +1,54 @@
+package extension
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	message "github.com/strugglebak/goMule/message"
+)
+
+func TestHandshake(t *testing.T) {
+	msg, err := FormatHandshake(&Handshake{V: "goMule/0.0.0.1", Reqq: 250})
+	require.Nil(t, err)
+	assert.Equal(t, message.MessageExtended, msg.ID)
+	assert.Equal(t, "\x00d1:mde4:reqqi250e1:v14:goMule/0.0.0.1e", string(msg.Payload))
+	assert.True(t, IsHandshake(msg))
+
+	h, err := ParseHandshake(msg)
+	require.Nil(t, err)
+	assert.Equal(t, "goMule/0.0.0.1", h.V)
+	assert.Equal(t, 250, h.Reqq)
+	assert.Equal(t, 0, h.UploadOnly)
+
+	// BEP 21
+	msg, err = FormatHandshake(&Handshake{Reqq: 250, UploadOnly: 1})
+	require.Nil(t, err)
+	assert.Equal(t, "\x00d1:mde4:reqqi250e11:upload_onlyi1ee", string(msg.Payload))
+	h, err = ParseHandshake(msg)
+	require.Nil(t, err)
+	assert.Equal(t, 1, h.UploadOnly)
+}
+
+func TestParseHandshake(t *testing.T) {
+	// 不认识的字段被忽略
+	payload := "\x00d1:md11:ut_metadatai2e6:ut_pexi1ee1:pi6881e4:reqqi500e1:v17:qBittorrent/4.2.56:yourip4:\x7f\x00\x00\x01e"
+	h, err := ParseHandshake(&message.Message{ID: message.MessageExtended, Payload: []byte(payload)})
+	require.Nil(t, err)
+	assert.Equal(t, map[string]int{"ut_metadata": 2, "ut_pex": 1}, h.M)
+	assert.Equal(t, "qBittorrent/4.2.5", h.V)
+	assert.Equal(t, 500, h.Reqq)
+
+	tests := map[string]*message.Message{
+		"not extended":      {ID: message.MessageHave, Payload: []byte("\x00de")},
+		"empty":             {ID: message.MessageExtended},
+		"other extension":   {ID: message.MessageExtended, Payload: []byte("\x01de")},
+		"malformed payload": {ID: message.MessageExtended, Payload: []byte("\x00d1:m")},
+	}
+	for name, msg := range tests {
+		_, err := ParseHandshake(msg)
+		assert.NotNil(t, err, name)
+	}
+	assert.False(t, IsHandshake(nil))
+}
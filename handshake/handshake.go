@@ -7,9 +7,28 @@ import (
 
 type Handshake struct {
 	ProtocolIdentifier 	string
+	Reserved						[8]byte // 每一位代表一个扩展，见 SupportsV2
 	InfoHash 						[20]byte
 	PeerID							[20]byte
 }
+
+// BEP 10: reserved 第 6 个 byte 的 0x10 表示支持扩展协议
+func (handshake *Handshake) SupportsExtensions() bool {
+	return handshake.Reserved[5]&0x10 != 0
+}
+
+func (handshake *Handshake) SetExtensions() {
+	handshake.Reserved[5] |= 0x10
+}
+
+// BEP 52: reserved 最后一个 byte 的 0x10 表示支持 v2 协议
+func (handshake *Handshake) SupportsV2() bool {
+	return handshake.Reserved[7]&0x10 != 0
+}
+
+func (handshake *Handshake) SetV2() {
+	handshake.Reserved[7] |= 0x10
+}
 // 序列化 handshake 数据，结果为
 // ------------------------------------------------------------------------------
 // |ProtocolIdentifier length| |ProtocolIdentifier| |reserve| |InfoHash| |PeerID|
@@ -31,7 +50,7 @@ func (handshake *Handshake) Serialize() []byte {
 	index := 1
 	index += copy(buffer[index:], handshake.ProtocolIdentifier)
 	// 保留 8 个字节
-	index += copy(buffer[index:], make([]byte, ReserveLength))
+	index += copy(buffer[index:], handshake.Reserved[:ReserveLength])
 	index += copy(buffer[index:], handshake.InfoHash[:])
 	index += copy(buffer[index:], handshake.PeerID[:])
 
@@ -64,12 +83,15 @@ func Read(reader io.Reader) (*Handshake, error) {
 
 	// 构建 handshake 数据结构
 	var infoHash, peerID [20]byte
+	var reserved [8]byte
+	copy(reserved[:], handshakeBuffer[protocolIdentifierLength : protocolIdentifierLength+8])
 	infoHashStartIndex := protocolIdentifierLength + 8
 	infoHashEndIndex := protocolIdentifierLength + 8 + 20
 	copy(infoHash[:], handshakeBuffer[infoHashStartIndex : infoHashEndIndex])
 	copy(peerID[:], handshakeBuffer[infoHashEndIndex:])
 	handshake := Handshake {
 		ProtocolIdentifier: string(handshakeBuffer[0 : protocolIdentifierLength]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID: peerID,
 	}
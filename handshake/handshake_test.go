@@ -89,6 +89,22 @@ func TestRead(t *testing.T) {
 			},
 			fails: false,
 		},
+		"parse reserved bits": {
+			input: []byte{
+				19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0, 0, 0x10, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20,
+			},
+			output: &Handshake{
+				ProtocolIdentifier: "BitTorrent protocol",
+				Reserved: 					[8]byte{0, 0, 0, 0, 0, 0, 0, 0x10},
+				InfoHash: 					[20]byte{
+					134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116,
+				},
+				PeerID:   					[20]byte{
+					1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20,
+				},
+			},
+			fails: false,
+		},
 		"empty": {
 			input:  []byte{},
 			output: nil,
@@ -121,3 +137,20 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, test.output, handshake)
 	}
 }
+
+func TestSupportsV2(t *testing.T) {
+	h := BuildHandshake([20]byte{}, [20]byte{})
+	assert.False(t, h.SupportsV2())
+	h.SetV2()
+	assert.True(t, h.SupportsV2())
+	assert.Equal(t, byte(0x10), h.Serialize()[27])
+}
+
+func TestSupportsExtensions(t *testing.T) {
+	h := BuildHandshake([20]byte{}, [20]byte{})
+	assert.False(t, h.SupportsExtensions())
+	h.SetExtensions()
+	assert.True(t, h.SupportsExtensions())
+	assert.False(t, h.SupportsV2())
+	assert.Equal(t, byte(0x10), h.Serialize()[25])
+}
@@ -0,0 +1,228 @@
+package listener
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+
+	client "github.com/strugglebak/goMule/client"
+	logging "github.com/strugglebak/goMule/logging"
+	mse "github.com/strugglebak/goMule/mse"
+	peerId "github.com/strugglebak/goMule/peer_id"
+)
+
+// 接受其他 peer 主动发起的连接
+// 先读对方的握手，根据其中的 info hash 找到加入过的种子，回应我们的握手之后把连接交给这个种子
+// 不认识的 info hash 和连到自己的连接会被直接关闭
+
+// 握手完成之后处理连接，infoHash 是对方握手时用的 info hash，peerID 是对方的 peer ID
+// Handler 负责关闭 conn，p2p.Torrent 的 AcceptPeer 就是一个 Handler
+type Handler func(conn net.Conn, infoHash, peerID [20]byte) error
+
+type Options struct {
+	PeerID         [20]byte     // 回应握手时使用，应该和主动连接时的一样，全 0 时用 peerId.Generate 生成
+	Encryption     mse.Policy   // 连入的连接的加密策略
+	MaxConnections int          // 同时处理的连入连接数量上限，包括还在握手的，为 0 时不限制
+	Logger         *slog.Logger // 为 nil 时使用 slog.Default()
+}
+
+// 加入过的种子
+type entry struct {
+	handler Handler
+	v2      bool // 种子支持 v2 协议，回应握手时在 reserved 中声明 (BEP 52)
+}
+
+type Listener struct {
+	listener net.Listener
+	options  Options
+	logger   *slog.Logger
+
+	mutex       sync.Mutex
+	handlers    map[[20]byte]entry
+	connections int
+	closed      bool
+}
+
+// 在 address 上监听，比如 :6881
+func Listen(address string, options Options) (*Listener, error) {
+	if options.PeerID == ([20]byte{}) {
+		var err error
+		options.PeerID, err = peerId.Generate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		listener: ln,
+		options:  options,
+		logger:   logging.OrDefault(options.Logger),
+		handlers: make(map[[20]byte]entry),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// 实际监听的端口，address 的端口为 0 时由系统分配
+func (l *Listener) Port() uint16 {
+	if addr, ok := l.listener.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+func (l *Listener) PeerID() [20]byte {
+	return l.options.PeerID
+}
+
+// 开始接受 infoHash 的连接，已经加入过时替换原来的 handler
+// hybrid 种子需要用 v1 和 v2 两个 info hash 分别加入，v2 和 hybrid 种子应该用 AddV2
+func (l *Listener) Add(infoHash [20]byte, handler Handler) {
+	l.add(infoHash, handler, false)
+}
+
+// 和 Add 一样，只是回应握手时声明支持 v2 协议
+func (l *Listener) AddV2(infoHash [20]byte, handler Handler) {
+	l.add(infoHash, handler, true)
+}
+
+func (l *Listener) add(infoHash [20]byte, handler Handler, v2 bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.handlers[infoHash] = entry{handler: handler, v2: v2}
+}
+
+// 不再接受 infoHash 的新连接，已经交给 handler 的连接不受影响
+func (l *Listener) Remove(infoHash [20]byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.handlers, infoHash)
+}
+
+// 停止监听，已经交给 handler 的连接由 handler 关闭
+func (l *Listener) Close() error {
+	l.mutex.Lock()
+	l.closed = true
+	l.mutex.Unlock()
+	return l.listener.Close()
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.mutex.Lock()
+			closed := l.closed
+			l.mutex.Unlock()
+			var netErr net.Error
+			if !closed && errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			if !closed {
+				l.logger.Error("stopped accepting peer connections", logging.ClassifiedError(err, logging.ClassNetwork))
+			}
+			return
+		}
+		if !l.acquire() {
+			l.logger.Debug("rejected peer connection, too many connections",
+				slog.String("peer", conn.RemoteAddr().String()), slog.Int("limit", l.options.MaxConnections))
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer l.release()
+			l.handle(conn)
+		}()
+	}
+}
+
+func (l *Listener) acquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.options.MaxConnections > 0 && l.connections >= l.options.MaxConnections {
+		return false
+	}
+	l.connections++
+	return true
+}
+
+func (l *Listener) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.connections--
+}
+
+// 当前正在处理的连入连接数量
+func (l *Listener) Connections() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.connections
+}
+
+func (l *Listener) infoHashes() [][20]byte {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	infoHashes := make([][20]byte, 0, len(l.handlers))
+	for infoHash := range l.handlers {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return infoHashes
+}
+
+func (l *Listener) entry(infoHash [20]byte) (entry, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	entry, ok := l.handlers[infoHash]
+	return entry, ok
+}
+
+// 完成加密握手和 BitTorrent 握手，然后交给种子的 handler
+func (l *Listener) handle(conn net.Conn) {
+	logger := l.logger.With(slog.String("peer", conn.RemoteAddr().String()))
+
+	// 加密握手里只有 info hash 的 hash，需要用所有加入过的 info hash 去匹配
+	encrypted, err := mse.Accept(conn, l.options.Encryption, mse.Lookup(l.infoHashes()...))
+	if err != nil {
+		logger.Debug("inbound encrypted handshake failed", logging.Error(err))
+		conn.Close()
+		return
+	}
+
+	h, err := client.AcceptHandshake(encrypted, l.options.PeerID, func(infoHash [20]byte) (bool, bool) {
+		// 经过加密握手时，BitTorrent 握手中的 info hash 必须是加密握手中的 SKEY
+		if conn, ok := encrypted.(*mse.Conn); ok {
+			if skey, obfuscated := conn.SKey(); obfuscated && skey != infoHash {
+				logger.Debug("inbound handshake does not match encryption key", logging.InfoHash(infoHash))
+				return false, false
+			}
+		}
+		entry, ok := l.entry(infoHash)
+		return ok, entry.v2
+	})
+	if err != nil {
+		logger.Debug("inbound handshake failed", logging.Error(err))
+		conn.Close()
+		return
+	}
+
+	// 握手期间种子可能被移除了
+	entry, ok := l.entry(h.InfoHash)
+	if !ok {
+		conn.Close()
+		return
+	}
+	logger.Debug("inbound handshake completed", logging.InfoHash(h.InfoHash))
+	err = entry.handler(encrypted, h.InfoHash, h.PeerID)
+	if err != nil {
+		logger.Debug("inbound peer closed", logging.InfoHash(h.InfoHash), logging.Error(err))
+	}
+}
@@ -0,0 +1,168 @@
+package listener
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	client "github.com/strugglebak/goMule/client"
+	handshake "github.com/strugglebak/goMule/handshake"
+	mse "github.com/strugglebak/goMule/mse"
+	peerId "github.com/strugglebak/goMule/peer_id"
+)
+
+var testInfoHash = [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+
+type accepted struct {
+	conn     net.Conn
+	infoHash [20]byte
+	peerID   [20]byte
+}
+
+func listen(t *testing.T, options Options) (*Listener, chan accepted) {
+	l, err := Listen("127.0.0.1:0", options)
+	require.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	connections := make(chan accepted, 1)
+	l.Add(testInfoHash, func(conn net.Conn, infoHash, peerID [20]byte) error {
+		connections <- accepted{conn, infoHash, peerID}
+		return nil
+	})
+	return l, connections
+}
+
+func dial(t *testing.T, l *Listener) net.Conn {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// 连接被对方关闭时读到 EOF
+func assertClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestListener(t *testing.T) {
+	l, connections := listen(t, Options{PeerID: [20]byte{1, 2, 3}})
+	assert.NotZero(t, l.Port())
+	assert.Equal(t, [20]byte{1, 2, 3}, l.PeerID())
+
+	conn := dial(t, l)
+	response, err := client.CompleteHandshake(conn, testInfoHash, [20]byte{9}, false, client.PeerIDCheck{})
+	require.Nil(t, err)
+	assert.Equal(t, [20]byte{1, 2, 3}, response.PeerID)
+
+	select {
+	case a := <-connections:
+		assert.Equal(t, testInfoHash, a.infoHash)
+		assert.Equal(t, [20]byte{9}, a.peerID)
+		// 握手之后的数据交给 handler
+		conn.Write([]byte("hello"))
+		buffer := make([]byte, 5)
+		_, err = io.ReadFull(a.conn, buffer)
+		require.Nil(t, err)
+		assert.Equal(t, "hello", string(buffer))
+		a.conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not handed to the torrent")
+	}
+}
+
+func TestListenerRejects(t *testing.T) {
+	l, connections := listen(t, Options{PeerID: [20]byte{1, 2, 3}})
+
+	// 不认识的 info hash
+	conn := dial(t, l)
+	conn.Write(handshake.BuildHandshake([20]byte{0xde, 0xad}, [20]byte{9}).Serialize())
+	assertClosed(t, conn)
+
+	// 连到了自己
+	conn = dial(t, l)
+	conn.Write(handshake.BuildHandshake(testInfoHash, [20]byte{1, 2, 3}).Serialize())
+	assertClosed(t, conn)
+
+	// 移除之后不再接受
+	l.Remove(testInfoHash)
+	conn = dial(t, l)
+	conn.Write(handshake.BuildHandshake(testInfoHash, [20]byte{9}).Serialize())
+	assertClosed(t, conn)
+
+	assert.Empty(t, connections)
+}
+
+func TestListenerMaxConnections(t *testing.T) {
+	l, _ := listen(t, Options{MaxConnections: 1})
+
+	// 第一个连接一直不握手，占着唯一的位置
+	dial(t, l)
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Connections() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 1, l.Connections())
+
+	assertClosed(t, dial(t, l))
+}
+
+func TestListenerEncrypted(t *testing.T) {
+	l, connections := listen(t, Options{Encryption: mse.PolicyRequire})
+	// 没有指定时生成 goMule 自己的 peer ID
+	assert.Equal(t, "goMule 0.0.0.1", peerId.Describe(l.PeerID()))
+
+	// 明文连接被拒绝
+	conn := dial(t, l)
+	conn.Write(handshake.BuildHandshake(testInfoHash, [20]byte{9}).Serialize())
+	assertClosed(t, conn)
+
+	encrypted, err := mse.Handshake(dial(t, l), testInfoHash, mse.PolicyRequire)
+	require.Nil(t, err)
+	_, err = client.CompleteHandshake(encrypted, testInfoHash, [20]byte{9}, false, client.PeerIDCheck{})
+	require.Nil(t, err)
+	select {
+	case a := <-connections:
+		assert.Equal(t, [20]byte{9}, a.peerID)
+		a.conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not handed to the torrent")
+	}
+}
+
+func TestListenerEncryptedInfoHashMismatch(t *testing.T) {
+	l, connections := listen(t, Options{Encryption: mse.PolicyRequire})
+	other := [20]byte{0xde, 0xad}
+	otherConnections := make(chan accepted, 1)
+	l.Add(other, func(conn net.Conn, infoHash, peerID [20]byte) error {
+		otherConnections <- accepted{conn, infoHash, peerID}
+		return nil
+	})
+
+	// 用一个种子完成加密握手，再用另一个种子的 info hash 做 BitTorrent 握手
+	encrypted, err := mse.Handshake(dial(t, l), testInfoHash, mse.PolicyRequire)
+	require.Nil(t, err)
+	_, err = client.CompleteHandshake(encrypted, other, [20]byte{9}, false, client.PeerIDCheck{})
+	assert.NotNil(t, err)
+	assertClosed(t, encrypted)
+	assert.Empty(t, connections)
+	assert.Empty(t, otherConnections)
+
+	// 两边一致时可以连接
+	encrypted, err = mse.Handshake(dial(t, l), other, mse.PolicyRequire)
+	require.Nil(t, err)
+	_, err = client.CompleteHandshake(encrypted, other, [20]byte{9}, false, client.PeerIDCheck{})
+	require.Nil(t, err)
+	select {
+	case a := <-otherConnections:
+		assert.Equal(t, other, a.infoHash)
+		a.conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not handed to the torrent")
+	}
+}
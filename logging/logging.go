@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+// 结构化日志的公共部分: 创建 logger，以及各个包共用的字段，保证同一个字段在所有日志中名字一样
+
+// 错误的分类，放在 error.class 字段中，方便日志系统过滤
+const (
+	ClassTimeout   = "timeout"   // 连接或者读写超时
+	ClassNetwork   = "network"   // 连接被拒绝、被重置或者被关闭
+	ClassProtocol  = "protocol"  // 对方发来的数据不符合协议
+	ClassIntegrity = "integrity" // piece 没有通过校验
+	ClassStorage   = "storage"   // 读写磁盘失败
+	ClassTracker   = "tracker"   // tracker 返回了错误或者无法解析的响应
+)
+
+// 根据错误的类型猜测它的分类，猜不出时认为是协议错误
+func ErrorClass(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ClassTimeout
+	}
+	// 文件操作的错误里面也是 syscall.Errno，所以要先判断
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return ClassStorage
+	}
+	var opErr *net.OpError
+	var errno syscall.Errno
+	if errors.As(err, &opErr) || errors.As(err, &errno) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return ClassNetwork
+	}
+	return ClassProtocol
+}
+
+// error 字段，包括错误信息和 ErrorClass 猜出的分类
+func Error(err error) slog.Attr {
+	return ClassifiedError(err, ErrorClass(err))
+}
+
+// 和 Error 一样，只不过分类由调用者决定
+func ClassifiedError(err error, class string) slog.Attr {
+	return slog.Group("error", slog.String("message", err.Error()), slog.String("class", class))
+}
+
+func Peer(peer peers.Peer) slog.Attr {
+	return slog.String("peer", peer.String())
+}
+
+func InfoHash(infoHash [20]byte) slog.Attr {
+	return slog.String("infohash", hex.EncodeToString(infoHash[:]))
+}
+
+func Piece(index int) slog.Attr {
+	return slog.Int("piece", index)
+}
+
+// logger 为 nil 时返回 slog.Default()
+func OrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// 创建一个输出到 writer 的 logger
+// level 是 debug、info、warn 或者 error，format 是 text 或者 json
+func New(writer io.Writer, level, format string) (*slog.Logger, error) {
+	var slogLevel slog.Level
+	switch level {
+	case "debug":
+		slogLevel = slog.LevelDebug
+	case "info":
+		slogLevel = slog.LevelInfo
+	case "warn":
+		slogLevel = slog.LevelWarn
+	case "error":
+		slogLevel = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+	}
+
+	options := &slog.HandlerOptions{Level: slogLevel}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(writer, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(writer, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+}
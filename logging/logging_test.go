@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+func TestErrorClass(t *testing.T) {
+	_, dialErr := net.DialTimeout("tcp", "127.0.0.1:1", time.Second)
+	require.NotNil(t, dialErr)
+	conn, _ := net.Pipe()
+	conn.SetReadDeadline(time.Now())
+	_, timeoutErr := conn.Read(make([]byte, 1))
+	_, pathErr := os.Open("does not exist")
+
+	tests := map[string]struct {
+		err   error
+		class string
+	}{
+		"refused":   {dialErr, ClassNetwork},
+		"timeout":   {timeoutErr, ClassTimeout},
+		"eof":       {fmt.Errorf("reading: %w", io.EOF), ClassNetwork},
+		"file":      {pathErr, ClassStorage},
+		"malformed": {errors.New("received malformed peers"), ClassProtocol},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.class, ErrorClass(test.err), name)
+	}
+}
+
+func TestNew(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := New(&buffer, "info", "json")
+	require.Nil(t, err)
+	logger.Debug("hidden")
+	logger.Warn("piece failed",
+		Peer(peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 6881}),
+		InfoHash([20]byte{0xab}),
+		Piece(3),
+		ClassifiedError(errors.New("bad hash"), ClassIntegrity),
+	)
+
+	record := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(buffer.Bytes(), &record))
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "piece failed", record["msg"])
+	assert.Equal(t, "127.0.0.1:6881", record["peer"])
+	assert.Equal(t, "ab00000000000000000000000000000000000000", record["infohash"])
+	assert.Equal(t, 3.0, record["piece"])
+	assert.Equal(t, map[string]interface{}{"message": "bad hash", "class": "integrity"}, record["error"])
+
+	buffer.Reset()
+	logger, err = New(&buffer, "debug", "text")
+	require.Nil(t, err)
+	logger.Debug("handshaking", Piece(1))
+	assert.Contains(t, buffer.String(), "level=DEBUG msg=handshaking piece=1")
+
+	_, err = New(&buffer, "loud", "text")
+	assert.NotNil(t, err)
+	_, err = New(&buffer, "info", "xml")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,247 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/strugglebak/goMule/logging"
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+// Local Service Discovery (BEP 14)
+// 定期向局域网的多播地址发送 BT-SEARCH，同一个网络中下载相同种子的 peer 可以互相发现
+// 规范见 http://bittorrent.org/beps/bep_0014.html
+
+const (
+	DefaultAddress   = "239.192.152.143:6771"
+	AnnounceInterval = 5 * time.Minute
+	maxMessageSize   = 1400
+)
+
+// Service 监听多播地址上的 announce，并定期为加入的种子发送 announce
+type Service struct {
+	Interval time.Duration // announce 的间隔，Listen 之后、Add 之前可以修改
+
+	conn     *net.UDPConn // 加入了多播组，用来接收 announce
+	sender   *net.UDPConn // 用来发送 announce
+	group    *net.UDPAddr
+	port     uint16 // announce 中的端口，也就是接受 peer 连接的端口
+	cookie   string // 用来忽略自己发出的 announce
+	logger   *slog.Logger
+	mutex    sync.Mutex
+	torrents map[[20]byte]*torrent
+	closed   chan struct{}
+}
+
+type torrent struct {
+	onPeer  func(peers.Peer)
+	removed chan struct{}
+}
+
+// 加入 address 这个多播组，port 是 announce 给其他 peer 的端口
+// 收发 announce 失败时记录到 logger，为 nil 时使用 slog.Default()
+func Listen(address string, port uint16, logger *slog.Logger) (*Service, error) {
+	group, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", address)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	cookie := make([]byte, 8)
+	_, err = rand.Read(cookie)
+	if err != nil {
+		conn.Close()
+		sender.Close()
+		return nil, err
+	}
+
+	s := &Service{
+		Interval: AnnounceInterval,
+		conn:     conn,
+		sender:   sender,
+		group:    group,
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		logger:   logging.OrDefault(logger),
+		torrents: make(map[[20]byte]*torrent),
+		closed:   make(chan struct{}),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// 开始为 infoHash 发送 announce，收到其他 peer 的 announce 时调用 onPeer
+func (s *Service) Add(infoHash [20]byte, onPeer func(peers.Peer)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if existing, ok := s.torrents[infoHash]; ok {
+		existing.onPeer = onPeer
+		return
+	}
+	t := &torrent{onPeer: onPeer, removed: make(chan struct{})}
+	s.torrents[infoHash] = t
+	go s.announceLoop(infoHash, t.removed)
+}
+
+// 停止为 infoHash 发送 announce，也不再报告它的 peer
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if t, ok := s.torrents[infoHash]; ok {
+		close(t.removed)
+		delete(s.torrents, infoHash)
+	}
+}
+
+func (s *Service) Close() error {
+	s.mutex.Lock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	s.mutex.Unlock()
+	s.sender.Close()
+	return s.conn.Close()
+}
+
+func (s *Service) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Service) announceLoop(infoHash [20]byte, removed chan struct{}) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		_, err := s.sender.WriteToUDP(FormatAnnounce(s.group.String(), s.port, infoHash, s.cookie), s.group)
+		if err != nil && !s.isClosed() {
+			s.logger.Warn("could not send local service discovery announce", logging.InfoHash(infoHash), logging.Error(err))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-removed:
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Service) readLoop() {
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, source, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			s.logger.Warn("could not read local service discovery announce", logging.Error(err))
+			continue
+		}
+
+		announce, err := ParseAnnounce(buffer[:n])
+		if err != nil || announce.Cookie == s.cookie {
+			continue
+		}
+		peer := peers.Peer{IP: source.IP, Port: announce.Port}
+		for _, infoHash := range announce.InfoHashes {
+			var onPeer func(peers.Peer)
+			s.mutex.Lock()
+			if t, ok := s.torrents[infoHash]; ok {
+				onPeer = t.onPeer
+			}
+			s.mutex.Unlock()
+			if onPeer != nil {
+				onPeer(peer)
+			}
+		}
+	}
+}
+
+// 一个 BT-SEARCH 消息
+type Announce struct {
+	Port       uint16
+	InfoHashes [][20]byte
+	Cookie     string
+}
+
+// BT-SEARCH * HTTP/1.1\r\n
+// Host: <host>\r\n
+// Port: <port>\r\n
+// Infohash: <40 个字符的 hex>\r\n
+// cookie: <cookie>\r\n
+// \r\n
+// \r\n
+func FormatAnnounce(host string, port uint16, infoHash [20]byte, cookie string) []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buffer, "Host: %s\r\n", host)
+	fmt.Fprintf(&buffer, "Port: %d\r\n", port)
+	fmt.Fprintf(&buffer, "Infohash: %s\r\n", hex.EncodeToString(infoHash[:]))
+	if cookie != "" {
+		fmt.Fprintf(&buffer, "cookie: %s\r\n", cookie)
+	}
+	fmt.Fprintf(&buffer, "\r\n\r\n")
+	return buffer.Bytes()
+}
+
+// 消息的格式和 HTTP 请求一样，一个消息里可以有多个 Infohash
+func ParseAnnounce(buffer []byte) (*Announce, error) {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buffer)))
+	if err != nil {
+		return nil, err
+	}
+	if request.Method != "BT-SEARCH" {
+		return nil, fmt.Errorf("expected BT-SEARCH but got %s", request.Method)
+	}
+
+	port, err := strconv.ParseUint(request.Header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port %q in announce", request.Header.Get("Port"))
+	}
+	announce := &Announce{
+		Port:   uint16(port),
+		Cookie: request.Header.Get("Cookie"),
+	}
+	for _, value := range request.Header.Values("Infohash") {
+		decoded, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(decoded) != 20 {
+			return nil, fmt.Errorf("invalid infohash %q in announce", value)
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], decoded)
+		announce.InfoHashes = append(announce.InfoHashes, infoHash)
+	}
+	if len(announce.InfoHashes) == 0 {
+		return nil, fmt.Errorf("announce has no infohash")
+	}
+	return announce, nil
+}
@@ -0,0 +1,161 @@
+package lsd
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+var testInfoHash = [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+
+func TestFormatAndParseAnnounce(t *testing.T) {
+	buffer := FormatAnnounce(DefaultAddress, 6881, testInfoHash, "abc")
+	assert.Equal(t, "BT-SEARCH * HTTP/1.1\r\n"+
+		"Host: 239.192.152.143:6771\r\n"+
+		"Port: 6881\r\n"+
+		"Infohash: 86d4c80024a469be4c50bc5a102cf71780310074\r\n"+
+		"cookie: abc\r\n"+
+		"\r\n\r\n", string(buffer))
+
+	announce, err := ParseAnnounce(buffer)
+	require.Nil(t, err)
+	assert.Equal(t, &Announce{Port: 6881, InfoHashes: [][20]byte{testInfoHash}, Cookie: "abc"}, announce)
+}
+
+func TestParseAnnounce(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output *Announce
+		fails  bool
+	}{
+		"multiple infohashes": {
+			input: "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 1\r\n" +
+				"Infohash: 86d4c80024a469be4c50bc5a102cf71780310074\r\nInfohash: 0000000000000000000000000000000000000000\r\n\r\n\r\n",
+			output: &Announce{Port: 1, InfoHashes: [][20]byte{testInfoHash, {}}},
+		},
+		"uppercase infohash": {
+			input:  "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: 86D4C80024A469BE4C50BC5A102CF71780310074\r\n\r\n\r\n",
+			output: &Announce{Port: 1, InfoHashes: [][20]byte{testInfoHash}},
+		},
+		"wrong method": {
+			input: "GET * HTTP/1.1\r\nPort: 1\r\nInfohash: 86d4c80024a469be4c50bc5a102cf71780310074\r\n\r\n\r\n",
+			fails: true,
+		},
+		"no port": {
+			input: "BT-SEARCH * HTTP/1.1\r\nInfohash: 86d4c80024a469be4c50bc5a102cf71780310074\r\n\r\n\r\n",
+			fails: true,
+		},
+		"short infohash": {
+			input: "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: 86d4c8\r\n\r\n\r\n",
+			fails: true,
+		},
+		"no infohash": {
+			input: "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n\r\n",
+			fails: true,
+		},
+		"garbage": {
+			input: "hello",
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		announce, err := ParseAnnounce([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			require.Nil(t, err, name)
+			assert.Equal(t, test.output, announce, name)
+		}
+	}
+}
+
+// 找一个空闲的端口，避免和本机其他 BitTorrent 客户端的 announce 混在一起
+func testAddress(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	require.Nil(t, err)
+	defer conn.Close()
+	return fmt.Sprintf("239.192.152.143:%d", conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestDiscovery(t *testing.T) {
+	address := testAddress(t)
+	first, err := Listen(address, 1111, nil)
+	if err != nil {
+		t.Skipf("multicast is not available: %v", err)
+	}
+	defer first.Close()
+	second, err := Listen(address, 2222, nil)
+	require.Nil(t, err)
+	defer second.Close()
+
+	// 第一个 announce 可能在对方 Add 之前就发出去了，所以缩短间隔
+	first.Interval = 50 * time.Millisecond
+	second.Interval = 50 * time.Millisecond
+
+	firstPeers := make(chan peers.Peer, 100)
+	secondPeers := make(chan peers.Peer, 100)
+	first.Add(testInfoHash, func(peer peers.Peer) { firstPeers <- peer })
+	// 另一个种子的 announce 不会被报告给 first
+	second.Add([20]byte{1}, func(peers.Peer) {})
+	second.Add(testInfoHash, func(peer peers.Peer) { secondPeers <- peer })
+
+	// 每一方都只发现对方，不会发现自己
+	for _, test := range []struct {
+		peers chan peers.Peer
+		port  uint16
+	}{
+		{firstPeers, 2222},
+		{secondPeers, 1111},
+	} {
+		select {
+		case peer := <-test.peers:
+			assert.Equal(t, test.port, peer.Port)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no peer discovered on port %d", test.port)
+		}
+	}
+
+	// Remove 之后不再报告
+	first.Remove(testInfoHash)
+	time.Sleep(100 * time.Millisecond)
+	for len(firstPeers) > 0 {
+		<-firstPeers
+	}
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, firstPeers, 0)
+}
+
+// 把每一行日志发到 channel 里
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestLogger(t *testing.T) {
+	lines := make(lineWriter, 10)
+	s, err := Listen(testAddress(t), 1111, slog.New(slog.NewTextHandler(lines, nil)))
+	if err != nil {
+		t.Skipf("multicast is not available: %v", err)
+	}
+	defer s.Close()
+
+	// 发送失败的日志写到传入的 logger 里，而不是 slog.Default()
+	s.sender.Close()
+	s.Add(testInfoHash, func(peers.Peer) {})
+	select {
+	case line := <-lines:
+		assert.Contains(t, line, "could not send local service discovery announce")
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was logged")
+	}
+}
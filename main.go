@@ -1,25 +1,11 @@
 package main
 
 import (
-	"log"
 	"os"
 
-	torrentFile "github.com/strugglebak/goMule/torrent_file"
+	cli "github.com/strugglebak/goMule/cli"
 )
 
-const Port = 6881
-
 func main() {
-	inPath := os.Args[1]
-	outPath := os.Args[2]
-
-	tf, err := torrentFile.Open(inPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = tf.DownloadAndSaveFile(outPath, Port)
-	if err != nil {
-		log.Fatal(err)
-	}
+	os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
 }
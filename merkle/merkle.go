@@ -0,0 +1,96 @@
+package merkle
+
+import (
+	"crypto/sha256"
+)
+
+// BEP 52 中 merkle tree 叶子对应的数据块大小
+const BlockSize = 16384
+
+// 对 data 按 BlockSize 分块，返回每一块的 SHA-256，最后一块可能不满 BlockSize
+func HashBlocks(data []byte) [][32]byte {
+	var hashes [][32]byte
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha256.Sum256(data[begin:end]))
+	}
+	return hashes
+}
+
+// 大于等于 n 的最小的 2 的幂，n <= 1 时返回 1
+func NextPowerOfTwo(n int) int {
+	power := 1
+	for power < n {
+		power <<= 1
+	}
+	return power
+}
+
+// 计算 merkle root，hashes 不足 count 个时用 pad 补齐
+// count 必须是 2 的幂
+func Root(hashes [][32]byte, count int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, count)
+	copy(layer, hashes)
+	for index := len(hashes); index < count; index++ {
+		layer[index] = pad
+	}
+
+	for len(layer) > 1 {
+		next := make([][32]byte, len(layer)/2)
+		for index := range next {
+			next[index] = Combine(layer[2*index], layer[2*index+1])
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// 父节点的 hash
+func Combine(left, right [32]byte) [32]byte {
+	var buffer [64]byte
+	copy(buffer[:32], left[:])
+	copy(buffer[32:], right[:])
+	return sha256.Sum256(buffer[:])
+}
+
+// 有 leaves 个全 0 叶子的子树的 root，用来补齐 piece layer
+func ZeroRoot(leaves int) [32]byte {
+	return Root(nil, NextPowerOfTwo(leaves), [32]byte{})
+}
+
+// 计算一个 piece 的 hash，leaves 是这个 piece 对应的叶子数量
+// piece 所在文件大于 piece length 时 leaves 为 piece length / BlockSize，
+// 否则为文件块数向上取到 2 的幂
+func PieceRoot(data []byte, leaves int) [32]byte {
+	return Root(HashBlocks(data), leaves, [32]byte{})
+}
+
+// 用 piece layer 计算文件的 pieces root，pieceLength 用来计算补齐用的 hash
+func LayerRoot(layer [][32]byte, pieceLength int) [32]byte {
+	return Root(layer, NextPowerOfTwo(len(layer)), ZeroRoot(pieceLength/BlockSize))
+}
+
+// 校验 hashes 消息: hashes 是某一层中从 index 开始的一段连续的 hash，
+// proof 是从这一段的 root 往上每一层的兄弟节点，校验最终得到的 root 是否等于 root
+// len(hashes) 必须是 2 的幂，index 必须是 len(hashes) 的倍数
+func VerifyProof(root [32]byte, hashes [][32]byte, index int, proof [][32]byte) bool {
+	count := len(hashes)
+	if count == 0 || count != NextPowerOfTwo(count) || index%count != 0 {
+		return false
+	}
+
+	current := Root(hashes, count, [32]byte{})
+	position := index / count
+	for _, uncle := range proof {
+		if position%2 == 0 {
+			current = Combine(current, uncle)
+		} else {
+			current = Combine(uncle, current)
+		}
+		position /= 2
+	}
+	return position == 0 && current == root
+}
@@ -0,0 +1,74 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashBlocks(t *testing.T) {
+	data := make([]byte, BlockSize+10)
+	data[BlockSize] = 1
+	hashes := HashBlocks(data)
+	assert.Equal(t, [][32]byte{
+		sha256.Sum256(data[:BlockSize]),
+		sha256.Sum256(data[BlockSize:]),
+	}, hashes)
+	assert.Nil(t, HashBlocks(nil))
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	tests := map[int]int{0: 1, 1: 1, 2: 2, 3: 4, 4: 4, 5: 8, 1000: 1024}
+	for input, output := range tests {
+		assert.Equal(t, output, NextPowerOfTwo(input), input)
+	}
+}
+
+func TestRoot(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	c := sha256.Sum256([]byte("c"))
+	zero := [32]byte{}
+
+	assert.Equal(t, a, Root([][32]byte{a}, 1, zero))
+	assert.Equal(t, Combine(a, b), Root([][32]byte{a, b}, 2, zero))
+	assert.Equal(t, Combine(Combine(a, b), Combine(c, zero)), Root([][32]byte{a, b, c}, 4, zero))
+	assert.Equal(t, Combine(zero, zero), ZeroRoot(2))
+}
+
+func TestPieceRoot(t *testing.T) {
+	data := make([]byte, 3*BlockSize)
+	for index := range data {
+		data[index] = byte(index)
+	}
+	hashes := HashBlocks(data)
+	expected := Combine(Combine(hashes[0], hashes[1]), Combine(hashes[2], [32]byte{}))
+	assert.Equal(t, expected, PieceRoot(data, 4))
+}
+
+func TestLayerRoot(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	c := sha256.Sum256([]byte("c"))
+	pad := ZeroRoot(2)
+	assert.Equal(t, Combine(Combine(a, b), Combine(c, pad)), LayerRoot([][32]byte{a, b, c}, 2*BlockSize))
+}
+
+func TestVerifyProof(t *testing.T) {
+	var layer [][32]byte
+	for index := 0; index < 8; index++ {
+		layer = append(layer, sha256.Sum256([]byte{byte(index)}))
+	}
+	root := Root(layer, 8, [32]byte{})
+
+	// 整层，不需要 proof
+	assert.True(t, VerifyProof(root, layer, 0, nil))
+
+	// layer[4:6]，往上需要 root(layer[6:8]) 和 root(layer[0:4])
+	proof := [][32]byte{Root(layer[6:8], 2, [32]byte{}), Root(layer[0:4], 4, [32]byte{})}
+	assert.True(t, VerifyProof(root, layer[4:6], 4, proof))
+	assert.False(t, VerifyProof(root, layer[4:6], 2, proof))
+	assert.False(t, VerifyProof(root, layer[4:6], 4, proof[:1]))
+	assert.False(t, VerifyProof(root, layer[4:7], 4, proof))
+}
@@ -18,6 +18,14 @@ const (
 	MessageRequest        messageID = 6 // 从接收者那里请求一个 message
 	MessagePiece          messageID = 7 // 执行请求，交付一个 piece
 	MessageCancel         messageID = 8 // 取消请求
+
+	// BEP 10
+	MessageExtended       messageID = 20 // 扩展协议的消息，payload 第一个 byte 是扩展消息的 ID，0 是扩展握手
+
+	// BEP 52
+	MessageHashRequest    messageID = 21 // 请求 merkle tree 中某一层的一段 hash
+	MessageHashes         messageID = 22 // 回应 hash request
+	MessageHashReject     messageID = 23 // 拒绝 hash request
 )
 
 type Message struct {
@@ -47,6 +55,14 @@ func (message *Message) Name() string {
 		return "Piece"
 	case MessageCancel:
 		return "Cancel"
+	case MessageExtended:
+		return "Extended"
+	case MessageHashRequest:
+		return "HashRequest"
+	case MessageHashes:
+		return "Hashes"
+	case MessageHashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("Unknown#%d", message.ID)
 	}
@@ -128,6 +144,35 @@ func FormatMessageRequest(index, begin, length int) *Message {
 	}
 }
 
+// 回应 request，payload 是 index、begin 和这一块的数据
+func FormatMessagePiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{
+		ID: MessagePiece,
+		Payload: payload,
+	}
+}
+
+// 解析 request 和 cancel，它们的 payload 是一样的
+func ParseRequest(message *Message) (index, begin, length int, err error) {
+	if message.ID != MessageRequest && message.ID != MessageCancel {
+		return 0, 0, 0, fmt.Errorf("expected REQUEST or CANCEL, got ID %d", message.ID)
+	}
+
+	const PayloadLength = 12
+	if len(message.Payload) != PayloadLength {
+		return 0, 0, 0, fmt.Errorf("expected payload length %d. got %d", PayloadLength, len(message.Payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(message.Payload[0 : PayloadLength/3]))
+	begin = int(binary.BigEndian.Uint32(message.Payload[PayloadLength/3 : PayloadLength/3*2]))
+	length = int(binary.BigEndian.Uint32(message.Payload[PayloadLength/3*2 : PayloadLength]))
+	return index, begin, length, nil
+}
+
 func FormatMessageHave(index int) *Message {
 	const PayloadLength = 4
 	payload := make([]byte, PayloadLength)
@@ -171,6 +216,20 @@ func ParsePiece(index int, buffer []byte, message *Message) (int, error) {
 	return len(parsedData), nil
 }
 
+// 解析 piece 消息，不检查 index，请求可以跨 piece 时先用它找到数据属于哪个 piece
+// block 和 message.Payload 共用内存
+func ParseBlock(message *Message) (index, begin int, block []byte, err error) {
+	if message.ID != MessagePiece {
+		return 0, 0, nil, fmt.Errorf("expected PIECE (ID %d), got ID %d", MessagePiece, message.ID)
+	}
+	if len(message.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("payload too short. %d < 8", len(message.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(message.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(message.Payload[4:8]))
+	return index, begin, message.Payload[8:], nil
+}
+
 func ParseHave(message *Message) (int, error) {
 	if message.ID != MessageHave {
 		return 0, fmt.Errorf("expected HAVE (ID %d), got ID %d", MessageHave, message.ID)
@@ -184,3 +243,99 @@ func ParseHave(message *Message) (int, error) {
 
 	return index, nil
 }
+
+// hash request、hashes 和 hash reject 共同的头部
+// -----------------------------------------------------------
+// |pieces root| |base layer| |index| |length| |proof layers|
+// -----------------------------------------------------------
+//       ↓             ↓          ↓       ↓           ↓
+//    32 byte        4 byte    4 byte  4 byte      4 byte
+type HashRequest struct {
+	PiecesRoot  [32]byte // 文件的 merkle root
+	BaseLayer   int      // 请求的是哪一层，叶子那一层是 0
+	Index       int      // 请求的第一个 hash 在这一层中的下标
+	Length      int      // 请求的 hash 数量
+	ProofLayers int      // 除了请求的 hash 之外，还需要往上多少层的兄弟节点
+}
+
+const hashRequestLength = 32 + 4*4
+
+func (request *HashRequest) serialize() []byte {
+	payload := make([]byte, hashRequestLength)
+	copy(payload[0:32], request.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(request.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(request.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(request.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(request.ProofLayers))
+	return payload
+}
+
+func parseHashRequest(payload []byte) (*HashRequest, error) {
+	if len(payload) < hashRequestLength {
+		return nil, fmt.Errorf("payload too short. %d < %d", len(payload), hashRequestLength)
+	}
+	request := HashRequest{
+		BaseLayer:   int(binary.BigEndian.Uint32(payload[32:36])),
+		Index:       int(binary.BigEndian.Uint32(payload[36:40])),
+		Length:      int(binary.BigEndian.Uint32(payload[40:44])),
+		ProofLayers: int(binary.BigEndian.Uint32(payload[44:48])),
+	}
+	copy(request.PiecesRoot[:], payload[0:32])
+	return &request, nil
+}
+
+func FormatMessageHashRequest(request *HashRequest) *Message {
+	return &Message{
+		ID: MessageHashRequest,
+		Payload: request.serialize(),
+	}
+}
+
+func FormatMessageHashReject(request *HashRequest) *Message {
+	return &Message{
+		ID: MessageHashReject,
+		Payload: request.serialize(),
+	}
+}
+
+// hashes 消息在头部之后是请求的 hash，再之后是 proof 用的兄弟节点
+func FormatMessageHashes(request *HashRequest, hashes [][32]byte) *Message {
+	payload := request.serialize()
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
+	}
+	return &Message{
+		ID: MessageHashes,
+		Payload: payload,
+	}
+}
+
+// 解析 hash request 或者 hash reject
+func ParseHashRequest(message *Message) (*HashRequest, error) {
+	if message.ID != MessageHashRequest && message.ID != MessageHashReject {
+		return nil, fmt.Errorf("expected HASH REQUEST or HASH REJECT, got ID %d", message.ID)
+	}
+	if len(message.Payload) != hashRequestLength {
+		return nil, fmt.Errorf("expected payload length %d. got %d", hashRequestLength, len(message.Payload))
+	}
+	return parseHashRequest(message.Payload)
+}
+
+func ParseHashes(message *Message) (*HashRequest, [][32]byte, error) {
+	if message.ID != MessageHashes {
+		return nil, nil, fmt.Errorf("expected HASHES (ID %d), got ID %d", MessageHashes, message.ID)
+	}
+	request, err := parseHashRequest(message.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := message.Payload[hashRequestLength:]
+	if len(data)%32 != 0 {
+		return nil, nil, fmt.Errorf("received malformed hashes of length %d", len(data))
+	}
+	hashes := make([][32]byte, len(data)/32)
+	for i := range hashes {
+		copy(hashes[i][:], data[i*32:(i+1)*32])
+	}
+	return request, hashes, nil
+}
@@ -22,6 +22,9 @@ func TestString(t *testing.T) {
 		{&Message{MessageRequest, []byte{1, 2, 3}}, "Request [3]"},
 		{&Message{MessagePiece, []byte{1, 2, 3}}, "Piece [3]"},
 		{&Message{MessageCancel, []byte{1, 2, 3}}, "Cancel [3]"},
+		{&Message{MessageHashRequest, []byte{1, 2, 3}}, "HashRequest [3]"},
+		{&Message{MessageHashes, []byte{1, 2, 3}}, "Hashes [3]"},
+		{&Message{MessageHashReject, []byte{1, 2, 3}}, "HashReject [3]"},
 		{&Message{99, []byte{1, 2, 3}}, "Unknown#99 [3]"},
 	}
 
@@ -261,3 +264,86 @@ func TestParseHave(t *testing.T) {
 		assert.Equal(t, test.output, index)
 	}
 }
+
+func TestFormatMessagePiece(t *testing.T) {
+	message := FormatMessagePiece(4, 567, []byte{0xaa, 0xbb})
+	expected := &Message {
+		ID: MessagePiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0xaa, 0xbb,             // Block
+		},
+	}
+	assert.Equal(t, expected, message)
+
+	// 生成的 piece 可以被 ParsePiece 解析
+	buffer := make([]byte, 569)
+	n, err := ParsePiece(4, buffer, message)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte{0xaa, 0xbb}, buffer[567:])
+}
+
+func TestParseRequest(t *testing.T) {
+	index, begin, length, err := ParseRequest(FormatMessageRequest(4, 567, 4321))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 567, 4321}, []int{index, begin, length})
+
+	cancel := &Message{ID: MessageCancel, Payload: FormatMessageRequest(1, 2, 3).Payload}
+	index, begin, length, err = ParseRequest(cancel)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3}, []int{index, begin, length})
+
+	_, _, _, err = ParseRequest(&Message{ID: MessageHave, Payload: make([]byte, 12)})
+	assert.NotNil(t, err)
+	_, _, _, err = ParseRequest(&Message{ID: MessageRequest, Payload: make([]byte, 8)})
+	assert.NotNil(t, err)
+}
+
+func TestParseBlock(t *testing.T) {
+	index, begin, block, err := ParseBlock(FormatMessagePiece(3, 16384, []byte{1, 2, 3}))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{3, 16384}, []int{index, begin})
+	assert.Equal(t, []byte{1, 2, 3}, block)
+
+	_, _, _, err = ParseBlock(&Message{ID: MessageHave, Payload: make([]byte, 8)})
+	assert.NotNil(t, err)
+	_, _, _, err = ParseBlock(&Message{ID: MessagePiece, Payload: make([]byte, 7)})
+	assert.NotNil(t, err)
+}
+
+func TestHashMessages(t *testing.T) {
+	request := &HashRequest{
+		PiecesRoot:  [32]byte{1, 2, 3},
+		BaseLayer:   2,
+		Index:       4,
+		Length:      2,
+		ProofLayers: 1,
+	}
+
+	msg := FormatMessageHashRequest(request)
+	assert.Equal(t, MessageHashRequest, msg.ID)
+	assert.Equal(t, 48, len(msg.Payload))
+	assert.Equal(t, []byte{0, 0, 0, 2, 0, 0, 0, 4, 0, 0, 0, 2, 0, 0, 0, 1}, msg.Payload[32:])
+	parsed, err := ParseHashRequest(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, request, parsed)
+
+	parsed, err = ParseHashRequest(FormatMessageHashReject(request))
+	assert.Nil(t, err)
+	assert.Equal(t, request, parsed)
+
+	hashes := [][32]byte{{4}, {5}, {6}}
+	parsed, parsedHashes, err := ParseHashes(FormatMessageHashes(request, hashes))
+	assert.Nil(t, err)
+	assert.Equal(t, request, parsed)
+	assert.Equal(t, hashes, parsedHashes)
+
+	_, err = ParseHashRequest(&Message{ID: MessageHave, Payload: msg.Payload})
+	assert.NotNil(t, err)
+	_, err = ParseHashRequest(&Message{ID: MessageHashRequest, Payload: msg.Payload[:40]})
+	assert.NotNil(t, err)
+	_, _, err = ParseHashes(&Message{ID: MessageHashes, Payload: append(msg.Payload, 1)})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,361 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	event "github.com/strugglebak/goMule/event"
+	logging "github.com/strugglebak/goMule/logging"
+	p2p "github.com/strugglebak/goMule/p2p"
+	session "github.com/strugglebak/goMule/session"
+)
+
+// 以 Prometheus 的文本格式导出下载的指标
+// 格式见 https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+// 一部分指标来自事件 (piece 校验、握手失败、tracker 请求)，另一部分在每次抓取时从种子当前的状态中读取
+// (流量、peer 数量、请求积压、choke 时间)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// tracker 请求耗时的 histogram 的上界，单位是秒，tracker 请求的超时时间是 15 秒
+var AnnounceBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15}
+
+// 一个种子在抓取时的状态
+type TorrentStats struct {
+	InfoHash   [20]byte
+	Name       string
+	Downloaded int64 // 累计下载的 byte 数量
+	Uploaded   int64
+	Peers      []p2p.PeerStatus // 正在连接的 peer
+	ChokedTime time.Duration    // 所有 peer 被 choke 的总时间
+}
+
+// 每次抓取时调用，返回当前所有种子的状态
+type Source func() []TorrentStats
+
+// 从一个 p2p.Torrent 读取状态
+func TorrentSource(t *p2p.Torrent) Source {
+	return func() []TorrentStats {
+		return []TorrentStats{{
+			InfoHash:   t.InfoHash,
+			Name:       t.Name,
+			Downloaded: t.Downloaded(),
+			Uploaded:   t.Uploaded(),
+			Peers:      t.ActivePeers(),
+			ChokedTime: t.ChokedTime(),
+		}}
+	}
+}
+
+// 读取 session 中所有种子的状态
+func SessionSource(s *session.Session) Source {
+	return func() []TorrentStats {
+		var list []TorrentStats
+		for _, t := range s.Torrents() {
+			status := t.Status()
+			list = append(list, TorrentStats{
+				InfoHash:   status.InfoHash,
+				Name:       status.Name,
+				Downloaded: status.Downloaded,
+				Uploaded:   status.Uploaded,
+				Peers:      status.Peers,
+				ChokedTime: status.ChokedTime,
+			})
+		}
+		return list
+	}
+}
+
+type histogram struct {
+	counts []int64 // 每个 bucket 的数量，不是累计的
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(AnnounceBuckets))
+	}
+	for index, bound := range AnnounceBuckets {
+		if value <= bound {
+			h.counts[index]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// 从事件中统计的一个种子的指标
+type torrentCounters struct {
+	name      string
+	verified  int64
+	failed    int64
+	stalled   bool
+	lastPiece time.Time // 最后一次有 piece 校验通过的时间
+}
+
+// 收集指标，并且作为 http.Handler 输出
+type Collector struct {
+	mutex             sync.Mutex
+	sources           []Source
+	torrents          map[[20]byte]*torrentCounters
+	handshakeFailures map[string]int64      // 按错误分类
+	announces         map[string]int64      // 按 tracker
+	announceErrors    map[[2]string]int64   // 按 tracker 和错误分类
+	announceDurations map[string]*histogram // 按 tracker，包括失败的请求
+}
+
+func New() *Collector {
+	return &Collector{
+		torrents:          map[[20]byte]*torrentCounters{},
+		handshakeFailures: map[string]int64{},
+		announces:         map[string]int64{},
+		announceErrors:    map[[2]string]int64{},
+		announceDurations: map[string]*histogram{},
+	}
+}
+
+func (c *Collector) AddSource(source Source) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sources = append(c.sources, source)
+}
+
+// 统计 bus 上的事件，返回的函数用来取消
+func (c *Collector) Subscribe(bus *event.Bus) (cancel func()) {
+	return bus.Subscribe(c.handle)
+}
+
+// 调用时必须持有锁
+func (c *Collector) torrent(infoHash [20]byte, name string) *torrentCounters {
+	counters, ok := c.torrents[infoHash]
+	if !ok {
+		counters = &torrentCounters{}
+		c.torrents[infoHash] = counters
+	}
+	if name != "" {
+		counters.name = name
+	}
+	return counters
+}
+
+func (c *Collector) handle(e event.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch e.Type {
+	case event.HandshakeFailed:
+		c.handshakeFailures[logging.ErrorClass(e.Err)]++
+	case event.PieceVerified:
+		counters := c.torrent(e.InfoHash, e.Name)
+		counters.verified++
+		counters.stalled = false
+		counters.lastPiece = e.Time
+	case event.PieceFailed:
+		c.torrent(e.InfoHash, e.Name).failed++
+	case event.Stalled:
+		c.torrent(e.InfoHash, e.Name).stalled = true
+	case event.Completed:
+		c.torrent(e.InfoHash, e.Name).stalled = false
+	case event.TrackerAnnounced, event.TrackerErrored:
+		if e.Type == event.TrackerAnnounced {
+			c.announces[e.Tracker]++
+		} else {
+			c.announceErrors[[2]string{e.Tracker, logging.ErrorClass(e.Err)}]++
+		}
+		h, ok := c.announceDurations[e.Tracker]
+		if !ok {
+			h = &histogram{}
+			c.announceDurations[e.Tracker] = h
+		}
+		h.observe(e.Duration.Seconds())
+	}
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	c.WriteTo(w)
+}
+
+// 一个指标中的一行
+type sample struct {
+	suffix string   // histogram 的 _bucket、_sum 和 _count
+	labels []string // 依次是名字和值
+	value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	samples []sample
+}
+
+func (f *family) add(value float64, labels ...string) {
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+// 按照 Prometheus 文本格式输出所有指标
+func (c *Collector) WriteTo(writer io.Writer) (int64, error) {
+	c.mutex.Lock()
+	sources := append([]Source{}, c.sources...)
+	c.mutex.Unlock()
+	var stats []TorrentStats
+	for _, source := range sources {
+		stats = append(stats, source()...)
+	}
+
+	downloaded := &family{name: "gomule_torrent_downloaded_bytes_total", help: "Bytes downloaded and verified.", kind: "counter"}
+	uploaded := &family{name: "gomule_torrent_uploaded_bytes_total", help: "Bytes of piece data uploaded to peers.", kind: "counter"}
+	activePeers := &family{name: "gomule_torrent_active_peers", help: "Peers with a completed handshake.", kind: "gauge"}
+	chokedPeers := &family{name: "gomule_torrent_choked_peers", help: "Connected peers currently choking us.", kind: "gauge"}
+	backlog := &family{name: "gomule_torrent_request_backlog", help: "Block requests sent to peers and not answered yet.", kind: "gauge"}
+	chokedSeconds := &family{name: "gomule_torrent_choked_seconds_total", help: "Time peers spent choking us, summed over peers.", kind: "counter"}
+	for _, s := range stats {
+		labels := torrentLabels(s.InfoHash, s.Name)
+		var choked, requests int
+		for _, peer := range s.Peers {
+			if peer.Choked {
+				choked++
+			}
+			requests += peer.Backlog
+		}
+		downloaded.add(float64(s.Downloaded), labels...)
+		uploaded.add(float64(s.Uploaded), labels...)
+		activePeers.add(float64(len(s.Peers)), labels...)
+		chokedPeers.add(float64(choked), labels...)
+		backlog.add(float64(requests), labels...)
+		chokedSeconds.add(s.ChokedTime.Seconds(), labels...)
+	}
+
+	c.mutex.Lock()
+	verified := &family{name: "gomule_pieces_verified_total", help: "Pieces that passed the hash check.", kind: "counter"}
+	failed := &family{name: "gomule_pieces_failed_total", help: "Pieces that failed the hash check.", kind: "counter"}
+	stalled := &family{name: "gomule_torrent_stalled", help: "1 if no piece completed within the stall timeout.", kind: "gauge"}
+	lastPiece := &family{name: "gomule_torrent_last_piece_timestamp_seconds", help: "Unix time the last piece was verified.", kind: "gauge"}
+	for infoHash, counters := range c.torrents {
+		labels := torrentLabels(infoHash, counters.name)
+		verified.add(float64(counters.verified), labels...)
+		failed.add(float64(counters.failed), labels...)
+		stalled.add(boolValue(counters.stalled), labels...)
+		if !counters.lastPiece.IsZero() {
+			lastPiece.add(float64(counters.lastPiece.UnixNano())/1e9, labels...)
+		}
+	}
+
+	handshakeFailures := &family{name: "gomule_handshake_failures_total", help: "Failed connections or handshakes with peers by error class.", kind: "counter"}
+	for reason, count := range c.handshakeFailures {
+		handshakeFailures.add(float64(count), "reason", reason)
+	}
+	announces := &family{name: "gomule_tracker_announces_total", help: "Successful tracker announces.", kind: "counter"}
+	for tracker, count := range c.announces {
+		announces.add(float64(count), "tracker", tracker)
+	}
+	announceErrors := &family{name: "gomule_tracker_announce_errors_total", help: "Failed tracker announces by error class.", kind: "counter"}
+	for key, count := range c.announceErrors {
+		announceErrors.add(float64(count), "tracker", key[0], "reason", key[1])
+	}
+	durations := &family{name: "gomule_tracker_announce_duration_seconds", help: "Latency of tracker announces, including failed ones.", kind: "histogram"}
+	for tracker, h := range c.announceDurations {
+		var cumulative int64
+		for index, bound := range AnnounceBuckets {
+			cumulative += h.counts[index]
+			durations.samples = append(durations.samples, sample{suffix: "_bucket", labels: []string{"tracker", tracker, "le", formatFloat(bound)}, value: float64(cumulative)})
+		}
+		durations.samples = append(durations.samples,
+			sample{suffix: "_bucket", labels: []string{"tracker", tracker, "le", "+Inf"}, value: float64(h.count)},
+			sample{suffix: "_sum", labels: []string{"tracker", tracker}, value: h.sum},
+			sample{suffix: "_count", labels: []string{"tracker", tracker}, value: float64(h.count)},
+		)
+	}
+	c.mutex.Unlock()
+
+	buffered := bufio.NewWriter(writer)
+	counting := &countingWriter{writer: buffered}
+	for _, f := range []*family{
+		downloaded, uploaded, activePeers, chokedPeers, backlog, chokedSeconds,
+		verified, failed, stalled, lastPiece,
+		handshakeFailures, announces, announceErrors, durations,
+	} {
+		f.write(counting)
+	}
+	err := buffered.Flush()
+	if err == nil {
+		err = counting.err
+	}
+	return counting.n, err
+}
+
+func (f *family) write(writer io.Writer) {
+	fmt.Fprintf(writer, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(writer, "# TYPE %s %s\n", f.name, f.kind)
+	// histogram 的 bucket 要保持原来的顺序，其他的按 label 排序，保证输出稳定
+	if f.kind != "histogram" {
+		sort.Slice(f.samples, func(i, j int) bool {
+			return strings.Join(f.samples[i].labels, "\x00") < strings.Join(f.samples[j].labels, "\x00")
+		})
+	} else {
+		sort.SliceStable(f.samples, func(i, j int) bool { return f.samples[i].labels[1] < f.samples[j].labels[1] })
+	}
+	for _, s := range f.samples {
+		fmt.Fprintf(writer, "%s%s%s %s\n", f.name, s.suffix, formatLabels(s.labels), formatFloat(s.value))
+	}
+}
+
+func torrentLabels(infoHash [20]byte, name string) []string {
+	return []string{"infohash", hex.EncodeToString(infoHash[:]), "name", name}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var parts []string
+	for index := 0; index+1 < len(labels); index += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[index], labelEscaper.Replace(labels[index+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// 记录写了多少 byte，以及第一个错误
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+	err    error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.writer.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
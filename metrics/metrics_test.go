@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	event "github.com/strugglebak/goMule/event"
+	p2p "github.com/strugglebak/goMule/p2p"
+)
+
+func TestWriteTo(t *testing.T) {
+	infoHash := [20]byte{0xab}
+	bus := &event.Bus{}
+	collector := New()
+	cancel := collector.Subscribe(bus)
+	defer cancel()
+	collector.AddSource(func() []TorrentStats {
+		return []TorrentStats{{
+			InfoHash:   infoHash,
+			Name:       `a "b"`,
+			Downloaded: 1024,
+			Uploaded:   512,
+			Peers:      []p2p.PeerStatus{{Backlog: 5, Choked: true}, {Backlog: 3}},
+			ChokedTime: 1500 * time.Millisecond,
+		}}
+	})
+
+	bus.Publish(event.Event{Type: event.PieceVerified, InfoHash: infoHash, Name: `a "b"`, Time: time.Unix(100, 0)})
+	bus.Publish(event.Event{Type: event.PieceVerified, InfoHash: infoHash})
+	bus.Publish(event.Event{Type: event.PieceFailed, InfoHash: infoHash})
+	bus.Publish(event.Event{Type: event.HandshakeFailed, Err: io.EOF})
+	bus.Publish(event.Event{Type: event.HandshakeFailed, Err: errors.New("bad protocol")})
+	bus.Publish(event.Event{Type: event.TrackerAnnounced, Tracker: "http://t", Duration: 200 * time.Millisecond})
+	bus.Publish(event.Event{Type: event.TrackerErrored, Tracker: "http://t", Duration: 20 * time.Second, Err: &net.OpError{Op: "dial", Err: errors.New("refused")}})
+	bus.Publish(event.Event{Type: event.Stalled, InfoHash: infoHash})
+
+	buffer := &bytes.Buffer{}
+	n, err := collector.WriteTo(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(buffer.Len()), n)
+	output := buffer.String()
+
+	labels := `{infohash="ab00000000000000000000000000000000000000",name="a \"b\""}`
+	for _, line := range []string{
+		"# TYPE gomule_torrent_downloaded_bytes_total counter",
+		"gomule_torrent_downloaded_bytes_total" + labels + " 1024",
+		"gomule_torrent_uploaded_bytes_total" + labels + " 512",
+		"gomule_torrent_active_peers" + labels + " 2",
+		"gomule_torrent_choked_peers" + labels + " 1",
+		"gomule_torrent_request_backlog" + labels + " 8",
+		"gomule_torrent_choked_seconds_total" + labels + " 1.5",
+		"gomule_pieces_verified_total" + labels + " 2",
+		"gomule_pieces_failed_total" + labels + " 1",
+		"gomule_torrent_stalled" + labels + " 1",
+		`gomule_handshake_failures_total{reason="network"} 1`,
+		`gomule_handshake_failures_total{reason="protocol"} 1`,
+		`gomule_tracker_announces_total{tracker="http://t"} 1`,
+		`gomule_tracker_announce_errors_total{tracker="http://t",reason="network"} 1`,
+		"# TYPE gomule_tracker_announce_duration_seconds histogram",
+		`gomule_tracker_announce_duration_seconds_bucket{tracker="http://t",le="0.1"} 0`,
+		`gomule_tracker_announce_duration_seconds_bucket{tracker="http://t",le="0.25"} 1`,
+		`gomule_tracker_announce_duration_seconds_bucket{tracker="http://t",le="15"} 1`,
+		`gomule_tracker_announce_duration_seconds_bucket{tracker="http://t",le="+Inf"} 2`,
+		`gomule_tracker_announce_duration_seconds_sum{tracker="http://t"} 20.2`,
+		`gomule_tracker_announce_duration_seconds_count{tracker="http://t"} 2`,
+	} {
+		assert.Contains(t, output, line+"\n")
+	}
+
+	// 有 piece 完成之后不再是 stalled
+	bus.Publish(event.Event{Type: event.PieceVerified, InfoHash: infoHash})
+	buffer.Reset()
+	collector.WriteTo(buffer)
+	assert.Contains(t, buffer.String(), "gomule_torrent_stalled"+labels+" 0\n")
+}
+
+func TestServeHTTP(t *testing.T) {
+	collector := New()
+	collector.AddSource(func() []TorrentStats {
+		return []TorrentStats{{InfoHash: [20]byte{2}, Name: "b"}, {InfoHash: [20]byte{1}, Name: "a"}}
+	})
+	recorder := httptest.NewRecorder()
+	collector.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, ContentType, recorder.Header().Get("Content-Type"))
+
+	// 输出按 label 排序
+	var peersLines []string
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if strings.HasPrefix(line, "gomule_torrent_active_peers{") {
+			peersLines = append(peersLines, line)
+		}
+	}
+	assert.Equal(t, []string{
+		`gomule_torrent_active_peers{infohash="0100000000000000000000000000000000000000",name="a"} 0`,
+		`gomule_torrent_active_peers{infohash="0200000000000000000000000000000000000000",name="b"} 0`,
+	}, peersLines)
+}
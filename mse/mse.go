@@ -0,0 +1,451 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	mathRand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Message Stream Encryption (MSE/PE)
+// 在 BitTorrent 握手之前先用 Diffie-Hellman 交换密钥，然后用 RC4 加密之后的所有数据
+// 规范见 https://wiki.vuze.com/w/Message_Stream_Encryption
+
+// 加密策略
+type Policy int
+
+const (
+	PolicyDisable Policy = iota // 只用明文
+	PolicyPrefer                // 优先加密，对方不支持时退回明文
+	PolicyRequire               // 只接受加密的连接
+)
+
+func (policy Policy) String() string {
+	switch policy {
+	case PolicyDisable:
+		return "disable"
+	case PolicyPrefer:
+		return "prefer"
+	case PolicyRequire:
+		return "require"
+	default:
+		return fmt.Sprintf("Policy#%d", int(policy))
+	}
+}
+
+func ParsePolicy(value string) (Policy, error) {
+	for _, policy := range []Policy{PolicyDisable, PolicyPrefer, PolicyRequire} {
+		if policy.String() == value {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid encryption policy %q, expected prefer, require or disable", value)
+}
+
+// crypto_provide 和 crypto_select 中的每一位
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+const (
+	keyLength     = 96  // DH 公钥的长度
+	maxPadLength  = 512 // padding 最长的长度
+	handshakeTime = 10 * time.Second
+)
+
+var (
+	prime     = mustParsePrime()
+	generator = big.NewInt(2)
+	// 8 个 0，用来在加密的数据流中找到同步点
+	verificationConstant = make([]byte, 8)
+	protocolHeader       = append([]byte{19}, "BitTorrent protocol"...)
+)
+
+func mustParsePrime() *big.Int {
+	p, ok := new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	if !ok {
+		panic("invalid MSE prime")
+	}
+	return p
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// 生成 DH 私钥和 96 个 byte 的公钥
+func generateKeys() (*big.Int, []byte, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(secret)
+	public := new(big.Int).Exp(generator, private, prime)
+	return private, padKey(public), nil
+}
+
+func sharedSecret(private *big.Int, remote []byte) []byte {
+	return padKey(new(big.Int).Exp(new(big.Int).SetBytes(remote), private, prime))
+}
+
+func padKey(n *big.Int) []byte {
+	key := make([]byte, keyLength)
+	n.FillBytes(key)
+	return key
+}
+
+// RC4 的前 1024 个 byte 要丢掉
+func newCipher(name string, secret, skey []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash([]byte(name), secret, skey))
+	discard := make([]byte, 1024)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+func randomPad() []byte {
+	pad := make([]byte, mathRand.Intn(maxPadLength+1))
+	rand.Read(pad)
+	return pad
+}
+
+// 在 reader 中找到 pattern，最多跳过 limit 个 byte，找到后 pattern 已经被读掉
+func synchronize(reader *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, len(pattern))
+	for skipped := 0; ; {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(pattern) {
+			window = window[1:]
+			skipped++
+			if skipped > limit {
+				return fmt.Errorf("could not find synchronization point of encrypted handshake")
+			}
+		}
+		window = append(window, b)
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+}
+
+func readDecrypted(reader io.Reader, cipher *rc4.Cipher, n int) ([]byte, error) {
+	buffer := make([]byte, n)
+	_, err := io.ReadFull(reader, buffer)
+	if err != nil {
+		return nil, err
+	}
+	cipher.XORKeyStream(buffer, buffer)
+	return buffer, nil
+}
+
+func encrypt(cipher *rc4.Cipher, parts ...[]byte) []byte {
+	var buffer []byte
+	for _, part := range parts {
+		buffer = append(buffer, part...)
+	}
+	cipher.XORKeyStream(buffer, buffer)
+	return buffer
+}
+
+func uint16Bytes(n int) []byte {
+	buffer := make([]byte, 2)
+	binary.BigEndian.PutUint16(buffer, uint16(n))
+	return buffer
+}
+
+func uint32Bytes(n uint32) []byte {
+	buffer := make([]byte, 4)
+	binary.BigEndian.PutUint32(buffer, n)
+	return buffer
+}
+
+// 作为发起方完成加密握手，infoHash 用作 SKEY
+// 返回的 Conn 之后的读写都会按照协商的结果加密，接下来照常发送 BitTorrent 握手即可
+func Handshake(conn net.Conn, infoHash [20]byte, policy Policy) (net.Conn, error) {
+	if policy == PolicyDisable {
+		return nil, fmt.Errorf("encryption is disabled")
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTime))
+	defer conn.SetDeadline(time.Time{})
+
+	// 1. A->B: Ya, PadA
+	private, public, err := generateKeys()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, randomPad()...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	reader := bufio.NewReader(conn)
+	remote := make([]byte, keyLength)
+	_, err = io.ReadFull(reader, remote)
+	if err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(private, remote)
+	skey := infoHash[:]
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	//    ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	encryptor := newCipher("keyA", secret, skey)
+	decryptor := newCipher("keyB", secret, skey)
+	provide := cryptoRC4
+	if policy == PolicyPrefer {
+		provide |= cryptoPlaintext
+	}
+	req2 := hash([]byte("req2"), skey)
+	req3 := hash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	message := append(hash([]byte("req1"), secret), req2...)
+	message = append(message, encrypt(encryptor, verificationConstant, uint32Bytes(provide), uint16Bytes(0), uint16Bytes(0))...)
+	_, err = conn.Write(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// PadB 的长度未知，要在数据流中找到加密后的 VC
+	encryptedVC := make([]byte, len(verificationConstant))
+	decryptor.XORKeyStream(encryptedVC, verificationConstant)
+	err = synchronize(reader, encryptedVC, maxPadLength)
+	if err != nil {
+		return nil, err
+	}
+	header, err := readDecrypted(reader, decryptor, 6)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(header[0:4])
+	padLength := int(binary.BigEndian.Uint16(header[4:6]))
+	if padLength > maxPadLength {
+		return nil, fmt.Errorf("invalid padding length %d", padLength)
+	}
+	_, err = readDecrypted(reader, decryptor, padLength)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case selected == cryptoRC4:
+		return newConn(conn, reader, encryptor, decryptor, nil), nil
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return newConn(conn, reader, nil, nil, nil), nil
+	default:
+		return nil, fmt.Errorf("peer selected unsupported crypto method %#x", selected)
+	}
+}
+
+// 作为接收方处理一个连入的连接，它可能是明文的 BitTorrent 握手，也可能是加密握手
+// lookup 用 HASH('req2', SKEY) 找到对应的 info hash，找不到时返回 false
+// 返回的 Conn 接下来可以直接读取对方的 BitTorrent 握手
+func Accept(conn net.Conn, policy Policy, lookup func(req2 [20]byte) ([20]byte, bool)) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTime))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	head, err := reader.Peek(len(protocolHeader))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(head, protocolHeader) {
+		if policy == PolicyRequire {
+			return nil, fmt.Errorf("rejected plaintext connection, encryption is required")
+		}
+		return newConn(conn, reader, nil, nil, nil), nil
+	}
+	if policy == PolicyDisable {
+		return nil, fmt.Errorf("rejected encrypted connection, encryption is disabled")
+	}
+
+	// 1. A->B: Ya, PadA
+	remote := make([]byte, keyLength)
+	_, err = io.ReadFull(reader, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	private, public, err := generateKeys()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, randomPad()...))
+	if err != nil {
+		return nil, err
+	}
+	secret := sharedSecret(private, remote)
+
+	// 3. 在 PadA 之后找到 HASH('req1', S)，然后根据 HASH('req2', SKEY) 找到 info hash
+	err = synchronize(reader, hash([]byte("req1"), secret), maxPadLength)
+	if err != nil {
+		return nil, err
+	}
+	var req2 [20]byte
+	_, err = io.ReadFull(reader, req2[:])
+	if err != nil {
+		return nil, err
+	}
+	req3 := hash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	infoHash, ok := lookup(req2)
+	if !ok {
+		return nil, fmt.Errorf("encrypted handshake for unknown torrent")
+	}
+	skey := infoHash[:]
+	decryptor := newCipher("keyA", secret, skey)
+	encryptor := newCipher("keyB", secret, skey)
+
+	header, err := readDecrypted(reader, decryptor, len(verificationConstant)+4+2)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], verificationConstant) {
+		return nil, fmt.Errorf("invalid verification constant in encrypted handshake")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLength := int(binary.BigEndian.Uint16(header[12:14]))
+	if padLength > maxPadLength {
+		return nil, fmt.Errorf("invalid padding length %d", padLength)
+	}
+	_, err = readDecrypted(reader, decryptor, padLength)
+	if err != nil {
+		return nil, err
+	}
+	lengthBuffer, err := readDecrypted(reader, decryptor, 2)
+	if err != nil {
+		return nil, err
+	}
+	initialPayload, err := readDecrypted(reader, decryptor, int(binary.BigEndian.Uint16(lengthBuffer)))
+	if err != nil {
+		return nil, err
+	}
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy == PolicyPrefer:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("no acceptable crypto method in %#x", provide)
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	_, err = conn.Write(encrypt(encryptor, verificationConstant, uint32Bytes(selected), uint16Bytes(0)))
+	if err != nil {
+		return nil, err
+	}
+
+	var c *Conn
+	if selected == cryptoRC4 {
+		c = newConn(conn, reader, encryptor, decryptor, initialPayload)
+	} else {
+		c = newConn(conn, reader, nil, nil, initialPayload)
+	}
+	c.skey, c.obfuscated = infoHash, true
+	return c, nil
+}
+
+// 给定一组 info hash，返回 Accept 需要的 lookup
+func Lookup(infoHashes ...[20]byte) func(req2 [20]byte) ([20]byte, bool) {
+	known := make(map[[20]byte][20]byte)
+	for _, infoHash := range infoHashes {
+		var key [20]byte
+		copy(key[:], hash([]byte("req2"), infoHash[:]))
+		known[key] = infoHash
+	}
+	return func(req2 [20]byte) ([20]byte, bool) {
+		infoHash, ok := known[req2]
+		return infoHash, ok
+	}
+}
+
+// Conn 是加密握手之后的连接，明文模式下 encryptor 和 decryptor 为 nil
+type Conn struct {
+	net.Conn
+	reader     io.Reader
+	mutex      sync.Mutex
+	encryptor  *rc4.Cipher
+	decryptor  *rc4.Cipher
+	skey       [20]byte // 加密握手中用作 SKEY 的 info hash
+	obfuscated bool     // 是否经过了加密握手，选择了明文传输时也是 true
+}
+
+// 握手过程中多读的数据还在 reader 里，initialPayload 是对方在握手中顺带发来的数据
+func newConn(conn net.Conn, reader *bufio.Reader, encryptor, decryptor *rc4.Cipher, initialPayload []byte) *Conn {
+	c := &Conn{
+		Conn:      conn,
+		encryptor: encryptor,
+		decryptor: decryptor,
+	}
+	var remaining io.Reader = reader
+	if decryptor != nil {
+		remaining = &decryptReader{reader: reader, decryptor: decryptor}
+	}
+	c.reader = io.MultiReader(bytes.NewReader(initialPayload), remaining)
+	return c
+}
+
+// 是否加密了之后的数据
+func (c *Conn) Encrypted() bool {
+	return c.encryptor != nil
+}
+
+// Accept 在加密握手中匹配到的 info hash，没有经过加密握手 (对方直接发来明文的 BitTorrent 握手) 时返回 false
+// 之后 BitTorrent 握手中的 info hash 必须和它一样，否则对方是在用一个种子的 SKEY 访问另一个种子
+func (c *Conn) SKey() ([20]byte, bool) {
+	return c.skey, c.obfuscated
+}
+
+func (c *Conn) Read(buffer []byte) (int, error) {
+	return c.reader.Read(buffer)
+}
+
+func (c *Conn) Write(buffer []byte) (int, error) {
+	if c.encryptor == nil {
+		return c.Conn.Write(buffer)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	encrypted := make([]byte, len(buffer))
+	c.encryptor.XORKeyStream(encrypted, buffer)
+	return c.Conn.Write(encrypted)
+}
+
+type decryptReader struct {
+	reader    io.Reader
+	decryptor *rc4.Cipher
+}
+
+func (r *decryptReader) Read(buffer []byte) (int, error) {
+	n, err := r.reader.Read(buffer)
+	r.decryptor.XORKeyStream(buffer[:n], buffer[:n])
+	return n, err
+}
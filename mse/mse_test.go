@@ -0,0 +1,188 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testInfoHash = [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// 在本地监听，用 Accept 处理第一个连入的连接，返回发起方的连接和接收方的结果
+func connect(t *testing.T, policy Policy, infoHashes ...[20]byte) (net.Conn, chan acceptResult) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	result := make(chan acceptResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- acceptResult{err: err}
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		accepted, err := Accept(conn, policy, Lookup(infoHashes...))
+		if err != nil {
+			conn.Close()
+		}
+		result <- acceptResult{conn: accepted, err: err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn, result
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{PolicyDisable, PolicyPrefer, PolicyRequire} {
+		parsed, err := ParsePolicy(policy.String())
+		assert.Nil(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := ParsePolicy("maybe")
+	assert.NotNil(t, err)
+}
+
+func TestHandshake(t *testing.T) {
+	tests := map[string]struct {
+		initiator Policy
+		receiver  Policy
+		encrypted bool
+	}{
+		"prefer and prefer":  {initiator: PolicyPrefer, receiver: PolicyPrefer, encrypted: true},
+		"prefer and require": {initiator: PolicyPrefer, receiver: PolicyRequire, encrypted: true},
+		"require and prefer": {initiator: PolicyRequire, receiver: PolicyPrefer, encrypted: true},
+	}
+
+	for name, test := range tests {
+		conn, result := connect(t, test.receiver, [20]byte{1}, testInfoHash)
+		encrypted, err := Handshake(conn, testInfoHash, test.initiator)
+		require.Nil(t, err, name)
+		accepted := <-result
+		require.Nil(t, accepted.err, name)
+		assert.Equal(t, test.encrypted, encrypted.(*Conn).Encrypted(), name)
+		assert.Equal(t, test.encrypted, accepted.conn.(*Conn).Encrypted(), name)
+		// 接收方匹配到的 SKEY
+		skey, obfuscated := accepted.conn.(*Conn).SKey()
+		assert.True(t, obfuscated, name)
+		assert.Equal(t, testInfoHash, skey, name)
+
+		// 两个方向的数据都能正确收到
+		_, err = encrypted.Write([]byte("\x13BitTorrent protocol"))
+		require.Nil(t, err)
+		buffer := make([]byte, 20)
+		_, err = io.ReadFull(accepted.conn, buffer)
+		require.Nil(t, err)
+		assert.Equal(t, "\x13BitTorrent protocol", string(buffer), name)
+
+		_, err = accepted.conn.Write([]byte("hello"))
+		require.Nil(t, err)
+		buffer = make([]byte, 5)
+		_, err = io.ReadFull(encrypted, buffer)
+		require.Nil(t, err)
+		assert.Equal(t, "hello", string(buffer), name)
+	}
+}
+
+func TestHandshakeEncryptedOnTheWire(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+
+	// 接收方直接读原始的 TCP 数据，看不到明文
+	raw := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			raw <- nil
+			return
+		}
+		defer conn.Close()
+		var captured []byte
+		wrapped := &recordingConn{Conn: conn, captured: &captured}
+		accepted, err := Accept(wrapped, PolicyRequire, Lookup(testInfoHash))
+		if err != nil {
+			raw <- nil
+			return
+		}
+		buffer := make([]byte, 20)
+		io.ReadFull(accepted, buffer)
+		raw <- captured
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	encrypted, err := Handshake(conn, testInfoHash, PolicyRequire)
+	require.Nil(t, err)
+	_, err = encrypted.Write([]byte("\x13BitTorrent protocol"))
+	require.Nil(t, err)
+
+	captured := <-raw
+	require.NotNil(t, captured)
+	assert.NotContains(t, string(captured), "BitTorrent protocol")
+}
+
+type recordingConn struct {
+	net.Conn
+	captured *[]byte
+}
+
+func (c *recordingConn) Read(buffer []byte) (int, error) {
+	n, err := c.Conn.Read(buffer)
+	*c.captured = append(*c.captured, buffer[:n]...)
+	return n, err
+}
+
+func TestHandshakeFails(t *testing.T) {
+	// 接收方不接受加密
+	conn, result := connect(t, PolicyDisable, testInfoHash)
+	_, err := Handshake(conn, testInfoHash, PolicyRequire)
+	assert.NotNil(t, err)
+	assert.NotNil(t, (<-result).err)
+
+	// 接收方不认识这个 info hash
+	conn, result = connect(t, PolicyPrefer, [20]byte{1})
+	_, err = Handshake(conn, testInfoHash, PolicyPrefer)
+	assert.NotNil(t, err)
+	assert.NotNil(t, (<-result).err)
+
+	// 发起方不加密时不能做加密握手
+	conn, _ = connect(t, PolicyPrefer, testInfoHash)
+	_, err = Handshake(conn, testInfoHash, PolicyDisable)
+	assert.NotNil(t, err)
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	header := "\x13BitTorrent protocol\x00\x00\x00\x00\x00\x00\x00\x00"
+
+	conn, result := connect(t, PolicyPrefer, testInfoHash)
+	_, err := conn.Write([]byte(header))
+	require.Nil(t, err)
+	accepted := <-result
+	require.Nil(t, accepted.err)
+	assert.False(t, accepted.conn.(*Conn).Encrypted())
+	_, obfuscated := accepted.conn.(*Conn).SKey()
+	assert.False(t, obfuscated)
+	// 已经读到的握手数据不会丢
+	buffer := make([]byte, len(header))
+	_, err = io.ReadFull(accepted.conn, buffer)
+	require.Nil(t, err)
+	assert.Equal(t, header, string(buffer))
+
+	// require 时拒绝明文的连接
+	conn, result = connect(t, PolicyRequire, testInfoHash)
+	_, err = conn.Write([]byte(header))
+	require.Nil(t, err)
+	assert.NotNil(t, (<-result).err)
+}
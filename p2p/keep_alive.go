@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	message "github.com/strugglebak/goMule/message"
+)
+
+// 超过这么久没有向 peer 发送任何消息时发送一个 keep-alive，对方一般在 2 分钟多一点之后断开没有动静的连接
+const KeepAliveInterval = 2 * time.Minute
+
+// 超过这么久没有收到对方的任何消息 (包括 keep-alive) 时断开
+const MessageTimeout = KeepAliveInterval + 30*time.Second
+
+// peer 超过这么久既没有给我们数据、也没有从我们这里下载数据时断开，把位置让给别的 peer
+const DefaultIdleTimeout = 5 * time.Minute
+
+// peer 太久没有有用的数据往来
+var ErrIdlePeer = errors.New("peer has been idle for too long")
+
+// 等待 peer 的消息超时
+var ErrMessageTimeout = errors.New("timed out waiting for a message from peer")
+
+// 在 conn 上每隔 interval 检查一次，这段时间内没有写过数据就发送一个 keep-alive
+// 写操作都加了锁，keep-alive 不会插在一个消息的中间，加密和限速的连接也可以这样用
+type keepAliveConn struct {
+	net.Conn
+	mutex     sync.Mutex
+	lastWrite time.Time
+	done      chan struct{}
+	once      sync.Once
+}
+
+// 返回的 stop 用来停止发送 keep-alive，不会关闭 conn
+func startKeepAlive(conn net.Conn, interval time.Duration) (*keepAliveConn, func()) {
+	k := &keepAliveConn{Conn: conn, lastWrite: time.Now(), done: make(chan struct{})}
+	go k.loop(interval)
+	return k, func() { k.once.Do(func() { close(k.done) }) }
+}
+
+func (k *keepAliveConn) Write(buffer []byte) (int, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.lastWrite = time.Now()
+	return k.Conn.Write(buffer)
+}
+
+func (k *keepAliveConn) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-k.done:
+			return
+		}
+		k.mutex.Lock()
+		if time.Since(k.lastWrite) >= interval {
+			k.lastWrite = time.Now()
+			// 写失败时读写消息的地方也会出错，这里不用处理
+			var keepAlive *message.Message
+			k.Conn.Write(keepAlive.Serialize())
+		}
+		k.mutex.Unlock()
+	}
+}
+
+// 记录和一个 peer 之间最后一次有用的数据往来，给 peer 发送或者从 peer 收到 piece 数据才算
+type idleTimer struct {
+	timeout    time.Duration
+	lastUseful time.Time
+}
+
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	if timeout <= 0 {
+		timeout = DefaultIdleTimeout
+	}
+	return &idleTimer{timeout: timeout, lastUseful: time.Now()}
+}
+
+func (i *idleTimer) useful() {
+	i.lastUseful = time.Now()
+}
+
+// 超过这个时间还没有有用的数据往来就断开
+func (i *idleTimer) deadline() time.Time {
+	return i.lastUseful.Add(i.timeout)
+}
+
+// 读下一个消息的 deadline，不超过 timeout，也不超过 idle 的 deadline
+// 到了 idle 的 deadline 时返回 ErrIdlePeer
+func (i *idleTimer) readDeadline(timeout time.Duration) (time.Time, error) {
+	now := time.Now()
+	idle := i.deadline()
+	if !now.Before(idle) {
+		return time.Time{}, ErrIdlePeer
+	}
+	deadline := now.Add(timeout)
+	if idle.Before(deadline) {
+		deadline = idle
+	}
+	return deadline, nil
+}
+
+// 等消息超时的时候，如果是因为 idle 的 deadline 到了，返回 ErrIdlePeer
+func (i *idleTimer) timedOut() error {
+	if !time.Now().Before(i.deadline()) {
+		return ErrIdlePeer
+	}
+	return ErrMessageTimeout
+}
@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	handshake "github.com/strugglebak/goMule/handshake"
+	message "github.com/strugglebak/goMule/message"
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+func TestKeepAlive(t *testing.T) {
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	keepAlive, stop := startKeepAlive(conn, 50*time.Millisecond)
+	defer stop()
+
+	go keepAlive.Write((&message.Message{ID: message.MessageInterested}).Serialize())
+	msg, err := message.Read(remote)
+	require.Nil(t, err)
+	assert.Equal(t, message.MessageInterested, msg.ID)
+
+	// 之后没有写过数据，应该收到 keep-alive
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err = message.Read(remote)
+	require.Nil(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestIdleInboundPeer(t *testing.T) {
+	seeder, data := newTestTorrent(t, 100000, 16384)
+	seeder.IdleTimeout = 200 * time.Millisecond
+	startSeeding(t, seeder, data)
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	// 对方只接收 bitfield，从来不请求数据
+	go io.Copy(io.Discard, remote)
+	result := make(chan error, 1)
+	go func() { result <- seeder.AcceptPeer(conn, seeder.InfoHash, [20]byte{9}) }()
+
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrIdlePeer, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle peer was not dropped")
+	}
+}
+
+func TestIdleOutboundPeer(t *testing.T) {
+	torrent, data := newTestTorrent(t, 100000, 16384)
+	torrent.IdleTimeout = 200 * time.Millisecond
+	torrent.Store = memoryStore(make([]byte, len(data)))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h, err := handshake.Read(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(handshake.BuildHandshake(h.InfoHash, [20]byte{9}).Serialize())
+		// 有全部 piece，但是一直 choke 着我们
+		count := torrent.pieceCount()
+		bf := make([]byte, (count+7)/8)
+		for i := 0; i < count; i++ {
+			bf[i/8] |= 1 << uint(7-i%8)
+		}
+		conn.Write((&message.Message{ID: message.MessageBitfield, Payload: bf}).Serialize())
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	torrent.Peers = []peers.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle peer was not dropped")
+	}
+}
@@ -4,18 +4,44 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	progressbar "github.com/schollz/progressbar/v3"
-
+	bitField "github.com/strugglebak/goMule/bit_field"
 	client "github.com/strugglebak/goMule/client"
-	message "github.com/strugglebak/goMule/message"
+	event "github.com/strugglebak/goMule/event"
+	logging "github.com/strugglebak/goMule/logging"
+	mse "github.com/strugglebak/goMule/mse"
+	peerId "github.com/strugglebak/goMule/peer_id"
 	peers "github.com/strugglebak/goMule/peers"
+	rateLimiter "github.com/strugglebak/goMule/rate_limiter"
 )
 
 const MaxRequestBlockSize = 2 << 13
-const MaxUnfulfilledRequestBacklog = 5
+
+// Store 是下载好的 piece 的去处，storage.Storage 就是一个 Store
+type Store interface {
+	ReadAt(buffer []byte, offset int64) (int, error)
+	WriteAt(buffer []byte, offset int64) (int, error)
+}
+
+// 多文件 torrent 中的一个文件
+type File struct {
+	Length   int
+	Priority int      // PrioritySkip、PriorityNormal 或 PriorityHigh
+	Path     []string // 文件在 torrent 中的路径，web seed 用它拼出 URL
+	Offset   int      // 文件在整个 torrent 数据中的起始偏移，文件之间可能有对齐用的空隙
+}
+
+// Store 实现了这个接口时，被跳过的文件不会在磁盘上创建
+type fileSkipper interface {
+	SetSkip(index int, skip bool) error
+}
 
 type Torrent struct {
 	Peers       []peers.Peer
@@ -25,225 +51,773 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+
+	MaxPeers        int                  // 同时连接的 peer 数量上限，为 0 时不限制
+	DownloadLimiter *rateLimiter.Limiter // 为 nil 时不限速
+	UploadLimiter   *rateLimiter.Limiter
+	Sequential      bool              // 按 piece 的顺序下载，而不是随机挑选
+	Store           Store             // Start 之前必须设置
+	Files           []File            // 多文件 torrent 中每个文件的大小和优先级
+	WebSeeds        []string          // BEP 19 的 web seed URL
+	Encryption      mse.Policy        // 和 peer 连接时的加密策略，默认不加密
+	Completed       bitField.BitField // Start 之前已经在 Store 里校验过的 piece，不会再下载
+	Events          *event.Bus        // 下载过程中的事件，为 nil 时 Start 会创建一个
+	StallTimeout    time.Duration     // 超过这么久没有完成任何 piece 时发出 Stalled 事件，为 0 时使用 DefaultStallTimeout
+	IdleTimeout     time.Duration     // peer 超过这么久既没有给我们数据、也没有从我们这里下载时断开，为 0 时使用 DefaultIdleTimeout
+	UploadOnly      bool              // 只上传、不再下载，比如做种，会在扩展握手中声明 upload_only (BEP 21)，为 false 时下载完需要的 piece 之后也会声明
+	Logger          *slog.Logger      // 为 nil 时使用 slog.Default()
+
+	// v2 和 hybrid 种子 (BEP 52)，见 v2.go
+	PieceRoots  []PieceRoot  // 每个 piece 的 merkle 校验信息，v1 种子为空
+	AltInfoHash [20]byte     // hybrid 种子在 v2 swarm 中的 info hash (截断的 SHA-256)
+	AltPeers    []peers.Peer // 从 v2 swarm 中得到的 peer，握手时使用 AltInfoHash
+
+	picker    *picker
+	logger    *slog.Logger // Start 时由 Logger 加上种子的字段得到
+	stop      chan struct{}
+	exited    chan struct{} // Stop 之后所有 worker 都退出时关闭
+	mutex     sync.Mutex
+	workers   int                     // 还在运行的 worker 数量
+	err       error                   // 导致下载停止的错误
+	semaphore chan struct{}           // MaxPeers 大于 0 时限制同时连接的 peer 数量
+	connected map[peerKey]bool        // 已经加入过的 peer，避免重复连接
+	known     []peers.Peer            // 加入过的 peer，按加入的顺序
+	active    map[peerKey]*PeerStatus // 已经完成握手、还没有断开的 peer
+	peerConns map[[20]byte]*peerConn  // 按对方的 peer ID 记录正在使用的连接，避免和同一个 peer 连接两次
+	// 声明了 upload_only 而被断开的 peer，按地址和 peer ID 记录，我们也只上传时不再连接
+	uploadOnlyAddrs map[string]bool
+	uploadOnlyIDs   map[[20]byte]bool
+	// 下载并校验通过的数据，以及上传给 peer 的数据，单位是 byte，原子操作
+	downloaded int64
+	uploaded   int64
+	chokedTime time.Duration // 已经断开的 peer 被 choke 的总时间，由 mutex 保护
 }
 
-type pieceResult struct {
-	Index 	int
-	Buffer  []byte
+const DefaultStallTimeout = time.Minute
+
+// hybrid 种子中同一个 peer 可能同时在 v1 和 v2 两个 swarm 中
+type peerKey struct {
+	addr     string
+	infoHash [20]byte
 }
 
-func (t *Torrent) StartDownloadWorker(
-	peer peers.Peer,
-	workQueue chan *pieceWork,
-	results chan *pieceResult,
-) {
-	log.Printf("Handshaking with %s...\n", peer.IP)
+// 在后台开始下载，下载好的 piece 会写入 Store
+func (t *Torrent) Start() error {
+	if t.Store == nil {
+		return fmt.Errorf("no store to save %s to", t.Name)
+	}
+	if t.picker != nil {
+		return fmt.Errorf("%s has already been started", t.Name)
+	}
 
-	c, err := client.BuildClient(peer, t.InfoHash, t.PeerID)
-	if err != nil {
-		log.Printf("NETWORK ERROR: Could not handshake with %s. Disconnecting!\n", peer.IP)
-		return
+	t.logger = logging.OrDefault(t.Logger).With(logging.InfoHash(t.InfoHash), slog.String("torrent", t.Name))
+	t.picker = newPicker(t)
+	t.stop = make(chan struct{})
+	t.exited = make(chan struct{})
+	if t.Events == nil {
+		t.Events = &event.Bus{}
+	}
+	if len(t.Files) > 0 {
+		if skipper, ok := t.Store.(fileSkipper); ok {
+			for index, file := range t.Files {
+				err := skipper.SetSkip(index, file.Priority == PrioritySkip)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		t.picker.SetPriorities(t.piecePriorities())
+	}
+	// 开始时已经有了所有需要的 piece，只是做种
+	done, wanted, _ := t.picker.Progress()
+	if done >= wanted {
+		t.logger.Info("starting to seed", slog.Int("pieces", done))
+	} else {
+		t.logger.Info("starting download", slog.Int("pieces", t.pieceCount()), slog.Int("peers", len(t.Peers)+len(t.AltPeers)))
 	}
-	defer c.Conn.Close()
 
-	log.Printf("Completed handshake with %s!\n", peer.IP)
+	// web seed 不占用 peer 的连接数
+	// 开始从 peer 那里下载，连接数超过 MaxPeers 的 peer 要等前面的 worker 退出
+	if t.MaxPeers > 0 {
+		t.semaphore = make(chan struct{}, t.MaxPeers)
+	}
+	t.connected = make(map[peerKey]bool)
+	t.active = make(map[peerKey]*PeerStatus)
+	t.peerConns = make(map[[20]byte]*peerConn)
+	t.uploadOnlyAddrs = make(map[string]bool)
+	t.uploadOnlyIDs = make(map[[20]byte]bool)
+	t.workers = len(t.WebSeeds)
+	for _, seedURL := range t.WebSeeds {
+		go func(seedURL string) {
+			defer t.workerExited()
+			t.StartWebSeedWorker(seedURL)
+		}(seedURL)
+	}
+	for _, peer := range t.Peers {
+		t.addPeer(peer, t.InfoHash, false)
+	}
+	for _, peer := range t.AltPeers {
+		t.addPeer(peer, t.AltInfoHash, false)
+	}
+	go t.watch()
 
-	c.SendUnchoke()
-	c.SendInterested()
+	return nil
+}
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.Index) {
-			// 将 piece 放入队列
-			workQueue <- pw
-			continue
+// 发出一个事件，InfoHash 为零值时使用 t.InfoHash
+func (t *Torrent) publish(e event.Event) {
+	if e.InfoHash == ([20]byte{}) {
+		e.InfoHash = t.InfoHash
+	}
+	e.Name = t.Name
+	t.Events.Publish(e)
+}
+
+// 一个 piece 下载好、校验通过并且已经保存了，peer 和 seedURL 只有一个有值
+func (t *Torrent) pieceVerified(index int, length int, e event.Event) {
+	t.picker.Complete(index)
+	atomic.AddInt64(&t.downloaded, int64(length))
+	e.Type = event.PieceVerified
+	e.Piece = index
+	e.Done, e.Wanted, _ = t.picker.Progress()
+	t.publish(e)
+}
+
+// 在后台检查进度，发出 Completed 和 Stalled 事件，直到下载被停止
+func (t *Torrent) watch() {
+	timeout := t.StallTimeout
+	if timeout <= 0 {
+		timeout = DefaultStallTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// 开始时就已经完成的不算，做种时不发出 Completed
+	done, wanted, _ := t.picker.Progress()
+	completed, stalled := done >= wanted, false
+	lastDone := -1
+	for {
+		done, wanted, changed := t.picker.Progress()
+		if done >= wanted {
+			if !completed {
+				completed = true
+				t.logger.Info("download completed", slog.Int("pieces", done))
+				t.publish(event.Event{Type: event.Completed, Done: done, Wanted: wanted})
+			}
+		} else {
+			completed = false
+		}
+		// 只有完成了新的 piece 才重新计时，优先级变化之类的不算
+		if done != lastDone {
+			lastDone, stalled = done, false
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(timeout)
 		}
 
-		// 下载 piece
-		buffer, err := AttemptDownloadPiece(c, pw)
-		if err != nil {
-			log.Println("Exiting", err)
-			workQueue <- pw
+		select {
+		case <-changed:
+		case <-timer.C:
+			if !stalled && !completed {
+				stalled = true
+				t.logger.Warn("download stalled", slog.Int("done", done), slog.Int("wanted", wanted), slog.Duration("timeout", timeout))
+				t.publish(event.Event{Type: event.Stalled, Done: done, Wanted: wanted})
+			}
+		case <-t.stop:
 			return
 		}
+	}
+}
 
-		// check sum
-		err = CheckIntegrity(pw, buffer)
+// 下载过程中加入新的 peer，已经连接过的 peer 会被忽略
+func (t *Torrent) AddPeer(peer peers.Peer) {
+	t.addPeer(peer, t.InfoHash, false)
+}
+
+// 加入局域网中发现的 peer，它们不用排队等 MaxPeers 的空位，马上开始连接
+func (t *Torrent) AddLocalPeer(peer peers.Peer) {
+	t.addPeer(peer, t.InfoHash, true)
+}
+
+// hybrid 种子在 v2 swarm 中的 peer 用 AltInfoHash 握手
+func (t *Torrent) AddLocalAltPeer(peer peers.Peer) {
+	t.addPeer(peer, t.AltInfoHash, true)
+}
+
+func (t *Torrent) addPeer(peer peers.Peer, infoHash [20]byte, local bool) {
+	key := peerKey{peer.String(), infoHash}
+	t.mutex.Lock()
+	if t.picker == nil || t.connected[key] {
+		t.mutex.Unlock()
+		return
+	}
+	select {
+	case <-t.stop:
+		t.mutex.Unlock()
+		return
+	default:
+	}
+	// 双方都只上传，连上了也会马上断开
+	if t.isUploadOnlyPeer(peer) && t.uploadOnly() {
+		t.mutex.Unlock()
+		t.logger.Debug("skipping upload-only peer", logging.Peer(peer))
+		return
+	}
+	t.connected[key] = true
+	t.known = append(t.known, peer)
+	t.workers++
+	t.mutex.Unlock()
+
+	go func() {
+		defer t.workerExited()
+		if t.semaphore != nil && !local {
+			select {
+			case t.semaphore <- struct{}{}:
+			case <-t.stop:
+				return
+			}
+			defer func() { <-t.semaphore }()
+		}
+		t.downloadFromPeer(peer, infoHash)
+	}()
+}
+
+func (t *Torrent) workerExited() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.workers--
+	// 让等待者重新检查是否还有 worker
+	t.picker.Wake()
+	t.checkExited()
+}
+
+// 停止之后不会再有新的 worker，最后一个 worker 退出时通知 WaitStopped
+// 调用时必须持有 mutex
+func (t *Torrent) checkExited() {
+	select {
+	case <-t.stop:
+	default:
+		return
+	}
+	select {
+	case <-t.exited:
+	default:
+		if t.workers == 0 {
+			close(t.exited)
+		}
+	}
+}
+
+// 停止下载，并且等待所有 worker 退出，返回之后不会再写 Store
+// 比如删除下载的文件之前，避免 worker 又把文件创建出来
+func (t *Torrent) WaitStopped() {
+	t.Stop()
+	t.mutex.Lock()
+	exited := t.exited
+	t.mutex.Unlock()
+	if exited != nil {
+		<-exited
+	}
+}
+
+// 停止下载，所有 worker 会在当前 piece 结束后退出
+func (t *Torrent) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stop == nil {
+		return
+	}
+	select {
+	case <-t.stop:
+	default:
+		close(t.stop)
+		t.checkExited()
+	}
+}
+
+// 每个 piece 的优先级是它覆盖到的所有文件中最高的那个，
+// 所以跨了被跳过的文件和想要的文件的 piece 仍然会被下载
+func (t *Torrent) piecePriorities() []int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	priorities := make([]int, t.pieceCount())
+	for _, file := range t.Files {
+		if file.Length > 0 {
+			first := file.Offset / t.PieceLength
+			last := (file.Offset + file.Length - 1) / t.PieceLength
+			for index := first; index <= last && index < len(priorities); index++ {
+				if file.Priority > priorities[index] {
+					priorities[index] = file.Priority
+				}
+			}
+		}
+	}
+	return priorities
+}
+
+// 设置第 index 个文件的优先级，下载过程中也可以调用
+func (t *Torrent) SetFilePriority(index int, priority int) error {
+	if index < 0 || index >= len(t.Files) {
+		return fmt.Errorf("file index %d out of range [0, %d)", index, len(t.Files))
+	}
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+
+	if skipper, ok := t.Store.(fileSkipper); ok {
+		err := skipper.SetSkip(index, priority == PrioritySkip)
 		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.Index)
-			workQueue <- pw
-			// 这个时候说明 piece 没下完，要继续下
-			continue
+			return err
 		}
+	}
 
-		c.SendHave(pw.Index)
+	t.mutex.Lock()
+	t.Files[index].Priority = priority
+	t.mutex.Unlock()
 
-		// 下载完成之后将结果放入 results
-		results <- &pieceResult{pw.Index, buffer}
+	if t.picker != nil {
+		t.picker.SetPriorities(t.piecePriorities())
 	}
+	return nil
 }
 
-func (t *Torrent) CalculatePieceBounds(index int) (begin int, end int) {
-	// index 指的是下的是第几块 piece
-	begin = index * t.PieceLength
-	end = begin + t.PieceLength
-	if end > t.Length {
-		end = t.Length
+// 因为 err 停止下载
+func (t *Torrent) fail(err error) {
+	t.mutex.Lock()
+	if t.err == nil {
+		t.err = err
 	}
-	return begin, end
+	t.mutex.Unlock()
+	t.Stop()
 }
 
-func (t *Torrent) CalculatePieceSize(index int) int {
-	begin, end := t.CalculatePieceBounds(index)
-	return end - begin
+// 返回已经完成的 piece 数量和需要下载的 piece 数量
+func (t *Torrent) Progress() (done int, wanted int) {
+	if t.picker == nil {
+		return 0, t.pieceCount()
+	}
+	done, wanted, _ = t.picker.Progress()
+	return done, wanted
 }
 
-// 下载整个 file ，数据存储在内存中
-func (t *Torrent) Download() ([]byte, error) {
-	prompt := "downloading " + t.Name + "..."
-	bar := progressbar.Default(100 * 100, prompt)
+// 已经完成的 piece，没有 Start 时返回 Completed
+func (t *Torrent) Bitfield() bitField.BitField {
+	if t.picker == nil {
+		return t.Completed
+	}
+	return t.picker.Bitfield()
+}
+
+// 加入过的 peer，包括已经断开的
+func (t *Torrent) KnownPeers() []peers.Peer {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]peers.Peer{}, t.known...)
+}
+
+// 已经完成握手的一个 peer
+type PeerStatus struct {
+	Peer        peers.Peer
+	PeerID      [20]byte // 对方在握手时发来的 peer ID，可以看出对方用的客户端
+	ConnectedAt time.Time
+	Downloaded  int64         // 从这个 peer 下载并校验通过的 byte 数量
+	Uploaded    int64         // 上传给这个 peer 的 piece 数据的 byte 数量
+	Backlog     int           // 已经发出、还没有收到回应的请求数量
+	Choked      bool          // 对方是否正在 choke 我们
+	Interested  bool          // 对方是否对我们的数据感兴趣
+	ChokedTime  time.Duration // 连接之后被对方 choke 的总时间
+
+	// worker 更新、ActivePeers 读取，都是原子操作
+	backlog     int64
+	choked      int32
+	interested  int32
+	chokedSince int64 // 开始被 choke 的时间，UnixNano
+	chokedTotal int64 // 之前被 choke 的总时间，不包括正在进行的这一段
+}
 
-	log.Printf("Starting download for %s...", t.Name)
+// 刚完成握手时对方都是 choke 我们的
+func (t *Torrent) peerConnected(key peerKey, peer peers.Peer, peerID [20]byte) *PeerStatus {
+	status := &PeerStatus{Peer: peer, PeerID: peerID, ConnectedAt: time.Now()}
+	status.setChoked(true)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.active[key] = status
+	return status
+}
+
+// 一个 peer ID 正在使用的连接
+type peerConn struct {
+	conn     net.Conn
+	outbound bool // 是不是我们发起的连接
+}
 
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
-	for index, hash := range t.PieceHashes {
-		// 先计算 piece size，然后对队列进行初始化
-		length := t.CalculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+// 登记和 peerID 之间的连接，已经有连接时按 client.PreferConnection 决定保留哪一个
+// 返回 false 时应该放弃 conn，返回 true 时被替换掉的旧连接已经被关闭了
+func (t *Torrent) claimPeerID(peerID [20]byte, conn net.Conn, outbound bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if existing, ok := t.peerConns[peerID]; ok {
+		if !client.PreferConnection(t.PeerID, peerID, outbound, existing.outbound) {
+			return false
+		}
+		// 旧连接的 worker 会在读写出错之后退出
+		t.logger.Debug("replacing duplicate peer connection", slog.String("peer_id", fmt.Sprintf("%x", peerID)))
+		existing.conn.Close()
 	}
+	t.peerConns[peerID] = &peerConn{conn: conn, outbound: outbound}
+	return true
+}
 
-	// 开始从 peer 那里下载
-	for _, peer := range t.Peers {
-		go t.StartDownloadWorker(peer, workQueue, results)
-	}
-
-	// 将 results 中的数据给 buffer
-	buffer := make([]byte, t.Length)
-	donePieces := 0
-	prevPercent := float64(0)
-	for donePieces < len(t.PieceHashes) {
-		response := <-results
-		begin, end := t.CalculatePieceBounds(response.Index)
-		copy(buffer[begin:end], response.Buffer)
-		donePieces++
-
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		// 除了 main thread 的其他 worker 数
-		// numWorkers := runtime.NumGoroutine() - 1
-		bar.Add(int(percent*100 - float64(prevPercent)*100))
-		// log.Printf(
-		// 	"(%0.2f%%) Downloaded piece #%d from %d peers\n",
-		// 	percent,
-		// 	response.Index,
-		// 	numWorkers,
-		// )
-		prevPercent = percent
-	}
-	close(workQueue)
-
-	log.Printf("Completed download for %s!", t.Name)
+// 连接断开之后释放 peerID，已经被新连接替换时什么都不做
+func (t *Torrent) releasePeerID(peerID [20]byte, conn net.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if existing, ok := t.peerConns[peerID]; ok && existing.conn == conn {
+		delete(t.peerConns, peerID)
+	}
+}
 
-	return buffer, nil
+func (t *Torrent) peerDisconnected(key peerKey) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if status, ok := t.active[key]; ok {
+		t.chokedTime += status.chokedTime(time.Now())
+	}
+	delete(t.active, key)
 }
 
-type pieceWork struct {
-	Index  int
-	Hash   [20]byte
-	Length int
+func (status *PeerStatus) setChoked(choked bool) {
+	now := time.Now().UnixNano()
+	if choked {
+		if atomic.CompareAndSwapInt32(&status.choked, 0, 1) {
+			atomic.StoreInt64(&status.chokedSince, now)
+		}
+	} else if atomic.CompareAndSwapInt32(&status.choked, 1, 0) {
+		atomic.AddInt64(&status.chokedTotal, now-atomic.LoadInt64(&status.chokedSince))
+	}
 }
-func AttemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		Index:  pw.Index,
-		Buffer: make([]byte, pw.Length),
-		Client: c,
-	}
-
-	// 设置 deadline 可以使得未响应的 peers 不去阻塞，因为如果没响应就不用等待传数据了
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	// 函数结束后禁止 deadline
-	defer c.Conn.SetDeadline(time.Time{})
-
-	for state.Downloaded < pw.Length {
-		// 如果没有阻塞，就发送请求，直到请求的状态是 unfulfilled 的
-		if !state.Client.Choked {
-			for state.Backlog < MaxUnfulfilledRequestBacklog && state.Requested < pw.Length {
-				remainingBlockSize := MaxRequestBlockSize
-				// 最后一个块可能要比标准的要小
-				if remainingBlockSize > (pw.Length-state.Requested)  {
-					// 还剩下这么多
-					remainingBlockSize = pw.Length - state.Requested
-				}
 
-				// 继续请求剩下的
-				err := c.SendRequest(pw.Index, state.Requested, remainingBlockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.Backlog++
-				state.Requested += remainingBlockSize
-			}
+func (status *PeerStatus) setInterested(interested bool) {
+	value := int32(0)
+	if interested {
+		value = 1
+	}
+	atomic.StoreInt32(&status.interested, value)
+}
+
+func (status *PeerStatus) setBacklog(backlog int) {
+	atomic.StoreInt64(&status.backlog, int64(backlog))
+}
+
+// 到 now 为止被 choke 的总时间
+func (status *PeerStatus) chokedTime(now time.Time) time.Duration {
+	total := atomic.LoadInt64(&status.chokedTotal)
+	if atomic.LoadInt32(&status.choked) == 1 {
+		total += now.UnixNano() - atomic.LoadInt64(&status.chokedSince)
+	}
+	return time.Duration(total)
+}
+
+// 所有 peer 被 choke 的总时间，包括已经断开的 peer
+func (t *Torrent) ChokedTime() time.Duration {
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	total := t.chokedTime
+	for _, status := range t.active {
+		total += status.chokedTime(now)
+	}
+	return total
+}
+
+// 当前连接着的 peer，按连接的时间排列
+func (t *Torrent) ActivePeers() []PeerStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	list := make([]PeerStatus, 0, len(t.active))
+	for _, status := range t.active {
+		list = append(list, PeerStatus{
+			Peer:        status.Peer,
+			PeerID:      status.PeerID,
+			ConnectedAt: status.ConnectedAt,
+			Downloaded:  atomic.LoadInt64(&status.Downloaded),
+			Uploaded:    atomic.LoadInt64(&status.Uploaded),
+			Backlog:     int(atomic.LoadInt64(&status.backlog)),
+			Choked:      atomic.LoadInt32(&status.choked) == 1,
+			Interested:  atomic.LoadInt32(&status.interested) == 1,
+			ChokedTime:  status.chokedTime(now),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ConnectedAt.Before(list[j].ConnectedAt) })
+	return list
+}
+
+// 这次 Start 之后下载并校验通过的 byte 数量
+func (t *Torrent) Downloaded() int64 {
+	return atomic.LoadInt64(&t.downloaded)
+}
+
+// 这次 Start 之后上传给 peer 的 piece 数据的 byte 数量
+func (t *Torrent) Uploaded() int64 {
+	return atomic.LoadInt64(&t.uploaded)
+}
+
+// 阻塞直到下载完成、被停止，或者所有 peer 都断开了连接
+// onProgress 不为 nil 时，每完成一个 piece 都会被调用一次
+func (t *Torrent) Wait(onProgress func(done, wanted int)) error {
+	if t.picker == nil {
+		return fmt.Errorf("%s has not been started", t.Name)
+	}
+
+	for {
+		done, wanted, changed := t.picker.Progress()
+		if onProgress != nil {
+			onProgress(done, wanted)
+		}
+		if done >= wanted {
+			t.Stop()
+			return nil
 		}
 
-		// 请求状态变成 unfulfilled 的了，那么就开始解析响应回来的数据
-		// 并更改对应的 message 状态
-		err := state.ChangeState()
-		if err != nil {
-			return nil, err
+		t.mutex.Lock()
+		workers := t.workers
+		t.mutex.Unlock()
+		if workers == 0 {
+			return fmt.Errorf("no peers left to download %s from", t.Name)
+		}
+
+		select {
+		case <-changed:
+		case <-t.stop:
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if t.err != nil {
+				return t.err
+			}
+			return fmt.Errorf("download of %s was stopped", t.Name)
 		}
 	}
+}
 
-	return state.Buffer, nil
+// 下载整个 file ，数据存储在内存中
+func (t *Torrent) Download() ([]byte, error) {
+	buffer := make(memoryStore, t.Length)
+	t.Store = buffer
+
+	err := t.Start()
+	if err != nil {
+		return nil, err
+	}
+	err = t.Wait(nil)
+	if err != nil {
+		return nil, err
+	}
+	return buffer, nil
 }
 
-// 检查完整性，即 check sum
-func CheckIntegrity(pw *pieceWork, buffer []byte) error {
-	hash := sha1.Sum(buffer)
-	if !bytes.Equal(hash[:], pw.Hash[:]) {
-		return fmt.Errorf("index %d failed integrity check", pw.Index)
+// 停止下载，如果 Store 实现了 io.Closer 也一并关闭
+func (t *Torrent) Close() error {
+	t.Stop()
+	if closer, ok := t.Store.(io.Closer); ok {
+		return closer.Close()
 	}
 	return nil
 }
 
-type pieceProgress struct {
-	Index      int
-	Buffer     []byte
-	Client     *client.Client
-	Downloaded int // 从 peer 那里下载了多少个块数据
-	Requested  int // 请求了多少个 byte 的块数据
-	Backlog    int // 请求有没有到最大限制(目前是 5 个)
+func (t *Torrent) StartDownloadWorker(peer peers.Peer) {
+	t.downloadFromPeer(peer, t.InfoHash)
 }
-func (state *pieceProgress) ChangeState() error {
-	msg, err := state.Client.Read()
+
+// 和 peer 握手时使用 infoHash，hybrid 种子在 v1 和 v2 swarm 中的 info hash 不同
+func (t *Torrent) downloadFromPeer(peer peers.Peer, infoHash [20]byte) {
+	logger := t.logger.With(logging.Peer(peer))
+	if infoHash != t.InfoHash {
+		logger = logger.With(slog.String("swarm", "v2"))
+	}
+	logger.Debug("handshaking")
+
+	// 握手时登记对方的 peer ID，断开之后释放
+	var claimedID [20]byte
+	var claimed net.Conn
+	claim := func(remotePeerID [20]byte, conn net.Conn) bool {
+		if !t.claimPeerID(remotePeerID, conn, true) {
+			return false
+		}
+		claimedID, claimed = remotePeerID, conn
+		return true
+	}
+	defer func() {
+		if claimed != nil {
+			t.releasePeerID(claimedID, claimed)
+		}
+	}()
+
+	announced := t.picker.Bitfield()
+	c, err := client.BuildClient(peer, infoHash, t.PeerID, t.Encryption, t.isV2(), claim, announced, logger)
 	if err != nil {
-		return err
+		logger.Debug("handshake failed", logging.Error(err))
+		t.publish(event.Event{Type: event.HandshakeFailed, InfoHash: infoHash, Peer: peer, Err: err})
+		return
 	}
+	defer c.Conn.Close()
 
-	// KeepAlive
-	if msg == nil {
-		return nil
+	logger.Debug("handshake completed", slog.String("client", peerId.Describe(c.RemotePeerID)))
+	status := t.peerConnected(peerKey{peer.String(), infoHash}, peer, c.RemotePeerID)
+	t.publish(event.Event{Type: event.PeerConnected, InfoHash: infoHash, Peer: peer})
+	err = t.runPeer(c, status, announced, false, logger)
+	if err != nil {
+		logger.Debug("peer disconnected", logging.Error(err))
+	} else {
+		logger.Debug("peer disconnected")
 	}
+	t.peerDisconnected(peerKey{peer.String(), infoHash})
+	t.publish(event.Event{Type: event.PeerDisconnected, InfoHash: infoHash, Peer: peer, Err: err})
+}
 
-	switch msg.ID {
-	case message.MessageUnChoke:
-		state.Client.Choked = false
-	case message.MessageChoke:
-		state.Client.Choked = true
+// 和一个已经完成握手的 peer 交换数据，连入和连出的连接都一样:
+// 向对方请求我们需要的 piece，同时回应对方的 request
+// 阻塞直到连接断开或者下载被停止，返回断开的原因，下载被停止时返回 nil，不会关闭 c.Conn
+// announced 是握手之后发给对方的 bitfield，inbound 表示连接是对方发起的，这时对方先发送扩展握手，我们再回应
+func (t *Torrent) runPeer(c *client.Client, status *PeerStatus, announced bitField.BitField, inbound bool, logger *slog.Logger) error {
+	// 下载被停止时关闭连接，让阻塞的 Read 马上返回
+	closed := make(chan struct{})
+	defer close(closed)
+	go func(conn net.Conn) {
+		select {
+		case <-t.stop:
+			conn.Close()
+		case <-closed:
+		}
+	}(c.Conn)
+
+	conn, stopKeepAlive := startKeepAlive(rateLimiter.WrapConn(c.Conn, t.DownloadLimiter, t.UploadLimiter), KeepAliveInterval)
+	defer stopKeepAlive()
+	c.Conn = conn
+
+	// 停止或者出错之前一直读对方的消息，等待时也能处理对方的 HAVE 和 REQUEST
+	messages := readMessages(c, closed)
+	idle := newIdleTimer(t.IdleTimeout)
+	p := newPipeline(t, c, status, messages, idle, announced)
+	defer p.release()
+	// 下载被停止时连接也会出错，这时不算断开的原因
+	disconnect := func(err error) error {
+		select {
+		case <-t.stop:
+			return nil
+		default:
+		}
+		if err == errStopped {
+			return nil
+		}
+		return err
+	}
+	// 我们主动连接时 BuildClient 已经发送了没有 upload_only 的扩展握手
+	extended, advertised := !inbound && c.Extensions, false
+	for {
+		// 对方的扩展握手到了之后回应，下载完成或者又要下载时 (比如改了文件优先级) 重新发送
+		uploadOnly := t.uploadOnly()
+		if c.Extensions && (!extended || uploadOnly != advertised) {
+			err := c.SendExtendedHandshake(uploadOnly)
+			if err != nil {
+				return disconnect(err)
+			}
+			extended, advertised = true, uploadOnly
+		}
+		// 双方都不会再下载，把位置让给别的 peer
+		// 连入的 peer 用的是临时端口，只记录它的 peer ID
+		if uploadOnly && c.UploadOnly {
+			logger.Debug("dropping upload-only peer")
+			remembered := c.Peer
+			if inbound {
+				remembered = peers.Peer{}
+			}
+			t.rememberUploadOnly(remembered, c.RemotePeerID)
+			return ErrUploadOnlyPeer
+		}
 
-	case message.MessageHave:
-		index, err := message.ParseHave(msg)
+		err := p.sendHaves()
 		if err != nil {
-			return err
+			return disconnect(err)
 		}
-		state.Client.Bitfield.SetPiece(index)
+		changed, err := p.fill()
+		if err != nil {
+			return disconnect(err)
+		}
+
+		// 读对方的消息，一个 piece 下载完之后校验并保存
+		// 这个 peer 暂时没有我们需要的 piece 时 (我们只上传时也是这样) 一边读消息一边等 picker 的状态改变，
+		// 对方的 HAVE 可能让它又有了我们需要的 piece，太久没有有用的数据往来时把位置让给别的 peer
+		piece, err := p.readMessage(changed)
+		if err != nil {
+			return disconnect(err)
+		}
+		if piece == nil {
+			continue
+		}
+		pw, buffer := piece.work, piece.buffer
 
-	case message.MessagePiece:
-		n, err := message.ParsePiece(state.Index, state.Buffer, msg)
+		// check sum
+		err = t.checkPiece(pw, buffer)
 		if err != nil {
+			logger.Warn("piece failed integrity check", logging.Piece(pw.Index), logging.ClassifiedError(err, logging.ClassIntegrity))
+			t.publish(event.Event{Type: event.PieceFailed, InfoHash: c.InfoHash, Peer: c.Peer, Piece: pw.Index, Err: err})
+			// 这个时候说明 piece 没下完，要继续下
+			t.picker.Release(pw.Index)
+			continue
+		}
+
+		// 保存 piece
+		begin, _ := t.CalculatePieceBounds(pw.Index)
+		_, err = t.Store.WriteAt(buffer, int64(begin))
+		if err != nil {
+			logger.Error("could not save piece", logging.Piece(pw.Index), logging.ClassifiedError(err, logging.ClassStorage))
+			t.picker.Release(pw.Index)
+			err = fmt.Errorf("could not save piece #%d: %w", pw.Index, err)
+			t.fail(err)
 			return err
 		}
-		state.Downloaded += n
-		state.Backlog--
+		atomic.AddInt64(&status.Downloaded, int64(len(buffer)))
+		t.pieceVerified(pw.Index, len(buffer), event.Event{InfoHash: c.InfoHash, Peer: c.Peer})
+
+		select {
+		case <-t.stop:
+			return nil
+		default:
+		}
+	}
+}
+
+func (t *Torrent) CalculatePieceBounds(index int) (begin int, end int) {
+	// index 指的是下的是第几块 piece
+	begin = index * t.PieceLength
+	end = begin + t.PieceLength
+	if end > t.Length {
+		end = t.Length
 	}
+	return begin, end
+}
+
+func (t *Torrent) CalculatePieceSize(index int) int {
+	begin, end := t.CalculatePieceBounds(index)
+	return end - begin
+}
 
+type pieceWork struct {
+	Index  int
+	Hash   [20]byte
+	Length int
+}
+// 检查完整性，即 check sum
+func CheckIntegrity(pw *pieceWork, buffer []byte) error {
+	hash := sha1.Sum(buffer)
+	if !bytes.Equal(hash[:], pw.Hash[:]) {
+		return fmt.Errorf("index %d failed integrity check", pw.Index)
+	}
 	return nil
 }
@@ -0,0 +1,416 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	event "github.com/strugglebak/goMule/event"
+	handshake "github.com/strugglebak/goMule/handshake"
+	merkle "github.com/strugglebak/goMule/merkle"
+	message "github.com/strugglebak/goMule/message"
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+// 构建一个随机内容的 torrent
+func newTestTorrent(t *testing.T, length, pieceLength int) (*Torrent, []byte) {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(int64(length))).Read(data)
+
+	var hashes [][20]byte
+	for begin := 0; begin < length; begin += pieceLength {
+		end := begin + pieceLength
+		if end > length {
+			end = length
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+
+	return &Torrent{
+		PeerID:      [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+		InfoHash:    sha1.Sum([]byte("test torrent")),
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      length,
+		Name:        "test",
+	}, data
+}
+
+// 启动一个拥有全部数据的 peer，它会响应所有的 request
+func startSeeder(t *testing.T, torrent *Torrent, data []byte) peers.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSeeder(conn, torrent, data)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func serveSeeder(conn net.Conn, torrent *Torrent, data []byte) {
+	defer conn.Close()
+
+	h, err := handshake.Read(conn)
+	if err != nil {
+		return
+	}
+	// hybrid 种子的 peer 可能用 v2 的 info hash 握手
+	if h.InfoHash != torrent.InfoHash && h.InfoHash != torrent.AltInfoHash {
+		return
+	}
+	var peerID [20]byte
+	copy(peerID[:], "-XX0001-seeder000000")
+	conn.Write(handshake.BuildHandshake(h.InfoHash, peerID).Serialize())
+
+	count := torrent.pieceCount()
+	bf := make([]byte, (count+7)/8)
+	for i := 0; i < count; i++ {
+		bf[i/8] |= 1 << uint(7-i%8)
+	}
+	conn.Write((&message.Message{ID: message.MessageBitfield, Payload: bf}).Serialize())
+	conn.Write((&message.Message{ID: message.MessageUnChoke}).Serialize())
+
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg != nil && msg.ID == message.MessageHashRequest {
+			request, err := message.ParseHashRequest(msg)
+			if err != nil {
+				return
+			}
+			conn.Write(seederHashes(torrent, data, request).Serialize())
+			continue
+		}
+		if msg == nil || msg.ID != message.MessageRequest {
+			continue
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+		offset := index*torrent.PieceLength + begin
+
+		payload := make([]byte, 8+length)
+		copy(payload, msg.Payload[0:8])
+		copy(payload[8:], data[offset:offset+length])
+		_, err = conn.Write((&message.Message{ID: message.MessagePiece, Payload: payload}).Serialize())
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 用完整的数据计算请求的 piece layer，只支持从 0 开始请求整层
+func seederHashes(torrent *Torrent, data []byte, request *message.HashRequest) *message.Message {
+	var layer [][32]byte
+	leaves := torrent.PieceLength / merkle.BlockSize
+	for index, root := range torrent.PieceRoots {
+		if root.FileRoot == request.PiecesRoot {
+			begin := index * torrent.PieceLength
+			layer = append(layer, merkle.PieceRoot(data[begin:begin+root.Length], leaves))
+		}
+	}
+	if len(layer) == 0 || request.Index != 0 || request.Length < len(layer) {
+		return message.FormatMessageHashReject(request)
+	}
+	for len(layer) < request.Length {
+		layer = append(layer, merkle.ZeroRoot(leaves))
+	}
+	return message.FormatMessageHashes(request, layer)
+}
+
+func TestDownload(t *testing.T) {
+	torrent, data := newTestTorrent(t, 100000, 16384)
+	torrent.Peers = []peers.Peer{startSeeder(t, torrent, data)}
+
+	buffer, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+	assert.Equal(t, int64(len(data)), torrent.Downloaded())
+	assert.Equal(t, torrent.Peers, torrent.KnownPeers())
+}
+
+func TestEvents(t *testing.T) {
+	torrent, data := newTestTorrent(t, 100000, 16384)
+	seeder := startSeeder(t, torrent, data)
+	refused := peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 1}
+	torrent.Peers = []peers.Peer{refused, seeder}
+	torrent.Store = make(memoryStore, torrent.Length)
+	torrent.Events = &event.Bus{}
+	events, cancel := torrent.Events.Channel()
+	defer cancel()
+
+	require.Nil(t, torrent.Start())
+	require.Nil(t, torrent.Wait(nil))
+	require.Nil(t, torrent.Close())
+
+	counts := map[event.Type]int{}
+	verified := map[int]bool{}
+	timeout := time.After(5 * time.Second)
+	for counts[event.Completed] == 0 || counts[event.PeerDisconnected] == 0 || counts[event.HandshakeFailed] == 0 {
+		select {
+		case e := <-events:
+			counts[e.Type]++
+			assert.Equal(t, torrent.InfoHash, e.InfoHash)
+			switch e.Type {
+			case event.HandshakeFailed:
+				assert.Equal(t, refused, e.Peer)
+				assert.NotNil(t, e.Err)
+			case event.PeerConnected, event.PeerDisconnected:
+				assert.Equal(t, seeder, e.Peer)
+			case event.PieceVerified:
+				verified[e.Piece] = true
+				assert.Equal(t, len(verified), e.Done)
+				assert.Equal(t, 7, e.Wanted)
+			case event.Completed:
+				assert.Equal(t, 7, e.Done)
+			}
+		case <-timeout:
+			t.Fatalf("missing events, got %v", counts)
+		}
+	}
+	assert.Equal(t, 1, counts[event.PeerConnected])
+	assert.Equal(t, 7, counts[event.PieceVerified])
+	assert.Zero(t, counts[event.PieceFailed])
+	assert.Zero(t, counts[event.Stalled])
+}
+
+func TestStalledEvent(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 100000, 16384)
+	silent, _ := startSilentPeer(t)
+	torrent.Peers = []peers.Peer{silent}
+	torrent.Store = make(memoryStore, torrent.Length)
+	torrent.StallTimeout = 50 * time.Millisecond
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+	events, cancel := torrent.Events.Channel()
+	defer cancel()
+
+	select {
+	case e := <-events:
+		assert.Equal(t, event.Stalled, e.Type)
+		assert.Equal(t, 0, e.Done)
+		assert.Equal(t, 7, e.Wanted)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stalled event")
+	}
+	// 没有新的进度时只发一次
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected %s event", e.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// 可以在多个 goroutine 中同时写入和读取的 buffer
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]byte{}, b.buffer.Bytes()...)
+}
+
+func TestLogger(t *testing.T) {
+	torrent, data := newTestTorrent(t, 100000, 16384)
+	seeder := startSeeder(t, torrent, data)
+	torrent.Peers = []peers.Peer{seeder}
+	torrent.Store = make(memoryStore, torrent.Length)
+	var buffer lockedBuffer
+	torrent.Logger = slog.New(slog.NewJSONHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	require.Nil(t, torrent.Start())
+	require.Nil(t, torrent.Wait(nil))
+	require.Nil(t, torrent.Close())
+
+	// 每一行都带着种子的字段，和 peer 有关的日志还带着 peer
+	messages := map[string]map[string]interface{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for messages["peer disconnected"] == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		for _, line := range bytes.Split(bytes.TrimSpace(buffer.Bytes()), []byte("\n")) {
+			record := map[string]interface{}{}
+			require.Nil(t, json.Unmarshal(line, &record))
+			assert.Equal(t, hex.EncodeToString(torrent.InfoHash[:]), record["infohash"])
+			messages[record["msg"].(string)] = record
+		}
+	}
+	assert.Equal(t, seeder.String(), messages["handshake completed"]["peer"])
+	assert.Equal(t, "DEBUG", messages["handshaking"]["level"])
+	assert.Equal(t, "INFO", messages["download completed"]["level"])
+	assert.NotNil(t, messages["peer disconnected"])
+}
+
+func TestDownloadWithoutPeers(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 1000, 16384)
+	torrent.Peers = []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 1}}
+
+	_, err := torrent.Download()
+	assert.NotNil(t, err)
+}
+
+// 启动一个只接受连接、从不回应的 peer，返回它收到的连接数
+func startSilentPeer(t *testing.T) (peers.Peer, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}, &accepted
+}
+
+func TestAddLocalPeer(t *testing.T) {
+	torrent, data := newTestTorrent(t, 100000, 16384)
+	silent, accepted := startSilentPeer(t)
+	torrent.Peers = []peers.Peer{silent}
+	torrent.MaxPeers = 1
+	buffer := make(memoryStore, torrent.Length)
+	torrent.Store = buffer
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+
+	// 已经加入过的 peer 不会重复连接
+	torrent.AddPeer(silent)
+	// 局域网的 peer 不用等 silent 握手超时空出位置
+	start := time.Now()
+	torrent.AddLocalPeer(startSeeder(t, torrent, data))
+	require.Nil(t, torrent.Wait(nil))
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, data, []byte(buffer))
+	assert.Equal(t, int32(1), atomic.LoadInt32(accepted))
+}
+
+func TestDownloadWithCompletedPieces(t *testing.T) {
+	torrent, data := newTestTorrent(t, 4*16384, 16384)
+	// 这个 peer 的第一个 piece 是坏的，已经有了的 piece 不应该再向它请求
+	corrupted := append([]byte{}, data...)
+	corrupted[0] ^= 1
+	torrent.Peers = []peers.Peer{startSeeder(t, torrent, corrupted)}
+	torrent.Completed = bitField.BitField{0x80}
+	buffer := make(memoryStore, torrent.Length)
+	copy(buffer, data[:16384])
+	torrent.Store = buffer
+	assert.Equal(t, bitField.BitField{0x80}, torrent.Bitfield())
+
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+	require.Nil(t, torrent.Wait(nil))
+	assert.Equal(t, data, []byte(buffer))
+	assert.Equal(t, bitField.BitField{0xf0}, torrent.Bitfield())
+}
+
+func TestReader(t *testing.T) {
+	torrent, data := newTestTorrent(t, 200000, 16384)
+	torrent.Peers = []peers.Peer{startSeeder(t, torrent, data)}
+	torrent.Sequential = true
+	torrent.Store = make(memoryStore, torrent.Length)
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+
+	reader := torrent.NewReader()
+	defer reader.Close()
+
+	// 从中间某个 piece 的中间开始读
+	position, err := reader.Seek(50000, io.SeekStart)
+	require.Nil(t, err)
+	assert.Equal(t, int64(50000), position)
+	buffer := make([]byte, 1000)
+	_, err = io.ReadFull(reader, buffer)
+	require.Nil(t, err)
+	assert.Equal(t, data[50000:51000], buffer)
+
+	_, err = reader.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+	all, err := io.ReadAll(reader)
+	require.Nil(t, err)
+	assert.Equal(t, data, all)
+
+	position, err = reader.Seek(-10, io.SeekEnd)
+	require.Nil(t, err)
+	assert.Equal(t, int64(len(data)-10), position)
+}
+
+func TestDownloadSelectedFiles(t *testing.T) {
+	// 三个文件，piece 1 跨了文件 0 和 1，piece 3 跨了文件 1 和 2
+	torrent, data := newTestTorrent(t, 4*16384, 16384)
+	torrent.Peers = []peers.Peer{startSeeder(t, torrent, data)}
+	torrent.Files = []File{
+		{Length: 20000, Priority: PrioritySkip, Offset: 0},
+		{Length: 30000, Priority: PriorityNormal, Offset: 20000},
+		{Length: 4*16384 - 50000, Priority: PrioritySkip, Offset: 50000},
+	}
+	store := make(memoryStore, torrent.Length)
+	torrent.Store = store
+
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+	require.Nil(t, torrent.Wait(nil))
+
+	done, wanted := torrent.Progress()
+	assert.Equal(t, 3, done)
+	assert.Equal(t, 3, wanted)
+	assert.Equal(t, data[20000:50000], []byte(store[20000:50000]))
+	// piece 0 只属于被跳过的文件 0
+	assert.Equal(t, make([]byte, 16384), []byte(store[:16384]))
+}
+
+func TestSetFilePriority(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 4*16384, 16384)
+	torrent.Files = []File{
+		{Length: 16384, Priority: PriorityNormal, Offset: 0},
+		{Length: 3 * 16384, Priority: PriorityNormal, Offset: 16384},
+	}
+	assert.Equal(t, []int{1, 1, 1, 1}, torrent.piecePriorities())
+
+	require.Nil(t, torrent.SetFilePriority(1, PriorityHigh))
+	assert.Equal(t, []int{1, 2, 2, 2}, torrent.piecePriorities())
+	require.Nil(t, torrent.SetFilePriority(0, PrioritySkip))
+	assert.Equal(t, []int{0, 2, 2, 2}, torrent.piecePriorities())
+
+	assert.NotNil(t, torrent.SetFilePriority(2, PriorityHigh))
+	assert.NotNil(t, torrent.SetFilePriority(0, 7))
+}
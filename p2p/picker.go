@@ -0,0 +1,224 @@
+package p2p
+
+import (
+	"math/rand"
+	"sync"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+)
+
+// piece 的优先级，数值越大越先下载
+const (
+	PrioritySkip   = 0 // 不下载
+	PriorityNormal = 1
+	PriorityHigh   = 2
+	// 正在被 Reader 读取的 piece，比任何普通优先级都高
+	priorityUrgent = 3
+)
+
+type pieceState int
+
+const (
+	pieceMissing pieceState = iota
+	pieceRequested
+	pieceDone
+)
+
+// 读取窗口，[Begin, End) 之间的 piece 会被提升为 priorityUrgent
+type readWindow struct {
+	Begin int
+	End   int
+}
+
+// picker 决定每个 worker 下一个要下载哪个 piece
+// 它取代了原来的 workQueue channel，这样 piece 的顺序和优先级可以在下载过程中改变
+type picker struct {
+	mutex      sync.Mutex
+	hashes     [][20]byte
+	lengths    []int
+	states     []pieceState
+	priorities []int
+	windows    map[interface{}]readWindow
+	sequential bool
+	done       int // 已经完成的 piece 数量
+	// 每次状态改变时关闭并替换，等待者通过它得知需要重新检查
+	changed chan struct{}
+}
+
+func newPicker(t *Torrent) *picker {
+	count := t.pieceCount()
+	p := &picker{
+		hashes:     t.PieceHashes,
+		lengths:    make([]int, count),
+		states:     make([]pieceState, count),
+		priorities: make([]int, count),
+		windows:    make(map[interface{}]readWindow),
+		sequential: t.Sequential,
+		changed:    make(chan struct{}),
+	}
+	for index := 0; index < count; index++ {
+		p.lengths[index] = t.pieceDataLength(index)
+		p.priorities[index] = PriorityNormal
+		if t.Completed.HasPiece(index) {
+			p.states[index] = pieceDone
+			p.done++
+		}
+	}
+	return p
+}
+
+// 调用时必须持有锁
+func (p *picker) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// 调用时必须持有锁
+func (p *picker) effectivePriority(index int) int {
+	for _, window := range p.windows {
+		if index >= window.Begin && index < window.End {
+			return priorityUrgent
+		}
+	}
+	return p.priorities[index]
+}
+
+// 挑一个 peer 拥有的、还没开始下载的、优先级最高的 piece
+// 没有可下载的 piece 时返回 nil，以及一个在状态改变时会被关闭的 channel
+func (p *picker) Next(bf bitField.BitField) (*pieceWork, <-chan struct{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	best := -1
+	bestPriority := PrioritySkip
+	ties := 0
+	for index, state := range p.states {
+		if state != pieceMissing || !bf.HasPiece(index) {
+			continue
+		}
+		priority := p.effectivePriority(index)
+		if priority == PrioritySkip || priority < bestPriority {
+			continue
+		}
+		if priority > bestPriority {
+			best, bestPriority, ties = index, priority, 1
+			continue
+		}
+		// 优先级相同: 顺序模式和 Reader 需要的 piece 按下标顺序，否则随机挑一个，
+		// 避免所有 peer 都挤在同一段 piece 上
+		if p.sequential || priority == priorityUrgent {
+			continue
+		}
+		ties++
+		if rand.Intn(ties) == 0 {
+			best = index
+		}
+	}
+
+	if best == -1 {
+		return nil, p.changed
+	}
+	p.states[best] = pieceRequested
+	// v2 种子没有 SHA-1 hash，用 PieceRoots 校验
+	var hash [20]byte
+	if best < len(p.hashes) {
+		hash = p.hashes[best]
+	}
+	return &pieceWork{best, hash, p.lengths[best]}, nil
+}
+
+// 下载失败，把 piece 放回去让其他 worker 下载
+func (p *picker) Release(index int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.states[index] == pieceRequested {
+		p.states[index] = pieceMissing
+		p.notify()
+	}
+}
+
+// piece 已经校验并保存好了
+func (p *picker) Complete(index int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.states[index] != pieceDone {
+		p.done++
+	}
+	p.states[index] = pieceDone
+	p.notify()
+}
+
+// 已经完成的 piece 数量，不用像 Progress 那样遍历所有 piece
+func (p *picker) Done() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.done
+}
+
+func (p *picker) IsDone(index int) (bool, <-chan struct{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.states[index] == pieceDone, p.changed
+}
+
+// 已经完成的 piece
+func (p *picker) Bitfield() bitField.BitField {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	bf := make(bitField.BitField, (len(p.states)+7)/8)
+	for index, state := range p.states {
+		if state == pieceDone {
+			bf.SetPiece(index)
+		}
+	}
+	return bf
+}
+
+// 返回已经完成的 piece 数量、需要下载的 piece 数量，以及状态改变时会被关闭的 channel
+func (p *picker) Progress() (done int, wanted int, changed <-chan struct{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for index, state := range p.states {
+		if state == pieceDone {
+			done++
+			wanted++
+		} else if p.effectivePriority(index) != PrioritySkip {
+			wanted++
+		}
+	}
+	return done, wanted, p.changed
+}
+
+// 替换所有 piece 的优先级
+func (p *picker) SetPriorities(priorities []int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	copy(p.priorities, priorities)
+	p.notify()
+}
+
+// 让所有等待者重新检查一次状态
+func (p *picker) Wake() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.notify()
+}
+
+func (p *picker) SetSequential(sequential bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.sequential = sequential
+	p.notify()
+}
+
+// 设置 owner 的读取窗口，End <= Begin 时移除
+func (p *picker) SetWindow(owner interface{}, window readWindow) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if window.End <= window.Begin {
+		delete(p.windows, owner)
+	} else {
+		p.windows[owner] = window
+	}
+	p.notify()
+}
@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+)
+
+func newTestPicker(count int, sequential bool) *picker {
+	torrent := &Torrent{
+		PieceHashes: make([][20]byte, count),
+		PieceLength: 10,
+		Length:      count*10 - 5,
+		Sequential:  sequential,
+	}
+	return newPicker(torrent)
+}
+
+func TestPickerSequential(t *testing.T) {
+	p := newTestPicker(10, true)
+	all := bitField.BitField{0xff, 0xff}
+
+	for index := 0; index < 10; index++ {
+		pw, _ := p.Next(all)
+		require.NotNil(t, pw)
+		assert.Equal(t, index, pw.Index)
+	}
+	assert.Equal(t, 5, p.lengths[9])
+
+	// 全部都在下载中，需要等待
+	pw, changed := p.Next(all)
+	assert.Nil(t, pw)
+	assert.NotNil(t, changed)
+
+	// 放回去之后可以重新拿到，并且会通知等待者
+	p.Release(3)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("release should notify waiters")
+	}
+	pw, _ = p.Next(all)
+	require.NotNil(t, pw)
+	assert.Equal(t, 3, pw.Index)
+}
+
+func TestPickerOnlyPiecesPeerHas(t *testing.T) {
+	p := newTestPicker(16, false)
+	bf := bitField.BitField{0x00, 0x01} // 只有 piece 15
+
+	pw, _ := p.Next(bf)
+	require.NotNil(t, pw)
+	assert.Equal(t, 15, pw.Index)
+
+	pw, _ = p.Next(bf)
+	assert.Nil(t, pw)
+}
+
+func TestPickerWindow(t *testing.T) {
+	p := newTestPicker(10, false)
+	all := bitField.BitField{0xff, 0xff}
+
+	owner := new(int)
+	p.SetWindow(owner, readWindow{Begin: 6, End: 8})
+	pw, _ := p.Next(all)
+	assert.Equal(t, 6, pw.Index)
+	pw, _ = p.Next(all)
+	assert.Equal(t, 7, pw.Index)
+
+	p.SetWindow(owner, readWindow{})
+	assert.Empty(t, p.windows)
+}
+
+func TestPickerProgress(t *testing.T) {
+	p := newTestPicker(4, true)
+	all := bitField.BitField{0xff}
+
+	done, wanted, _ := p.Progress()
+	assert.Equal(t, 0, done)
+	assert.Equal(t, 4, wanted)
+
+	pw, _ := p.Next(all)
+	p.Complete(pw.Index)
+	ok, _ := p.IsDone(pw.Index)
+	assert.True(t, ok)
+
+	done, wanted, _ = p.Progress()
+	assert.Equal(t, 1, done)
+	assert.Equal(t, 4, wanted)
+}
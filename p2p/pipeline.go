@@ -0,0 +1,495 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	client "github.com/strugglebak/goMule/client"
+	message "github.com/strugglebak/goMule/message"
+)
+
+// 向一个 peer 发出的请求不止属于一个 piece: 一个 piece 的块都请求完了就开始请求下一个 piece，
+// 这样 peer 在两个 piece 之间不会空闲
+// 同时在途的请求数量随着这个 peer 的速度 × 往返时间增长，最多是对方在扩展握手中声明的 reqq
+
+const (
+	// 开始时和最少同时在途的请求数量
+	MinRequestBacklog = 5
+	// 对方没有声明 reqq 时最多同时在途的请求数量
+	DefaultRequestQueue = 250
+	// 有在途的请求时，超过这么久收不到对方的任何消息就断开连接
+	RequestTimeout = 30 * time.Second
+)
+
+// 在途请求数量是带宽时延积的这么多倍，否则队列本身就会限制速度，永远长不上去
+const backlogHeadroom = 2
+
+// 等待对方的消息时下载被停止了
+var errStopped = errors.New("download stopped")
+
+// 计算速度的最短间隔
+const rateInterval = 500 * time.Millisecond
+
+// 估计往返时间时使用最近这么多个请求中最短的那个，排队的时间不算在往返时间里
+const rttSamples = 32
+
+// 根据 peer 的速度和往返时间计算应该有多少个在途的请求
+type requestQueue struct {
+	rate        float64 // byte/s，指数平均
+	windowStart time.Time
+	windowBytes int
+	rtts        [rttSamples]time.Duration
+	rttCount    int
+}
+
+// 收到了一个块，latency 是它从请求到收到的时间
+func (q *requestQueue) received(n int, latency time.Duration, now time.Time) {
+	if latency > 0 {
+		q.rtts[q.rttCount%rttSamples] = latency
+		q.rttCount++
+	}
+
+	if q.windowStart.IsZero() {
+		q.windowStart = now
+	}
+	q.windowBytes += n
+	elapsed := now.Sub(q.windowStart)
+	if elapsed < rateInterval {
+		return
+	}
+	sample := float64(q.windowBytes) / elapsed.Seconds()
+	if q.rate == 0 {
+		q.rate = sample
+	} else {
+		q.rate = 0.7*q.rate + 0.3*sample
+	}
+	q.windowStart, q.windowBytes = now, 0
+}
+
+func (q *requestQueue) rtt() time.Duration {
+	count := q.rttCount
+	if count > rttSamples {
+		count = rttSamples
+	}
+	var min time.Duration
+	for _, rtt := range q.rtts[:count] {
+		if min == 0 || rtt < min {
+			min = rtt
+		}
+	}
+	return min
+}
+
+// 应该同时在途的请求数量，limit 是对方能接受的上限
+func (q *requestQueue) depth(limit int) int {
+	depth := int(math.Ceil(backlogHeadroom * q.rate * q.rtt().Seconds() / MaxRequestBlockSize))
+	if depth < MinRequestBacklog {
+		depth = MinRequestBacklog
+	}
+	if depth > limit {
+		depth = limit
+	}
+	return depth
+}
+
+// 一个正在下载的 piece
+type inflightPiece struct {
+	work       *pieceWork
+	buffer     []byte
+	next       int               // 下一个还没有请求过的块的偏移
+	pending    map[int]time.Time // 已经请求、还没有收到的块，值是请求的时间
+	retry      []int             // 被 choke 之后需要重新请求的块
+	downloaded int
+}
+
+// 还有没有需要请求的块
+func (piece *inflightPiece) hasRequests() bool {
+	return len(piece.retry) > 0 || piece.next < piece.work.Length
+}
+
+func blockLength(pieceLength, begin int) int {
+	if pieceLength-begin < MaxRequestBlockSize {
+		return pieceLength - begin
+	}
+	return MaxRequestBlockSize
+}
+
+// 读到的一个消息，或者读消息时出的错
+type incoming struct {
+	msg *message.Message
+	err error
+}
+
+// 在后台一直读对方的消息，这样等待 picker 的状态改变时也能及时处理对方的 HAVE
+// 读出错之后停止，done 被关闭时也停止，调用者要关闭连接让阻塞的 Read 返回
+func readMessages(c *client.Client, done <-chan struct{}) <-chan incoming {
+	messages := make(chan incoming)
+	go func() {
+		for {
+			msg, err := c.Read()
+			select {
+			case messages <- incoming{msg, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return messages
+}
+
+// 一个 peer 上所有在途的请求
+type pipeline struct {
+	t        *Torrent
+	c        *client.Client
+	status   *PeerStatus
+	messages <-chan incoming  // 见 readMessages，除此之外不能再读 c.Conn
+	pieces   []*inflightPiece // 按开始请求的顺序
+	waiting  *pieceWork       // 需要先请求 piece layer 的 piece，要等前面的 piece 都下载完
+	backlog  int
+	queue    requestQueue
+	idle     *idleTimer
+	// 我们这一端的状态
+	choking    bool              // 是否 choke 着对方，对方 interested 之后 unchoke
+	interested bool              // 是否已经告诉对方我们感兴趣
+	announced  bitField.BitField // 对方已经知道我们有的 piece
+	// 上次 sendHaves 时已经完成的 piece 数量，没有变化时不用比较 bitfield
+	announcedCount int
+}
+
+// announced 是握手之后发给对方的 bitfield
+func newPipeline(t *Torrent, c *client.Client, status *PeerStatus, messages <-chan incoming, idle *idleTimer, announced bitField.BitField) *pipeline {
+	return &pipeline{
+		t:              t,
+		c:              c,
+		status:         status,
+		messages:       messages,
+		idle:           idle,
+		choking:        true,
+		announced:      announced,
+		announcedCount: -1,
+	}
+}
+
+// 告诉对方我们新完成的 piece，包括从别的 peer 那里下载的，这样对方才会向我们请求
+func (p *pipeline) sendHaves() error {
+	done := p.t.picker.Done()
+	if done == p.announcedCount {
+		return nil
+	}
+	current := p.t.picker.Bitfield()
+	for index := 0; index < p.t.pieceCount(); index++ {
+		if current.HasPiece(index) && !p.announced.HasPiece(index) {
+			err := p.c.SendHave(index)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	p.announced, p.announcedCount = current, done
+	return nil
+}
+
+// 对方能接受的在途请求数量上限
+func (p *pipeline) limit() int {
+	if p.c.RequestQueue > 0 {
+		return p.c.RequestQueue
+	}
+	return DefaultRequestQueue
+}
+
+// 发出请求，直到在途的请求数量达到 requestQueue 算出的深度
+// 没有正在下载的 piece、picker 里也没有这个 peer 能提供的 piece 时，返回 picker 状态改变时关闭的 channel
+func (p *pipeline) fill() (<-chan struct{}, error) {
+	if len(p.pieces) == 0 {
+		if p.waiting != nil {
+			pw := p.waiting
+			p.waiting = nil
+			err := p.requestPieceLayer(pw)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			pw, changed := p.t.picker.Next(p.c.Bitfield)
+			if pw == nil {
+				return changed, nil
+			}
+			err := p.add(pw)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// 对方有我们需要的 piece 时才告诉它我们感兴趣
+	if !p.interested {
+		err := p.c.SendInterested()
+		if err != nil {
+			return nil, err
+		}
+		p.interested = true
+	}
+	// 被 choke 时也先拿着一个 piece，一边读消息一边等 unchoke
+	if p.c.Choked {
+		return nil, nil
+	}
+
+	depth := p.queue.depth(p.limit())
+	for p.backlog < depth {
+		piece := p.nextPiece()
+		if piece == nil {
+			break
+		}
+		begin := piece.next
+		if len(piece.retry) > 0 {
+			begin, piece.retry = piece.retry[0], piece.retry[1:]
+		} else {
+			piece.next += blockLength(piece.work.Length, begin)
+		}
+		err := p.c.SendRequest(piece.work.Index, begin, blockLength(piece.work.Length, begin))
+		if err != nil {
+			return nil, err
+		}
+		piece.pending[begin] = time.Now()
+		p.backlog++
+	}
+	p.updateStatus()
+	return nil, nil
+}
+
+// 找一个还有块需要请求的 piece，前面的 piece 都请求完了就从 picker 里拿一个新的
+func (p *pipeline) nextPiece() *inflightPiece {
+	for _, piece := range p.pieces {
+		if piece.hasRequests() {
+			return piece
+		}
+	}
+	if p.waiting != nil {
+		return nil
+	}
+	pw, _ := p.t.picker.Next(p.c.Bitfield)
+	if pw == nil {
+		return nil
+	}
+	// 需要 piece layer 的 piece 要等前面的下载完，因为请求 hash 时要独占这个连接
+	if p.t.needsPieceLayer(pw.Index) {
+		p.waiting = pw
+		return nil
+	}
+	p.start(pw)
+	return p.pieces[len(p.pieces)-1]
+}
+
+func (p *pipeline) add(pw *pieceWork) error {
+	if p.t.needsPieceLayer(pw.Index) {
+		return p.requestPieceLayer(pw)
+	}
+	p.start(pw)
+	return nil
+}
+
+// v2 种子里没有这个 piece 的 hash，先向 peer 请求，调用时没有在途的请求
+func (p *pipeline) requestPieceLayer(pw *pieceWork) error {
+	err := p.fetchPieceLayer(pw.Index)
+	p.status.setChoked(p.c.Choked)
+	if err != nil {
+		p.t.picker.Release(pw.Index)
+		return err
+	}
+	p.start(pw)
+	return nil
+}
+
+func (p *pipeline) start(pw *pieceWork) {
+	p.pieces = append(p.pieces, &inflightPiece{
+		work:    pw,
+		buffer:  make([]byte, pw.Length),
+		pending: make(map[int]time.Time),
+	})
+}
+
+// 处理对方发来的块，一个 piece 的数据都收到了时返回这个 piece，它已经不在 pipeline 中了
+func (p *pipeline) receive(msg *message.Message) (*inflightPiece, error) {
+	index, begin, block, err := message.ParseBlock(msg)
+	if err != nil {
+		return nil, err
+	}
+	position := -1
+	for i, piece := range p.pieces {
+		if piece.work.Index == index {
+			position = i
+			break
+		}
+	}
+	// 已经放弃了的 piece
+	if position < 0 {
+		return nil, nil
+	}
+	piece := p.pieces[position]
+
+	now := time.Now()
+	var latency time.Duration
+	if sentAt, ok := piece.pending[begin]; ok {
+		latency = now.Sub(sentAt)
+		delete(piece.pending, begin)
+		p.backlog--
+	} else if i := sort.SearchInts(piece.retry, begin); i < len(piece.retry) && piece.retry[i] == begin {
+		// choke 之前发出的请求，对方还是发过来了
+		piece.retry = append(piece.retry[:i], piece.retry[i+1:]...)
+	} else {
+		// 没有请求过或者已经收到过的块
+		return nil, nil
+	}
+	if len(block) != blockLength(piece.work.Length, begin) {
+		return nil, fmt.Errorf("received block of %d bytes at offset %d of piece #%d", len(block), begin, index)
+	}
+
+	copy(piece.buffer[begin:], block)
+	piece.downloaded += len(block)
+	p.idle.useful()
+	p.queue.received(len(block), latency, now)
+	p.updateStatus()
+
+	if piece.downloaded < piece.work.Length {
+		return nil, nil
+	}
+	p.pieces = append(p.pieces[:position], p.pieces[position+1:]...)
+	return piece, nil
+}
+
+// 被 choke 之后对方会丢掉还没有回应的请求，unchoke 之后重新请求
+func (p *pipeline) choked() {
+	for _, piece := range p.pieces {
+		for begin := range piece.pending {
+			piece.retry = append(piece.retry, begin)
+		}
+		sort.Ints(piece.retry)
+		piece.pending = make(map[int]time.Time)
+	}
+	p.backlog = 0
+	p.updateStatus()
+}
+
+// 断开连接时把没有下载完的 piece 还给 picker
+func (p *pipeline) release() {
+	for _, piece := range p.pieces {
+		p.t.picker.Release(piece.work.Index)
+	}
+	if p.waiting != nil {
+		p.t.picker.Release(p.waiting.Index)
+	}
+	p.pieces, p.waiting, p.backlog = nil, nil, 0
+	p.status.setBacklog(0)
+}
+
+func (p *pipeline) updateStatus() {
+	p.status.setChoked(p.c.Choked)
+	p.status.setInterested(p.c.Interested)
+	p.status.setBacklog(p.backlog)
+}
+
+// 等对方的下一个消息，最多等到 deadline
+// changed 被关闭时返回 nil, nil，和 keep-alive 一样调用者什么都不用做；下载被停止时返回 errStopped
+func (p *pipeline) next(deadline time.Time, changed <-chan struct{}) (*message.Message, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case in := <-p.messages:
+		return in.msg, in.err
+	case <-changed:
+		return nil, nil
+	case <-timer.C:
+		return nil, p.idle.timedOut()
+	case <-p.t.stop:
+		return nil, errStopped
+	}
+}
+
+// 读一个消息并处理，一个 piece 下载完时返回这个 piece
+// changed 不为 nil 时 (这个 peer 暂时没有我们需要的 piece) 它被关闭时也会返回，调用者重新 fill
+// 等待对方回应请求时最多等 RequestTimeout，否则对方至少应该定时发送 keep-alive
+func (p *pipeline) readMessage(changed <-chan struct{}) (*inflightPiece, error) {
+	timeout := MessageTimeout
+	if p.backlog > 0 {
+		timeout = RequestTimeout
+	}
+	deadline, err := p.idle.readDeadline(timeout)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := p.next(deadline, changed)
+	// KeepAlive
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	return p.handle(msg)
+}
+
+// 处理对方的一个消息，一个 piece 下载完时返回这个 piece
+func (p *pipeline) handle(msg *message.Message) (*inflightPiece, error) {
+	switch msg.ID {
+	case message.MessageUnChoke:
+		p.c.Choked = false
+	case message.MessageChoke:
+		p.c.Choked = true
+		p.choked()
+	case message.MessageInterested:
+		p.c.Interested = true
+		if p.choking {
+			p.choking = false
+			err := p.c.SendUnchoke()
+			if err != nil {
+				return nil, err
+			}
+		}
+	case message.MessageNotInterested:
+		p.c.Interested = false
+	case message.MessageHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return nil, err
+		}
+		p.c.Bitfield.SetPiece(index)
+	case message.MessageBitfield:
+		// 对方主动连接我们时 bitfield 是在这里收到的，没有任何 piece 的 peer 也可以不发送
+		bitfield := make(bitField.BitField, (p.t.pieceCount()+7)/8)
+		copy(bitfield, msg.Payload)
+		p.c.Bitfield = bitfield
+	case message.MessageExtended:
+		err := p.c.HandleExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+		// 对方发来了扩展握手，说明它支持扩展协议
+		p.c.Extensions = true
+	case message.MessageHashRequest:
+		// v2 种子里没有 piece layer 的 peer 要先向我们请求
+		request, err := message.ParseHashRequest(msg)
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.c.Conn.Write(p.t.answerHashRequest(request).Serialize())
+		if err != nil {
+			return nil, err
+		}
+	case message.MessageRequest:
+		// choke 对方时收到的 request 直接忽略
+		if p.choking {
+			return nil, nil
+		}
+		err := p.t.uploadBlock(p.c.Conn, msg, p.status)
+		if err != nil {
+			return nil, err
+		}
+		p.idle.useful()
+	case message.MessagePiece:
+		return p.receive(msg)
+	}
+	p.updateStatus()
+	return nil, nil
+}
@@ -0,0 +1,197 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	extension "github.com/strugglebak/goMule/extension"
+	handshake "github.com/strugglebak/goMule/handshake"
+	message "github.com/strugglebak/goMule/message"
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+func TestRequestQueueDepth(t *testing.T) {
+	var q requestQueue
+	assert.Equal(t, MinRequestBacklog, q.depth(DefaultRequestQueue))
+	assert.Equal(t, 2, q.depth(2))
+
+	// 10 MB/s，往返 100ms，带宽时延积是 1 MB，在途请求是它的两倍
+	now := time.Now()
+	q.received(MaxRequestBlockSize, 100*time.Millisecond, now)
+	q.received(5*1000*1000-MaxRequestBlockSize, 300*time.Millisecond, now.Add(500*time.Millisecond))
+	assert.Equal(t, 100*time.Millisecond, q.rtt())
+	assert.Equal(t, 123, q.depth(DefaultRequestQueue))
+	assert.Equal(t, 100, q.depth(100))
+}
+
+// 一个只在收到一批请求之后才回应的 peer，用来检查请求是不是跨 piece 发出的
+// reqq 大于 0 时在扩展握手中声明，choke 为 true 时收到第一批请求之后先 choke 再 unchoke
+// late 为 true 时先发送空的 bitfield，过一会儿再用 HAVE 声明所有的 piece
+type batchPeer struct {
+	reqq     int
+	choke    bool
+	late     bool
+	batches  chan []int // 每一批请求的 piece index
+	maxQueue chan int   // 断开时最多同时在途的请求数量
+}
+
+func startBatchPeer(t *testing.T, torrent *Torrent, data []byte, bp *batchPeer) peers.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		bp.serve(conn, torrent, data)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (bp *batchPeer) serve(conn net.Conn, torrent *Torrent, data []byte) {
+	defer conn.Close()
+	h, err := handshake.Read(conn)
+	if err != nil {
+		return
+	}
+	response := handshake.BuildHandshake(h.InfoHash, [20]byte{9})
+	response.SetExtensions()
+	conn.Write(response.Serialize())
+
+	count := torrent.pieceCount()
+	bf := make([]byte, (count+7)/8)
+	if !bp.late {
+		for i := 0; i < count; i++ {
+			bf[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+	conn.Write((&message.Message{ID: message.MessageBitfield, Payload: bf}).Serialize())
+	if bp.late {
+		time.Sleep(200 * time.Millisecond)
+		for i := 0; i < count; i++ {
+			conn.Write(message.FormatMessageHave(i).Serialize())
+		}
+	}
+	if bp.reqq > 0 {
+		msg, _ := extension.FormatHandshake(&extension.Handshake{Reqq: bp.reqq})
+		conn.Write(msg.Serialize())
+	}
+	conn.Write((&message.Message{ID: message.MessageUnChoke}).Serialize())
+
+	type request struct{ index, begin, length int }
+	maxQueue := 0
+	defer func() { bp.maxQueue <- maxQueue }()
+	for {
+		// 一直读到对方停下来，这一批就是对方愿意同时发出的全部请求
+		var batch []request
+		for {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			msg, err := message.Read(conn)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return
+			}
+			if msg != nil && msg.ID == message.MessageRequest {
+				index, begin, length, _ := message.ParseRequest(msg)
+				batch = append(batch, request{index, begin, length})
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if len(batch) > maxQueue {
+			maxQueue = len(batch)
+		}
+		var indexes []int
+		for _, r := range batch {
+			indexes = append(indexes, r.index)
+		}
+		bp.batches <- indexes
+
+		// 被 choke 的请求会被丢掉，对方应该在 unchoke 之后重新请求
+		if bp.choke {
+			bp.choke = false
+			conn.Write((&message.Message{ID: message.MessageChoke}).Serialize())
+			conn.Write((&message.Message{ID: message.MessageUnChoke}).Serialize())
+			continue
+		}
+		for _, r := range batch {
+			offset := r.index*torrent.PieceLength + r.begin
+			conn.Write(message.FormatMessagePiece(r.index, r.begin, data[offset:offset+r.length]).Serialize())
+		}
+	}
+}
+
+func TestPipelineAcrossPieces(t *testing.T) {
+	// 每个 piece 只有一个块，一次只请求一个 piece 时每批只有一个请求
+	torrent, data := newTestTorrent(t, 20*MaxRequestBlockSize, MaxRequestBlockSize)
+	bp := &batchPeer{choke: true, batches: make(chan []int, 100), maxQueue: make(chan int, 1)}
+	torrent.Peers = []peers.Peer{startBatchPeer(t, torrent, data, bp)}
+
+	buffer, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+
+	first := <-bp.batches
+	assert.Len(t, first, MinRequestBacklog)
+	pieces := make(map[int]bool)
+	for _, index := range first {
+		pieces[index] = true
+	}
+	assert.Len(t, pieces, MinRequestBacklog)
+	// choke 之后重新请求同样的块
+	assert.ElementsMatch(t, first, <-bp.batches)
+}
+
+func TestPipelineRespectsReqq(t *testing.T) {
+	torrent, data := newTestTorrent(t, 10*MaxRequestBlockSize, 2*MaxRequestBlockSize)
+	bp := &batchPeer{reqq: 2, batches: make(chan []int, 100), maxQueue: make(chan int, 1)}
+	torrent.Peers = []peers.Peer{startBatchPeer(t, torrent, data, bp)}
+
+	buffer, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+	torrent.Close()
+
+	select {
+	case maxQueue := <-bp.maxQueue:
+		assert.Equal(t, 2, maxQueue)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer was not disconnected")
+	}
+}
+
+func TestPipelineHaveWhileWaiting(t *testing.T) {
+	// 对方一开始没有任何 piece，等待的时候也要处理它后来发送的 HAVE
+	torrent, data := newTestTorrent(t, 10*MaxRequestBlockSize, 2*MaxRequestBlockSize)
+	bp := &batchPeer{late: true, batches: make(chan []int, 100), maxQueue: make(chan int, 1)}
+	torrent.Peers = []peers.Peer{startBatchPeer(t, torrent, data, bp)}
+
+	type result struct {
+		buffer []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		buffer, err := torrent.Download()
+		done <- result{buffer, err}
+	}()
+	select {
+	case r := <-done:
+		require.Nil(t, r.err)
+		assert.Equal(t, data, r.buffer)
+	case <-time.After(5 * time.Second):
+		torrent.Close()
+		t.Fatal("pieces announced with HAVE were not downloaded")
+	}
+}
@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Reader 没有指定时预读的 piece 数量
+const DefaultReadahead = 4
+
+// Reader 以 io.ReadSeeker 的形式读取正在下载的 torrent
+// 读取某个位置时，它会把这个位置往后的几个 piece 提到最高优先级，
+// 然后阻塞直到这些 piece 下载并校验完成
+type Reader struct {
+	torrent   *Torrent
+	offset    int64
+	Readahead int // 预读的 piece 数量，包括当前正在读的 piece
+	closed    bool
+}
+
+// 必须在 Start 之后调用
+func (t *Torrent) NewReader() *Reader {
+	return &Reader{
+		torrent:   t,
+		Readahead: DefaultReadahead,
+	}
+}
+
+func (r *Reader) Read(buffer []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("read from closed reader")
+	}
+	t := r.torrent
+	if t.picker == nil {
+		return 0, fmt.Errorf("%s has not been started", t.Name)
+	}
+	if r.offset >= int64(t.Length) {
+		return 0, io.EOF
+	}
+	if len(buffer) == 0 {
+		return 0, nil
+	}
+
+	index := int(r.offset / int64(t.PieceLength))
+	readahead := r.Readahead
+	if readahead < 1 {
+		readahead = 1
+	}
+	t.picker.SetWindow(r, readWindow{Begin: index, End: index + readahead})
+
+	err := t.waitPiece(index)
+	if err != nil {
+		return 0, err
+	}
+
+	// 一次最多读到当前 piece 的末尾
+	_, end := t.CalculatePieceBounds(index)
+	if remaining := int64(end) - r.offset; int64(len(buffer)) > remaining {
+		buffer = buffer[:remaining]
+	}
+	n, err := t.Store.ReadAt(buffer, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n == len(buffer) {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = r.offset + offset
+	case io.SeekEnd:
+		position = int64(r.torrent.Length) + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if position < 0 {
+		return 0, fmt.Errorf("negative position %d", position)
+	}
+	r.offset = position
+	return position, nil
+}
+
+// 取消这个 Reader 对 piece 优先级的影响
+func (r *Reader) Close() error {
+	if !r.closed && r.torrent.picker != nil {
+		r.torrent.picker.SetWindow(r, readWindow{})
+	}
+	r.closed = true
+	return nil
+}
+
+// 阻塞直到 index 这个 piece 完成，下载停止时返回错误
+func (t *Torrent) waitPiece(index int) error {
+	for {
+		done, changed := t.picker.IsDone(index)
+		if done {
+			return nil
+		}
+
+		t.mutex.Lock()
+		workers := t.workers
+		t.mutex.Unlock()
+		if workers == 0 {
+			return fmt.Errorf("no peers left to download piece #%d of %s from", index, t.Name)
+		}
+
+		select {
+		case <-changed:
+		case <-t.stop:
+			// 停止前可能刚好下载完
+			if done, _ := t.picker.IsDone(index); done {
+				return nil
+			}
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if t.err != nil {
+				return t.err
+			}
+			return fmt.Errorf("download of %s was stopped before piece #%d completed", t.Name, index)
+		}
+	}
+}
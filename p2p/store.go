@@ -0,0 +1,27 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+)
+
+// memoryStore 把整个文件放在内存中，Download 使用它
+type memoryStore []byte
+
+func (store memoryStore) ReadAt(buffer []byte, offset int64) (int, error) {
+	if offset < 0 || offset > int64(len(store)) {
+		return 0, fmt.Errorf("offset %d out of bounds %d", offset, len(store))
+	}
+	n := copy(buffer, store[offset:])
+	if n < len(buffer) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (store memoryStore) WriteAt(buffer []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(buffer)) > int64(len(store)) {
+		return 0, fmt.Errorf("range [%d, %d) out of bounds %d", offset, offset+int64(len(buffer)), len(store))
+	}
+	return copy(store[offset:], buffer), nil
+}
@@ -0,0 +1,180 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	client "github.com/strugglebak/goMule/client"
+	event "github.com/strugglebak/goMule/event"
+	logging "github.com/strugglebak/goMule/logging"
+	message "github.com/strugglebak/goMule/message"
+	peerId "github.com/strugglebak/goMule/peer_id"
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+// 对方请求的一块数据最大的长度，超过时断开连接
+// 规范建议的是 16 KiB，有些客户端会请求更大的块
+const MaxUploadBlockSize = 1 << 17
+
+// 我们和对方都声明了 upload_only (BEP 21)，谁也不会从对方那里下载
+var ErrUploadOnlyPeer = errors.New("peer is upload only, and so are we")
+
+// 我们是不是不会再下载了: 只做种，或者需要的 piece 都已经下载完了
+func (t *Torrent) uploadOnly() bool {
+	if t.UploadOnly {
+		return true
+	}
+	done, wanted, _ := t.picker.Progress()
+	return done >= wanted
+}
+
+// 记住声明了 upload_only 的 peer，之后我们也只上传时 addPeer 不会再连接它
+// 连入的 peer 用的是临时端口，peer.IP 为空时只记录 peer ID
+func (t *Torrent) rememberUploadOnly(peer peers.Peer, peerID [20]byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if peer.IP != nil {
+		t.uploadOnlyAddrs[peer.String()] = true
+	}
+	if peerID != ([20]byte{}) {
+		t.uploadOnlyIDs[peerID] = true
+	}
+}
+
+// 调用时必须持有 mutex
+func (t *Torrent) isUploadOnlyPeer(peer peers.Peer) bool {
+	if t.uploadOnlyAddrs[peer.String()] {
+		return true
+	}
+	return peer.ID != ([20]byte{}) && t.uploadOnlyIDs[peer.ID]
+}
+
+// 处理其他 peer 主动发起的连接，conn 已经完成了握手，infoHash 是对方握手时用的 info hash
+// 连接之后先发送我们的 bitfield，之后和我们主动连接的 peer 一样由 runPeer 处理，
+// 对方 interested 之后 unchoke 并回应它的 request，对方有我们需要的 piece 时也向它下载
+// 阻塞直到连接断开或者下载被停止，连接数已经达到 MaxPeers 时直接返回错误，conn 总是会被关闭
+// 已经和这个 peer ID 有连接、并且应该保留已有的连接时返回 client.ErrDuplicateConnection
+func (t *Torrent) AcceptPeer(conn net.Conn, infoHash, remotePeerID [20]byte) error {
+	defer conn.Close()
+
+	t.mutex.Lock()
+	if t.picker == nil {
+		t.mutex.Unlock()
+		return fmt.Errorf("%s has not been started", t.Name)
+	}
+	select {
+	case <-t.stop:
+		t.mutex.Unlock()
+		return fmt.Errorf("%s has been stopped", t.Name)
+	default:
+	}
+	t.workers++
+	t.mutex.Unlock()
+	defer t.workerExited()
+
+	// 连入的 peer 不排队，没有空位时直接拒绝
+	if t.semaphore != nil {
+		select {
+		case t.semaphore <- struct{}{}:
+			defer func() { <-t.semaphore }()
+		default:
+			return fmt.Errorf("too many peers for %s, limit is %d", t.Name, t.MaxPeers)
+		}
+	}
+
+	// 已经和这个 peer 有连接时按 client.PreferConnection 保留其中一个
+	if !t.claimPeerID(remotePeerID, conn, false) {
+		return client.ErrDuplicateConnection
+	}
+	defer t.releasePeerID(remotePeerID, conn)
+
+	peer := remotePeer(conn)
+	key := peerKey{peer.String(), infoHash}
+	logger := t.logger.With(logging.Peer(peer), slog.String("direction", "inbound"))
+	if infoHash != t.InfoHash {
+		logger = logger.With(slog.String("swarm", "v2"))
+	}
+	logger.Debug("accepted peer", slog.String("client", peerId.Describe(remotePeerID)))
+	status := t.peerConnected(key, peer, remotePeerID)
+	t.publish(event.Event{Type: event.PeerConnected, InfoHash: infoHash, Peer: peer})
+
+	// 连接之后先发送我们的 bitfield，对方的 bitfield 和扩展握手由 runPeer 处理
+	announced := t.picker.Bitfield()
+	bitfield := message.Message{ID: message.MessageBitfield, Payload: announced}
+	_, err := conn.Write(bitfield.Serialize())
+	if err == nil {
+		c := &client.Client{
+			Conn:         conn,
+			Choked:       true,
+			Bitfield:     make(bitField.BitField, len(announced)),
+			Peer:         peer,
+			InfoHash:     infoHash,
+			PeerID:       t.PeerID,
+			Logger:       logger,
+			RemotePeerID: remotePeerID,
+		}
+		err = t.runPeer(c, status, announced, true, logger)
+	}
+	select {
+	case <-t.stop:
+		err = nil
+	default:
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		logger.Debug("peer disconnected", logging.Error(err))
+	} else {
+		logger.Debug("peer disconnected")
+	}
+	t.peerDisconnected(key)
+	t.publish(event.Event{Type: event.PeerDisconnected, InfoHash: infoHash, Peer: peer, Err: err})
+	return err
+}
+
+// 连接的对端，conn 不是 TCP 连接时 IP 为空
+func remotePeer(conn net.Conn) peers.Peer {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	return peers.Peer{}
+}
+
+// 从 Store 中读出对方请求的一块数据并发送出去
+func (t *Torrent) uploadBlock(conn net.Conn, msg *message.Message, status *PeerStatus) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= t.pieceCount() {
+		return fmt.Errorf("requested piece #%d out of range [0, %d)", index, t.pieceCount())
+	}
+	if length <= 0 || length > MaxUploadBlockSize || begin < 0 || begin+length > t.pieceDataLength(index) {
+		return fmt.Errorf("invalid request for piece #%d: begin %d, length %d", index, begin, length)
+	}
+	if done, _ := t.picker.IsDone(index); !done {
+		return fmt.Errorf("requested piece #%d which we do not have", index)
+	}
+
+	pieceBegin, _ := t.CalculatePieceBounds(index)
+	block := make([]byte, length)
+	n, err := t.Store.ReadAt(block, int64(pieceBegin+begin))
+	if err != nil && !(err == io.EOF && n == length) {
+		t.logger.Error("could not read piece", logging.Piece(index), logging.ClassifiedError(err, logging.ClassStorage))
+		return fmt.Errorf("could not read piece #%d: %w", index, err)
+	}
+
+	_, err = conn.Write(message.FormatMessagePiece(index, begin, block).Serialize())
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&status.Uploaded, int64(length))
+	atomic.AddInt64(&t.uploaded, int64(length))
+	return nil
+}
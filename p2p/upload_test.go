@@ -0,0 +1,291 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	client "github.com/strugglebak/goMule/client"
+	extension "github.com/strugglebak/goMule/extension"
+	handshake "github.com/strugglebak/goMule/handshake"
+	message "github.com/strugglebak/goMule/message"
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+// 开始做种，torrent 已经有全部数据
+func startSeeding(t *testing.T, torrent *Torrent, data []byte) {
+	torrent.Store = memoryStore(append([]byte{}, data...))
+	torrent.Completed = make(bitField.BitField, (torrent.pieceCount()+7)/8)
+	for index := 0; index < torrent.pieceCount(); index++ {
+		torrent.Completed.SetPiece(index)
+	}
+	require.Nil(t, torrent.Start())
+	t.Cleanup(func() { torrent.Close() })
+}
+
+// 监听一个端口，连入的连接握手之后交给 torrent
+func listenForPeers(t *testing.T, torrent *Torrent) peers.Peer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				h, err := client.AcceptHandshake(conn, torrent.PeerID, func(infoHash [20]byte) (bool, bool) {
+					return infoHash == torrent.InfoHash, torrent.isV2()
+				})
+				if err != nil {
+					conn.Close()
+					return
+				}
+				torrent.AcceptPeer(conn, h.InfoHash, h.PeerID)
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestAcceptPeer(t *testing.T) {
+	seeder, data := newTestTorrent(t, 100000, 16384)
+	startSeeding(t, seeder, data)
+	address := listenForPeers(t, seeder)
+
+	leecher, _ := newTestTorrent(t, 100000, 16384)
+	leecher.PeerID = [20]byte{9}
+	leecher.Peers = []peers.Peer{address}
+	buffer, err := leecher.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+	// 最后一块数据发出去之后才会计入上传量
+	assert.Eventually(t, func() bool { return seeder.Uploaded() == int64(len(data)) }, 5*time.Second, 10*time.Millisecond)
+
+	// 下载完成之后 leecher 断开连接
+	deadline := time.Now().Add(5 * time.Second)
+	for len(seeder.ActivePeers()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, seeder.ActivePeers())
+}
+
+func TestAcceptPeerLimit(t *testing.T) {
+	seeder, data := newTestTorrent(t, 100000, 16384)
+	seeder.MaxPeers = 1
+	startSeeding(t, seeder, data)
+
+	first, remote := net.Pipe()
+	defer remote.Close()
+	go seeder.AcceptPeer(first, seeder.InfoHash, [20]byte{9})
+	// 第一个连接会先收到 bitfield
+	bf, err := client.ReceiveBitField(remote)
+	require.Nil(t, err)
+	assert.Equal(t, bitField.BitField{0xfe}, bf)
+
+	second, other := net.Pipe()
+	defer other.Close()
+	assert.NotNil(t, seeder.AcceptPeer(second, seeder.InfoHash, [20]byte{10}))
+	require.Len(t, seeder.ActivePeers(), 1)
+	assert.Equal(t, [20]byte{9}, seeder.ActivePeers()[0].PeerID)
+}
+
+func TestAcceptPeerRejectsMissingPiece(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 100000, 16384)
+	torrent.Store = make(memoryStore, torrent.Length)
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	result := make(chan error, 1)
+	go func() { result <- torrent.AcceptPeer(conn, torrent.InfoHash, [20]byte{9}) }()
+	_, err := client.ReceiveBitField(remote)
+	require.Nil(t, err)
+
+	c := &client.Client{Conn: remote}
+	require.Nil(t, c.SendInterested())
+	// unchoke 之后请求一个还没有下载的 piece
+	msg, err := c.Read()
+	require.Nil(t, err)
+	require.NotNil(t, msg)
+	require.Nil(t, c.SendRequest(0, 0, 16384))
+	select {
+	case err := <-result:
+		assert.NotNil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("AcceptPeer did not return")
+	}
+}
+
+func TestDuplicatePeerConnections(t *testing.T) {
+	seeder, data := newTestTorrent(t, 100000, 16384)
+	seeder.PeerID = [20]byte{5}
+	startSeeding(t, seeder, data)
+
+	first, remote := net.Pipe()
+	defer remote.Close()
+	go seeder.AcceptPeer(first, seeder.InfoHash, [20]byte{9})
+	_, err := client.ReceiveBitField(remote)
+	require.Nil(t, err)
+
+	// 同一个 peer ID 再次连入时保留已有的连接
+	second, other := net.Pipe()
+	defer other.Close()
+	assert.Equal(t, client.ErrDuplicateConnection, seeder.AcceptPeer(second, seeder.InfoHash, [20]byte{9}))
+	assert.Len(t, seeder.ActivePeers(), 1)
+
+	// 我们的 peer ID 较小，我们发起的连接替换掉对方发起的
+	outbound, outboundRemote := net.Pipe()
+	defer outboundRemote.Close()
+	assert.True(t, seeder.claimPeerID([20]byte{9}, outbound, true))
+	_, err = client.ReceiveBitField(remote)
+	assert.NotNil(t, err)
+	seeder.releasePeerID([20]byte{9}, outbound)
+
+	// 对方的 peer ID 较小，保留对方发起的连接
+	inbound, inboundRemote := net.Pipe()
+	defer inboundRemote.Close()
+	assert.True(t, seeder.claimPeerID([20]byte{1}, inbound, false))
+	assert.False(t, seeder.claimPeerID([20]byte{1}, outbound, true))
+}
+
+func TestAcceptPeerUploadOnly(t *testing.T) {
+	seeder, data := newTestTorrent(t, 100000, 16384)
+	startSeeding(t, seeder, data)
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	result := make(chan error, 1)
+	go func() { result <- seeder.AcceptPeer(conn, seeder.InfoHash, [20]byte{9}) }()
+	_, err := client.ReceiveBitField(remote)
+	require.Nil(t, err)
+
+	// 对方发送扩展握手之后，我们回应的扩展握手中声明了 upload_only
+	ours, err := extension.FormatHandshake(&extension.Handshake{V: "qBittorrent/4.2.5"})
+	require.Nil(t, err)
+	_, err = remote.Write(ours.Serialize())
+	require.Nil(t, err)
+	msg, err := message.Read(remote)
+	require.Nil(t, err)
+	h, err := extension.ParseHandshake(msg)
+	require.Nil(t, err)
+	assert.Equal(t, 1, h.UploadOnly)
+
+	// 对方也下载完了
+	uploadOnly, err := extension.FormatHandshake(&extension.Handshake{UploadOnly: 1})
+	require.Nil(t, err)
+	_, err = remote.Write(uploadOnly.Serialize())
+	require.Nil(t, err)
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrUploadOnlyPeer, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("AcceptPeer did not return")
+	}
+
+	// 之后 tracker 返回的同一个 peer 不用再连接
+	seeder.AddPeer(peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 1, ID: [20]byte{9}})
+	assert.Empty(t, seeder.KnownPeers())
+}
+
+func TestUploadOnlyPeers(t *testing.T) {
+	torrent, data := newTestTorrent(t, 100000, 16384)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	// 对方收到的扩展握手中的 upload_only，连接断开时关闭
+	advertised := make(chan int, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(advertised)
+		h, err := handshake.Read(conn)
+		if err != nil {
+			return
+		}
+		response := handshake.BuildHandshake(h.InfoHash, [20]byte{9})
+		response.SetExtensions()
+		conn.Write(response.Serialize())
+		conn.Write((&message.Message{ID: message.MessageBitfield, Payload: make([]byte, (torrent.pieceCount()+7)/8)}).Serialize())
+		msg, _ := extension.FormatHandshake(&extension.Handshake{UploadOnly: 1})
+		conn.Write(msg.Serialize())
+		for {
+			msg, err := message.Read(conn)
+			if err != nil {
+				return
+			}
+			if extension.IsHandshake(msg) {
+				h, err := extension.ParseHandshake(msg)
+				if err != nil {
+					return
+				}
+				advertised <- h.UploadOnly
+			}
+		}
+	}()
+
+	// 我们已经有了全部数据，对方也只上传，连接没有用
+	startSeeding(t, torrent, data)
+	addr := ln.Addr().(*net.TCPAddr)
+	torrent.AddPeer(peers.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+
+	var received []int
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case uploadOnly, ok := <-advertised:
+			if !ok {
+				assert.Equal(t, []int{0, 1}, received)
+				// 断开之后不再连接这个 peer，换了地址也能通过 peer ID 认出来
+				assert.Eventually(t, func() bool {
+					torrent.mutex.Lock()
+					defer torrent.mutex.Unlock()
+					return torrent.uploadOnlyAddrs[addr.String()]
+				}, 5*time.Second, 10*time.Millisecond)
+				torrent.AddPeer(peers.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+				torrent.AddLocalAltPeer(peers.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+				torrent.AddPeer(peers.Peer{IP: addr.IP, Port: 1, ID: [20]byte{9}})
+				assert.Len(t, torrent.KnownPeers(), 1)
+				return
+			}
+			received = append(received, uploadOnly)
+		case <-timeout:
+			t.Fatal("upload-only peer was not dropped")
+		}
+	}
+}
+
+func TestDownloadFromInboundPeer(t *testing.T) {
+	// 做种的一方主动连接我们: 我们通过连入的连接下载，对方通过连出的连接上传
+	seeder, data := newTestTorrent(t, 100000, 16384)
+	seeder.PeerID = [20]byte{5}
+	startSeeding(t, seeder, data)
+
+	leecher, _ := newTestTorrent(t, 100000, 16384)
+	leecher.PeerID = [20]byte{9}
+	store := make(memoryStore, leecher.Length)
+	leecher.Store = store
+	require.Nil(t, leecher.Start())
+	defer leecher.Close()
+
+	seeder.AddPeer(listenForPeers(t, leecher))
+	assert.Eventually(t, func() bool {
+		done, wanted := leecher.Progress()
+		return done == wanted
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, data, []byte(store))
+	assert.Eventually(t, func() bool { return seeder.Uploaded() == int64(len(data)) }, 5*time.Second, 10*time.Millisecond)
+}
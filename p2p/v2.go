@@ -0,0 +1,225 @@
+package p2p
+
+import (
+	"fmt"
+	"math/bits"
+	"time"
+
+	merkle "github.com/strugglebak/goMule/merkle"
+	message "github.com/strugglebak/goMule/message"
+)
+
+// v2 (BEP 52) 种子中一个 piece 的校验信息
+// 每个 piece 只属于一个文件，它的 hash 是这段数据的 merkle root
+type PieceRoot struct {
+	Hash       [32]byte // piece layer 中的 hash，全 0 表示种子里没有，要通过 hash request 向 peer 请求
+	Leaves     int      // 计算 Hash 时 merkle tree 叶子的数量
+	Length     int      // piece 中属于文件的数据长度，不包括后面对齐用的空隙
+	FileRoot   [32]byte // piece 所在文件的 pieces root
+	FileIndex  int      // piece 在文件中的下标
+	FilePieces int      // 文件的 piece 数量
+}
+
+func (root *PieceRoot) known() bool {
+	return root.Hash != [32]byte{}
+}
+
+// v2 和 hybrid 种子，握手时要声明支持 v2 协议
+func (t *Torrent) isV2() bool {
+	return len(t.PieceRoots) > 0
+}
+
+// piece 的数量，v2 种子可能没有 v1 的 PieceHashes
+func (t *Torrent) pieceCount() int {
+	if len(t.PieceHashes) > 0 {
+		return len(t.PieceHashes)
+	}
+	return len(t.PieceRoots)
+}
+
+// 向 peer 请求的 piece 的长度
+// 只有 v2 的种子中，文件最后一个 piece 后面对齐用的空隙是不能请求的
+func (t *Torrent) pieceDataLength(index int) int {
+	if len(t.PieceHashes) == 0 && index < len(t.PieceRoots) {
+		return t.PieceRoots[index].Length
+	}
+	return t.CalculatePieceSize(index)
+}
+
+func (t *Torrent) pieceRoot(index int) (PieceRoot, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if index >= len(t.PieceRoots) || t.PieceRoots[index].Length == 0 {
+		return PieceRoot{}, false
+	}
+	return t.PieceRoots[index], true
+}
+
+// 下载 piece 之前是否要先向 peer 请求 piece layer
+// 有 v1 hash 的 piece (hybrid 种子) 用 SHA-1 就可以校验，不需要请求
+func (t *Torrent) needsPieceLayer(index int) bool {
+	if len(t.PieceHashes) > 0 {
+		return false
+	}
+	root, ok := t.pieceRoot(index)
+	return ok && !root.known()
+}
+
+// 校验 piece，v1 用 SHA-1，v2 用 merkle root，hybrid 种子两个都要对
+func (t *Torrent) checkPiece(pw *pieceWork, buffer []byte) error {
+	if len(t.PieceHashes) > 0 {
+		err := CheckIntegrity(pw, buffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	root, ok := t.pieceRoot(pw.Index)
+	if !ok {
+		if len(t.PieceHashes) == 0 {
+			return fmt.Errorf("index %d has no hash to check against", pw.Index)
+		}
+		return nil
+	}
+	if !root.known() {
+		if len(t.PieceHashes) == 0 {
+			return fmt.Errorf("index %d has no piece layer to check against", pw.Index)
+		}
+		return nil
+	}
+	if root.Length > len(buffer) || merkle.PieceRoot(buffer[:root.Length], root.Leaves) != root.Hash {
+		return fmt.Errorf("index %d failed merkle integrity check", pw.Index)
+	}
+	return nil
+}
+
+// 通过 hash request 向 peer 请求 index 这个 piece 所在文件的整个 piece layer，
+// 用 pieces root 校验之后保存下来，等待回应时对方的其他消息照常处理
+func (p *pipeline) fetchPieceLayer(index int) error {
+	t := p.t
+	root, _ := t.pieceRoot(index)
+	request := &message.HashRequest{
+		PiecesRoot: root.FileRoot,
+		BaseLayer:  bits.Len(uint(t.PieceLength/merkle.BlockSize)) - 1,
+		Index:      0,
+		Length:     merkle.NextPowerOfTwo(root.FilePieces),
+	}
+
+	_, err := p.c.Conn.Write(message.FormatMessageHashRequest(request).Serialize())
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		msg, err := p.next(deadline, nil)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case message.MessageHashReject:
+			rejected, err := message.ParseHashRequest(msg)
+			if err == nil && *rejected == *request {
+				return fmt.Errorf("peer rejected hash request for piece #%d", index)
+			}
+		case message.MessageHashes:
+			response, hashes, err := message.ParseHashes(msg)
+			if err != nil {
+				return err
+			}
+			if *response != *request {
+				continue
+			}
+			if len(hashes) != request.Length || !merkle.VerifyProof(root.FileRoot, hashes, 0, nil) {
+				return fmt.Errorf("received invalid piece layer for piece #%d", index)
+			}
+			t.setPieceLayer(root.FileRoot, hashes[:root.FilePieces])
+			return nil
+		default:
+			_, err = p.handle(msg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (t *Torrent) setPieceLayer(fileRoot [32]byte, layer [][32]byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for index := range t.PieceRoots {
+		root := &t.PieceRoots[index]
+		if root.FileRoot == fileRoot && root.FilePieces == len(layer) && root.FileIndex < len(layer) {
+			root.Hash = layer[root.FileIndex]
+		}
+	}
+}
+
+// 回应对方的 hash request，只支持请求 piece layer 中的一段，对方要求的 proof 也一起发送
+// 我们没有这个文件的 piece layer，或者请求的范围不对时回应 hash reject
+func (t *Torrent) answerHashRequest(request *message.HashRequest) *message.Message {
+	leaves := t.PieceLength / merkle.BlockSize
+	layer := t.pieceLayer(request.PiecesRoot)
+	count := merkle.NextPowerOfTwo(len(layer))
+	if layer == nil || request.BaseLayer != bits.Len(uint(leaves))-1 ||
+		request.Length <= 0 || request.Length != merkle.NextPowerOfTwo(request.Length) ||
+		request.Index < 0 || request.Index%request.Length != 0 || request.Index+request.Length > count {
+		return message.FormatMessageHashReject(request)
+	}
+
+	// 补齐到 2 的幂之后一层层往上算，记下 proof 需要的兄弟节点
+	padded := make([][32]byte, count)
+	copy(padded, layer)
+	for index := len(layer); index < count; index++ {
+		padded[index] = merkle.ZeroRoot(leaves)
+	}
+	hashes := append([][32]byte{}, padded[request.Index:request.Index+request.Length]...)
+	current := padded
+	for size := 1; size < request.Length; size *= 2 {
+		current = parentLayer(current)
+	}
+	position := request.Index / request.Length
+	for proof := 0; proof < request.ProofLayers && len(current) > 1; proof++ {
+		hashes = append(hashes, current[position^1])
+		current = parentLayer(current)
+		position /= 2
+	}
+	return message.FormatMessageHashes(request, hashes)
+}
+
+func parentLayer(layer [][32]byte) [][32]byte {
+	parent := make([][32]byte, len(layer)/2)
+	for index := range parent {
+		parent[index] = merkle.Combine(layer[2*index], layer[2*index+1])
+	}
+	return parent
+}
+
+// fileRoot 这个文件的 piece layer，只有一个 piece 的文件没有 piece layer，不知道时返回 nil
+func (t *Torrent) pieceLayer(fileRoot [32]byte) [][32]byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var layer [][32]byte
+	found := 0
+	for _, root := range t.PieceRoots {
+		if root.FileRoot != fileRoot || root.FilePieces <= 1 {
+			continue
+		}
+		if layer == nil {
+			layer = make([][32]byte, root.FilePieces)
+		}
+		if !root.known() || root.FileIndex >= len(layer) {
+			return nil
+		}
+		layer[root.FileIndex] = root.Hash
+		found++
+	}
+	if found != len(layer) {
+		return nil
+	}
+	return layer
+}
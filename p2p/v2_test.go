@@ -0,0 +1,202 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	merkle "github.com/strugglebak/goMule/merkle"
+	message "github.com/strugglebak/goMule/message"
+	peers "github.com/strugglebak/goMule/peers"
+)
+
+// 构建一个 v2 种子: 两个文件，每个文件都从 piece 的边界开始，文件之间的空隙为 0
+// 第一个文件占两个 piece，第二个文件不到一个 piece
+func newTestV2Torrent(t *testing.T) (*Torrent, []byte) {
+	const pieceLength = 2 * merkle.BlockSize
+	lengths := []int{40000, 10000}
+	offsets := []int{0, 2 * pieceLength}
+	data := make([]byte, offsets[1]+lengths[1])
+	random := rand.New(rand.NewSource(2))
+	for index, length := range lengths {
+		random.Read(data[offsets[index] : offsets[index]+length])
+	}
+
+	torrent := &Torrent{
+		PeerID:      [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+		InfoHash:    [20]byte{2},
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "test",
+	}
+
+	for index, length := range lengths {
+		torrent.Files = append(torrent.Files, File{Length: length, Priority: PriorityNormal, Offset: offsets[index]})
+		var layer [][32]byte
+		for begin := 0; begin < length; begin += pieceLength {
+			end := begin + pieceLength
+			if end > length {
+				end = length
+			}
+			leaves := pieceLength / merkle.BlockSize
+			if length <= pieceLength {
+				leaves = merkle.NextPowerOfTwo((length + merkle.BlockSize - 1) / merkle.BlockSize)
+			}
+			layer = append(layer, merkle.PieceRoot(data[offsets[index]+begin:offsets[index]+end], leaves))
+			torrent.PieceRoots = append(torrent.PieceRoots, PieceRoot{
+				Hash:      layer[len(layer)-1],
+				Leaves:    leaves,
+				Length:    end - begin,
+				FileIndex: len(layer) - 1,
+			})
+		}
+		fileRoot := layer[0]
+		if len(layer) > 1 {
+			fileRoot = merkle.LayerRoot(layer, pieceLength)
+		}
+		for i := range torrent.PieceRoots {
+			if torrent.PieceRoots[i].FileRoot == ([32]byte{}) {
+				torrent.PieceRoots[i].FileRoot = fileRoot
+				torrent.PieceRoots[i].FilePieces = len(layer)
+			}
+		}
+	}
+	return torrent, data
+}
+
+func TestDownloadV2(t *testing.T) {
+	torrent, data := newTestV2Torrent(t)
+	torrent.Peers = []peers.Peer{startSeeder(t, torrent, data)}
+
+	buffer, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+}
+
+func TestDownloadV2WithoutPieceLayer(t *testing.T) {
+	torrent, data := newTestV2Torrent(t)
+	// 种子里没有第一个文件的 piece layer，需要通过 hash request 向 peer 请求
+	expected := []PieceRoot{torrent.PieceRoots[0], torrent.PieceRoots[1]}
+	torrent.PieceRoots[0].Hash = [32]byte{}
+	torrent.PieceRoots[1].Hash = [32]byte{}
+	torrent.Peers = []peers.Peer{startSeeder(t, torrent, data)}
+
+	buffer, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+	assert.Equal(t, expected, torrent.PieceRoots[:2])
+}
+
+// 两个 goMule 之间: 下载的一方没有 piece layer，通过 hash request 向做种的一方请求
+func TestServePieceLayer(t *testing.T) {
+	seeder, data := newTestV2Torrent(t)
+	startSeeding(t, seeder, data)
+	address := listenForPeers(t, seeder)
+
+	leecher, _ := newTestV2Torrent(t)
+	leecher.PeerID = [20]byte{9}
+	expected := []PieceRoot{leecher.PieceRoots[0], leecher.PieceRoots[1]}
+	leecher.PieceRoots[0].Hash = [32]byte{}
+	leecher.PieceRoots[1].Hash = [32]byte{}
+	leecher.Peers = []peers.Peer{address}
+
+	buffer, err := leecher.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+	assert.Equal(t, expected, leecher.PieceRoots[:2])
+}
+
+func TestAnswerHashRequest(t *testing.T) {
+	torrent, _ := newTestV2Torrent(t)
+	fileRoot := torrent.PieceRoots[0].FileRoot
+	layer := [][32]byte{torrent.PieceRoots[0].Hash, torrent.PieceRoots[1].Hash}
+
+	// 第二个 hash 加上到 root 的 proof
+	request := &message.HashRequest{PiecesRoot: fileRoot, BaseLayer: 1, Index: 1, Length: 1, ProofLayers: 1}
+	msg := torrent.answerHashRequest(request)
+	response, hashes, err := message.ParseHashes(msg)
+	require.Nil(t, err)
+	assert.Equal(t, request, response)
+	assert.Equal(t, [][32]byte{layer[1], layer[0]}, hashes)
+	assert.True(t, merkle.VerifyProof(fileRoot, hashes[:1], 1, hashes[1:]))
+
+	// 整层
+	request = &message.HashRequest{PiecesRoot: fileRoot, BaseLayer: 1, Index: 0, Length: 2}
+	_, hashes, err = message.ParseHashes(torrent.answerHashRequest(request))
+	require.Nil(t, err)
+	assert.Equal(t, layer, hashes)
+
+	rejected := map[string]*message.HashRequest{
+		"unknown file":       {PiecesRoot: [32]byte{1}, BaseLayer: 1, Length: 2},
+		"single piece file":  {PiecesRoot: torrent.PieceRoots[2].FileRoot, BaseLayer: 1, Length: 1},
+		"other layer":        {PiecesRoot: fileRoot, BaseLayer: 0, Length: 2},
+		"out of range":       {PiecesRoot: fileRoot, BaseLayer: 1, Index: 2, Length: 2},
+		"not a power of two": {PiecesRoot: fileRoot, BaseLayer: 1, Length: 3},
+		"unaligned":          {PiecesRoot: fileRoot, BaseLayer: 1, Index: 1, Length: 2},
+	}
+	for name, request := range rejected {
+		assert.Equal(t, message.MessageHashReject, torrent.answerHashRequest(request).ID, name)
+	}
+
+	// 没有 piece layer 时也不能回应
+	torrent.PieceRoots[1].Hash = [32]byte{}
+	request = &message.HashRequest{PiecesRoot: fileRoot, BaseLayer: 1, Length: 2}
+	assert.Equal(t, message.MessageHashReject, torrent.answerHashRequest(request).ID)
+}
+
+func TestCheckPieceV2(t *testing.T) {
+	torrent, data := newTestV2Torrent(t)
+	pw := &pieceWork{Index: 1, Length: torrent.PieceRoots[1].Length}
+	begin := torrent.PieceLength
+	assert.Nil(t, torrent.checkPiece(pw, data[begin:begin+pw.Length]))
+
+	corrupted := append([]byte{}, data[begin:begin+pw.Length]...)
+	corrupted[0] ^= 1
+	assert.NotNil(t, torrent.checkPiece(pw, corrupted))
+
+	// 不知道 hash 的 piece 不能通过校验
+	torrent.PieceRoots[1].Hash = [32]byte{}
+	assert.NotNil(t, torrent.checkPiece(pw, data[begin:begin+pw.Length]))
+}
+
+func TestDownloadHybrid(t *testing.T) {
+	torrent, data := newTestTorrent(t, 4*16384, 16384)
+	torrent.AltInfoHash = [20]byte{9, 9, 9}
+	// v2 swarm 中的 peer 只认 v2 的 info hash
+	v2Swarm := &Torrent{
+		InfoHash:    torrent.AltInfoHash,
+		PieceHashes: torrent.PieceHashes,
+		PieceLength: torrent.PieceLength,
+		Length:      torrent.Length,
+	}
+	torrent.AltPeers = []peers.Peer{startSeeder(t, v2Swarm, data)}
+	// hybrid 种子同时有 SHA-1 和 merkle 校验
+	for index := range torrent.PieceHashes {
+		piece := data[index*16384 : (index+1)*16384]
+		torrent.PieceRoots = append(torrent.PieceRoots, PieceRoot{
+			Hash:   merkle.PieceRoot(piece, 1),
+			Leaves: 1,
+			Length: 16384,
+		})
+		assert.Equal(t, sha1.Sum(piece), torrent.PieceHashes[index])
+		assert.Equal(t, sha256.Sum256(piece), torrent.PieceRoots[index].Hash)
+	}
+
+	// 只有 v2 swarm 中的 peer
+	buffer, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+
+	// 同时从两个 swarm 下载
+	torrent, _ = newTestTorrent(t, 4*16384, 16384)
+	torrent.AltInfoHash = v2Swarm.InfoHash
+	torrent.Peers = []peers.Peer{startSeeder(t, torrent, data)}
+	torrent.AltPeers = []peers.Peer{startSeeder(t, v2Swarm, data)}
+	buffer, err = torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+}
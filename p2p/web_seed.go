@@ -0,0 +1,217 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	event "github.com/strugglebak/goMule/event"
+	logging "github.com/strugglebak/goMule/logging"
+)
+
+// web seed 连续失败时的等待时间，从 WebSeedMinBackoff 开始每次翻倍，最多 WebSeedMaxBackoff
+var (
+	WebSeedMinBackoff = 5 * time.Second
+	WebSeedMaxBackoff = 5 * time.Minute
+)
+
+// web seed 连续失败这么多次之后就放弃
+const MaxWebSeedFailures = 8
+
+// 请求 web seed 用的 http client
+var webSeedClient = &http.Client{Timeout: 60 * time.Second}
+
+// 从 web seed (BEP 19) 下载 piece，web seed 被当成一个拥有全部 piece 的 peer
+// 失败时 piece 会被放回去，然后等一段时间再试，连续失败太多次就退出
+func (t *Torrent) StartWebSeedWorker(seedURL string) {
+	logger := t.logger.With(slog.String("web_seed", seedURL))
+	logger.Info("downloading from web seed")
+
+	// web seed 拥有全部 piece
+	count := t.pieceCount()
+	bf := make(bitField.BitField, (count+7)/8)
+	for index := 0; index < count; index++ {
+		bf.SetPiece(index)
+	}
+
+	failures := 0
+	for {
+		pw, changed := t.picker.Next(bf)
+		if pw == nil {
+			select {
+			case <-changed:
+			case <-t.stop:
+				return
+			}
+			continue
+		}
+
+		buffer, err := t.downloadWebSeedPiece(seedURL, pw)
+		if err == nil {
+			err = t.checkPiece(pw, buffer)
+			if err != nil {
+				logger.Warn("piece failed integrity check", logging.Piece(pw.Index), logging.ClassifiedError(err, logging.ClassIntegrity))
+				t.publish(event.Event{Type: event.PieceFailed, WebSeed: seedURL, Piece: pw.Index, Err: err})
+			}
+		}
+		if err != nil {
+			t.picker.Release(pw.Index)
+			failures++
+			if failures >= MaxWebSeedFailures {
+				logger.Warn("giving up on web seed", slog.Int("failures", failures), logging.Error(err))
+				return
+			}
+
+			backoff := WebSeedMinBackoff << uint(failures-1)
+			if backoff > WebSeedMaxBackoff || backoff <= 0 {
+				backoff = WebSeedMaxBackoff
+			}
+			logger.Info("web seed failed, retrying", slog.Duration("backoff", backoff), logging.Piece(pw.Index), logging.Error(err))
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-t.stop:
+				timer.Stop()
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		begin, _ := t.CalculatePieceBounds(pw.Index)
+		_, err = t.Store.WriteAt(buffer, int64(begin))
+		if err != nil {
+			logger.Error("could not save piece", logging.Piece(pw.Index), logging.ClassifiedError(err, logging.ClassStorage))
+			t.picker.Release(pw.Index)
+			t.fail(fmt.Errorf("could not save piece #%d: %w", pw.Index, err))
+			return
+		}
+		t.pieceVerified(pw.Index, len(buffer), event.Event{WebSeed: seedURL})
+
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+	}
+}
+
+// piece 可能跨了多个文件，每个文件发一个 Range 请求，文件之间的空隙保持为 0
+func (t *Torrent) downloadWebSeedPiece(seedURL string, pw *pieceWork) ([]byte, error) {
+	buffer := make([]byte, pw.Length)
+	begin, _ := t.CalculatePieceBounds(pw.Index)
+
+	for _, segment := range t.fileSegments(begin, pw.Length) {
+		fileURL, err := t.webSeedFileURL(seedURL, segment.File)
+		if err != nil {
+			return nil, err
+		}
+		err = t.fetchRange(fileURL, segment.FileOffset, buffer[segment.Begin:segment.End])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buffer, nil
+}
+
+// 从 fileURL 的 offset 处读取 len(buffer) 个 byte
+func (t *Torrent) fetchRange(fileURL string, offset int64, buffer []byte) error {
+	request, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buffer))-1))
+
+	response, err := webSeedClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// 服务器不支持 Range，跳过前面不需要的部分
+		_, err = io.CopyN(io.Discard, response.Body, offset)
+		if err != nil {
+			return fmt.Errorf("short response from %s: %w", fileURL, err)
+		}
+	default:
+		return fmt.Errorf("unexpected status %q from %s", response.Status, fileURL)
+	}
+
+	_, err = io.ReadFull(response.Body, buffer)
+	if err != nil {
+		return fmt.Errorf("short response from %s: %w", fileURL, err)
+	}
+	t.DownloadLimiter.Wait(len(buffer))
+	return nil
+}
+
+// 按照 BEP 19 拼出第 index 个文件的 URL
+// 单文件: URL 以 / 结尾时加上 Name，否则 URL 就是这个文件
+// 多文件: URL/Name/path...
+func (t *Torrent) webSeedFileURL(seedURL string, index int) (string, error) {
+	if _, err := url.Parse(seedURL); err != nil {
+		return "", err
+	}
+
+	if len(t.Files) == 0 {
+		if strings.HasSuffix(seedURL, "/") {
+			return seedURL + url.PathEscape(t.Name), nil
+		}
+		return seedURL, nil
+	}
+
+	if !strings.HasSuffix(seedURL, "/") {
+		seedURL += "/"
+	}
+	parts := []string{url.PathEscape(t.Name)}
+	for _, part := range t.Files[index].Path {
+		parts = append(parts, url.PathEscape(part))
+	}
+	return seedURL + strings.Join(parts, "/"), nil
+}
+
+// 一段数据在某个文件中的位置
+type fileSegment struct {
+	File       int   // 文件下标，单文件 torrent 中总是 0
+	FileOffset int64 // 在文件中的偏移
+	Begin      int   // 在 buffer 中的范围
+	End        int
+}
+
+// 把 torrent 中 [offset, offset+length) 这段数据拆成每个文件中的一段，不在任何文件中的空隙会被跳过
+func (t *Torrent) fileSegments(offset int, length int) []fileSegment {
+	if len(t.Files) == 0 {
+		return []fileSegment{{File: 0, FileOffset: int64(offset), Begin: 0, End: length}}
+	}
+
+	var segments []fileSegment
+	end := offset + length
+	for index, file := range t.Files {
+		begin := offset
+		if file.Offset > begin {
+			begin = file.Offset
+		}
+		fileEnd := file.Offset + file.Length
+		if fileEnd > end {
+			fileEnd = end
+		}
+		if file.Length == 0 || begin >= fileEnd {
+			continue
+		}
+		segments = append(segments, fileSegment{
+			File:       index,
+			FileOffset: int64(begin - file.Offset),
+			Begin:      begin - offset,
+			End:        fileEnd - offset,
+		})
+	}
+	return segments
+}
@@ -0,0 +1,148 @@
+package p2p
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSeedFileURL(t *testing.T) {
+	torrent := &Torrent{Name: "my file"}
+	tests := map[string]struct {
+		files  []File
+		seed   string
+		output string
+	}{
+		"single file url": {
+			seed:   "http://example.com/a.iso",
+			output: "http://example.com/a.iso",
+		},
+		"single file directory": {
+			seed:   "http://example.com/dir/",
+			output: "http://example.com/dir/my%20file",
+		},
+		"multi file": {
+			files:  []File{{Length: 1, Path: []string{"sub dir", "b.txt"}}},
+			seed:   "http://example.com/dir",
+			output: "http://example.com/dir/my%20file/sub%20dir/b.txt",
+		},
+	}
+
+	for name, test := range tests {
+		torrent.Files = test.files
+		output, err := torrent.webSeedFileURL(test.seed, 0)
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, output, name)
+	}
+}
+
+func TestFileSegments(t *testing.T) {
+	torrent := &Torrent{Files: []File{
+		{Length: 10, Offset: 0},
+		{Length: 0, Offset: 10},
+		{Length: 5, Offset: 10},
+		{Length: 20, Offset: 15},
+	}}
+	assert.Equal(t, []fileSegment{
+		{File: 0, FileOffset: 8, Begin: 0, End: 2},
+		{File: 2, FileOffset: 0, Begin: 2, End: 7},
+		{File: 3, FileOffset: 0, Begin: 7, End: 10},
+	}, torrent.fileSegments(8, 10))
+	assert.Equal(t, []fileSegment{
+		{File: 3, FileOffset: 5, Begin: 0, End: 4},
+	}, torrent.fileSegments(20, 4))
+
+	// 文件之间有空隙时，空隙不属于任何文件
+	torrent.Files = []File{{Length: 10, Offset: 0}, {Length: 5, Offset: 16}}
+	assert.Equal(t, []fileSegment{
+		{File: 0, FileOffset: 8, Begin: 0, End: 2},
+		{File: 1, FileOffset: 0, Begin: 8, End: 10},
+	}, torrent.fileSegments(8, 10))
+}
+
+func TestDownloadFromWebSeed(t *testing.T) {
+	torrent, data := newTestTorrent(t, 3*16384+100, 16384)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	torrent.WebSeeds = []string{server.URL + "/"}
+
+	buffer, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+}
+
+func TestDownloadFromMultiFileWebSeed(t *testing.T) {
+	torrent, data := newTestTorrent(t, 4*16384, 16384)
+	torrent.Files = []File{
+		{Length: 20000, Priority: PriorityNormal, Path: []string{"a"}, Offset: 0},
+		{Length: 30000, Priority: PriorityNormal, Path: []string{"dir", "b"}, Offset: 20000},
+		{Length: 4*16384 - 50000, Priority: PriorityNormal, Path: []string{"c"}, Offset: 50000},
+	}
+	files := map[string][]byte{
+		"/test/a":     data[:20000],
+		"/test/dir/b": data[20000:50000],
+		"/test/c":     data[50000:],
+	}
+
+	// 前两个请求失败，之后 worker 应该在退避之后重试
+	WebSeedMinBackoff, WebSeedMaxBackoff = time.Millisecond, 10*time.Millisecond
+	defer func() { WebSeedMinBackoff, WebSeedMaxBackoff = 5*time.Second, 5*time.Minute }()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	torrent.WebSeeds = []string{server.URL}
+
+	store := make(memoryStore, torrent.Length)
+	torrent.Store = store
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+	require.Nil(t, torrent.Wait(nil))
+	assert.Equal(t, data, []byte(store))
+}
+
+func TestWebSeedGivesUp(t *testing.T) {
+	torrent, _ := newTestTorrent(t, 16384, 16384)
+	WebSeedMinBackoff, WebSeedMaxBackoff = time.Millisecond, time.Millisecond
+	defer func() { WebSeedMinBackoff, WebSeedMaxBackoff = 5*time.Second, 5*time.Minute }()
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	torrent.WebSeeds = []string{server.URL + "/"}
+
+	torrent.Store = make(memoryStore, torrent.Length)
+	require.Nil(t, torrent.Start())
+	defer torrent.Close()
+	assert.NotNil(t, torrent.Wait(nil))
+}
+
+func TestDownloadFromPeersAndWebSeed(t *testing.T) {
+	torrent, data := newTestTorrent(t, 8*16384, 16384)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	torrent.WebSeeds = []string{server.URL + "/test"}
+	torrent.Peers = append(torrent.Peers, startSeeder(t, torrent, data))
+
+	buffer, err := torrent.Download()
+	require.Nil(t, err)
+	assert.Equal(t, data, buffer)
+}
@@ -0,0 +1,261 @@
+package peerId
+
+import (
+	"crypto/rand"
+	"strconv"
+	"strings"
+)
+
+// 从 peer ID 或者 BEP 10 扩展握手中的 v 认出对方用的客户端
+// peer ID 常见的有几种写法:
+//   Azureus 风格: -qB4250-xxxxxxxxxxxx，两个字母的客户端缩写加四位版本号
+//   Shadow 风格: S58B-----xxxxxxxxxxx，一个字母的客户端缩写加最多五位版本号，用 - 补齐
+//   Mainline 风格: M4-3-6--xxxxxxxxxxx，M 加用 - 分隔的版本号
+// 还有一些客户端用自己的前缀，比如 exbc 和 XBT
+
+// goMule 自己的 peer ID 前缀，版本 0.0.0.1
+const Prefix = "-GM0001-"
+
+// goMule 的版本和在 BEP 10 扩展握手的 v 中使用的名字
+const (
+	Version   = "0.0.0.1"
+	UserAgent = "goMule/" + Version
+)
+
+// 生成一个 Prefix 开头、后面 12 个字节随机的 peer ID
+func Generate() ([20]byte, error) {
+	var peerID [20]byte
+	copy(peerID[:], Prefix)
+	_, err := rand.Read(peerID[len(Prefix):])
+	return peerID, err
+}
+
+// 认出的客户端，认不出时 Name 为空
+type Client struct {
+	Name    string
+	Version string // 可能为空
+}
+
+func (c Client) String() string {
+	if c.Name == "" {
+		return "unknown"
+	}
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// Azureus 风格的客户端缩写
+var azureusClients = map[string]string{
+	"7T": "aTorrent",
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BF": "Bitflu",
+	"BI": "BiglyBT",
+	"BN": "Baidu Netdisk",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FW": "FrostWire",
+	"GM": "goMule",
+	"HL": "Halite",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"LW": "LimeWire",
+	"MG": "MediaGet",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"SZ": "Shareaza",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UM": "µTorrent for Mac",
+	"UT": "µTorrent",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+	"ZT": "ZipTorrent",
+}
+
+// Shadow 风格的客户端缩写
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// 没有固定格式、只能按前缀认的客户端
+var prefixClients = []struct {
+	prefix string
+	name   string
+}{
+	{"exbc", "BitComet"},
+	{"FUTB", "BitComet"},
+	{"Plus", "Plus!"},
+	{"XBT", "XBT"},
+	{"-BOW", "Bits on Wheels"},
+	{"-ML", "MLDonkey"},
+	{"OP", "Opera"},
+}
+
+// 从 peer ID 认出客户端
+func Parse(peerID [20]byte) Client {
+	if c, ok := parseAzureus(peerID); ok {
+		return c
+	}
+	if c, ok := parseMainline(peerID); ok {
+		return c
+	}
+	if c, ok := parseShadow(peerID); ok {
+		return c
+	}
+	for _, known := range prefixClients {
+		if strings.HasPrefix(string(peerID[:]), known.prefix) {
+			return Client{Name: known.name}
+		}
+	}
+	return Client{}
+}
+
+// 解析 BEP 10 扩展握手中的 v，比如 qBittorrent/4.2.5、µTorrent 3.5.5、Transmission 2.94
+func ParseVersion(v string) Client {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return Client{}
+	}
+	// 版本号是最后一个空格或者 / 后面以数字开头的部分
+	index := strings.LastIndexAny(v, " /")
+	if index > 0 && index < len(v)-1 && v[index+1] >= '0' && v[index+1] <= '9' {
+		return Client{Name: strings.TrimSpace(v[:index]), Version: v[index+1:]}
+	}
+	return Client{Name: v}
+}
+
+// 优先使用扩展握手中的 v，它通常比 peer ID 更准确，比如能区分基于 libtorrent 的不同客户端
+func Identify(peerID [20]byte, v string) Client {
+	if c := ParseVersion(v); c.Name != "" {
+		return c
+	}
+	return Parse(peerID)
+}
+
+// 用来显示的客户端名字
+// 认不出的 Azureus 风格 peer ID 显示前 8 个字节，其他的显示开头可以打印的部分，都没有时是 unknown
+func Describe(peerID [20]byte) string {
+	if peerID == ([20]byte{}) {
+		return "unknown"
+	}
+	if c := Parse(peerID); c.Name != "" {
+		return c.String()
+	}
+	if isAzureus(peerID) {
+		return string(peerID[:8])
+	}
+	var builder strings.Builder
+	for _, b := range peerID[:8] {
+		if b < 0x20 || b > 0x7e {
+			break
+		}
+		builder.WriteByte(b)
+	}
+	if builder.Len() == 0 {
+		return "unknown"
+	}
+	return builder.String()
+}
+
+func isAzureus(peerID [20]byte) bool {
+	return peerID[0] == '-' && peerID[7] == '-'
+}
+
+// -XX1234-，版本号每一位是一段，4250 是 4.2.5，末尾的 0 去掉，但至少保留两段
+func parseAzureus(peerID [20]byte) (Client, bool) {
+	if !isAzureus(peerID) {
+		return Client{}, false
+	}
+	name, ok := azureusClients[string(peerID[1:3])]
+	if !ok {
+		return Client{}, false
+	}
+
+	var parts []string
+	for _, b := range peerID[3:7] {
+		value, ok := versionDigit(b)
+		if !ok {
+			break
+		}
+		parts = append(parts, value)
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return Client{Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+// Azureus 风格的版本号一般是数字，有的客户端用 A-Z 表示 10 以上
+func versionDigit(b byte) (string, bool) {
+	switch {
+	case b >= '0' && b <= '9':
+		return string(b), true
+	case b >= 'A' && b <= 'Z':
+		return strconv.Itoa(int(b-'A') + 10), true
+	default:
+		return "", false
+	}
+}
+
+// M4-3-6--，版本号的每一段可能有多位，以 -- 结束
+func parseMainline(peerID [20]byte) (Client, bool) {
+	if peerID[0] != 'M' {
+		return Client{}, false
+	}
+	rest := string(peerID[1:])
+	end := strings.Index(rest, "--")
+	if end <= 0 {
+		return Client{}, false
+	}
+	parts := strings.Split(rest[:end], "-")
+	if len(parts) != 3 {
+		return Client{}, false
+	}
+	for _, part := range parts {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return Client{}, false
+		}
+	}
+	return Client{Name: "BitTorrent", Version: strings.Join(parts, ".")}, true
+}
+
+// Shadow 风格的版本号每一位用 0-9、A-Z、a-z、.、- 表示 0 到 63
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// S58B-----，客户端缩写之后是最多 5 位版本号，然后用 - 补齐到第 9 个字节
+func parseShadow(peerID [20]byte) (Client, bool) {
+	name, ok := shadowClients[peerID[0]]
+	if !ok {
+		return Client{}, false
+	}
+	end := strings.Index(string(peerID[1:9]), "---")
+	if end <= 0 || end > 5 {
+		return Client{}, false
+	}
+
+	var parts []string
+	for _, b := range peerID[1 : 1+end] {
+		value := strings.IndexByte(shadowDigits, b)
+		// - 在版本号里表示 63，但这里已经是结尾了
+		if value < 0 || value == 63 {
+			return Client{}, false
+		}
+		parts = append(parts, strconv.Itoa(value))
+	}
+	return Client{Name: name, Version: strings.Join(parts, ".")}, true
+}
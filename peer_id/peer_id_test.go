@@ -0,0 +1,78 @@
+package peerId
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func id(prefix string) [20]byte {
+	var peerID [20]byte
+	copy(peerID[:], prefix)
+	return peerID
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]Client{
+		"-qB4250-abcdefghijkl": {Name: "qBittorrent", Version: "4.2.5"},
+		"-qB4390-abcdefghijkl": {Name: "qBittorrent", Version: "4.3.9"},
+		"-TR3000-abcdefghijkl": {Name: "Transmission", Version: "3.0"},
+		"-UT355S-abcdefghijkl": {Name: "µTorrent", Version: "3.5.5.28"},
+		"-GM0001-abcdefghijkl": {Name: "goMule", Version: "0.0.0.1"},
+		"S58B-----abcdefghijk": {Name: "Shadow", Version: "5.8.11"},
+		"T03I-----abcdefghijk": {Name: "BitTornado", Version: "0.3.18"},
+		"M4-3-6--abcdefghijkl": {Name: "BitTorrent", Version: "4.3.6"},
+		"M7-10-2--abcdefghijk": {Name: "BitTorrent", Version: "7.10.2"},
+		"exbc0L..abcdefghijkl": {Name: "BitComet"},
+		"XBT054d-abcdefghijkl": {Name: "XBT"},
+		"-XX1234-abcdefghijkl": {},
+		"Sabcdefghijklmnopqrs": {},
+		"M7-2-x--abcdefghijkl": {},
+	}
+	for input, expected := range tests {
+		assert.Equal(t, expected, Parse(id(input)), input)
+	}
+	assert.Equal(t, Client{}, Parse([20]byte{}))
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := map[string]Client{
+		"qBittorrent/4.2.5":  {Name: "qBittorrent", Version: "4.2.5"},
+		"µTorrent 3.5.5":     {Name: "µTorrent", Version: "3.5.5"},
+		"Transmission 2.94":  {Name: "Transmission", Version: "2.94"},
+		"libtorrent/1.2.3.0": {Name: "libtorrent", Version: "1.2.3.0"},
+		"Deluge 2.0.3 (lt)":  {Name: "Deluge 2.0.3 (lt)"},
+		"BitComet":           {Name: "BitComet"},
+		" goMule/0.0.0.1 ":   {Name: "goMule", Version: "0.0.0.1"},
+		"":                   {},
+	}
+	for input, expected := range tests {
+		assert.Equal(t, expected, ParseVersion(input), input)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	peerID := id("-LT1200-abcdefghijkl")
+	assert.Equal(t, "libtorrent 1.2", Identify(peerID, "").String())
+	assert.Equal(t, "Deluge 2.1.1", Identify(peerID, "Deluge 2.1.1").String())
+}
+
+func TestDescribe(t *testing.T) {
+	assert.Equal(t, "qBittorrent 4.3.9", Describe(id("-qB4390-abcdefghijkl")))
+	assert.Equal(t, "BitTorrent 7.2.2", Describe(id("M7-2-2--abcdefghijkl")))
+	assert.Equal(t, "-XX1234-", Describe(id("-XX1234-abcdefghijkl")))
+	assert.Equal(t, "abcdefgh", Describe(id("abcdefghijkl")))
+	assert.Equal(t, "unknown", Describe([20]byte{}))
+	assert.Equal(t, "unknown", Describe([20]byte{0xff, 1, 2}))
+}
+
+func TestGenerate(t *testing.T) {
+	first, err := Generate()
+	require.Nil(t, err)
+	second, err := Generate()
+	require.Nil(t, err)
+	assert.Equal(t, Prefix, string(first[:8]))
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, "goMule 0.0.0.1", Describe(first))
+}
@@ -10,6 +10,7 @@ import (
 type Peer struct {
 	IP 		net.IP
 	Port	uint16
+	ID		[20]byte	// tracker 返回的 peer ID，compact 格式里没有，这时为全 0
 }
 // 返回 host:port 这种字符串
 func (p Peer) String() string {
@@ -47,3 +48,19 @@ func Unmarshal(buffer []byte)([]Peer, error) {
 
 	return peers, nil
 }
+
+// 和 Unmarshal 相反，把 peer 编码成 compact 格式，不是 IPv4 的 peer 会被忽略
+func Marshal(peers []Peer) []byte {
+	buffer := make([]byte, 0, len(peers) * 6)
+	for _, peer := range peers {
+		ip := peer.IP.To4()
+		if ip == nil {
+			continue
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, peer.Port)
+		buffer = append(buffer, ip...)
+		buffer = append(buffer, port...)
+	}
+	return buffer
+}
@@ -54,3 +54,20 @@ func TestUnmarshal(t *testing.T) {
 		assert.Equal(t, test.output, peers)
 	}
 }
+
+func TestMarshal(t *testing.T) {
+	input := []Peer {
+		{ IP: net.IP { 127, 0, 0, 1 }, Port: 80 },
+		{ IP: net.ParseIP("::1"), Port: 1 },
+		{ IP: net.ParseIP("1.1.1.1"), Port: 443 },
+	}
+	buffer := Marshal(input)
+	assert.Equal(t, []byte { 127, 0, 0, 1, 0x00, 0x50, 1, 1, 1, 1, 0x01, 0xbb }, buffer)
+
+	peers, err := Unmarshal(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, []Peer {
+		{ IP: net.IP { 127, 0, 0, 1 }, Port: 80 },
+		{ IP: net.IP { 1, 1, 1, 1 }, Port: 443 },
+	}, peers)
+}
@@ -0,0 +1,119 @@
+package rateLimiter
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter 是一个简单的令牌桶，用来限制每秒传输的 byte 数量
+// 为 nil 时表示不限速，所有方法都可以在 nil 上调用
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   int     // 每秒允许的 byte 数量
+	tokens float64 // 当前可用的令牌，可以为负数，表示欠下的令牌
+	last   time.Time
+}
+
+// bytesPerSecond <= 0 时返回 nil，即不限速
+func New(bytesPerSecond int) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   bytesPerSecond,
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// 和 New 一样，只不过 bytesPerSecond <= 0 时返回一个不限速的 Limiter，而不是 nil，
+// 这样之后还可以用 SetRate 开始限速
+func NewAdjustable(bytesPerSecond int) *Limiter {
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	return &Limiter{
+		rate:   bytesPerSecond,
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+// 修改速率，bytesPerSecond <= 0 时不再限速
+func (l *Limiter) SetRate(bytesPerSecond int) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = bytesPerSecond
+	if l.tokens > float64(bytesPerSecond) {
+		l.tokens = float64(bytesPerSecond)
+	}
+}
+
+// 消耗 n 个令牌，令牌不够时会 sleep 到把欠下的令牌补回来为止
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	// 补充令牌，最多攒 1 秒的量
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Conn 在读写的时候分别经过下载和上传的限速
+type Conn struct {
+	net.Conn
+	Download *Limiter
+	Upload   *Limiter
+}
+
+// 两个 limiter 都为 nil 时直接返回原来的 conn
+func WrapConn(conn net.Conn, download, upload *Limiter) net.Conn {
+	if download == nil && upload == nil {
+		return conn
+	}
+	return &Conn{Conn: conn, Download: download, Upload: upload}
+}
+
+func (c *Conn) Read(buffer []byte) (int, error) {
+	n, err := c.Conn.Read(buffer)
+	c.Download.Wait(n)
+	return n, err
+}
+
+func (c *Conn) Write(buffer []byte) (int, error) {
+	c.Upload.Wait(len(buffer))
+	return c.Conn.Write(buffer)
+}
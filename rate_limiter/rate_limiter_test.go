@@ -0,0 +1,66 @@
+package rateLimiter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	assert.Nil(t, New(0))
+	assert.Nil(t, New(-1))
+	assert.Equal(t, 100, New(100).Rate())
+}
+
+func TestNewAdjustable(t *testing.T) {
+	l := NewAdjustable(0)
+	start := time.Now()
+	l.Wait(1 << 30)
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Millisecond))
+
+	l.SetRate(1000)
+	assert.Equal(t, 1000, l.Rate())
+	l.Wait(1000)
+	start = time.Now()
+	l.Wait(100)
+	assert.Greater(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	start := time.Now()
+	l.Wait(1 << 30)
+	l.SetRate(10)
+	assert.Equal(t, 0, l.Rate())
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Millisecond))
+}
+
+func TestWait(t *testing.T) {
+	l := New(1000)
+
+	// 一开始有 1 秒的令牌
+	start := time.Now()
+	l.Wait(1000)
+	assert.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// 再消耗 100 个令牌大约需要 100ms
+	start = time.Now()
+	l.Wait(100)
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(80*time.Millisecond))
+	assert.Less(t, int64(elapsed), int64(500*time.Millisecond))
+}
+
+func TestWrapConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	assert.Equal(t, client, WrapConn(client, nil, nil))
+
+	wrapped := WrapConn(client, New(10), New(10))
+	_, ok := wrapped.(*Conn)
+	assert.True(t, ok)
+}
@@ -0,0 +1,143 @@
+package resume
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jackpal/bencode-go"
+	bitField "github.com/strugglebak/goMule/bit_field"
+	peers "github.com/strugglebak/goMule/peers"
+	storage "github.com/strugglebak/goMule/storage"
+)
+
+// fast-resume 文件，保存了上次退出时一个种子的下载状态
+// 重启时如果磁盘上的文件大小和修改时间都没变，就直接相信里面的 bitfield，不用重新校验所有 piece
+
+const (
+	fileFormat  = "goMule resume file"
+	fileVersion = 1
+)
+
+// 磁盘上一个文件的状态，文件不存在时 Size 为 -1
+type FileStat struct {
+	Size  int64
+	MTime int64 // UnixNano
+}
+
+type Data struct {
+	InfoHash   [20]byte
+	Bitfield   bitField.BitField // 已经校验过的 piece
+	Files      []FileStat        // 保存时每个文件的状态，和 torrent 中的文件一一对应
+	Peers      []peers.Peer      // 连接过的 peer，重启后不用等 tracker 就可以连接
+	Downloaded int64             // 累计下载的 byte 数量
+	Uploaded   int64             // 累计上传的 byte 数量
+}
+
+type bencodeFileStat struct {
+	Size  int64 `bencode:"size"`
+	MTime int64 `bencode:"mtime"`
+}
+
+type bencodeResume struct {
+	FileFormat  string            `bencode:"file-format"`
+	FileVersion int               `bencode:"file-version"`
+	InfoHash    string            `bencode:"info-hash"`
+	Pieces      string            `bencode:"pieces"`
+	Files       []bencodeFileStat `bencode:"files"`
+	Peers       string            `bencode:"peers"`
+	Downloaded  int64             `bencode:"total_downloaded"`
+	Uploaded    int64             `bencode:"total_uploaded"`
+}
+
+// 读取 files 在磁盘上的状态
+func Stat(files []storage.File) []FileStat {
+	stats := make([]FileStat, len(files))
+	for index, file := range files {
+		info, err := os.Stat(file.Path)
+		if err != nil {
+			stats[index] = FileStat{Size: -1}
+			continue
+		}
+		stats[index] = FileStat{Size: info.Size(), MTime: info.ModTime().UnixNano()}
+	}
+	return stats
+}
+
+// 磁盘上的文件和保存时相比有没有变化，有变化时 bitfield 就不可信了
+func (data *Data) Matches(files []storage.File) bool {
+	if len(files) != len(data.Files) {
+		return false
+	}
+	for index, stat := range Stat(files) {
+		if stat != data.Files[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// 保存到 path，先写临时文件再改名，写到一半退出也不会破坏原来的文件
+func Save(path string, data *Data) error {
+	br := bencodeResume{
+		FileFormat:  fileFormat,
+		FileVersion: fileVersion,
+		InfoHash:    string(data.InfoHash[:]),
+		Pieces:      string(data.Bitfield),
+		Files:       []bencodeFileStat{},
+		Peers:       string(peers.Marshal(data.Peers)),
+		Downloaded:  data.Downloaded,
+		Uploaded:    data.Uploaded,
+	}
+	for _, stat := range data.Files {
+		br.Files = append(br.Files, bencodeFileStat{Size: stat.Size, MTime: stat.MTime})
+	}
+
+	var buffer bytes.Buffer
+	err := bencode.Marshal(&buffer, br)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", buffer.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func Load(path string) (*Data, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	br := bencodeResume{}
+	err = bencode.Unmarshal(file, &br)
+	if err != nil {
+		return nil, err
+	}
+	if br.FileFormat != fileFormat || br.FileVersion != fileVersion {
+		return nil, fmt.Errorf("%s is not a version %d resume file", path, fileVersion)
+	}
+	if len(br.InfoHash) != 20 {
+		return nil, fmt.Errorf("received malformed info hash in %s", path)
+	}
+	peerList, err := peers.Unmarshal([]byte(br.Peers))
+	if err != nil {
+		return nil, err
+	}
+
+	data := &Data{
+		Bitfield:   bitField.BitField(br.Pieces),
+		Peers:      peerList,
+		Downloaded: br.Downloaded,
+		Uploaded:   br.Uploaded,
+	}
+	copy(data.InfoHash[:], br.InfoHash)
+	for _, stat := range br.Files {
+		data.Files = append(data.Files, FileStat{Size: stat.Size, MTime: stat.MTime})
+	}
+	return data, nil
+}
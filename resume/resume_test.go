@@ -0,0 +1,91 @@
+package resume
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	peers "github.com/strugglebak/goMule/peers"
+	storage "github.com/strugglebak/goMule/storage"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	files := []storage.File{
+		{Path: filepath.Join(dir, "a"), Length: 3},
+		{Path: filepath.Join(dir, "missing"), Length: 5, Offset: 3},
+	}
+	require.Nil(t, ioutil.WriteFile(files[0].Path, []byte("abc"), 0644))
+
+	data := &Data{
+		InfoHash:   [20]byte{1, 2, 3},
+		Bitfield:   bitField.BitField{0xa0, 0x01},
+		Files:      Stat(files),
+		Peers:      []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6881}},
+		Downloaded: 1 << 40,
+		Uploaded:   7,
+	}
+	assert.Equal(t, int64(3), data.Files[0].Size)
+	assert.Equal(t, FileStat{Size: -1}, data.Files[1])
+
+	path := filepath.Join(dir, "resume")
+	require.Nil(t, Save(path, data))
+	loaded, err := Load(path)
+	require.Nil(t, err)
+	assert.Equal(t, data, loaded)
+	assert.True(t, loaded.Matches(files))
+}
+
+func TestMatches(t *testing.T) {
+	dir := t.TempDir()
+	files := []storage.File{{Path: filepath.Join(dir, "a"), Length: 3}}
+	require.Nil(t, ioutil.WriteFile(files[0].Path, []byte("abc"), 0644))
+	data := &Data{Files: Stat(files)}
+	assert.True(t, data.Matches(files))
+
+	// 修改时间变了
+	later := time.Now().Add(time.Hour)
+	require.Nil(t, os.Chtimes(files[0].Path, later, later))
+	assert.False(t, data.Matches(files))
+
+	// 文件大小变了
+	data = &Data{Files: Stat(files)}
+	require.Nil(t, os.Truncate(files[0].Path, 1))
+	require.Nil(t, os.Chtimes(files[0].Path, later, later))
+	assert.False(t, data.Matches(files))
+
+	// 文件被删了
+	data = &Data{Files: Stat(files)}
+	require.Nil(t, os.Remove(files[0].Path))
+	assert.False(t, data.Matches(files))
+
+	// 文件数量不一样
+	assert.False(t, (&Data{}).Matches(files))
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"not bencode":     "hello",
+		"wrong format":    "d11:file-format5:other12:file-versioni1e9:info-hash20:aaaaaaaaaaaaaaaaaaaae",
+		"wrong version":   "d11:file-format18:goMule resume file12:file-versioni2e9:info-hash20:aaaaaaaaaaaaaaaaaaaae",
+		"bad info hash":   "d11:file-format18:goMule resume file12:file-versioni1e9:info-hash3:abce",
+		"malformed peers": "d11:file-format18:goMule resume file12:file-versioni1e9:info-hash20:aaaaaaaaaaaaaaaaaaaa5:peers3:abce",
+	}
+	for name, content := range tests {
+		path := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+		_, err := Load(path)
+		assert.NotNil(t, err, name)
+	}
+
+	_, err := Load(filepath.Join(dir, "does not exist"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,62 @@
+package session
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	logging "github.com/strugglebak/goMule/logging"
+	resume "github.com/strugglebak/goMule/resume"
+)
+
+// 从 fast-resume 文件中恢复连接过的 peer 和流量
+// 磁盘上的文件和保存时一样时，返回保存的 bitfield 和 true，否则需要重新校验
+func (s *Session) loadResume(t *Torrent) (bitField.BitField, bool) {
+	data, err := resume.Load(s.resumePath(t.File.InfoHash))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Warn("could not load resume file", logging.InfoHash(t.File.InfoHash), slog.String("torrent", t.File.Name), logging.Error(err))
+		}
+		return nil, false
+	}
+	if !bytes.Equal(data.InfoHash[:], t.File.InfoHash[:]) {
+		return nil, false
+	}
+
+	s.mutex.Lock()
+	t.peers = data.Peers
+	t.downloaded = data.Downloaded
+	t.uploaded = data.Uploaded
+	s.mutex.Unlock()
+
+	files := t.File.StorageFiles(s.config.DataDir)
+	if len(data.Bitfield) != (t.File.PieceCount()+7)/8 || !data.Matches(files) {
+		return nil, false
+	}
+	return data.Bitfield, true
+}
+
+// 保存 t 的 fast-resume 文件，还没校验过的种子没有可以保存的东西
+// 调用时必须持有锁
+func (s *Session) saveResume(t *Torrent) {
+	if !t.checked || t.download != nil {
+		return
+	}
+	// 校验或者下载期间种子被移除了，不要把 Remove 删掉的文件又写回来
+	if s.torrents[t.File.InfoHash] != t {
+		return
+	}
+	data := &resume.Data{
+		InfoHash:   t.File.InfoHash,
+		Bitfield:   t.completed,
+		Files:      resume.Stat(t.File.StorageFiles(s.config.DataDir)),
+		Peers:      t.peers,
+		Downloaded: t.downloaded,
+		Uploaded:   t.uploaded,
+	}
+	err := resume.Save(s.resumePath(t.File.InfoHash), data)
+	if err != nil {
+		s.logger.Warn("could not save resume file", logging.InfoHash(t.File.InfoHash), slog.String("torrent", t.File.Name), logging.ClassifiedError(err, logging.ClassStorage))
+	}
+}
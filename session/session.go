@@ -0,0 +1,750 @@
+package session
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	event "github.com/strugglebak/goMule/event"
+	listener "github.com/strugglebak/goMule/listener"
+	logging "github.com/strugglebak/goMule/logging"
+	lsd "github.com/strugglebak/goMule/lsd"
+	mse "github.com/strugglebak/goMule/mse"
+	peerId "github.com/strugglebak/goMule/peer_id"
+	rateLimiter "github.com/strugglebak/goMule/rate_limiter"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// Session 同时管理多个种子，它们共用同一个端口、peer ID、限速器和局域网发现
+// 端口上的连接按照握手中的 info hash 交给对应的种子，做种的种子只通过它上传
+// 种子的列表和暂停状态保存在 StateDir 中，重启之后会恢复
+// DHT 还没有实现，作为单独的一项放在 README 的 Roadmaps 中，实现之后 DHT 节点也应该由 Session 持有
+type Session struct {
+	PeerID [20]byte
+	Events *event.Bus // 所有种子的事件都会发到这里，可以用 InfoHash 区分
+
+	config          Config
+	downloadLimiter *rateLimiter.Limiter
+	uploadLimiter   *rateLimiter.Limiter
+	localDiscovery  *lsd.Service
+	listener        *listener.Listener // 监听 Port，失败时为 nil，这时无法做种
+	logger          *slog.Logger
+
+	mutex    sync.Mutex
+	torrents map[[20]byte]*Torrent
+	queue    []*Torrent // 按加入的顺序排列，排在前面的先开始
+	closed   bool
+	done     chan struct{} // Close 时关闭
+	running  sync.WaitGroup
+}
+
+type Config struct {
+	DataDir            string // 下载的数据保存在这里
+	StateDir           string // session 的状态和种子文件保存在这里
+	Port               uint16 // 接受 peer 连接的端口，为 0 时由系统分配
+	MaxPeers           int    // 每个种子同时连接的 peer 数量上限，为 0 时不限制
+	DownloadRate       int    // 所有种子加起来每秒下载的 byte 数量上限，为 0 时不限速
+	UploadRate         int
+	MaxActiveDownloads int // 同时下载的种子数量上限，为 0 时不限制，超过的种子会排队
+	MaxActiveSeeds     int // 同时做种的种子数量上限，为 0 时不限制
+	Encryption         mse.Policy
+	IdleTimeout        time.Duration // peer 超过这么久没有有用的数据往来时断开，为 0 时使用 p2p.DefaultIdleTimeout
+	LocalDiscovery     bool          // 是否通过 BEP 14 在局域网中寻找 peer
+	Logger             *slog.Logger  // session 和所有下载的日志，为 nil 时使用 slog.Default()
+}
+
+type State string
+
+const (
+	StateQueued      State = "queued"   // 等待空出下载或者做种的位置
+	StateChecking    State = "checking" // 正在校验磁盘上已有的数据
+	StateDownloading State = "downloading"
+	StateSeeding     State = "seeding"
+	StatePaused      State = "paused"
+	StateError       State = "error" // 出错后停止，Resume 可以重试
+)
+
+// 种子加入 session 时的可选项
+type AddOptions struct {
+	Paused         bool
+	FilePriorities []int    // 含义见 torrentFile.DownloadOptions
+	Sequential     bool     // 按顺序下载 piece
+	Trackers       []string // 不为空时代替种子里的 tracker
+}
+
+// 打开 session，恢复 StateDir 中保存的种子
+func New(config Config) (*Session, error) {
+	if config.DataDir == "" || config.StateDir == "" {
+		return nil, fmt.Errorf("session needs both a data and a state directory")
+	}
+	for _, dir := range []string{config.DataDir, config.StateDir} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Session{
+		config:          config,
+		downloadLimiter: rateLimiter.NewAdjustable(config.DownloadRate),
+		uploadLimiter:   rateLimiter.NewAdjustable(config.UploadRate),
+		torrents:        make(map[[20]byte]*Torrent),
+		done:            make(chan struct{}),
+		logger:          logging.OrDefault(config.Logger),
+		Events:          &event.Bus{},
+	}
+	peerID, err := peerId.Generate()
+	if err != nil {
+		return nil, err
+	}
+	s.PeerID = peerID
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s.listener, err = listener.Listen(fmt.Sprintf(":%d", config.Port), listener.Options{
+		PeerID:     s.PeerID,
+		Encryption: config.Encryption,
+		Logger:     s.logger,
+	})
+	if err != nil {
+		s.logger.Warn("could not listen for peer connections", slog.Int("port", int(config.Port)), logging.Error(err))
+	}
+
+	if config.LocalDiscovery {
+		s.localDiscovery, err = lsd.Listen(lsd.DefaultAddress, s.Port(), s.logger)
+		if err != nil {
+			s.logger.Warn("could not start local service discovery", logging.Error(err))
+		}
+	}
+
+	s.mutex.Lock()
+	s.schedule()
+	s.mutex.Unlock()
+	go s.measureRates()
+	return s, nil
+}
+
+// 加入一个种子，buffer 是 .torrent 文件的内容
+func (s *Session) Add(buffer []byte, options AddOptions) (*Torrent, error) {
+	tf, err := torrentFile.Parse(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.FilePriorities) > 0 && len(options.FilePriorities) != len(tf.Files) {
+		return nil, fmt.Errorf("got %d file priorities for %d files", len(options.FilePriorities), len(tf.Files))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("session is closed")
+	}
+	if _, ok := s.torrents[tf.InfoHash]; ok {
+		return nil, fmt.Errorf("torrent %x is already in the session", tf.InfoHash)
+	}
+
+	err = ioutil.WriteFile(s.torrentPath(tf.InfoHash), buffer, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := &Torrent{
+		File:           &tf,
+		AddedAt:        time.Now(),
+		paused:         options.Paused,
+		filePriorities: options.FilePriorities,
+		sequential:     options.Sequential,
+		trackers:       options.Trackers,
+	}
+	s.insert(t)
+	s.schedule()
+	return t, s.save()
+}
+
+// 加入一个 .torrent 文件
+func (s *Session) AddFile(path string, options AddOptions) (*Torrent, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.Add(buffer, options)
+}
+
+func (s *Session) insert(t *Torrent) {
+	t.session = s
+	t.state = StateQueued
+	if t.paused {
+		t.state = StatePaused
+	}
+	s.torrents[t.File.InfoHash] = t
+	s.queue = append(s.queue, t)
+}
+
+// 下载的数据保存的目录
+func (s *Session) DataDir() string {
+	return s.config.DataDir
+}
+
+// 监听的端口，Config.Port 为 0 时是系统分配的端口
+func (s *Session) Port() uint16 {
+	if s.listener != nil {
+		return s.listener.Port()
+	}
+	return s.config.Port
+}
+
+func (s *Session) Get(infoHash [20]byte) (*Torrent, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, ok := s.torrents[infoHash]
+	return t, ok
+}
+
+// 按队列顺序返回所有种子
+func (s *Session) Torrents() []*Torrent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*Torrent{}, s.queue...)
+}
+
+func (s *Session) lookup(infoHash [20]byte) (*Torrent, error) {
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return nil, fmt.Errorf("torrent %x is not in the session", infoHash)
+	}
+	return t, nil
+}
+
+// 暂停一个种子，它不会再占用下载或者做种的位置
+func (s *Session) Pause(infoHash [20]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, err := s.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+	t.paused = true
+	t.stop()
+	t.state = StatePaused
+	s.saveResume(t)
+	s.schedule()
+	return s.save()
+}
+
+// 恢复一个暂停或者出错的种子，有空位时马上开始，否则排队
+func (s *Session) Resume(infoHash [20]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, err := s.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+	if !t.paused && t.state != StateError {
+		return nil
+	}
+	t.paused = false
+	t.err = nil
+	t.state = StateQueued
+	s.schedule()
+	return s.save()
+}
+
+// 从 session 中移除一个种子，deleteData 为 true 时同时删除下载的数据
+// 删除数据之前会等后台任务和下载都停下来，避免文件被重新创建
+func (s *Session) Remove(infoHash [20]byte, deleteData bool) error {
+	s.mutex.Lock()
+	t, err := s.lookup(infoHash)
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	download, finished := t.download, t.finished
+	t.stop()
+	t.state = StatePaused
+	delete(s.torrents, infoHash)
+	for index, queued := range s.queue {
+		if queued == t {
+			s.queue = append(s.queue[:index], s.queue[index+1:]...)
+			break
+		}
+	}
+
+	for _, path := range []string{s.torrentPath(infoHash), s.resumePath(infoHash)} {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			s.mutex.Unlock()
+			return err
+		}
+	}
+	s.schedule()
+	err = s.save()
+	s.mutex.Unlock()
+	if err != nil || !deleteData {
+		return err
+	}
+
+	// 后台任务退出时会拿锁，所以要在释放锁之后等
+	if finished != nil {
+		<-finished
+	}
+	if download != nil {
+		// 停下来之前 worker 可能又打开了文件，再关一次
+		download.WaitStopped()
+		download.Close()
+	}
+	return s.deleteData(t.File)
+}
+
+// 删除种子下载的文件，只删除种子自己的文件和删空了的目录
+// 删除之前确认所有路径都在 DataDir 里面，不会删掉 DataDir 本身或者它外面的东西
+func (s *Session) deleteData(file *torrentFile.TorrentFile) error {
+	root, err := filepath.Abs(s.config.DataDir)
+	if err != nil {
+		return err
+	}
+	inside := func(path string) (string, error) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("refusing to delete %s outside of %s", path, root)
+		}
+		return abs, nil
+	}
+
+	content, err := inside(filepath.Join(root, file.Name))
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, storageFile := range file.StorageFiles(root) {
+		path, err := inside(storageFile.Path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+	parts, err := inside(filepath.Join(root, "."+file.Name+".parts"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range append(paths, parts) {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(file.Files) == 0 {
+		return nil
+	}
+	// 多文件种子的目录，从最深的开始删，还有别的文件的目录会删除失败，保留下来
+	dirs := map[string]bool{content: true}
+	for _, path := range paths {
+		for dir := filepath.Dir(path); dir != content && strings.HasPrefix(dir, content); dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, dir := range sorted {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// 停止所有种子并保存状态
+func (s *Session) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for _, t := range s.queue {
+		t.stop()
+		s.saveResume(t)
+	}
+	err := s.save()
+	s.mutex.Unlock()
+
+	s.running.Wait()
+	if s.localDiscovery != nil {
+		s.localDiscovery.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	return err
+}
+
+// 运行过程中可以修改的设置，含义见 Config
+type Settings struct {
+	DownloadRate       int
+	UploadRate         int
+	MaxPeers           int
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	Encryption         mse.Policy
+}
+
+func (s *Session) Settings() Settings {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return Settings{
+		DownloadRate:       s.config.DownloadRate,
+		UploadRate:         s.config.UploadRate,
+		MaxPeers:           s.config.MaxPeers,
+		MaxActiveDownloads: s.config.MaxActiveDownloads,
+		MaxActiveSeeds:     s.config.MaxActiveSeeds,
+		Encryption:         s.config.Encryption,
+	}
+}
+
+// 修改设置，限速马上生效，MaxPeers 和 Encryption 只影响之后开始的下载
+// 修改不会保存，重启之后仍然使用 Config 中的值
+func (s *Session) SetSettings(settings Settings) error {
+	if settings.DownloadRate < 0 || settings.UploadRate < 0 || settings.MaxPeers < 0 ||
+		settings.MaxActiveDownloads < 0 || settings.MaxActiveSeeds < 0 {
+		return fmt.Errorf("settings must not be negative")
+	}
+	if settings.Encryption < mse.PolicyDisable || settings.Encryption > mse.PolicyRequire {
+		return fmt.Errorf("invalid encryption policy %d", settings.Encryption)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.config.DownloadRate = settings.DownloadRate
+	s.config.UploadRate = settings.UploadRate
+	s.config.MaxPeers = settings.MaxPeers
+	s.config.MaxActiveDownloads = settings.MaxActiveDownloads
+	s.config.MaxActiveSeeds = settings.MaxActiveSeeds
+	s.config.Encryption = settings.Encryption
+	s.downloadLimiter.SetRate(settings.DownloadRate)
+	s.uploadLimiter.SetRate(settings.UploadRate)
+	s.schedule()
+	return nil
+}
+
+// 每秒计算一次正在下载的种子的速度
+func (s *Session) measureRates() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			for _, t := range s.queue {
+				t.measureRate(now.Sub(last))
+			}
+			s.mutex.Unlock()
+			last = now
+		}
+	}
+}
+
+// 按队列顺序让排队的种子开始，直到用完下载和做种的位置
+// 还没校验过的种子不占位置，先按顺序校验，知道是下载还是做种之后再排队
+// 调用时必须持有锁
+func (s *Session) schedule() {
+	if s.closed {
+		return
+	}
+	downloads, seeds, checking := 0, 0, false
+	for _, t := range s.queue {
+		switch t.state {
+		case StateDownloading:
+			downloads++
+		case StateSeeding:
+			seeds++
+		case StateChecking:
+			checking = true
+		}
+	}
+
+	for _, t := range s.queue {
+		if t.paused || t.active() || t.state == StateError {
+			continue
+		}
+		// 同一时间只校验一个种子，避免多个种子抢磁盘，也让种子按队列顺序开始
+		if !t.checked {
+			if !checking {
+				checking = true
+				s.check(t)
+			}
+			continue
+		}
+		if t.complete {
+			if s.config.MaxActiveSeeds > 0 && seeds >= s.config.MaxActiveSeeds {
+				continue
+			}
+			seeds++
+			s.seed(t)
+			continue
+		}
+		if s.config.MaxActiveDownloads > 0 && downloads >= s.config.MaxActiveDownloads {
+			continue
+		}
+		downloads++
+		s.start(t)
+	}
+}
+
+// 在后台运行 task，Pause 和 Remove 会关闭 stopped 让它退出
+// 调用时必须持有锁
+func (s *Session) spawn(t *Torrent, state State, task func(t *Torrent, stopped chan struct{})) {
+	t.state = state
+	stopped := make(chan struct{})
+	finished := make(chan struct{})
+	t.stopped, t.finished = stopped, finished
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer close(finished)
+		task(t, stopped)
+	}()
+}
+
+// 在后台校验磁盘上已有的数据
+// 调用时必须持有锁
+func (s *Session) check(t *Torrent) {
+	s.spawn(t, StateChecking, func(t *Torrent, stopped chan struct{}) {
+		// 磁盘上的文件没变时直接用 fast-resume 文件里的 bitfield，否则重新校验所有 piece
+		completed, ok := s.loadResume(t)
+		if !ok {
+			report := t.File.VerifyDir(s.config.DataDir)
+			completed = make(bitField.BitField, (len(report.Pieces)+7)/8)
+			for _, index := range report.PiecesWithStatus(torrentFile.PieceValid) {
+				completed.SetPiece(index)
+			}
+		}
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		t.checked = true
+		t.completed = completed
+		t.complete = t.hasWantedPieces()
+		s.saveResume(t)
+		if t.stoppedBy(stopped) {
+			return
+		}
+		t.stopped = nil
+		t.state = StateQueued
+		s.schedule()
+	})
+}
+
+// 在后台下载，完成之后排队做种
+// 调用时必须持有锁
+func (s *Session) start(t *Torrent) {
+	options := s.downloadOptions(t)
+	s.spawn(t, StateDownloading, func(t *Torrent, stopped chan struct{}) {
+		download, err := t.File.StartDownload(s.config.DataDir, options)
+
+		s.mutex.Lock()
+		if t.stoppedBy(stopped) {
+			s.mutex.Unlock()
+			if download != nil {
+				// 等 worker 都退出之后才算结束，Remove 要在这之后才能删除文件
+				download.WaitStopped()
+				download.Close()
+			}
+			return
+		}
+		if err != nil {
+			t.fail(err)
+			s.mutex.Unlock()
+			return
+		}
+		t.download = download
+		s.mutex.Unlock()
+
+		err = download.Wait(nil)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if t.stoppedBy(stopped) {
+			return
+		}
+		t.closeDownload()
+		s.saveResume(t)
+		if err != nil {
+			t.fail(err)
+			return
+		}
+		s.finish(t)
+	})
+}
+
+// 在后台做种，直到被暂停或者移除
+// 没有监听端口时其他 peer 连不上我们，只占用做种的位置
+// 调用时必须持有锁
+func (s *Session) seed(t *Torrent) {
+	if s.listener == nil {
+		t.state = StateSeeding
+		return
+	}
+	options := s.downloadOptions(t)
+	s.spawn(t, StateSeeding, func(t *Torrent, stopped chan struct{}) {
+		seeding, err := t.File.StartSeeding(s.config.DataDir, options)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if t.stoppedBy(stopped) {
+			if seeding != nil {
+				seeding.Close()
+			}
+			return
+		}
+		if err != nil {
+			t.fail(err)
+			return
+		}
+		t.download = seeding
+	})
+}
+
+// 调用时必须持有锁
+func (s *Session) downloadOptions(t *Torrent) torrentFile.DownloadOptions {
+	return torrentFile.DownloadOptions{
+		Port:            s.Port(),
+		MaxPeers:        s.config.MaxPeers,
+		Encryption:      s.config.Encryption,
+		IdleTimeout:     s.config.IdleTimeout,
+		Uploaded:        t.uploaded,
+		Downloaded:      t.downloaded,
+		LocalDiscovery:  s.localDiscovery,
+		Listener:        s.listener,
+		FilePriorities:  t.filePriorities,
+		Sequential:      t.sequential,
+		Trackers:        t.trackers,
+		PeerID:          s.PeerID,
+		DownloadLimiter: s.downloadLimiter,
+		UploadLimiter:   s.uploadLimiter,
+		Completed:       t.completed,
+		Peers:           t.peers,
+		Logger:          s.logger,
+		Events:          s.Events,
+	}
+}
+
+// 下载完成，让出下载的位置，排队做种
+// 调用时必须持有锁
+func (s *Session) finish(t *Torrent) {
+	t.complete = true
+	t.stopped = nil
+	t.state = StateQueued
+	s.schedule()
+}
+
+func (s *Session) torrentPath(infoHash [20]byte) string {
+	return filepath.Join(s.config.StateDir, hex.EncodeToString(infoHash[:])+".torrent")
+}
+
+func (s *Session) resumePath(infoHash [20]byte) string {
+	return filepath.Join(s.config.StateDir, hex.EncodeToString(infoHash[:])+".resume")
+}
+
+func (s *Session) statePath() string {
+	return filepath.Join(s.config.StateDir, "session.json")
+}
+
+// session.json 的结构，种子本身保存在 <info hash>.torrent 中
+type savedSession struct {
+	Torrents []savedTorrent `json:"torrents"`
+}
+
+type savedTorrent struct {
+	InfoHash       string    `json:"info_hash"`
+	Paused         bool      `json:"paused"`
+	AddedAt        time.Time `json:"added_at"`
+	FilePriorities []int     `json:"file_priorities,omitempty"`
+	Sequential     bool      `json:"sequential,omitempty"`
+	Trackers       []string  `json:"trackers,omitempty"`
+}
+
+// 调用时必须持有锁
+func (s *Session) save() error {
+	saved := savedSession{Torrents: []savedTorrent{}}
+	for _, t := range s.queue {
+		saved.Torrents = append(saved.Torrents, savedTorrent{
+			InfoHash:       hex.EncodeToString(t.File.InfoHash[:]),
+			Paused:         t.paused,
+			AddedAt:        t.AddedAt,
+			FilePriorities: t.filePriorities,
+			Sequential:     t.sequential,
+			Trackers:       t.trackers,
+		})
+	}
+	buffer, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// 先写到临时文件再改名，避免写到一半时退出导致状态丢失
+	path := s.statePath()
+	err = ioutil.WriteFile(path+".tmp", buffer, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *Session) load() error {
+	buffer, err := ioutil.ReadFile(s.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved savedSession
+	err = json.Unmarshal(buffer, &saved)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %w", s.statePath(), err)
+	}
+
+	for _, entry := range saved.Torrents {
+		decoded, err := hex.DecodeString(entry.InfoHash)
+		if err != nil || len(decoded) != 20 {
+			return fmt.Errorf("invalid info hash %q in %s", entry.InfoHash, s.statePath())
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], decoded)
+		// 一个种子文件损坏不应该让整个 session 打不开
+		tf, err := torrentFile.Open(s.torrentPath(infoHash))
+		if err != nil {
+			s.logger.Warn("could not restore torrent", slog.String("infohash", entry.InfoHash), logging.ClassifiedError(err, logging.ClassStorage))
+			continue
+		}
+		s.insert(&Torrent{
+			File:           &tf,
+			AddedAt:        entry.AddedAt,
+			paused:         entry.Paused,
+			filePriorities: entry.FilePriorities,
+			sequential:     entry.Sequential,
+			trackers:       entry.Trackers,
+		})
+	}
+	return nil
+}
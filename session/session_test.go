@@ -0,0 +1,367 @@
+package session
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	mse "github.com/strugglebak/goMule/mse"
+	peers "github.com/strugglebak/goMule/peers"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// 在 dir 下生成一个随机内容的文件，返回它的种子
+func createTorrent(t *testing.T, dir, name, announce string) []byte {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(int64(len(name)))).Read(data)
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, data, 0644))
+
+	var buffer bytes.Buffer
+	_, err := torrentFile.Create(path, torrentFile.CreateOptions{Announce: announce, PieceLength: 16384}, &buffer)
+	require.Nil(t, err)
+	return buffer.Bytes()
+}
+
+// 一个一直不回应的 tracker，让下载停在 StartDownload 里，直到 release 被关闭
+func startBlockingTracker(t *testing.T) (string, chan struct{}) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, release
+}
+
+func waitForState(t *testing.T, torrent *Torrent, state State) {
+	deadline := time.Now().Add(5 * time.Second)
+	for torrent.Status().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %s, expected %s", torrent.File.Name, torrent.Status().State, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestSession(t *testing.T, config Config) *Session {
+	if config.DataDir == "" {
+		config.DataDir = t.TempDir()
+	}
+	if config.StateDir == "" {
+		config.StateDir = t.TempDir()
+	}
+	s, err := New(config)
+	require.Nil(t, err)
+	return s
+}
+
+func TestAddCompleteTorrent(t *testing.T) {
+	s := newTestSession(t, Config{})
+	defer s.Close()
+
+	torrent, err := s.Add(createTorrent(t, s.config.DataDir, "complete", "http://127.0.0.1:1/announce"), AddOptions{})
+	require.Nil(t, err)
+	// 数据已经在磁盘上了，校验之后直接做种
+	waitForState(t, torrent, StateSeeding)
+	status := torrent.Status()
+	assert.Equal(t, "complete", status.Name)
+	assert.Equal(t, 100000, status.Length)
+	assert.Equal(t, 7, status.Done)
+	assert.Equal(t, 7, status.Wanted)
+
+	// 同一个种子不能加两次
+	_, err = s.Add(createTorrent(t, t.TempDir(), "complete", ""), AddOptions{})
+	assert.NotNil(t, err)
+	_, err = s.Add([]byte("not a torrent"), AddOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestQueue(t *testing.T) {
+	announce, release := startBlockingTracker(t)
+	s := newTestSession(t, Config{MaxActiveDownloads: 1, MaxActiveSeeds: 1})
+	defer s.Close()
+	defer close(release)
+
+	source := t.TempDir()
+	first, err := s.Add(createTorrent(t, source, "first", announce), AddOptions{})
+	require.Nil(t, err)
+	second, err := s.Add(createTorrent(t, source, "second", announce), AddOptions{})
+	require.Nil(t, err)
+	waitForState(t, first, StateDownloading)
+	waitForState(t, second, StateQueued)
+
+	// 做种的位置和下载的位置分开计算
+	seed, err := s.Add(createTorrent(t, s.config.DataDir, "seed", announce), AddOptions{})
+	require.Nil(t, err)
+	waitForState(t, seed, StateSeeding)
+	another, err := s.Add(createTorrent(t, s.config.DataDir, "another seed", announce), AddOptions{})
+	require.Nil(t, err)
+	waitForState(t, another, StateQueued)
+
+	// 暂停之后让出位置给排在后面的种子
+	require.Nil(t, s.Pause(first.File.InfoHash))
+	assert.Equal(t, StatePaused, first.Status().State)
+	waitForState(t, second, StateDownloading)
+
+	// 恢复之后要重新排队
+	require.Nil(t, s.Resume(first.File.InfoHash))
+	assert.Equal(t, StateQueued, first.Status().State)
+
+	assert.Equal(t, []*Torrent{first, second, seed, another}, s.Torrents())
+	assert.NotNil(t, s.Pause([20]byte{1}))
+}
+
+func TestPersist(t *testing.T) {
+	config := Config{DataDir: t.TempDir(), StateDir: t.TempDir()}
+	s := newTestSession(t, config)
+
+	paused, err := s.Add(createTorrent(t, t.TempDir(), "paused", ""), AddOptions{Paused: true, Sequential: true, Trackers: []string{"http://tracker/announce"}})
+	require.Nil(t, err)
+	assert.Equal(t, StatePaused, paused.Status().State)
+	seeding, err := s.Add(createTorrent(t, config.DataDir, "seeding", ""), AddOptions{})
+	require.Nil(t, err)
+	waitForState(t, seeding, StateSeeding)
+	removed, err := s.Add(createTorrent(t, config.DataDir, "removed", ""), AddOptions{})
+	require.Nil(t, err)
+	require.Nil(t, s.Remove(removed.File.InfoHash, true))
+	_, err = os.Stat(filepath.Join(config.DataDir, "removed"))
+	assert.True(t, os.IsNotExist(err))
+	require.Nil(t, s.Close())
+
+	// 重启之后恢复种子和暂停状态，已经有的数据重新校验之后继续做种
+	s = newTestSession(t, config)
+	defer s.Close()
+	torrents := s.Torrents()
+	require.Len(t, torrents, 2)
+	assert.Equal(t, paused.File.InfoHash, torrents[0].File.InfoHash)
+	assert.Equal(t, paused.AddedAt.Unix(), torrents[0].AddedAt.Unix())
+	assert.Equal(t, StatePaused, torrents[0].Status().State)
+	assert.True(t, torrents[0].sequential)
+	assert.Equal(t, []string{"http://tracker/announce"}, torrents[0].trackers)
+	assert.Equal(t, seeding.File.InfoHash, torrents[1].File.InfoHash)
+	waitForState(t, torrents[1], StateSeeding)
+	_, ok := s.Get(removed.File.InfoHash)
+	assert.False(t, ok)
+}
+
+func TestFastResume(t *testing.T) {
+	config := Config{DataDir: t.TempDir(), StateDir: t.TempDir()}
+	s := newTestSession(t, config)
+	torrent, err := s.Add(createTorrent(t, config.DataDir, "resumed", ""), AddOptions{})
+	require.Nil(t, err)
+	waitForState(t, torrent, StateSeeding)
+	require.Nil(t, s.Close())
+	_, err = os.Stat(filepath.Join(config.StateDir, hex.EncodeToString(torrent.File.InfoHash[:])+".resume"))
+	require.Nil(t, err)
+
+	// 改掉文件的内容，但是保持大小和修改时间不变，fast-resume 文件仍然会被相信
+	path := filepath.Join(config.DataDir, "resumed")
+	stat, err := os.Stat(path)
+	require.Nil(t, err)
+	corrupt := func() {
+		file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+		require.Nil(t, err)
+		_, err = file.WriteAt([]byte("corrupted"), 0)
+		require.Nil(t, err)
+		require.Nil(t, file.Close())
+	}
+	corrupt()
+	require.Nil(t, os.Chtimes(path, stat.ModTime(), stat.ModTime()))
+
+	s = newTestSession(t, config)
+	torrent = s.Torrents()[0]
+	waitForState(t, torrent, StateSeeding)
+	assert.Equal(t, 7, torrent.Status().Done)
+	require.Nil(t, s.Close())
+
+	// 修改时间变了，重新校验之后发现第一个 piece 是坏的，需要重新下载
+	later := stat.ModTime().Add(time.Hour)
+	require.Nil(t, os.Chtimes(path, later, later))
+	s = newTestSession(t, config)
+	defer s.Close()
+	torrent = s.Torrents()[0]
+	// 种子里没有 tracker，下载会失败
+	waitForState(t, torrent, StateError)
+	assert.Equal(t, 6, torrent.Status().Done)
+	assert.Equal(t, 7, torrent.Status().Wanted)
+}
+
+func TestRemoveDeletesResume(t *testing.T) {
+	config := Config{DataDir: t.TempDir(), StateDir: t.TempDir()}
+	s := newTestSession(t, config)
+	defer s.Close()
+	torrent, err := s.Add(createTorrent(t, config.DataDir, "removed", ""), AddOptions{})
+	require.Nil(t, err)
+	waitForState(t, torrent, StateSeeding)
+	path := filepath.Join(config.StateDir, hex.EncodeToString(torrent.File.InfoHash[:])+".resume")
+	_, err = os.Stat(path)
+	require.Nil(t, err)
+
+	// 移除之后还在运行的校验或者下载不能再写回 fast-resume 文件
+	require.Nil(t, s.Remove(torrent.File.InfoHash, false))
+	s.mutex.Lock()
+	s.saveResume(torrent)
+	s.mutex.Unlock()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAnnounceTotals(t *testing.T) {
+	queries := make(chan url.Values, 10)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	s := newTestSession(t, Config{})
+	defer s.Close()
+
+	torrent, err := s.Add(createTorrent(t, s.config.DataDir, "totals", tracker.URL), AddOptions{})
+	require.Nil(t, err)
+	query := <-queries
+	assert.Equal(t, "0", query.Get("uploaded"))
+
+	// 恢复之后 announce 带上之前累计的流量
+	require.Nil(t, s.Pause(torrent.File.InfoHash))
+	s.mutex.Lock()
+	torrent.uploaded, torrent.downloaded = 12345, 678
+	s.mutex.Unlock()
+	require.Nil(t, s.Resume(torrent.File.InfoHash))
+	select {
+	case query = <-queries:
+		assert.Equal(t, "12345", query.Get("uploaded"))
+		assert.Equal(t, "678", query.Get("downloaded"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no announce after resume")
+	}
+}
+
+func TestRemoveDeletesOnlyOwnFiles(t *testing.T) {
+	s := newTestSession(t, Config{})
+	defer s.Close()
+
+	// 多文件种子的目录里还有不属于种子的文件
+	dir := filepath.Join(s.config.DataDir, "album")
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "disc"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("aaaa"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "disc", "b"), []byte("bbbb"), 0644))
+	var buffer bytes.Buffer
+	_, err := torrentFile.Create(dir, torrentFile.CreateOptions{PieceLength: 16384}, &buffer)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(s.config.DataDir, "other"), []byte("other"), 0644))
+
+	torrent, err := s.Add(buffer.Bytes(), AddOptions{})
+	require.Nil(t, err)
+	waitForState(t, torrent, StateSeeding)
+	require.Nil(t, s.Remove(torrent.File.InfoHash, true))
+
+	for _, path := range []string{filepath.Join(dir, "a"), filepath.Join(dir, "disc")} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	for _, path := range []string{filepath.Join(dir, "notes.txt"), filepath.Join(s.config.DataDir, "other")} {
+		_, err = os.Stat(path)
+		assert.Nil(t, err, path)
+	}
+
+	// 名字指向 DataDir 本身或者外面时拒绝删除
+	for _, name := range []string{"", ".", ".."} {
+		assert.NotNil(t, s.deleteData(&torrentFile.TorrentFile{Name: name, Length: 1}), "name %q", name)
+	}
+	_, err = os.Stat(filepath.Join(s.config.DataDir, "other"))
+	assert.Nil(t, err)
+}
+
+func TestRemoveWhileStarting(t *testing.T) {
+	announce, release := startBlockingTracker(t)
+	s := newTestSession(t, Config{})
+	defer s.Close()
+
+	torrent, err := s.Add(createTorrent(t, t.TempDir(), "starting", announce), AddOptions{})
+	require.Nil(t, err)
+	waitForState(t, torrent, StateDownloading)
+
+	// StartDownload 还在等 tracker，Remove 要等它结束之后再删除文件
+	removed := make(chan error, 1)
+	go func() { removed <- s.Remove(torrent.File.InfoHash, true) }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	select {
+	case err := <-removed:
+		require.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Remove did not return")
+	}
+	_, err = os.Stat(filepath.Join(s.config.DataDir, "starting"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSettings(t *testing.T) {
+	s := newTestSession(t, Config{DownloadRate: 100, MaxActiveSeeds: 1})
+	defer s.Close()
+	settings := s.Settings()
+	assert.Equal(t, Settings{DownloadRate: 100, MaxActiveSeeds: 1}, settings)
+
+	settings.UploadRate = 200
+	settings.MaxActiveDownloads = 3
+	settings.Encryption = mse.PolicyRequire
+	require.Nil(t, s.SetSettings(settings))
+	assert.Equal(t, settings, s.Settings())
+	assert.Equal(t, 200, s.uploadLimiter.Rate())
+
+	assert.NotNil(t, s.SetSettings(Settings{MaxPeers: -1}))
+	assert.NotNil(t, s.SetSettings(Settings{Encryption: 9}))
+	assert.Equal(t, settings, s.Settings())
+}
+
+func TestSeeding(t *testing.T) {
+	s := newTestSession(t, Config{})
+	defer s.Close()
+	assert.NotZero(t, s.Port())
+
+	buffer := createTorrent(t, s.config.DataDir, "seeded", "http://127.0.0.1:1/announce")
+	torrent, err := s.Add(buffer, AddOptions{})
+	require.Nil(t, err)
+	waitForState(t, torrent, StateSeeding)
+
+	// 另一个客户端直接连接 session 的端口下载
+	tf, err := torrentFile.Parse(buffer)
+	require.Nil(t, err)
+	output := t.TempDir()
+	leecher, err := tf.StartDownload(output, torrentFile.DownloadOptions{
+		Peers: []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: s.Port()}},
+	})
+	require.Nil(t, err)
+	defer leecher.Close()
+	require.Nil(t, leecher.Wait(nil))
+	expected, err := ioutil.ReadFile(filepath.Join(s.config.DataDir, "seeded"))
+	require.Nil(t, err)
+	actual, err := ioutil.ReadFile(filepath.Join(output, "seeded"))
+	require.Nil(t, err)
+	assert.Equal(t, expected, actual)
+	assert.Eventually(t, func() bool { return torrent.Status().Uploaded == 100000 }, 5*time.Second, 10*time.Millisecond)
+
+	// 暂停之后不再接受这个种子的连接
+	require.Nil(t, s.Pause(tf.InfoHash))
+	leecher, err = tf.StartDownload(t.TempDir(), torrentFile.DownloadOptions{
+		Peers: []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: s.Port()}},
+	})
+	require.Nil(t, err)
+	defer leecher.Close()
+	assert.NotNil(t, leecher.Wait(nil))
+	assert.Equal(t, int64(100000), torrent.Status().Uploaded)
+}
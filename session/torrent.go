@@ -0,0 +1,207 @@
+package session
+
+import (
+	"time"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	"github.com/strugglebak/goMule/p2p"
+	peers "github.com/strugglebak/goMule/peers"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// session 中的一个种子，除了 File 和 AddedAt 之外的字段都由 session 的锁保护
+type Torrent struct {
+	File    *torrentFile.TorrentFile
+	AddedAt time.Time
+
+	session        *Session
+	state          State
+	err            error
+	paused         bool
+	filePriorities []int
+	sequential     bool
+	trackers       []string
+	checked        bool              // 是否校验过磁盘上的数据
+	complete       bool              // 需要的 piece 都已经下载好了
+	completed      bitField.BitField // 已经有的 piece
+	peers          []peers.Peer      // 连接过的 peer
+	downloaded     int64             // 不包括正在进行的下载，累计下载的 byte 数量
+	uploaded       int64
+	download       *p2p.Torrent  // 正在下载时不为 nil
+	stopped        chan struct{} // 后台任务运行时不为 nil，关闭后任务会退出
+	finished       chan struct{} // 最近一次启动的后台任务退出时关闭
+	downloadRate   int64         // 最近一秒的速度，byte/s
+	uploadRate     int64
+	sampled        *p2p.Torrent // 上次计算速度时的下载
+	lastDownloaded int64        // 上次计算速度时 sampled 的流量
+	lastUploaded   int64
+}
+
+// 种子在某一时刻的状态
+type Status struct {
+	InfoHash [20]byte
+	Name     string
+	State    State
+	Length   int
+	Done     int // 已经完成的 piece 数量
+	Wanted   int // 需要下载的 piece 数量，跳过的文件不算
+	// 累计下载和上传的 byte 数量，重启之后从 fast-resume 文件中恢复
+	Downloaded   int64
+	Uploaded     int64
+	DownloadRate int64 // byte/s
+	UploadRate   int64
+	Left         int64            // 还需要下载的 byte 数量
+	Peers        []p2p.PeerStatus // 正在连接的 peer
+	ChokedTime   time.Duration    // 这次开始下载之后所有 peer 被 choke 的总时间
+	Error        error
+	AddedAt      time.Time
+}
+
+func (t *Torrent) Status() Status {
+	t.session.mutex.Lock()
+	defer t.session.mutex.Unlock()
+
+	status := Status{
+		InfoHash:   t.File.InfoHash,
+		Name:       t.File.Name,
+		State:      t.state,
+		Length:     t.File.Length,
+		Error:      t.err,
+		AddedAt:    t.AddedAt,
+		Downloaded: t.downloaded,
+		Uploaded:   t.uploaded,
+	}
+	if t.download != nil {
+		status.Done, status.Wanted = t.download.Progress()
+		status.Downloaded += t.download.Downloaded()
+		status.Uploaded += t.download.Uploaded()
+		status.DownloadRate = t.downloadRate
+		status.UploadRate = t.uploadRate
+		status.Peers = t.download.ActivePeers()
+		status.ChokedTime = t.download.ChokedTime()
+	} else {
+		status.Wanted = t.File.PieceCount()
+		for index := 0; index < status.Wanted; index++ {
+			if t.completed.HasPiece(index) {
+				status.Done++
+			}
+		}
+		if t.complete {
+			status.Wanted = status.Done
+		}
+	}
+	// 最后一个 piece 可能比较短，所以不能超过总长度
+	status.Left = int64(status.Wanted-status.Done) * int64(t.File.PieceLength)
+	if status.Left > int64(t.File.Length) {
+		status.Left = int64(t.File.Length)
+	}
+	return status
+}
+
+// 已经有的 piece，正在下载时包括这次下载好的
+func (t *Torrent) Bitfield() bitField.BitField {
+	t.session.mutex.Lock()
+	defer t.session.mutex.Unlock()
+	if t.download != nil {
+		return t.download.Bitfield()
+	}
+	return append(bitField.BitField{}, t.completed...)
+}
+
+// 根据 elapsed 这段时间内的流量计算速度
+// 调用时必须持有 session 的锁
+func (t *Torrent) measureRate(elapsed time.Duration) {
+	if t.download == nil {
+		t.downloadRate, t.uploadRate, t.sampled = 0, 0, nil
+		return
+	}
+	downloaded, uploaded := t.download.Downloaded(), t.download.Uploaded()
+	if t.sampled == t.download && elapsed > 0 {
+		t.downloadRate = int64(float64(downloaded-t.lastDownloaded) / elapsed.Seconds())
+		t.uploadRate = int64(float64(uploaded-t.lastUploaded) / elapsed.Seconds())
+	}
+	t.sampled, t.lastDownloaded, t.lastUploaded = t.download, downloaded, uploaded
+}
+
+// 是否占用了下载或者做种的位置
+// 调用时必须持有 session 的锁
+func (t *Torrent) active() bool {
+	return t.state == StateChecking || t.state == StateDownloading || t.state == StateSeeding
+}
+
+// 停止后台任务和下载，状态由调用者设置
+// 调用时必须持有 session 的锁
+func (t *Torrent) stop() {
+	if t.stopped != nil {
+		close(t.stopped)
+		t.stopped = nil
+	}
+	if t.download != nil {
+		t.closeDownload()
+	}
+}
+
+// stopped 这个后台任务是否已经被停止了
+// 调用时必须持有 session 的锁
+func (t *Torrent) stoppedBy(stopped chan struct{}) bool {
+	select {
+	case <-stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// 停止下载或者做种，把进度、连接过的 peer 和流量记下来
+// 调用时必须持有 session 的锁
+func (t *Torrent) closeDownload() {
+	if l := t.session.listener; l != nil {
+		l.Remove(t.download.InfoHash)
+		if t.download.AltInfoHash != ([20]byte{}) {
+			l.Remove(t.download.AltInfoHash)
+		}
+	}
+	t.download.Close()
+	t.completed = t.download.Bitfield()
+	// 做种时不会主动连接 peer，保留下载时连接过的
+	if known := t.download.KnownPeers(); len(known) > 0 {
+		t.peers = known
+	}
+	t.downloaded += t.download.Downloaded()
+	t.uploaded += t.download.Uploaded()
+	t.download = nil
+}
+
+// 想要的文件是否都下载好了，没有选择文件时就是所有 piece
+// 调用时必须持有 session 的锁
+func (t *Torrent) hasWantedPieces() bool {
+	pieceLength := t.File.PieceLength
+	for index := 0; index < t.File.PieceCount(); index++ {
+		if t.completed.HasPiece(index) {
+			continue
+		}
+		if len(t.filePriorities) == 0 {
+			return false
+		}
+		// 只要这个 piece 覆盖到了一个不跳过的文件，就是想要的
+		begin, end := index*pieceLength, (index+1)*pieceLength
+		for fileIndex, file := range t.File.Files {
+			if t.filePriorities[fileIndex] != p2p.PrioritySkip && file.Length > 0 &&
+				file.Offset < end && file.Offset+file.Length > begin {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 调用时必须持有 session 的锁
+func (t *Torrent) fail(err error) {
+	t.err = err
+	t.state = StateError
+	t.stopped = nil
+	if t.download != nil {
+		t.closeDownload()
+	}
+	t.session.schedule()
+}
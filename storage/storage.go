@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// part file 在 handles 中的 key
+const partFileIndex = -1
+
+// File 表示 torrent 数据中的一个文件在磁盘上的位置
+type File struct {
+	Path   string // 磁盘上的路径
+	Length int    // 文件大小
+	Offset int    // 文件在整个 torrent 数据中的起始偏移
+}
+
+// Storage 把 torrent 的线性数据映射到磁盘上的一个或多个文件
+// 对于 piece 来说，它只关心 [offset, offset+length) 这段数据
+// 至于这段数据跨了几个文件，由 Storage 来处理
+//
+// 被跳过的文件不会在磁盘上创建，但是一个 piece 可能同时跨了想要的文件和被跳过的文件，
+// 这个 piece 中属于被跳过的文件的那部分数据会写到 PartPath 这个文件中，
+// part file 和整个 torrent 的数据一样长，只是大部分都是空洞
+type Storage struct {
+	Files    []File
+	Length   int
+	PartPath string // 为空时不能写入被跳过的文件
+	writable bool
+
+	// 读写数据时持有读锁，改变文件是否跳过时持有写锁
+	skipMutex sync.RWMutex
+	skipped   []bool
+
+	mutex   sync.Mutex
+	handles map[int]*os.File
+}
+
+// 根据每个文件的路径和大小计算偏移，构建 Storage
+// writable 为 true 时，文件不存在会被创建
+func New(files []File, writable bool) *Storage {
+	offset := 0
+	layout := make([]File, len(files))
+	for i, file := range files {
+		layout[i] = File{
+			Path:   file.Path,
+			Length: file.Length,
+			Offset: offset,
+		}
+		offset += file.Length
+	}
+
+	return NewLayout(layout, offset, writable)
+}
+
+// 使用 files 中已经算好的偏移构建 Storage，files 必须按偏移排好序
+// 文件之间的空隙 (比如 BEP 47 的 pad file) 不会落到磁盘上，读出来全是 0，写入会被丢弃
+func NewLayout(files []File, length int, writable bool) *Storage {
+	return &Storage{
+		Files:    files,
+		Length:   length,
+		writable: writable,
+		skipped:  make([]bool, len(files)),
+		handles:  make(map[int]*os.File),
+	}
+}
+
+func (s *Storage) open(index int) (*os.File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if handle, ok := s.handles[index]; ok {
+		return handle, nil
+	}
+
+	var path string
+	if index == partFileIndex {
+		if s.PartPath == "" {
+			return nil, fmt.Errorf("no part file for data of skipped files")
+		}
+		path = s.PartPath
+	} else {
+		path = s.Files[index].Path
+	}
+
+	var handle *os.File
+	var err error
+	if s.writable {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, err
+		}
+		handle, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		handle, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.handles[index] = handle
+	return handle, nil
+}
+
+// 遍历 [offset, offset+length) 这段数据覆盖到的文件
+// fn 拿到的是实际要读写的文件、文件内偏移，以及这段数据在 buffer 中的范围
+// 被跳过的文件会被映射到 part file 中相同的偏移上，文件之间的空隙 handle 为 nil
+// 调用时必须持有 skipMutex
+func (s *Storage) walk(
+	offset int,
+	length int,
+	fn func(handle *os.File, fileOffset int64, begin int, end int) error,
+) error {
+	if offset < 0 || offset+length > s.Length {
+		return fmt.Errorf("range [%d, %d) out of bounds %d", offset, offset+length, s.Length)
+	}
+
+	done := 0
+	// 空隙一直到 end 为止
+	gap := func(end int) error {
+		current := offset + done
+		if done >= length || current >= end {
+			return nil
+		}
+		n := end - current
+		if n > length-done {
+			n = length - done
+		}
+		err := fn(nil, 0, done, done+n)
+		done += n
+		return err
+	}
+
+	for index, file := range s.Files {
+		if done >= length {
+			break
+		}
+		if err := gap(file.Offset); err != nil {
+			return err
+		}
+		fileEnd := file.Offset + file.Length
+		current := offset + done
+		if current >= fileEnd || file.Length == 0 {
+			continue
+		}
+
+		n := fileEnd - current
+		if n > length-done {
+			n = length - done
+		}
+
+		handleIndex := index
+		fileOffset := int64(current - file.Offset)
+		if s.skipped[index] {
+			handleIndex = partFileIndex
+			fileOffset = int64(current)
+		}
+		handle, err := s.open(handleIndex)
+		if err != nil {
+			return err
+		}
+		err = fn(handle, fileOffset, done, done+n)
+		if err != nil {
+			return err
+		}
+		done += n
+	}
+
+	return gap(s.Length)
+}
+
+// 从 offset 处读取 len(buffer) 个 byte
+func (s *Storage) ReadAt(buffer []byte, offset int64) (int, error) {
+	s.skipMutex.RLock()
+	defer s.skipMutex.RUnlock()
+
+	n := 0
+	err := s.walk(int(offset), len(buffer), func(handle *os.File, fileOffset int64, begin, end int) error {
+		if handle == nil {
+			for i := begin; i < end; i++ {
+				buffer[i] = 0
+			}
+			n += end - begin
+			return nil
+		}
+		read, err := handle.ReadAt(buffer[begin:end], fileOffset)
+		n += read
+		if err == io.EOF && read < end-begin {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	})
+	return n, err
+}
+
+// 从 offset 处写入 buffer
+func (s *Storage) WriteAt(buffer []byte, offset int64) (int, error) {
+	if !s.writable {
+		return 0, fmt.Errorf("storage is read only")
+	}
+	s.skipMutex.RLock()
+	defer s.skipMutex.RUnlock()
+
+	n := 0
+	err := s.walk(int(offset), len(buffer), func(handle *os.File, fileOffset int64, begin, end int) error {
+		if handle == nil {
+			n += end - begin
+			return nil
+		}
+		written, err := handle.WriteAt(buffer[begin:end], fileOffset)
+		n += written
+		return err
+	})
+	return n, err
+}
+
+func (s *Storage) IsSkipped(index int) bool {
+	s.skipMutex.RLock()
+	defer s.skipMutex.RUnlock()
+	return s.skipped[index]
+}
+
+// 设置是否跳过第 index 个文件
+// 状态改变时，已经写入的数据会在文件和 part file 之间搬过去
+func (s *Storage) SetSkip(index int, skip bool) error {
+	s.skipMutex.Lock()
+	defer s.skipMutex.Unlock()
+
+	if s.skipped[index] == skip {
+		return nil
+	}
+
+	file := s.Files[index]
+	from, to := s.Files[index].Path, s.PartPath
+	fromOffset, toOffset := int64(0), int64(file.Offset)
+	if !skip {
+		from, to = to, from
+		fromOffset, toOffset = toOffset, fromOffset
+	}
+
+	// 还没有写过数据，不需要搬
+	if _, err := os.Stat(from); err != nil || !s.writable || file.Length == 0 {
+		s.skipped[index] = skip
+		return nil
+	}
+	if to == "" {
+		return fmt.Errorf("no part file for data of skipped files")
+	}
+
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	err = os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	target, err := os.OpenFile(to, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	buffer := make([]byte, 256*1024)
+	for copied := int64(0); copied < int64(file.Length); {
+		n := int64(len(buffer))
+		if remaining := int64(file.Length) - copied; n > remaining {
+			n = remaining
+		}
+		read, err := source.ReadAt(buffer[:n], fromOffset+copied)
+		if read > 0 {
+			_, writeErr := target.WriteAt(buffer[:read], toOffset+copied)
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		copied += int64(read)
+	}
+
+	s.skipped[index] = skip
+	return nil
+}
+
+// 创建所有不被跳过的文件，并把大小调整为种子中记录的大小，包括长度为 0 的文件
+func (s *Storage) Allocate() error {
+	if !s.writable {
+		return fmt.Errorf("storage is read only")
+	}
+	s.skipMutex.RLock()
+	defer s.skipMutex.RUnlock()
+
+	for index, file := range s.Files {
+		if s.skipped[index] {
+			continue
+		}
+		handle, err := s.open(index)
+		if err != nil {
+			return err
+		}
+		stat, err := handle.Stat()
+		if err != nil {
+			return err
+		}
+		if stat.Size() != int64(file.Length) {
+			err = handle.Truncate(int64(file.Length))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 关闭所有已经打开的文件
+func (s *Storage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result error
+	for index, handle := range s.handles {
+		err := handle.Close()
+		if err != nil && result == nil {
+			result = err
+		}
+		delete(s.handles, index)
+	}
+	return result
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	s := New([]File{
+		{Path: "a", Length: 3},
+		{Path: "b", Length: 0},
+		{Path: "c", Length: 5},
+	}, false)
+
+	assert.Equal(t, 8, s.Length)
+	assert.Equal(t, []File{
+		{Path: "a", Length: 3, Offset: 0},
+		{Path: "b", Length: 0, Offset: 3},
+		{Path: "c", Length: 5, Offset: 3},
+	}, s.Files)
+}
+
+func TestReadWriteAt(t *testing.T) {
+	dir := t.TempDir()
+	s := New([]File{
+		{Path: filepath.Join(dir, "a"), Length: 3},
+		{Path: filepath.Join(dir, "sub", "b"), Length: 4},
+		{Path: filepath.Join(dir, "c"), Length: 2},
+	}, true)
+	defer s.Close()
+
+	n, err := s.WriteAt([]byte("abcdefghi"), 0)
+	require.Nil(t, err)
+	assert.Equal(t, 9, n)
+
+	buffer := make([]byte, 5)
+	n, err = s.ReadAt(buffer, 2)
+	require.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("cdefg"), buffer)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "sub", "b"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("defg"), data)
+
+	_, err = s.ReadAt(buffer, 6)
+	assert.NotNil(t, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a")
+	require.Nil(t, ioutil.WriteFile(path, []byte("ab"), 0644))
+
+	s := New([]File{{Path: path, Length: 4}}, false)
+	defer s.Close()
+
+	_, err := s.WriteAt([]byte("x"), 0)
+	assert.NotNil(t, err)
+
+	// 文件比预期的短
+	_, err = s.ReadAt(make([]byte, 4), 0)
+	assert.NotNil(t, err)
+}
+
+func TestAllocate(t *testing.T) {
+	dir := t.TempDir()
+	s := New([]File{
+		{Path: filepath.Join(dir, "a"), Length: 3},
+		{Path: filepath.Join(dir, "empty"), Length: 0},
+	}, true)
+	defer s.Close()
+
+	require.Nil(t, s.Allocate())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0}, data)
+	data, err = ioutil.ReadFile(filepath.Join(dir, "empty"))
+	require.Nil(t, err)
+	assert.Empty(t, data)
+}
+
+func TestSkip(t *testing.T) {
+	dir := t.TempDir()
+	s := New([]File{
+		{Path: filepath.Join(dir, "a"), Length: 4},
+		{Path: filepath.Join(dir, "b"), Length: 4},
+	}, true)
+	s.PartPath = filepath.Join(dir, ".parts")
+	defer s.Close()
+
+	require.Nil(t, s.SetSkip(1, true))
+	assert.True(t, s.IsSkipped(1))
+	require.Nil(t, s.Allocate())
+
+	// 跨了两个文件的数据，属于 b 的部分写到 part file 里
+	_, err := s.WriteAt([]byte("abcdefgh"), 0)
+	require.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "b"))
+	assert.True(t, os.IsNotExist(err))
+
+	buffer := make([]byte, 8)
+	_, err = s.ReadAt(buffer, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("abcdefgh"), buffer)
+
+	// 不再跳过时，数据从 part file 搬到 b 中
+	require.Nil(t, s.SetSkip(1, false))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "b"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("efgh"), data)
+	_, err = s.ReadAt(buffer, 0)
+	require.Nil(t, err)
+	assert.Equal(t, []byte("abcdefgh"), buffer)
+}
+
+func TestLayoutWithGaps(t *testing.T) {
+	dir := t.TempDir()
+	s := NewLayout([]File{
+		{Path: filepath.Join(dir, "a"), Length: 3, Offset: 0},
+		{Path: filepath.Join(dir, "b"), Length: 2, Offset: 8},
+	}, 12, true)
+	defer s.Close()
+	require.Nil(t, s.Allocate())
+
+	n, err := s.WriteAt([]byte("abcXXXXXdeYY"), 0)
+	require.Nil(t, err)
+	assert.Equal(t, 12, n)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("abc"), data)
+	data, err = ioutil.ReadFile(filepath.Join(dir, "b"))
+	require.Nil(t, err)
+	assert.Equal(t, []byte("de"), data)
+
+	buffer := make([]byte, 12)
+	for i := range buffer {
+		buffer[i] = 'Z'
+	}
+	n, err = s.ReadAt(buffer, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 12, n)
+	assert.Equal(t, []byte("abc\x00\x00\x00\x00\x00de\x00\x00"), buffer)
+}
@@ -0,0 +1,228 @@
+package torrentFile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	storage "github.com/strugglebak/goMule/storage"
+)
+
+const (
+	MinPieceLength = 16 * 1024
+	MaxPieceLength = 16 * 1024 * 1024
+	// 自动选择 piece length 时，期望 piece 的数量不超过这个值
+	targetPieceCount = 1500
+)
+
+// 制作种子文件时的可选项
+type CreateOptions struct {
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Private      bool
+	URLList      []string
+	PieceLength  int // 为 0 时根据总大小自动选择
+	Workers      int // 并发计算 hash 的数量，为 0 时使用 CPU 核数
+}
+
+// 根据数据总大小选择一个 2 的幂次的 piece length
+func ChoosePieceLength(totalLength int) int {
+	pieceLength := MinPieceLength
+	for pieceLength < MaxPieceLength && (totalLength+pieceLength-1)/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// 把 rootPath 这个文件或者目录制作成种子，bencode 之后写入 writer
+func Create(rootPath string, options CreateOptions, writer io.Writer) (TorrentFile, error) {
+	info, diskFiles, err := buildInfo(rootPath, options)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	pieces, err := hashPieces(diskFiles, info.PieceLength, options.Workers)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	info.Pieces = string(pieces)
+
+	bt := bencodeTorrent{
+		Announce:     options.Announce,
+		AnnounceList: options.AnnounceList,
+		Comment:      options.Comment,
+		CreatedBy:    options.CreatedBy,
+		URLList:      options.URLList,
+		Info:         info,
+	}
+	if bt.CreatedBy == "" {
+		bt.CreatedBy = "goMule"
+	}
+	if !options.CreationDate.IsZero() {
+		bt.CreationDate = options.CreationDate.Unix()
+	}
+
+	err = bencode.Marshal(writer, bt)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	return bt.ToTorrentFile()
+}
+
+// 和 Create 一样，只不过直接写到 outPath 这个文件中
+func CreateFile(rootPath, outPath string, options CreateOptions) (TorrentFile, error) {
+	file, err := os.Create(outPath)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	torrentFile, err := Create(rootPath, options, file)
+	if err != nil {
+		file.Close()
+		os.Remove(outPath)
+		return TorrentFile{}, err
+	}
+
+	return torrentFile, file.Close()
+}
+
+// 遍历 rootPath，得到除 pieces 之外的 info 字段，以及按顺序排列的磁盘文件
+func buildInfo(rootPath string, options CreateOptions) (bencodeInfo, []storage.File, error) {
+	stat, err := os.Stat(rootPath)
+	if err != nil {
+		return bencodeInfo{}, nil, err
+	}
+
+	// rootPath 是 . 或者 .. 时 filepath.Base 得不到目录的名字，要先换成绝对路径
+	absPath, err := filepath.Abs(rootPath)
+	if err != nil {
+		return bencodeInfo{}, nil, err
+	}
+	info := bencodeInfo{
+		Name: filepath.Base(absPath),
+	}
+	err = checkPathComponent(info.Name)
+	if err != nil {
+		return bencodeInfo{}, nil, fmt.Errorf("cannot create torrent from %s: %w", rootPath, err)
+	}
+	if options.Private {
+		info.Private = 1
+	}
+
+	// filepath.Walk 按字典序遍历，所以文件的顺序是确定的
+	var diskFiles []storage.File
+	if !stat.IsDir() {
+		info.Length = int(stat.Size())
+		diskFiles = append(diskFiles, storage.File{Path: rootPath, Length: info.Length})
+	} else {
+		err = filepath.Walk(rootPath, func(path string, fileInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fileInfo.Mode().IsRegular() {
+				return nil
+			}
+			relativePath, err := filepath.Rel(rootPath, path)
+			if err != nil {
+				return err
+			}
+			info.Files = append(info.Files, bencodeFile{
+				Length: int(fileInfo.Size()),
+				Path:   strings.Split(filepath.ToSlash(relativePath), "/"),
+			})
+			diskFiles = append(diskFiles, storage.File{Path: path, Length: int(fileInfo.Size())})
+			return nil
+		})
+		if err != nil {
+			return bencodeInfo{}, nil, err
+		}
+		if len(info.Files) == 0 {
+			return bencodeInfo{}, nil, fmt.Errorf("no files found in %s", rootPath)
+		}
+	}
+
+	totalLength := 0
+	for _, file := range diskFiles {
+		totalLength += file.Length
+	}
+	if totalLength == 0 {
+		return bencodeInfo{}, nil, fmt.Errorf("cannot create torrent from empty content %s", rootPath)
+	}
+
+	info.PieceLength = options.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = ChoosePieceLength(totalLength)
+	}
+	// 和 BEP 52 一样要求 piece length 是 2 的幂次，并且不小于 16 KiB
+	if info.PieceLength < MinPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return bencodeInfo{}, nil, fmt.Errorf("invalid piece length %d, must be a power of two and at least %d", info.PieceLength, MinPieceLength)
+	}
+
+	return info, diskFiles, nil
+}
+
+// 并发地对每个 piece 做 sha1，结果按 piece 的顺序拼接在一起
+func hashPieces(diskFiles []storage.File, pieceLength int, workers int) ([]byte, error) {
+	s := storage.New(diskFiles, false)
+	defer s.Close()
+
+	count := (s.Length + pieceLength - 1) / pieceLength
+	pieces := make([]byte, count*sha1.Size)
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	indexes := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, pieceLength)
+			for index := range indexes {
+				begin := index * pieceLength
+				end := begin + pieceLength
+				if end > s.Length {
+					end = s.Length
+				}
+				_, err := s.ReadAt(buffer[:end-begin], int64(begin))
+				if err != nil {
+					errs <- err
+					// 把剩下的 index 消费掉，避免阻塞发送方
+					for range indexes {
+					}
+					return
+				}
+				hash := sha1.Sum(buffer[:end-begin])
+				copy(pieces[index*sha1.Size:], hash[:])
+			}
+		}()
+	}
+
+	for index := 0; index < count; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+
+	return pieces, nil
+}
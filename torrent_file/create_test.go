@@ -0,0 +1,163 @@
+package torrentFile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChoosePieceLength(t *testing.T) {
+	tests := []struct {
+		input  int
+		output int
+	}{
+		{input: 1, output: MinPieceLength},
+		{input: 1500 * MinPieceLength, output: MinPieceLength},
+		{input: 1500*MinPieceLength + 1, output: 2 * MinPieceLength},
+		{input: 670040064, output: 512 * 1024},
+		{input: 1 << 45, output: MaxPieceLength},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.output, ChoosePieceLength(test.input))
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("goMule"), 10000)
+	path := filepath.Join(dir, "artifact.bin")
+	require.Nil(t, ioutil.WriteFile(path, content, 0644))
+
+	outPath := filepath.Join(dir, "artifact.torrent")
+	created, err := CreateFile(path, outPath, CreateOptions{
+		Announce: "http://tracker.example.com/announce",
+		AnnounceList: [][]string{
+			{"http://tracker.example.com/announce"},
+			{"http://backup.example.com/announce"},
+		},
+		Comment:      "nightly build",
+		CreationDate: time.Unix(1650000000, 0),
+		Private:      true,
+		URLList:      []string{"http://mirror.example.com/"},
+		PieceLength:  MinPieceLength,
+	})
+	require.Nil(t, err)
+
+	tf, err := Open(outPath)
+	require.Nil(t, err)
+	assert.Equal(t, created, tf)
+
+	assert.Equal(t, "artifact.bin", tf.Name)
+	assert.Equal(t, len(content), tf.Length)
+	assert.Nil(t, tf.Files)
+	assert.Equal(t, "http://tracker.example.com/announce", tf.Announce)
+	assert.Len(t, tf.AnnounceList, 2)
+	assert.Equal(t, "nightly build", tf.Comment)
+	assert.Equal(t, "goMule", tf.CreatedBy)
+	assert.Equal(t, int64(1650000000), tf.CreationDate)
+	assert.True(t, tf.Private)
+	assert.Equal(t, []string{"http://mirror.example.com/"}, tf.URLList)
+
+	require.Len(t, tf.PieceHashes, 4)
+	for index, hash := range tf.PieceHashes {
+		begin := index * MinPieceLength
+		end := begin + MinPieceLength
+		if end > len(content) {
+			end = len(content)
+		}
+		assert.Equal(t, sha1.Sum(content[begin:end]), hash)
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "release")
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "bin"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "README"), []byte("hello"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "bin", "tool"), bytes.Repeat([]byte{7}, 20000), 0644))
+
+	var buffer bytes.Buffer
+	created, err := Create(root, CreateOptions{PieceLength: MinPieceLength, Workers: 2}, &buffer)
+	require.Nil(t, err)
+
+	outPath := filepath.Join(dir, "release.torrent")
+	require.Nil(t, ioutil.WriteFile(outPath, buffer.Bytes(), 0644))
+	tf, err := Open(outPath)
+	require.Nil(t, err)
+	assert.Equal(t, created, tf)
+
+	assert.Equal(t, "release", tf.Name)
+	assert.Equal(t, 20005, tf.Length)
+	assert.Equal(t, []File{
+		{Length: 5, Path: []string{"README"}},
+		{Length: 20000, Path: []string{"bin", "tool"}, Offset: 5},
+	}, tf.Files)
+	assert.False(t, tf.Private)
+
+	// 第一个 piece 跨了两个文件
+	first := append([]byte("hello"), bytes.Repeat([]byte{7}, MinPieceLength-5)...)
+	assert.Equal(t, sha1.Sum(first), tf.PieceHashes[0])
+}
+
+func TestCreateEmpty(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Create(dir, CreateOptions{}, ioutil.Discard)
+	assert.NotNil(t, err)
+}
+
+func TestCreateCurrentDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "release")
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("goMule"), 0644))
+
+	wd, err := os.Getwd()
+	require.Nil(t, err)
+	require.Nil(t, os.Chdir(filepath.Join(dir, "sub")))
+	defer os.Chdir(wd)
+
+	// 种子的名字是目录本身的名字，而不是 . 或者 ..
+	for _, rootPath := range []string{"..", "../sub/.."} {
+		tf, err := Create(rootPath, CreateOptions{}, ioutil.Discard)
+		require.Nil(t, err, rootPath)
+		assert.Equal(t, "release", tf.Name, rootPath)
+	}
+	require.Nil(t, os.Chdir(dir))
+	tf, err := Create(".", CreateOptions{}, ioutil.Discard)
+	require.Nil(t, err)
+	assert.Equal(t, "release", tf.Name)
+	assert.Equal(t, []string{"a.txt"}, tf.Files[0].Path)
+}
+
+func TestCreatePieceLength(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "artifact.bin")
+	require.Nil(t, ioutil.WriteFile(path, bytes.Repeat([]byte("goMule"), 10000), 0644))
+
+	tests := map[int]bool{
+		MinPieceLength:       true,
+		4 * MinPieceLength:   true,
+		-1:                   false,
+		1:                    false,
+		MinPieceLength / 2:   false,
+		MinPieceLength + 1:   false,
+		3 * MinPieceLength:   false,
+		100 * MinPieceLength: false,
+	}
+	for pieceLength, valid := range tests {
+		tf, err := Create(path, CreateOptions{PieceLength: pieceLength}, ioutil.Discard)
+		if valid {
+			require.Nil(t, err, pieceLength)
+			assert.Equal(t, pieceLength, tf.PieceLength)
+		} else {
+			assert.NotNil(t, err, pieceLength)
+		}
+	}
+}
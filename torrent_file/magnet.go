@@ -0,0 +1,51 @@
+package torrentFile
+
+import (
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// 返回所有 tracker，announce-list 存在时以它为准，否则只有 announce
+func (t *TorrentFile) Trackers() []string {
+	var trackers []string
+	seen := make(map[string]bool)
+	add := func(tracker string) {
+		if tracker != "" && !seen[tracker] {
+			seen[tracker] = true
+			trackers = append(trackers, tracker)
+		}
+	}
+
+	for _, tier := range t.AnnounceList {
+		for _, tracker := range tier {
+			add(tracker)
+		}
+	}
+	add(t.Announce)
+	return trackers
+}
+
+// 生成磁力链接，格式为
+// magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>&ws=<web seed>
+// v2 种子的 xt 是 urn:btmh:1220<SHA-256 info hash>，hybrid 种子两个 xt 都有
+func (t *TorrentFile) MagnetURI() string {
+	var params []string
+	if !t.IsV2() || t.IsHybrid() {
+		params = append(params, "xt=urn:btih:"+hex.EncodeToString(t.InfoHash[:]))
+	}
+	if t.IsV2() {
+		// 0x12 表示 SHA-256，0x20 是 hash 的长度 (multihash)
+		params = append(params, "xt=urn:btmh:1220"+hex.EncodeToString(t.InfoHashV2[:]))
+	}
+	if t.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(t.Name))
+	}
+	for _, tracker := range t.Trackers() {
+		params = append(params, "tr="+url.QueryEscape(tracker))
+	}
+	for _, webSeed := range t.URLList {
+		params = append(params, "ws="+url.QueryEscape(webSeed))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
@@ -0,0 +1,72 @@
+package torrentFile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackers(t *testing.T) {
+	tests := map[string]struct {
+		input  TorrentFile
+		output []string
+	}{
+		"announce only": {
+			input:  TorrentFile{Announce: "http://a/announce"},
+			output: []string{"http://a/announce"},
+		},
+		"announce list with duplicates": {
+			input: TorrentFile{
+				Announce:     "http://a/announce",
+				AnnounceList: [][]string{{"http://a/announce"}, {"http://b/announce", "http://c/announce"}},
+			},
+			output: []string{"http://a/announce", "http://b/announce", "http://c/announce"},
+		},
+		"no trackers": {
+			input:  TorrentFile{},
+			output: nil,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.output, test.input.Trackers())
+	}
+}
+
+func TestMagnetURI(t *testing.T) {
+	tf := TorrentFile{
+		Announce: "http://bttracker.debian.org:6969/announce",
+		InfoHash: [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		Name:     "debian 10.iso",
+		URLList:  []string{"http://mirror/"},
+	}
+	expected := "magnet:?xt=urn:btih:d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6" +
+		"&dn=debian+10.iso" +
+		"&tr=http%3A%2F%2Fbttracker.debian.org%3A6969%2Fannounce" +
+		"&ws=http%3A%2F%2Fmirror%2F"
+	assert.Equal(t, expected, tf.MagnetURI())
+}
+
+func TestMagnetURIV2(t *testing.T) {
+	var infoHashV2 [32]byte
+	for i := range infoHashV2 {
+		infoHashV2[i] = byte(i)
+	}
+	v2Hash := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+	// v2 种子只有 btmh，截断的 info hash 不会作为 btih 出现
+	tf := TorrentFile{MetaVersion: MetaVersion2, InfoHashV2: infoHashV2, Name: "v2"}
+	tf.InfoHash = tf.TruncatedInfoHashV2()
+	assert.Equal(t, "magnet:?xt=urn:btmh:1220"+v2Hash+"&dn=v2", tf.MagnetURI())
+
+	// hybrid 种子两个都有，btih 是 v1 的 SHA-1 info hash
+	tf = TorrentFile{
+		MetaVersion: MetaVersion2,
+		InfoHash:    [20]byte{0xaa, 0xbb},
+		InfoHashV2:  infoHashV2,
+		PieceHashes: [][20]byte{{1}},
+		Name:        "hybrid",
+	}
+	assert.Equal(t, "magnet:?xt=urn:btih:aabb000000000000000000000000000000000000"+
+		"&xt=urn:btmh:1220"+v2Hash+"&dn=hybrid", tf.MagnetURI())
+}
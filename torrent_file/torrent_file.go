@@ -2,22 +2,59 @@ package torrentFile
 
 import (
 	"bytes"
-	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/jackpal/bencode-go"
+	bitField "github.com/strugglebak/goMule/bit_field"
+	event "github.com/strugglebak/goMule/event"
+	listener "github.com/strugglebak/goMule/listener"
+	logging "github.com/strugglebak/goMule/logging"
+	lsd "github.com/strugglebak/goMule/lsd"
+	mse "github.com/strugglebak/goMule/mse"
 	"github.com/strugglebak/goMule/p2p"
+	peerId "github.com/strugglebak/goMule/peer_id"
+	peers "github.com/strugglebak/goMule/peers"
+	rateLimiter "github.com/strugglebak/goMule/rate_limiter"
+	storage "github.com/strugglebak/goMule/storage"
 )
 
 type TorrentFile struct {
 	Announce			string
+	AnnounceList	[][]string
 	InfoHash			[20]byte
 	PieceHashes		[][20]byte
 	PieceLength		int
 	Length				int
 	Name					string
+	Files					[]File
+	Private				bool
+	URLList				[]string
+	Comment				string
+	CreatedBy			string
+	CreationDate	int64
+
+	// BEP 52，见 v2.go
+	MetaVersion		int													// v2 和 hybrid 种子为 2，v1 种子为 0
+	InfoHashV2		[32]byte
+	PiecesRoot		[32]byte										// v2 单文件种子的 merkle root，多文件种子在 File 中
+	PieceLayers		map[[32]byte][][32]byte	`json:"-"`	// pieces root 到这个文件的 piece layer
+}
+
+// 多文件 torrent 中的一个文件，Path 是相对于 Name 目录的路径
+// BEP 47 的 pad file 不在其中，它们只体现在 Offset 上
+type File struct {
+	Length			int
+	Path				[]string
+	Offset			int				// 文件在整个 torrent 数据中的起始偏移
+	PiecesRoot	[32]byte	// v2 种子中这个文件的 merkle root，长度为 0 的文件没有
 }
 
 func Open(filePath string) (TorrentFile, error) {
@@ -29,61 +66,466 @@ func Open(filePath string) (TorrentFile, error) {
 	// 等待 Open 函数结束，会自动执行 file.Close()
 	defer file.Close()
 
+	buffer, err := ioutil.ReadAll(file)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	return Parse(buffer)
+}
+
+// 解析 .torrent 文件的内容
+func Parse(buffer []byte) (TorrentFile, error) {
 	bt := bencodeTorrent{}
 	// 解析种子文件结构，并将对应的字段写入到 bt 中
-	err = bencode.Unmarshal(file, &bt)
+	err := bencode.Unmarshal(bytes.NewReader(buffer), &bt)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	// url-list 既可以是一个列表，也可以是单个字符串
+	if len(bt.URLList) == 0 {
+		single := struct {
+			URLList	string	`bencode:"url-list"`
+		}{}
+		err = bencode.Unmarshal(bytes.NewReader(buffer), &single)
+		if err == nil && single.URLList != "" {
+			bt.URLList = []string{single.URLList}
+		}
+	}
+
+	torrentFile, err := bt.ToTorrentFile()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	err = torrentFile.parseV2(buffer)
 	if err != nil {
 		return TorrentFile{}, err
 	}
-	return bt.ToTorrentFile()
+	return torrentFile, nil
+}
+
+// 下载时的可选项
+type DownloadOptions struct {
+	Port					uint16
+	MaxPeers			int				// 同时连接的 peer 数量上限，为 0 时不限制
+	DownloadRate	int				// 每秒下载的 byte 数量上限，为 0 时不限速
+	UploadRate		int				// 每秒上传的 byte 数量上限，为 0 时不限速
+	Trackers			[]string	// 不为空时代替种子里的 tracker
+	Sequential		bool			// 按顺序下载 piece，方便边下边读
+	Encryption		mse.Policy	// 和 peer 连接时的加密策略 (MSE/PE)
+	IdleTimeout		time.Duration	// peer 超过这么久没有有用的数据往来时断开，为 0 时使用 p2p.DefaultIdleTimeout
+	// 之前的会话中累计上传和下载的 byte 数量，announce 时报告给 tracker
+	Uploaded		int64
+	Downloaded	int64
+	// 不为 nil 时通过 BEP 14 在局域网中寻找 peer，私有种子不会使用
+	LocalDiscovery	*lsd.Service
+	// 不为 nil 时接受其他 peer 主动发起的连接，PeerID 为全 0 时使用 Listener 的 peer ID
+	// 它应该监听在 Port 上，这样 tracker 返回给其他 peer 的地址才能连上
+	Listener	*listener.Listener
+	// 多文件 torrent 中每个文件的优先级 (p2p.PrioritySkip、p2p.PriorityNormal、p2p.PriorityHigh)
+	// 为空时所有文件都是 p2p.PriorityNormal
+	FilePriorities	[]int
+	// 以下几项让多个种子共用同一个 peer ID 和限速器，见 session 包
+	PeerID					[20]byte							// 全 0 时用 peerId.Generate 生成
+	DownloadLimiter	*rateLimiter.Limiter	// 不为 nil 时代替 DownloadRate
+	UploadLimiter		*rateLimiter.Limiter	// 不为 nil 时代替 UploadRate
+	Completed				bitField.BitField			// 磁盘上已经校验过的 piece，不会再下载
+	Peers						[]peers.Peer					// tracker 之外的 peer，比如上次连接过的
+	// 下载过程中的事件会发到这里，包括开始下载之前向 tracker 请求 peer 的结果
+	// 为 nil 时会创建一个，可以通过返回的 p2p.Torrent 的 Events 订阅
+	Events	*event.Bus
+	Logger	*slog.Logger	// 为 nil 时使用 slog.Default()
+}
+
+// 多文件 torrent 会保存在 outputDir/Name 这个目录下，单文件则保存为 outputDir/Name
+func (t *TorrentFile) StorageFiles(outputDir string) []storage.File {
+	return t.ContentFiles(filepath.Join(outputDir, t.Name))
+}
+
+// contentPath 对于单文件 torrent 就是文件本身，对于多文件 torrent 是存放所有文件的目录
+func (t *TorrentFile) ContentFiles(contentPath string) []storage.File {
+	if len(t.Files) == 0 {
+		return []storage.File{{
+			Path: contentPath,
+			Length: t.Length,
+		}}
+	}
+
+	files := make([]storage.File, len(t.Files))
+	for i, file := range t.Files {
+		files[i] = storage.File{
+			Path: filepath.Join(append([]string{contentPath}, file.Path...)...),
+			Length: file.Length,
+			Offset: file.Offset,
+		}
+	}
+	return files
+}
+
+// 按照种子中的偏移构建 Storage，pad file 占的空间不会写到磁盘上
+func (t *TorrentFile) newStorage(contentPath string, writable bool) *storage.Storage {
+	return storage.NewLayout(t.ContentFiles(contentPath), t.Length, writable)
 }
 
-func (t *TorrentFile) DownloadAndSaveFile(savePath string, port uint16) error {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+// 按照 priorities 设置每个文件的优先级，priorities 为空时都是 p2p.PriorityNormal
+func (t *TorrentFile) p2pFiles(priorities []int) ([]p2p.File, error) {
+	if len(priorities) > 0 && len(priorities) != len(t.Files) {
+		return nil, fmt.Errorf("got %d file priorities for %d files", len(priorities), len(t.Files))
+	}
+	var files []p2p.File
+	for index, file := range t.Files {
+		priority := p2p.PriorityNormal
+		if len(priorities) > 0 {
+			priority = priorities[index]
+		}
+		if priority < p2p.PrioritySkip || priority > p2p.PriorityHigh {
+			return nil, fmt.Errorf("invalid priority %d for file #%d", priority, index)
+		}
+		files = append(files, p2p.File{
+			Length: file.Length,
+			Priority: priority,
+			Path: file.Path,
+			Offset: file.Offset,
+		})
+	}
+	return files, nil
+}
+
+// 向 tracker 请求 peers，然后在后台开始下载到 outputDir 中
+// 返回的 p2p.Torrent 可以用来等待下载完成，或者通过 NewReader 边下边读
+func (t *TorrentFile) StartDownload(outputDir string, options DownloadOptions) (*p2p.Torrent, error) {
+	files, err := t.p2pFiles(options.FilePriorities)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	peers, err := t.RequestPeers(peerID, port)
+	peerID, err := options.peerID()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	downloadLimiter := options.DownloadLimiter
+	if downloadLimiter == nil {
+		downloadLimiter = rateLimiter.New(options.DownloadRate)
+	}
+	uploadLimiter := options.UploadLimiter
+	if uploadLimiter == nil {
+		uploadLimiter = rateLimiter.New(options.UploadRate)
+	}
+
+	events := options.Events
+	if events == nil {
+		events = &event.Bus{}
+	}
+	logger := logging.OrDefault(options.Logger)
+	trackers := t.announceList(options)
+	peerList, err := t.announce(events, logger, trackers, t.InfoHash, peerID, options.Port, options.Uploaded, options.Downloaded, t.Length)
+	// hybrid 种子同时加入 v2 的 swarm
+	var altPeers []peers.Peer
+	if t.IsHybrid() {
+		var altErr error
+		altPeers, altErr = t.announce(events, logger, trackers, t.TruncatedInfoHashV2(), peerID, options.Port, options.Uploaded, options.Downloaded, t.Length)
+		// 两个 swarm 中有一个成功就可以
+		if altErr == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		// 有 web seed 或者其他来源的 peer 时，tracker 失败也可以下载
+		if len(t.URLList) == 0 && len(options.Peers) == 0 {
+			return nil, err
+		}
+		logger.Warn("no peers from tracker, downloading from other sources", logging.InfoHash(t.InfoHash),
+			slog.Int("web_seeds", len(t.URLList)), slog.Int("peers", len(options.Peers)))
 	}
+	peerList = append(peerList, options.Peers...)
 
-	torrent := p2p.Torrent{
-		Peers:       peers,
+	s := t.newStorage(filepath.Join(outputDir, t.Name), true)
+	// 跨了被跳过的文件的 piece，属于被跳过的文件的那部分数据放在这里
+	s.PartPath = filepath.Join(outputDir, "." + t.Name + ".parts")
+	for index, file := range files {
+		err = s.SetSkip(index, file.Priority == p2p.PrioritySkip)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	err = s.Allocate()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	torrent := &p2p.Torrent{
+		Peers:       peerList,
 		PeerID:      peerID,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		MaxPeers:        options.MaxPeers,
+		DownloadLimiter: downloadLimiter,
+		UploadLimiter:   uploadLimiter,
+		Sequential:      options.Sequential,
+		Encryption:      options.Encryption,
+		IdleTimeout:     options.IdleTimeout,
+		Completed:       options.Completed,
+		Events:          events,
+		Logger:          options.Logger,
+		Store:           s,
+		Files:           files,
+		WebSeeds:        t.URLList,
+		PieceRoots:      t.PieceRoots(),
+	}
+	if t.IsHybrid() {
+		torrent.AltInfoHash = t.TruncatedInfoHashV2()
+		torrent.AltPeers = altPeers
 	}
-	buffer, err := torrent.Download()
+	err = torrent.Start()
 	if err != nil {
-		return err
+		s.Close()
+		return nil, err
 	}
 
-	file, err := os.Create(savePath)
+	// 局域网中的 peer 不用排队，优先连接
+	if options.LocalDiscovery != nil && !t.Private {
+		options.LocalDiscovery.Add(t.InfoHash, torrent.AddLocalPeer)
+		if t.IsHybrid() {
+			options.LocalDiscovery.Add(torrent.AltInfoHash, torrent.AddLocalAltPeer)
+		}
+	}
+	t.accept(torrent, options.Listener)
+
+	return torrent, nil
+}
+
+// 向 tracker 宣布我们在做种，然后在后台把 outputDir 中已有的数据上传给连入的 peer
+// options.Completed 为 nil 时数据必须是完整的，调用之前应该用 VerifyDir 校验过
+// 做种只能等其他 peer 连接我们，所以 options.Listener 不能为 nil
+// 返回的 p2p.Torrent 不会自己结束，不需要时调用 Close
+func (t *TorrentFile) StartSeeding(outputDir string, options DownloadOptions) (*p2p.Torrent, error) {
+	if options.Listener == nil {
+		return nil, fmt.Errorf("seeding %s needs a listener for inbound connections", t.Name)
+	}
+	files, err := t.p2pFiles(options.FilePriorities)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	peerID, err := options.peerID()
+	if err != nil {
+		return nil, err
+	}
+	events := options.Events
+	if events == nil {
+		events = &event.Bus{}
+	}
+	logger := logging.OrDefault(options.Logger)
+	trackers := t.announceList(options)
+	// 做种时 tracker 返回的 peer 用不上，失败了也可以等局域网中的 peer 连接
+	t.announce(events, logger, trackers, t.InfoHash, peerID, options.Port, options.Uploaded, options.Downloaded, 0)
+	if t.IsHybrid() {
+		t.announce(events, logger, trackers, t.TruncatedInfoHashV2(), peerID, options.Port, options.Uploaded, options.Downloaded, 0)
 	}
 
-	defer file.Close()
+	// 只下载了部分文件时，只上传已经有的 piece
+	completed := options.Completed
+	if completed == nil {
+		completed = make(bitField.BitField, (t.PieceCount()+7)/8)
+		for index := 0; index < t.PieceCount(); index++ {
+			completed.SetPiece(index)
+		}
+	}
+	uploadLimiter := options.UploadLimiter
+	if uploadLimiter == nil {
+		uploadLimiter = rateLimiter.New(options.UploadRate)
+	}
+	s := t.newStorage(filepath.Join(outputDir, t.Name), false)
+	s.PartPath = filepath.Join(outputDir, "." + t.Name + ".parts")
+	torrent := &p2p.Torrent{
+		PeerID:      peerID,
+		InfoHash:    t.InfoHash,
+		PieceHashes: t.PieceHashes,
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Name:        t.Name,
+		MaxPeers:        options.MaxPeers,
+		DownloadLimiter: options.DownloadLimiter,
+		UploadLimiter:   uploadLimiter,
+		IdleTimeout:     options.IdleTimeout,
+		UploadOnly:      true,
+		Completed:       completed,
+		Events:          events,
+		Logger:          options.Logger,
+		Store:           s,
+		Files:           files,
+		PieceRoots:      t.PieceRoots(),
+	}
+	if t.IsHybrid() {
+		torrent.AltInfoHash = t.TruncatedInfoHashV2()
+	}
+	err = torrent.Start()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	// 局域网中的 peer 会根据 announce 连接我们，我们不需要去连接它们
+	if options.LocalDiscovery != nil && !t.Private {
+		options.LocalDiscovery.Add(t.InfoHash, func(peers.Peer) {})
+		if t.IsHybrid() {
+			options.LocalDiscovery.Add(torrent.AltInfoHash, func(peers.Peer) {})
+		}
+	}
+	t.accept(torrent, options.Listener)
+
+	return torrent, nil
+}
+
+// 全 0 时使用 Listener 的 peer ID，没有 Listener 时生成一个 -GM0001- 开头的
+func (options *DownloadOptions) peerID() ([20]byte, error) {
+	peerID := options.PeerID
+	if peerID == ([20]byte{}) && options.Listener != nil {
+		peerID = options.Listener.PeerID()
+	}
+	if peerID == ([20]byte{}) {
+		return peerId.Generate()
+	}
+	return peerID, nil
+}
+
+// 把连入的连接交给 torrent，hybrid 种子在 v1 和 v2 swarm 中的连接都要接受
+func (t *TorrentFile) accept(torrent *p2p.Torrent, l *listener.Listener) {
+	if l == nil {
+		return
+	}
+	if !t.IsV2() {
+		l.Add(t.InfoHash, torrent.AcceptPeer)
+		return
+	}
+	l.AddV2(t.InfoHash, torrent.AcceptPeer)
+	if t.IsHybrid() {
+		l.AddV2(torrent.AltInfoHash, torrent.AcceptPeer)
+	}
+}
+
+// 停止接受 torrent 的连接，LocalDiscovery 和 Listener 都可以为 nil
+func (options *DownloadOptions) Remove(torrent *p2p.Torrent) {
+	for _, infoHash := range [][20]byte{torrent.InfoHash, torrent.AltInfoHash} {
+		if infoHash == ([20]byte{}) {
+			continue
+		}
+		if options.LocalDiscovery != nil {
+			options.LocalDiscovery.Remove(infoHash)
+		}
+		if options.Listener != nil {
+			options.Listener.Remove(infoHash)
+		}
+	}
+}
 
-	_, err = file.Write(buffer)
+// 要 announce 的 tracker，按 BEP 12 分成若干层 (tier)，每一层中 tracker 的顺序是随机的
+// options.Trackers 不为空时代替种子里的 tracker，它们按给出的顺序各自是一层
+// 返回的是一份拷贝，announce 会调整其中的顺序，但不会修改 t，同一个 TorrentFile 可以用不同的 options 多次下载
+func (t *TorrentFile) announceList(options DownloadOptions) [][]string {
+	var tiers [][]string
+	if len(options.Trackers) > 0 {
+		for _, tracker := range options.Trackers {
+			tiers = append(tiers, []string{tracker})
+		}
+		return tiers
+	}
+
+	seen := make(map[string]bool)
+	for _, tier := range t.AnnounceList {
+		var trackers []string
+		for _, tracker := range tier {
+			if tracker != "" && !seen[tracker] {
+				seen[tracker] = true
+				trackers = append(trackers, tracker)
+			}
+		}
+		if len(trackers) == 0 {
+			continue
+		}
+		rand.Shuffle(len(trackers), func(i, j int) { trackers[i], trackers[j] = trackers[j], trackers[i] })
+		tiers = append(tiers, trackers)
+	}
+	// 没有 announce-list 时只有 announce，有的种子的 announce 不在 announce-list 中，作为最后一层
+	if t.Announce != "" && !seen[t.Announce] {
+		tiers = append(tiers, []string{t.Announce})
+	}
+	return tiers
+}
+
+// 按 BEP 12 从第一层开始依次请求每个 tracker，第一个成功的 tracker 返回的 peer 就是结果，不再请求后面的
+// 成功的 tracker 被移到它那一层的最前面，之后 (比如 hybrid 种子的另一个 info hash) 先请求它
+// 每个 tracker 的结果都作为事件发出去，所有 tracker 都失败时返回最后一个错误
+func (t *TorrentFile) announce(events *event.Bus, logger *slog.Logger, tiers [][]string, infoHash, peerID [20]byte, port uint16, uploaded, downloaded int64, left int) ([]peers.Peer, error) {
+	var lastErr error
+	for _, tier := range tiers {
+		for i, tracker := range tier {
+			peerList, err := t.announceTo(events, logger, tracker, infoHash, peerID, port, uploaded, downloaded, left)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = tracker
+			return peerList, nil
+		}
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("%s has no tracker", t.Name)
+	}
+	return nil, lastErr
+}
+
+// 向一个 tracker 请求 peer，并且把结果作为事件发出去
+func (t *TorrentFile) announceTo(events *event.Bus, logger *slog.Logger, tracker string, infoHash, peerID [20]byte, port uint16, uploaded, downloaded int64, left int) ([]peers.Peer, error) {
+	logger = logger.With(logging.InfoHash(infoHash), slog.String("torrent", t.Name), slog.String("tracker", tracker))
+	start := time.Now()
+	peerList, err := t.requestPeers(tracker, infoHash, peerID, port, uploaded, downloaded, left)
+	duration := time.Since(start)
+	if err != nil {
+		class := logging.ErrorClass(err)
+		if class == logging.ClassProtocol {
+			// 能连上 tracker，但是响应解析不了
+			class = logging.ClassTracker
+		}
+		logger.Warn("tracker announce failed", logging.ClassifiedError(err, class))
+		events.Publish(event.Event{Type: event.TrackerErrored, InfoHash: infoHash, Name: t.Name, Tracker: tracker, Duration: duration, Err: err})
+		return nil, err
+	}
+	logger.Info("tracker announced", slog.Int("peers", len(peerList)), slog.Duration("duration", duration))
+	events.Publish(event.Event{Type: event.TrackerAnnounced, InfoHash: infoHash, Name: t.Name, Tracker: tracker, PeerCount: len(peerList), Duration: duration})
+	return peerList, nil
+}
+
+// 下载到 outputDir 中，阻塞直到下载完成，需要显示进度时订阅 options.Events
+func (t *TorrentFile) DownloadAndSaveFile(outputDir string, options DownloadOptions) error {
+	torrent, err := t.StartDownload(outputDir, options)
 	if err != nil {
 		return err
 	}
+	defer torrent.Close()
+	defer options.Remove(torrent)
 
-	return nil
+	return torrent.Wait(nil)
+}
+
+type bencodeFile struct {
+	Length	int				`bencode:"length"`
+	Path		[]string	`bencode:"path"`
+	Attr		string		`bencode:"attr,omitempty"`	// BEP 47，包含 p 时是 pad file
 }
 
 type bencodeInfo struct {
-	Pieces				string	`bencode:"pieces"`
-	PieceLength		int			`bencode:"piece length"`
-	Length				int			`bencode:"length"`
-	Name					string	`bencode:"name"`
+	Pieces				string				`bencode:"pieces"`
+	PieceLength		int						`bencode:"piece length"`
+	Length				int						`bencode:"length,omitempty"`
+	Name					string				`bencode:"name"`
+	Files					[]bencodeFile	`bencode:"files,omitempty"`
+	Private				int						`bencode:"private,omitempty"`
 }
 func (bi *bencodeInfo) GenerateInfoHash() ([20]byte, error) {
 	var buffer bytes.Buffer
@@ -116,8 +558,13 @@ func (bi *bencodeInfo) SplitPieceHashes() ([][20]byte, error) {
 }
 
 type bencodeTorrent struct {
-	Announce	string			`bencode:"announce"`
-	Info			bencodeInfo	`bencode:"info"`
+	Announce			string				`bencode:"announce,omitempty"`
+	AnnounceList	[][]string		`bencode:"announce-list,omitempty"`
+	Comment				string				`bencode:"comment,omitempty"`
+	CreatedBy			string				`bencode:"created by,omitempty"`
+	CreationDate	int64					`bencode:"creation date,omitempty"`
+	URLList				[]string			`bencode:"url-list,omitempty"`
+	Info					bencodeInfo		`bencode:"info"`
 }
 
 func (bt *bencodeTorrent) ToTorrentFile() (TorrentFile, error) {
@@ -130,14 +577,68 @@ func (bt *bencodeTorrent) ToTorrentFile() (TorrentFile, error) {
 		return TorrentFile{}, err
 	}
 
+	err = checkPathComponent(bt.Info.Name)
+	if err != nil {
+		return TorrentFile{}, fmt.Errorf("invalid name: %w", err)
+	}
+
+	// 多文件 torrent 没有 length 字段，总大小是所有文件大小之和
+	length := bt.Info.Length
+	var files []File
+	for _, file := range bt.Info.Files {
+		if len(file.Path) == 0 {
+			return TorrentFile{}, fmt.Errorf("received file without path in %s", bt.Info.Name)
+		}
+		// pad file 只是为了让下一个文件对齐到 piece 的边界，不需要保存
+		if !strings.Contains(file.Attr, "p") {
+			err = checkPath(file.Path)
+			if err != nil {
+				return TorrentFile{}, err
+			}
+			files = append(files, File{
+				Length: file.Length,
+				Path: file.Path,
+				Offset: length,
+			})
+		}
+		length += file.Length
+	}
+
 	torrentFile := TorrentFile {
 		Announce: bt.Announce,
+		AnnounceList: bt.AnnounceList,
 		InfoHash: infoHash,
 		PieceHashes: pieceHashes,
 		PieceLength: bt.Info.PieceLength,
-		Length: bt.Info.Length,
+		Length: length,
 		Name: bt.Info.Name,
+		Files: files,
+		Private: bt.Info.Private == 1,
+		URLList: bt.URLList,
+		Comment: bt.Comment,
+		CreatedBy: bt.CreatedBy,
+		CreationDate: bt.CreationDate,
 	}
 
 	return torrentFile, nil
 }
+
+// name 和文件路径的每一段都会直接拼到输出目录下面，恶意的种子可以用 ".."、绝对路径
+// 或者带分隔符的名字把文件写到输出目录之外，所以解析时就拒绝它们
+func checkPathComponent(component string) error {
+	if component == "" || component == "." || component == ".." ||
+		strings.ContainsAny(component, "/\\\x00") || filepath.IsAbs(component) || filepath.VolumeName(component) != "" {
+		return fmt.Errorf("unsafe path component %q", component)
+	}
+	return nil
+}
+
+func checkPath(path []string) error {
+	for _, component := range path {
+		err := checkPathComponent(component)
+		if err != nil {
+			return fmt.Errorf("invalid file path %q: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -1,13 +1,23 @@
 package torrentFile
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jackpal/bencode-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	listener "github.com/strugglebak/goMule/listener"
 )
 
 // 命令行执行 -update
@@ -87,3 +97,90 @@ func TestToTorrentFile(t *testing.T) {
 		assert.Equal(t, test.output, to)
 	}
 }
+
+func TestParsePathTraversal(t *testing.T) {
+	parse := func(name string, path []string) error {
+		bt := bencodeTorrent{Info: bencodeInfo{
+			Pieces:      "1234567890abcdefghij",
+			PieceLength: 16384,
+			Name:        name,
+			Files:       []bencodeFile{{Length: 1, Path: path}},
+		}}
+		var buffer bytes.Buffer
+		require.Nil(t, bencode.Marshal(&buffer, bt))
+		_, err := Parse(buffer.Bytes())
+		return err
+	}
+
+	assert.Nil(t, parse("files", []string{"dir", "a.txt"}))
+	// pad file 不会写到磁盘上
+	bt := bencodeTorrent{Info: bencodeInfo{
+		Pieces:      "1234567890abcdefghij",
+		PieceLength: 16384,
+		Name:        "files",
+		Files:       []bencodeFile{{Length: 1, Path: []string{"a"}}, {Length: 1, Path: []string{".pad", "1"}, Attr: "p"}},
+	}}
+	_, err := bt.ToTorrentFile()
+	assert.Nil(t, err)
+
+	for _, name := range []string{"", ".", "..", "../evil", "/etc", "a\\b", "a\x00b"} {
+		assert.NotNil(t, parse(name, []string{"a"}), "name %q", name)
+	}
+	for _, path := range [][]string{{".."}, {"..", "..", "evil"}, {"dir", ".."}, {"/etc", "passwd"}, {"a/../../b"}, {""}, {"."}, {"a\\..\\b"}} {
+		assert.NotNil(t, parse("files", path), "path %q", path)
+	}
+}
+
+func TestStartSeeding(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "data")
+	require.Nil(t, os.MkdirAll(root, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "a"), bytes.Repeat([]byte{1}, 20000), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "b"), bytes.Repeat([]byte{2}, 30000), 0644))
+
+	l, err := listener.Listen("127.0.0.1:0", listener.Options{})
+	require.Nil(t, err)
+	defer l.Close()
+
+	// tracker 把做种的地址返回给所有 peer，并记下每次请求的 left
+	var mutex sync.Mutex
+	var lefts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		lefts = append(lefts, r.URL.Query().Get("left"))
+		mutex.Unlock()
+		port := l.Port()
+		w.Write([]byte("d8:intervali900e5:peers6:" + string([]byte{127, 0, 0, 1, byte(port >> 8), byte(port)}) + "e"))
+	}))
+	defer ts.Close()
+
+	tf, err := Create(root, CreateOptions{Announce: ts.URL, PieceLength: MinPieceLength}, ioutil.Discard)
+	require.Nil(t, err)
+
+	_, err = tf.StartSeeding(dir, DownloadOptions{Port: l.Port()})
+	assert.NotNil(t, err)
+	seeder, err := tf.StartSeeding(dir, DownloadOptions{Port: l.Port(), Listener: l})
+	require.Nil(t, err)
+	defer seeder.Close()
+	assert.Equal(t, l.PeerID(), seeder.PeerID)
+	done, wanted := seeder.Progress()
+	assert.Equal(t, wanted, done)
+
+	output := t.TempDir()
+	leecher, err := tf.StartDownload(output, DownloadOptions{})
+	require.Nil(t, err)
+	defer leecher.Close()
+	require.Nil(t, leecher.Wait(nil))
+	for _, name := range []string{"a", "b"} {
+		expected, err := ioutil.ReadFile(filepath.Join(root, name))
+		require.Nil(t, err)
+		actual, err := ioutil.ReadFile(filepath.Join(output, "data", name))
+		require.Nil(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	assert.Eventually(t, func() bool { return seeder.Uploaded() == 50000 }, 5*time.Second, 10*time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"0", "50000"}, lefts)
+}
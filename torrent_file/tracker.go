@@ -1,37 +1,51 @@
 package torrentFile
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackpal/bencode-go"
 	peers "github.com/strugglebak/goMule/peers"
 )
 
-type bencodeTrackerResponse struct {
-	Interval	int			`bencode:"interval"`
-	Peers			string	`bencode:"peers"`
+func (torrentFile *TorrentFile) BuildTrackerURL(
+	peerID [20]byte,
+	port uint16,
+) (string, error) {
+	return torrentFile.buildTrackerURL(torrentFile.Announce, torrentFile.InfoHash, peerID, port, 0, 0, torrentFile.Length)
 }
 
-func (torrentFile *TorrentFile) BuildTrackerURL(
+// hybrid 种子要用 v1 和 v2 两个 info hash 分别向 tracker 请求
+// uploaded 和 downloaded 是这个种子累计上传和下载的 byte 数量，包括之前的会话
+// left 是还需要下载的 byte 数量，做种时为 0
+func (torrentFile *TorrentFile) buildTrackerURL(
+	announce string,
+	infoHash [20]byte,
 	peerID [20]byte,
-	port	 uint16,
+	port uint16,
+	uploaded int64,
+	downloaded int64,
+	left int,
 ) (string, error) {
-	baseURL, err := url.Parse(torrentFile.Announce)
+	baseURL, err := url.Parse(announce)
 	if err != nil {
 		return "", err
 	}
 
-	params := url.Values {
-		"info_hash":		[]string{ string(torrentFile.InfoHash[:]) },
-		"peer_id":   	 	[]string{ string(peerID[:]) },
-		"port":      	 	[]string{ string(strconv.Itoa(int(port))) },
-		"uploaded":  	 	[]string{ "0" },
-		"downloaded":  	[]string{ "0" },
-		"compact":		 	[]string{ "1" },
-		"left":				 	[]string{ strconv.Itoa(torrentFile.Length) },
+	params := url.Values{
+		"info_hash":  []string{string(infoHash[:])},
+		"peer_id":    []string{string(peerID[:])},
+		"port":       []string{string(strconv.Itoa(int(port)))},
+		"uploaded":   []string{strconv.FormatInt(uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(downloaded, 10)},
+		"compact":    []string{"1"},
+		"left":       []string{strconv.Itoa(left)},
 	}
 
 	baseURL.RawQuery = params.Encode()
@@ -40,16 +54,28 @@ func (torrentFile *TorrentFile) BuildTrackerURL(
 
 func (torrentFile *TorrentFile) RequestPeers(
 	peerID [20]byte,
-	port	 uint16,
-) ([] peers.Peer, error) {
+	port uint16,
+) ([]peers.Peer, error) {
+	return torrentFile.requestPeers(torrentFile.Announce, torrentFile.InfoHash, peerID, port, 0, 0, torrentFile.Length)
+}
+
+func (torrentFile *TorrentFile) requestPeers(
+	announce string,
+	infoHash [20]byte,
+	peerID [20]byte,
+	port uint16,
+	uploaded int64,
+	downloaded int64,
+	left int,
+) ([]peers.Peer, error) {
 	// 构建 tracker url
-	trackerURL, err := torrentFile.BuildTrackerURL(peerID, port)
+	trackerURL, err := torrentFile.buildTrackerURL(announce, infoHash, peerID, port, uploaded, downloaded, left)
 	if err != nil {
 		return nil, err
 	}
 
 	// 发送 get 请求
-	httpClient := &http.Client{ Timeout: 15 * time.Second }
+	httpClient := &http.Client{Timeout: 15 * time.Second}
 	response, err := httpClient.Get(trackerURL)
 	if err != nil {
 		return nil, err
@@ -57,12 +83,134 @@ func (torrentFile *TorrentFile) RequestPeers(
 
 	defer response.Body.Close()
 
-	// 把 get 请求回的 response 解析并装载进 trackerResponse
-	trackerResponse := bencodeTrackerResponse{}
-	err = bencode.Unmarshal(response.Body, &trackerResponse)
+	// 把 get 请求回的 response 解析出来
+	// peers 可能是 compact 格式的字符串，也可能是字典的列表，所以不能直接 Unmarshal 到结构体里
+	decoded, err := bencode.Decode(response.Body)
 	if err != nil {
 		return nil, err
 	}
+	trackerResponse, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("malformed tracker response")
+	}
 
-	return peers.Unmarshal([]byte(trackerResponse.Peers))
+	return parseTrackerPeers(trackerResponse["peers"])
+}
+
+// 解析 tracker 返回的 peers
+// 虽然请求时带了 compact=1，有的 tracker 仍然返回 [{ip, port, peer id}, ...] 这种列表，这时可以拿到 peer ID
+func parseTrackerPeers(value interface{}) ([]peers.Peer, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return peers.Unmarshal([]byte(value))
+	case []interface{}:
+		result := make([]peers.Peer, 0, len(value))
+		for _, item := range value {
+			dict, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("received malformed peers")
+			}
+			host, _ := dict["ip"].(string)
+			port, _ := dict["port"].(int64)
+			ip := net.ParseIP(host)
+			if ip == nil || port <= 0 || port > 65535 {
+				// 有的 tracker 会返回域名，不认识的跳过
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			peer := peers.Peer{IP: ip, Port: uint16(port)}
+			if id, ok := dict["peer id"].(string); ok && len(id) == len(peer.ID) {
+				copy(peer.ID[:], id)
+			}
+			result = append(result, peer)
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("received malformed peers")
+	}
+}
+
+// tracker scrape 的结果，Downloaders 见 BEP 21
+type ScrapeResult struct {
+	Complete    int // 做种的 peer 数量
+	Incomplete  int // 没有完整数据的 peer 数量，包括只下载了部分文件、已经不再下载的
+	Downloaded  int // 累计完成下载的次数
+	Downloaders int // 真正还在下载的 peer 数量，tracker 没有返回时等于 Incomplete
+}
+
+// announce URL 不是以 announce 结尾的 tracker 不支持 scrape
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// 按惯例把 announce URL 路径最后一段开头的 announce 换成 scrape
+// 比如 http://example.com/x/announce.php 对应 http://example.com/x/scrape.php
+func ScrapeURL(announce string) (string, error) {
+	baseURL, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	slash := strings.LastIndex(baseURL.Path, "/")
+	if !strings.HasPrefix(baseURL.Path[slash+1:], "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	baseURL.Path = baseURL.Path[:slash+1] + "scrape" + strings.TrimPrefix(baseURL.Path[slash+1:], "announce")
+	baseURL.RawPath = ""
+	return baseURL.String(), nil
+}
+
+// 向 tracker 查询这个种子的 swarm 中做种和下载的 peer 数量
+func (torrentFile *TorrentFile) Scrape() (ScrapeResult, error) {
+	scrapeURL, err := ScrapeURL(torrentFile.Announce)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	baseURL, err := url.Parse(scrapeURL)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	query := baseURL.Query()
+	query.Set("info_hash", string(torrentFile.InfoHash[:]))
+	baseURL.RawQuery = query.Encode()
+
+	httpClient := &http.Client{Timeout: 15 * time.Second}
+	response, err := httpClient.Get(baseURL.String())
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	defer response.Body.Close()
+
+	decoded, err := bencode.Decode(response.Body)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	scrapeResponse, ok := decoded.(map[string]interface{})
+	if !ok {
+		return ScrapeResult{}, fmt.Errorf("malformed scrape response")
+	}
+	if reason, ok := scrapeResponse["failure reason"].(string); ok {
+		return ScrapeResult{}, fmt.Errorf("tracker failure: %s", reason)
+	}
+	files, _ := scrapeResponse["files"].(map[string]interface{})
+	stats, ok := files[string(torrentFile.InfoHash[:])].(map[string]interface{})
+	if !ok {
+		return ScrapeResult{}, fmt.Errorf("tracker does not know %s", torrentFile.Name)
+	}
+
+	count := func(key string) int {
+		value, _ := stats[key].(int64)
+		return int(value)
+	}
+	result := ScrapeResult{
+		Complete:    count("complete"),
+		Incomplete:  count("incomplete"),
+		Downloaded:  count("downloaded"),
+		Downloaders: count("incomplete"),
+	}
+	if _, ok := stats["downloaders"]; ok {
+		result.Downloaders = count("downloaders")
+	}
+	return result, nil
 }
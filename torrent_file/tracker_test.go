@@ -1,12 +1,16 @@
 package torrentFile
 
 import (
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	neturl "net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	event "github.com/strugglebak/goMule/event"
 	peers "github.com/strugglebak/goMule/peers"
 )
 
@@ -28,6 +32,15 @@ func TestBuildTrackerURL(t *testing.T) {
 	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6881&uploaded=0"
 	assert.Nil(t, err)
 	assert.Equal(t, url, expected)
+
+	// 之前的会话中累计的流量也要报告给 tracker
+	trackerURL, err := to.buildTrackerURL(to.Announce, to.InfoHash, peerID, port, 1000, 2000, 0)
+	assert.Nil(t, err)
+	parsed, err := neturl.Parse(trackerURL)
+	assert.Nil(t, err)
+	assert.Equal(t, "1000", parsed.Query().Get("uploaded"))
+	assert.Equal(t, "2000", parsed.Query().Get("downloaded"))
+	assert.Equal(t, "0", parsed.Query().Get("left"))
 }
 
 func TestRequestPeers(t *testing.T) {
@@ -64,3 +77,169 @@ func TestRequestPeers(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, p)
 }
+
+func TestRequestPeersDictionary(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peersl" +
+			"d2:ip9:127.0.0.17:peer id20:-GM0001-abcdefghijkl4:porti6881ee" +
+			"d2:ip3:::14:porti6889ee" +
+			"d2:ip11:example.com4:porti6881ee" +
+			"ee"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL, InfoHash: [20]byte{1}, Length: 1, Name: "dictionary"}
+
+	p, err := tf.RequestPeers([20]byte{}, 6881)
+	assert.Nil(t, err)
+	expected := []peers.Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+		{IP: net.ParseIP("::1"), Port: 6889},
+	}
+	copy(expected[0].ID[:], "-GM0001-abcdefghijkl")
+	assert.Equal(t, expected, p)
+}
+
+func TestAnnounceEvents(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE1}) + "e"))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL, InfoHash: [20]byte{1}, Length: 1, Name: "events"}
+	bus := &event.Bus{}
+	var events []event.Event
+	bus.Subscribe(func(e event.Event) { events = append(events, e) })
+
+	_, err := tf.announce(bus, slog.Default(), [][]string{{ts.URL}}, tf.InfoHash, [20]byte{}, 6881, 0, 0, 1)
+	assert.Nil(t, err)
+	_, err = tf.announce(bus, slog.Default(), [][]string{{"http://127.0.0.1:1/announce"}}, [20]byte{2}, [20]byte{}, 6881, 0, 0, 1)
+	assert.NotNil(t, err)
+
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, event.TrackerAnnounced, events[0].Type)
+		assert.Equal(t, ts.URL, events[0].Tracker)
+		assert.Equal(t, 1, events[0].PeerCount)
+		assert.Equal(t, "events", events[0].Name)
+		assert.Equal(t, event.TrackerErrored, events[1].Type)
+		assert.Equal(t, [20]byte{2}, events[1].InfoHash)
+		assert.NotNil(t, events[1].Err)
+	}
+}
+
+func TestAnnounceFailover(t *testing.T) {
+	tracker := func(peer byte) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("d8:intervali900e5:peers12:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE1, 127, 0, 0, peer, 0x1A, 0xE1}) + "e"))
+		}))
+	}
+	first, second := tracker(2), tracker(3)
+	defer first.Close()
+	defer second.Close()
+	tf := TorrentFile{Announce: "http://example.com/announce", InfoHash: [20]byte{1}, Length: 1, Name: "failover"}
+	bus := &event.Bus{}
+	var announced []string
+	bus.Subscribe(func(e event.Event) { announced = append(announced, e.Tracker) })
+
+	// 第一个 tracker 连不上时请求下一个，第一个成功的 tracker 之后不再请求
+	options := DownloadOptions{Trackers: []string{"http://127.0.0.1:1/announce", first.URL, second.URL}}
+	trackers := tf.announceList(options)
+	assert.Equal(t, [][]string{{options.Trackers[0]}, {first.URL}, {second.URL}}, trackers)
+	peerList, err := tf.announce(bus, slog.Default(), trackers, tf.InfoHash, [20]byte{}, 6881, 0, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []peers.Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+		{IP: net.IP{127, 0, 0, 2}, Port: 6881},
+	}, peerList)
+	assert.Equal(t, options.Trackers[:2], announced)
+	// 不会修改种子里的 tracker
+	assert.Equal(t, "http://example.com/announce", tf.Announce)
+	assert.Equal(t, [][]string{{"http://example.com/announce"}}, tf.announceList(DownloadOptions{}))
+
+	// 同一层中成功的 tracker 被移到最前面，下次先请求它
+	announced = nil
+	tiers := [][]string{{"http://127.0.0.1:1/announce", first.URL}, {second.URL}}
+	_, err = tf.announce(bus, slog.Default(), tiers, tf.InfoHash, [20]byte{}, 6881, 0, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{first.URL, "http://127.0.0.1:1/announce"}, {second.URL}}, tiers)
+	assert.Equal(t, []string{"http://127.0.0.1:1/announce", first.URL}, announced)
+	announced = nil
+	_, err = tf.announce(bus, slog.Default(), tiers, tf.InfoHash, [20]byte{}, 6881, 0, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{first.URL}, announced)
+
+	// 第一层都失败时请求下一层
+	announced = nil
+	peerList, err = tf.announce(bus, slog.Default(), [][]string{{"http://127.0.0.1:1/announce"}, {second.URL}}, tf.InfoHash, [20]byte{}, 6881, 0, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, net.IP{127, 0, 0, 3}, peerList[1].IP)
+	assert.Equal(t, []string{"http://127.0.0.1:1/announce", second.URL}, announced)
+
+	_, err = tf.announce(bus, slog.Default(), [][]string{{"http://127.0.0.1:1/announce"}}, tf.InfoHash, [20]byte{}, 6881, 0, 0, 1)
+	assert.NotNil(t, err)
+	_, err = tf.announce(bus, slog.Default(), nil, tf.InfoHash, [20]byte{}, 6881, 0, 0, 1)
+	assert.NotNil(t, err)
+}
+
+func TestAnnounceListTiers(t *testing.T) {
+	tf := TorrentFile{
+		Announce: "http://d/announce",
+		AnnounceList: [][]string{
+			{"http://a/announce", "http://b/announce", "http://c/announce"},
+			{"http://a/announce", ""},
+			{"http://e/announce"},
+		},
+	}
+	// 每一层中的顺序是打乱的，重复的 tracker 只保留第一次出现的，不在 announce-list 中的 announce 作为最后一层
+	tiers := tf.announceList(DownloadOptions{})
+	require.Len(t, tiers, 3)
+	assert.ElementsMatch(t, []string{"http://a/announce", "http://b/announce", "http://c/announce"}, tiers[0])
+	assert.Equal(t, []string{"http://e/announce"}, tiers[1])
+	assert.Equal(t, []string{"http://d/announce"}, tiers[2])
+	assert.Equal(t, []string{"http://a/announce", "http://b/announce", "http://c/announce"}, tf.AnnounceList[0])
+}
+
+func TestScrapeURL(t *testing.T) {
+	tests := map[string]string{
+		"http://example.com/announce":            "http://example.com/scrape",
+		"http://example.com/x/announce":          "http://example.com/x/scrape",
+		"http://example.com/announce.php":        "http://example.com/scrape.php",
+		"http://example.com/announce?passkey=ab": "http://example.com/scrape?passkey=ab",
+	}
+	for announce, expected := range tests {
+		scrapeURL, err := ScrapeURL(announce)
+		assert.Nil(t, err, announce)
+		assert.Equal(t, expected, scrapeURL)
+	}
+	for _, announce := range []string{"http://example.com/a", "http://example.com/announce/x"} {
+		_, err := ScrapeURL(announce)
+		assert.Equal(t, ErrScrapeUnsupported, err, announce)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	response := "d5:filesd20:" + string(infoHash[:]) + "d8:completei10e10:downloadedi50e11:downloadersi3e10:incompletei7eeee"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/scrape", r.URL.Path)
+		assert.Equal(t, string(infoHash[:]), r.URL.Query().Get("info_hash"))
+		w.Write([]byte(response))
+	}))
+	defer ts.Close()
+	tf := TorrentFile{Announce: ts.URL + "/announce", InfoHash: infoHash, Name: "scrape"}
+
+	result, err := tf.Scrape()
+	assert.Nil(t, err)
+	assert.Equal(t, ScrapeResult{Complete: 10, Incomplete: 7, Downloaded: 50, Downloaders: 3}, result)
+
+	// 不支持 BEP 21 的 tracker
+	response = "d5:filesd20:" + string(infoHash[:]) + "d8:completei10e10:downloadedi50e10:incompletei7eeee"
+	result, err = tf.Scrape()
+	assert.Nil(t, err)
+	assert.Equal(t, 7, result.Downloaders)
+
+	response = "d5:filesdee"
+	_, err = tf.Scrape()
+	assert.NotNil(t, err)
+	response = "d14:failure reason6:bannede"
+	_, err = tf.Scrape()
+	assert.EqualError(t, err, "tracker failure: banned")
+}
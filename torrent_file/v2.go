@@ -0,0 +1,306 @@
+package torrentFile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"github.com/jackpal/bencode-go"
+	merkle "github.com/strugglebak/goMule/merkle"
+	"github.com/strugglebak/goMule/p2p"
+)
+
+// BEP 52 的 meta version
+const MetaVersion2 = 2
+
+// v2 种子有 file tree，hybrid 种子同时还有 v1 的 pieces
+func (t *TorrentFile) IsV2() bool {
+	return t.MetaVersion == MetaVersion2
+}
+
+func (t *TorrentFile) IsHybrid() bool {
+	return t.IsV2() && len(t.PieceHashes) > 0
+}
+
+// v2 swarm 中 handshake 和 tracker 用的是截断成 20 个 byte 的 SHA-256 info hash
+func (t *TorrentFile) TruncatedInfoHashV2() [20]byte {
+	var infoHash [20]byte
+	copy(infoHash[:], t.InfoHashV2[:])
+	return infoHash
+}
+
+// piece 的数量，v2 种子没有 v1 的 pieces 时由文件大小算出
+func (t *TorrentFile) PieceCount() int {
+	if len(t.PieceHashes) > 0 || t.PieceLength == 0 {
+		return len(t.PieceHashes)
+	}
+	return (t.Length + t.PieceLength - 1) / t.PieceLength
+}
+
+// file tree 中的一个文件
+type v2File struct {
+	Path       []string
+	Length     int
+	PiecesRoot [32]byte
+}
+
+// 从原始的种子数据中解析 BEP 52 的字段: meta version、file tree 和 piece layers
+// bencode-go 无法把 key 不固定的 file tree 解析到 struct 里，所以这里对整个种子再解析一遍
+func (t *TorrentFile) parseV2(buffer []byte) error {
+	decoded, err := bencode.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		return err
+	}
+	root, ok := decoded.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("torrent is not a dictionary")
+	}
+	info, ok := root["info"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("torrent has no info dictionary")
+	}
+	version, ok := info["meta version"]
+	if !ok {
+		return nil
+	}
+	if version != int64(MetaVersion2) {
+		return fmt.Errorf("unsupported meta version %v", version)
+	}
+	t.MetaVersion = MetaVersion2
+
+	// info hash 要对完整的 info 字典计算，v1 的 bencodeInfo 里没有 file tree
+	var raw bytes.Buffer
+	err = bencode.Marshal(&raw, info)
+	if err != nil {
+		return err
+	}
+	t.InfoHashV2 = sha256.Sum256(raw.Bytes())
+	if len(t.PieceHashes) > 0 {
+		t.InfoHash = sha1.Sum(raw.Bytes())
+	} else {
+		t.InfoHash = t.TruncatedInfoHashV2()
+		t.PieceHashes = nil
+	}
+
+	if t.PieceLength < merkle.BlockSize || t.PieceLength != merkle.NextPowerOfTwo(t.PieceLength) {
+		return fmt.Errorf("invalid piece length %d for v2 torrent", t.PieceLength)
+	}
+
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("v2 torrent has no file tree")
+	}
+	var files []v2File
+	err = walkFileTree(tree, nil, &files)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("v2 torrent has no files")
+	}
+
+	t.PieceLayers = make(map[[32]byte][][32]byte)
+	layers, _ := root["piece layers"].(map[string]interface{})
+	for key, value := range layers {
+		data, ok := value.(string)
+		if len(key) != 32 || !ok || len(data)%32 != 0 {
+			return fmt.Errorf("received malformed piece layer")
+		}
+		var piecesRoot [32]byte
+		copy(piecesRoot[:], key)
+		layer := make([][32]byte, len(data)/32)
+		for i := range layer {
+			copy(layer[i][:], data[i*32:(i+1)*32])
+		}
+		t.PieceLayers[piecesRoot] = layer
+	}
+
+	// 单文件种子的 file tree 里只有一个和 name 同名的文件
+	single := len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == t.Name
+	if t.IsHybrid() {
+		err = t.matchHybridFiles(files, single)
+	} else {
+		t.layoutV2Files(files, single)
+	}
+	if err != nil {
+		return err
+	}
+
+	return t.checkPieceLayers()
+}
+
+// file tree 的叶子是 key 为空字符串的字典，里面有 length 和 pieces root
+// bencode 字典的 key 是排好序的，所以得到的文件顺序和 BEP 52 规定的一致
+func walkFileTree(tree map[string]interface{}, path []string, files *[]v2File) error {
+	if leaf, ok := tree[""].(map[string]interface{}); ok {
+		if len(path) == 0 {
+			return fmt.Errorf("received file without path in file tree")
+		}
+		length, ok := leaf["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("received file without length in file tree")
+		}
+		file := v2File{Path: path, Length: int(length)}
+		if length > 0 {
+			piecesRoot, ok := leaf["pieces root"].(string)
+			if !ok || len(piecesRoot) != 32 {
+				return fmt.Errorf("received file without pieces root in file tree")
+			}
+			copy(file.PiecesRoot[:], piecesRoot)
+		}
+		*files = append(*files, file)
+		return nil
+	}
+
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		subtree, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("received malformed file tree entry %q", name)
+		}
+		// 和 v1 的 path 一样，不能让 file tree 把文件写到输出目录之外
+		err := checkPathComponent(name)
+		if err != nil {
+			return fmt.Errorf("invalid file tree entry: %w", err)
+		}
+		child := append(append([]string{}, path...), name)
+		err = walkFileTree(subtree, child, files)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// v2 种子中每个文件都从 piece 的边界开始，文件之间的空隙没有数据
+func (t *TorrentFile) layoutV2Files(files []v2File, single bool) {
+	if single {
+		t.Files = nil
+		t.Length = files[0].Length
+		t.PiecesRoot = files[0].PiecesRoot
+		return
+	}
+
+	t.Files = nil
+	t.Length = 0
+	offset := 0
+	for _, file := range files {
+		t.Files = append(t.Files, File{
+			Length:     file.Length,
+			Path:       file.Path,
+			Offset:     offset,
+			PiecesRoot: file.PiecesRoot,
+		})
+		if file.Length > 0 {
+			t.Length = offset + file.Length
+		}
+		offset += (file.Length + t.PieceLength - 1) / t.PieceLength * t.PieceLength
+	}
+}
+
+// hybrid 种子的文件来自 v1 的 files，这里把 v2 的 pieces root 对应上去
+// v1 中的文件必须用 pad file 对齐到 piece 的边界，否则两种 piece 对不上
+// 两边的文件必须一一对应，否则 v1 和 v2 的 peer 看到的是不同的文件
+func (t *TorrentFile) matchHybridFiles(files []v2File, single bool) error {
+	if single {
+		if len(t.Files) != 0 || files[0].Length != t.Length {
+			return fmt.Errorf("v1 and v2 files of hybrid torrent do not match")
+		}
+		t.PiecesRoot = files[0].PiecesRoot
+		return nil
+	}
+
+	roots := make(map[string]v2File)
+	for _, file := range files {
+		roots[fmt.Sprintf("%q", file.Path)] = file
+	}
+	for index := range t.Files {
+		file := &t.Files[index]
+		key := fmt.Sprintf("%q", file.Path)
+		v2, ok := roots[key]
+		if !ok || v2.Length != file.Length {
+			return fmt.Errorf("v1 and v2 files of hybrid torrent do not match at %q", file.Path)
+		}
+		// 每个 v2 的文件只能对应一个 v1 的文件
+		delete(roots, key)
+		if file.Length > 0 && file.Offset%t.PieceLength != 0 {
+			return fmt.Errorf("file %q of hybrid torrent is not aligned to a piece", file.Path)
+		}
+		file.PiecesRoot = v2.PiecesRoot
+	}
+	if len(roots) > 0 || len(t.Files) != len(files) {
+		return fmt.Errorf("v1 and v2 files of hybrid torrent do not match")
+	}
+	return nil
+}
+
+// 大于一个 piece 的文件，piece layer 算出来的 root 必须等于 pieces root
+// 种子中没有 piece layer 的文件，下载时会通过 hash request 向 peer 请求
+func (t *TorrentFile) checkPieceLayers() error {
+	for _, file := range t.v2Files() {
+		layer, ok := t.PieceLayers[file.PiecesRoot]
+		if !ok || file.Length <= t.PieceLength {
+			continue
+		}
+		pieces := (file.Length + t.PieceLength - 1) / t.PieceLength
+		if len(layer) != pieces {
+			return fmt.Errorf("piece layer of %q has %d hashes, expected %d", file.Path, len(layer), pieces)
+		}
+		if merkle.LayerRoot(layer, t.PieceLength) != file.PiecesRoot {
+			return fmt.Errorf("piece layer of %q does not match its pieces root", file.Path)
+		}
+	}
+	return nil
+}
+
+// 所有文件，单文件种子也当作一个 Offset 为 0 的文件
+func (t *TorrentFile) v2Files() []File {
+	if len(t.Files) == 0 {
+		return []File{{Length: t.Length, Path: []string{t.Name}, PiecesRoot: t.PiecesRoot}}
+	}
+	return t.Files
+}
+
+// 每个 piece 的 v2 校验信息，v1 种子返回 nil
+func (t *TorrentFile) PieceRoots() []p2p.PieceRoot {
+	if !t.IsV2() {
+		return nil
+	}
+
+	roots := make([]p2p.PieceRoot, t.PieceCount())
+	for _, file := range t.v2Files() {
+		if file.Length == 0 {
+			continue
+		}
+		pieces := (file.Length + t.PieceLength - 1) / t.PieceLength
+		layer := t.PieceLayers[file.PiecesRoot]
+		first := file.Offset / t.PieceLength
+		for i := 0; i < pieces && first+i < len(roots); i++ {
+			root := p2p.PieceRoot{
+				FileRoot:   file.PiecesRoot,
+				FileIndex:  i,
+				FilePieces: pieces,
+				Length:     t.PieceLength,
+				Leaves:     t.PieceLength / merkle.BlockSize,
+			}
+			if remaining := file.Length - i*t.PieceLength; remaining < root.Length {
+				root.Length = remaining
+			}
+			if pieces == 1 {
+				// 不超过一个 piece 的文件，piece 的 hash 就是 pieces root
+				root.Hash = file.PiecesRoot
+				root.Leaves = merkle.NextPowerOfTwo((file.Length + merkle.BlockSize - 1) / merkle.BlockSize)
+			} else if layer != nil {
+				root.Hash = layer[i]
+			}
+			roots[first+i] = root
+		}
+	}
+	return roots
+}
@@ -0,0 +1,273 @@
+package torrentFile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	merkle "github.com/strugglebak/goMule/merkle"
+)
+
+const v2PieceLength = 2 * merkle.BlockSize
+
+// v2 测试种子中的文件，按 file tree 的顺序排好
+var v2Files = []struct {
+	path []string
+	data []byte
+}{
+	{[]string{"a"}, bytes.Repeat([]byte("a"), 40000)},
+	{[]string{"dir", "b"}, bytes.Repeat([]byte("b"), 10000)},
+	{[]string{"empty"}, nil},
+}
+
+// 构建 v2 或者 hybrid 种子，返回种子文件的路径
+// hybrid 种子的 v1 部分用 pad file 把每个文件对齐到 piece 的边界
+func writeV2Torrent(t *testing.T, hybrid bool, withLayers bool) string {
+	tree := map[string]interface{}{}
+	layers := map[string]interface{}{}
+	var v1Files []interface{}
+	var v1Data []byte
+	for index, file := range v2Files {
+		leaf := map[string]interface{}{"length": int64(len(file.data))}
+		if len(file.data) > 0 {
+			var root [32]byte
+			if len(file.data) <= v2PieceLength {
+				root = merkle.PieceRoot(file.data, merkle.NextPowerOfTwo((len(file.data)+merkle.BlockSize-1)/merkle.BlockSize))
+			} else {
+				var layer [][32]byte
+				var raw []byte
+				for begin := 0; begin < len(file.data); begin += v2PieceLength {
+					end := begin + v2PieceLength
+					if end > len(file.data) {
+						end = len(file.data)
+					}
+					hash := merkle.PieceRoot(file.data[begin:end], v2PieceLength/merkle.BlockSize)
+					layer = append(layer, hash)
+					raw = append(raw, hash[:]...)
+				}
+				root = merkle.LayerRoot(layer, v2PieceLength)
+				if withLayers {
+					layers[string(root[:])] = string(raw)
+				}
+			}
+			leaf["pieces root"] = string(root[:])
+		}
+
+		node := tree
+		for _, name := range file.path[:len(file.path)-1] {
+			if _, ok := node[name]; !ok {
+				node[name] = map[string]interface{}{}
+			}
+			node = node[name].(map[string]interface{})
+		}
+		node[file.path[len(file.path)-1]] = map[string]interface{}{"": leaf}
+
+		path := []interface{}{}
+		for _, name := range file.path {
+			path = append(path, name)
+		}
+		v1Files = append(v1Files, map[string]interface{}{"length": int64(len(file.data)), "path": path})
+		v1Data = append(v1Data, file.data...)
+		if pad := len(v1Data) % v2PieceLength; pad != 0 && index < len(v2Files)-2 {
+			padLength := v2PieceLength - pad
+			v1Files = append(v1Files, map[string]interface{}{
+				"length": int64(padLength),
+				"path":   []interface{}{".pad", "pad"},
+				"attr":   "p",
+			})
+			v1Data = append(v1Data, make([]byte, padLength)...)
+		}
+	}
+
+	info := map[string]interface{}{
+		"name":         "release",
+		"piece length": int64(v2PieceLength),
+		"meta version": int64(2),
+		"file tree":    tree,
+	}
+	if hybrid {
+		var pieces []byte
+		for begin := 0; begin < len(v1Data); begin += v2PieceLength {
+			end := begin + v2PieceLength
+			if end > len(v1Data) {
+				end = len(v1Data)
+			}
+			hash := sha1.Sum(v1Data[begin:end])
+			pieces = append(pieces, hash[:]...)
+		}
+		info["pieces"] = string(pieces)
+		info["files"] = v1Files
+	}
+
+	var buffer bytes.Buffer
+	err := bencode.Marshal(&buffer, map[string]interface{}{
+		"announce":     "http://tracker/announce",
+		"info":         info,
+		"piece layers": layers,
+	})
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "release.torrent")
+	require.Nil(t, ioutil.WriteFile(path, buffer.Bytes(), 0644))
+	return path
+}
+
+func rawInfo(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	require.Nil(t, err)
+	var raw bytes.Buffer
+	require.Nil(t, bencode.Marshal(&raw, decoded.(map[string]interface{})["info"]))
+	return raw.Bytes()
+}
+
+func TestOpenV2(t *testing.T) {
+	path := writeV2Torrent(t, false, true)
+	tf, err := Open(path)
+	require.Nil(t, err)
+
+	assert.True(t, tf.IsV2())
+	assert.False(t, tf.IsHybrid())
+	assert.Equal(t, sha256.Sum256(rawInfo(t, path)), tf.InfoHashV2)
+	assert.Equal(t, tf.TruncatedInfoHashV2(), tf.InfoHash)
+	assert.Nil(t, tf.PieceHashes)
+	assert.Equal(t, 3, tf.PieceCount())
+	// 每个文件都对齐到 piece 的边界
+	assert.Equal(t, 2*v2PieceLength+10000, tf.Length)
+	require.Equal(t, 3, len(tf.Files))
+	assert.Equal(t, []string{"a"}, tf.Files[0].Path)
+	assert.Equal(t, 0, tf.Files[0].Offset)
+	assert.Equal(t, []string{"dir", "b"}, tf.Files[1].Path)
+	assert.Equal(t, 2*v2PieceLength, tf.Files[1].Offset)
+	assert.Equal(t, 0, tf.Files[2].Length)
+
+	roots := tf.PieceRoots()
+	require.Equal(t, 3, len(roots))
+	assert.Equal(t, tf.PieceLayers[tf.Files[0].PiecesRoot][1], roots[1].Hash)
+	assert.Equal(t, 40000-v2PieceLength, roots[1].Length)
+	assert.Equal(t, 2, roots[1].Leaves)
+	assert.Equal(t, tf.Files[1].PiecesRoot, roots[2].Hash)
+	assert.Equal(t, 10000, roots[2].Length)
+	assert.Equal(t, 1, roots[2].Leaves)
+
+	assert.True(t, strings.Contains(tf.MagnetURI(), "xt=urn:btmh:1220"))
+	assert.False(t, strings.Contains(tf.MagnetURI(), "urn:btih"))
+}
+
+func TestOpenHybrid(t *testing.T) {
+	path := writeV2Torrent(t, true, true)
+	tf, err := Open(path)
+	require.Nil(t, err)
+
+	assert.True(t, tf.IsHybrid())
+	raw := rawInfo(t, path)
+	assert.Equal(t, sha1.Sum(raw), tf.InfoHash)
+	assert.Equal(t, sha256.Sum256(raw), tf.InfoHashV2)
+	assert.Equal(t, 3, len(tf.PieceHashes))
+	// pad file 不在 Files 中
+	require.Equal(t, 3, len(tf.Files))
+	assert.Equal(t, 2*v2PieceLength, tf.Files[1].Offset)
+	assert.NotEqual(t, [32]byte{}, tf.Files[1].PiecesRoot)
+	assert.Equal(t, 3, len(tf.PieceRoots()))
+
+	magnet := tf.MagnetURI()
+	assert.True(t, strings.Contains(magnet, "xt=urn:btih:"))
+	assert.True(t, strings.Contains(magnet, "xt=urn:btmh:1220"))
+}
+
+func TestOpenV2WithoutPieceLayers(t *testing.T) {
+	tf, err := Open(writeV2Torrent(t, false, false))
+	require.Nil(t, err)
+	roots := tf.PieceRoots()
+	// 没有 piece layer 时，要在下载时向 peer 请求
+	assert.Equal(t, [32]byte{}, roots[0].Hash)
+	assert.Equal(t, tf.Files[0].PiecesRoot, roots[0].FileRoot)
+	assert.Equal(t, 2, roots[0].FilePieces)
+	assert.Equal(t, tf.Files[1].PiecesRoot, roots[2].Hash)
+}
+
+func TestOpenV2BadPieceLayer(t *testing.T) {
+	path := writeV2Torrent(t, false, true)
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	require.Nil(t, err)
+	layers := decoded.(map[string]interface{})["piece layers"].(map[string]interface{})
+	for key, value := range layers {
+		layer := []byte(value.(string))
+		layer[0] ^= 1
+		layers[key] = string(layer)
+	}
+	var buffer bytes.Buffer
+	require.Nil(t, bencode.Marshal(&buffer, decoded))
+	require.Nil(t, ioutil.WriteFile(path, buffer.Bytes(), 0644))
+
+	_, err = Open(path)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyV2(t *testing.T) {
+	for _, hybrid := range []bool{false, true} {
+		tf, err := Open(writeV2Torrent(t, hybrid, true))
+		require.Nil(t, err)
+
+		dir := filepath.Join(t.TempDir(), tf.Name)
+		for _, file := range v2Files {
+			path := filepath.Join(append([]string{dir}, file.path...)...)
+			require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+			require.Nil(t, ioutil.WriteFile(path, file.data, 0644))
+		}
+		report := tf.Verify(dir)
+		assert.True(t, report.Complete(), "hybrid: %t", hybrid)
+
+		// 改坏 a 的第二个 piece
+		data := append([]byte{}, v2Files[0].data...)
+		data[v2PieceLength] = 'x'
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), data, 0644))
+		report = tf.Verify(dir)
+		assert.Equal(t, []PieceStatus{PieceValid, PieceMismatch, PieceValid}, report.Pieces, "hybrid: %t", hybrid)
+	}
+}
+
+func TestOpenV2PathTraversal(t *testing.T) {
+	for _, hybrid := range []bool{false, true} {
+		for _, name := range []string{"..", ".", "a/b", "/etc"} {
+			path := writeV2Torrent(t, hybrid, true)
+			data, err := ioutil.ReadFile(path)
+			require.Nil(t, err)
+			decoded, err := bencode.Decode(bytes.NewReader(data))
+			require.Nil(t, err)
+			info := decoded.(map[string]interface{})["info"].(map[string]interface{})
+			tree := info["file tree"].(map[string]interface{})
+			tree[name] = map[string]interface{}{"evil": map[string]interface{}{"": map[string]interface{}{"length": int64(0)}}}
+			var buffer bytes.Buffer
+			require.Nil(t, bencode.Marshal(&buffer, decoded))
+
+			_, err = Parse(buffer.Bytes())
+			assert.NotNil(t, err, "hybrid: %t, name: %q", hybrid, name)
+		}
+	}
+}
+
+func TestMatchHybridFiles(t *testing.T) {
+	tf := &TorrentFile{PieceLength: v2PieceLength, Files: []File{
+		{Path: []string{"a"}},
+		{Path: []string{"a"}},
+	}}
+	// 两个 v1 的文件不能对应同一个 v2 的文件
+	err := tf.matchHybridFiles([]v2File{{Path: []string{"a"}}, {Path: []string{"b"}}}, false)
+	assert.NotNil(t, err)
+
+	tf.Files[1].Path = []string{"b"}
+	assert.Nil(t, tf.matchHybridFiles([]v2File{{Path: []string{"a"}}, {Path: []string{"b"}}}, false))
+	assert.NotNil(t, tf.matchHybridFiles([]v2File{{Path: []string{"a"}}, {Path: []string{"c"}}}, false))
+}
@@ -0,0 +1,193 @@
+package torrentFile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	merkle "github.com/strugglebak/goMule/merkle"
+	"github.com/strugglebak/goMule/p2p"
+	storage "github.com/strugglebak/goMule/storage"
+)
+
+type PieceStatus int
+
+const (
+	PieceValid    PieceStatus = iota // hash 一致
+	PieceMismatch                    // 数据存在，但是 hash 不一致
+	PieceMissing                     // 文件不存在或者长度不够
+)
+
+func (status PieceStatus) String() string {
+	switch status {
+	case PieceValid:
+		return "valid"
+	case PieceMismatch:
+		return "mismatch"
+	case PieceMissing:
+		return "missing"
+	default:
+		return "unknown"
+	}
+}
+
+// 单个文件的校验结果
+type FileReport struct {
+	Path        string
+	Length      int
+	Exists      bool
+	FirstPiece  int // 文件覆盖到的第一个 piece
+	LastPiece   int // 文件覆盖到的最后一个 piece，长度为 0 的文件没有 piece，此时为 FirstPiece - 1
+	ValidPieces int
+}
+
+func (report *FileReport) PieceCount() int {
+	return report.LastPiece - report.FirstPiece + 1
+}
+
+func (report *FileReport) Complete() bool {
+	return report.Exists && report.ValidPieces == report.PieceCount()
+}
+
+// 整个 torrent 的校验结果
+type VerifyReport struct {
+	Pieces      []PieceStatus
+	Files       []FileReport
+	PieceLength int
+	Length      int
+}
+
+func (report *VerifyReport) ValidPieces() int {
+	count := 0
+	for _, status := range report.Pieces {
+		if status == PieceValid {
+			count++
+		}
+	}
+	return count
+}
+
+// 返回状态为 status 的 piece 的下标
+func (report *VerifyReport) PiecesWithStatus(status PieceStatus) []int {
+	var indexes []int
+	for index, s := range report.Pieces {
+		if s == status {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+func (report *VerifyReport) Complete() bool {
+	return report.ValidPieces() == len(report.Pieces)
+}
+
+// 按 byte 计算的完成度，范围是 0 ~ 100
+func (report *VerifyReport) Percent() float64 {
+	if report.Length == 0 {
+		return 100
+	}
+	valid := 0
+	for index, status := range report.Pieces {
+		if status != PieceValid {
+			continue
+		}
+		begin := index * report.PieceLength
+		end := begin + report.PieceLength
+		if end > report.Length {
+			end = report.Length
+		}
+		valid += end - begin
+	}
+	return float64(valid) / float64(report.Length) * 100
+}
+
+// 校验 outputDir 下已有的数据，见 Verify
+func (t *TorrentFile) VerifyDir(outputDir string) *VerifyReport {
+	return t.Verify(filepath.Join(outputDir, t.Name))
+}
+
+// 并发校验 contentPath 下已有的数据，contentPath 的含义见 ContentFiles
+func (t *TorrentFile) Verify(contentPath string) *VerifyReport {
+	s := t.newStorage(contentPath, false)
+	defer s.Close()
+	roots := t.PieceRoots()
+
+	report := &VerifyReport{
+		Pieces:      make([]PieceStatus, t.PieceCount()),
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, t.PieceLength)
+			for index := range indexes {
+				report.Pieces[index] = t.verifyPiece(s, roots, index, buffer)
+			}
+		}()
+	}
+	for index := range report.Pieces {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, file := range s.Files {
+		fileReport := FileReport{
+			Path:       file.Path,
+			Length:     file.Length,
+			FirstPiece: file.Offset / t.PieceLength,
+			LastPiece:  (file.Offset + file.Length - 1) / t.PieceLength,
+		}
+		if file.Length == 0 {
+			fileReport.LastPiece = fileReport.FirstPiece - 1
+		}
+		if stat, err := os.Stat(file.Path); err == nil && !stat.IsDir() {
+			fileReport.Exists = true
+		}
+		for index := fileReport.FirstPiece; index <= fileReport.LastPiece; index++ {
+			if report.Pieces[index] == PieceValid {
+				fileReport.ValidPieces++
+			}
+		}
+		report.Files = append(report.Files, fileReport)
+	}
+
+	return report
+}
+
+// v1 用 SHA-1 校验，v2 用 merkle root 校验，hybrid 种子两个都要对
+// 种子中没有 piece layer 的 v2 piece 无法校验，当作不一致
+func (t *TorrentFile) verifyPiece(s *storage.Storage, roots []p2p.PieceRoot, index int, buffer []byte) PieceStatus {
+	begin := index * t.PieceLength
+	end := begin + t.PieceLength
+	if end > t.Length {
+		end = t.Length
+	}
+
+	_, err := s.ReadAt(buffer[:end-begin], int64(begin))
+	if err != nil {
+		return PieceMissing
+	}
+	if index < len(t.PieceHashes) {
+		hash := sha1.Sum(buffer[:end-begin])
+		if !bytes.Equal(hash[:], t.PieceHashes[index][:]) {
+			return PieceMismatch
+		}
+	}
+	if index < len(roots) && roots[index].Length > 0 {
+		root := roots[index]
+		if root.Hash == ([32]byte{}) || merkle.PieceRoot(buffer[:root.Length], root.Leaves) != root.Hash {
+			return PieceMismatch
+		}
+	}
+	return PieceValid
+}
@@ -0,0 +1,48 @@
+package torrentFile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "data")
+	require.Nil(t, os.MkdirAll(root, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "a"), bytes.Repeat([]byte{1}, 20000), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "b"), bytes.Repeat([]byte{2}, 30000), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "c"), bytes.Repeat([]byte{3}, 10000), 0644))
+
+	tf, err := Create(root, CreateOptions{PieceLength: MinPieceLength}, ioutil.Discard)
+	require.Nil(t, err)
+
+	report := tf.VerifyDir(dir)
+	assert.True(t, report.Complete())
+	assert.Equal(t, float64(100), report.Percent())
+
+	// 改掉 b 中间的一个 byte，删掉 c
+	b := bytes.Repeat([]byte{2}, 30000)
+	b[5000] = 0
+	require.Nil(t, ioutil.WriteFile(filepath.Join(root, "b"), b, 0644))
+	require.Nil(t, os.Remove(filepath.Join(root, "c")))
+
+	report = tf.Verify(root)
+	assert.Equal(t, []PieceStatus{PieceValid, PieceMismatch, PieceValid, PieceMissing}, report.Pieces)
+	assert.False(t, report.Complete())
+	assert.Equal(t, 2, report.ValidPieces())
+	assert.InDelta(t, float64(2*MinPieceLength)/60000*100, report.Percent(), 0.001)
+
+	require.Len(t, report.Files, 3)
+	assert.Equal(t, 0, report.Files[0].FirstPiece)
+	assert.Equal(t, 1, report.Files[0].LastPiece)
+	assert.False(t, report.Files[0].Complete())
+	assert.Equal(t, 1, report.Files[1].FirstPiece)
+	assert.Equal(t, 3, report.Files[1].LastPiece)
+	assert.False(t, report.Files[2].Exists)
+}
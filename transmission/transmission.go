@@ -0,0 +1,594 @@
+package transmission
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	mse "github.com/strugglebak/goMule/mse"
+	session "github.com/strugglebak/goMule/session"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// 兼容 Transmission 的 RPC 协议，这样已有的 Transmission 客户端不用修改就可以管理 goMule
+// 协议见 https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md
+// 只实现了核心的方法: torrent-add、torrent-get、torrent-start、torrent-start-now、
+// torrent-stop、torrent-remove、session-get、session-set 和 session-stats
+
+const (
+	// 客户端必须在请求头中带上服务端给的 session id，防止 CSRF
+	SessionIdHeader = "X-Transmission-Session-Id"
+	// 实现的 RPC 协议版本，对应 Transmission 3.00
+	rpcVersion        = 16
+	rpcVersionMinimum = 1
+	version           = "3.00 (goMule)"
+
+	maxRequestSize = 16 << 20
+	fetchTimeout   = 30 * time.Second
+)
+
+// torrent-get 中的 status
+const (
+	statusStopped      = 0
+	statusCheckWait    = 1
+	statusCheck        = 2
+	statusDownloadWait = 3
+	statusDownload     = 4
+	statusSeedWait     = 5
+	statusSeed         = 6
+)
+
+// torrent-get 中的 error
+const (
+	errorNone  = 0
+	errorLocal = 3
+)
+
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       interface{}     `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string      `json:"result"`
+	Arguments interface{} `json:"arguments"`
+	Tag       interface{} `json:"tag,omitempty"`
+}
+
+type handler struct {
+	session   *session.Session
+	sessionId string
+	client    *http.Client
+
+	mutex  sync.Mutex
+	ids    map[[20]byte]int // Transmission 用整数 id 表示种子，在这个进程内不变
+	nextId int
+}
+
+func NewHandler(s *session.Session) http.Handler {
+	buffer := make([]byte, 24)
+	rand.Read(buffer)
+	return &handler{
+		session:   s,
+		sessionId: base64.RawURLEncoding.EncodeToString(buffer),
+		client:    &http.Client{Timeout: fetchTimeout},
+		ids:       map[[20]byte]int{},
+		nextId:    1,
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(SessionIdHeader) != h.sessionId {
+		// 客户端收到 409 之后会带上响应头中的 session id 重试
+		w.Header().Set(SessionIdHeader, h.sessionId)
+		http.Error(w, fmt.Sprintf("<h1>409: Conflict</h1><p>Your request had an invalid session-id header.</p><p><code>%s: %s</code></p>", SessionIdHeader, h.sessionId), http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := request{}
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	arguments, err := h.call(req.Method, req.Arguments)
+	result := "success"
+	if err != nil {
+		result = err.Error()
+	}
+	if arguments == nil {
+		arguments = map[string]interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response{Result: result, Arguments: arguments, Tag: req.Tag})
+}
+
+func (h *handler) call(method string, raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+	switch method {
+	case "torrent-add":
+		arguments := addArguments{}
+		if err := json.Unmarshal(raw, &arguments); err != nil {
+			return nil, err
+		}
+		return h.add(arguments)
+	case "torrent-get":
+		arguments := getArguments{}
+		if err := json.Unmarshal(raw, &arguments); err != nil {
+			return nil, err
+		}
+		return h.get(arguments)
+	case "torrent-start", "torrent-start-now", "torrent-stop", "torrent-remove":
+		arguments := actionArguments{}
+		if err := json.Unmarshal(raw, &arguments); err != nil {
+			return nil, err
+		}
+		return nil, h.action(method, arguments)
+	case "session-get":
+		return h.sessionGet(), nil
+	case "session-set":
+		arguments := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &arguments); err != nil {
+			return nil, err
+		}
+		return nil, h.sessionSet(arguments)
+	case "session-stats":
+		return h.sessionStats(), nil
+	default:
+		return nil, fmt.Errorf("method name not recognized")
+	}
+}
+
+// 返回种子的 id，第一次见到时分配一个新的
+func (h *handler) id(infoHash [20]byte) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	id, ok := h.ids[infoHash]
+	if !ok {
+		id = h.nextId
+		h.nextId++
+		h.ids[infoHash] = id
+	}
+	return id
+}
+
+type addArguments struct {
+	Filename    string `json:"filename"` // URL、磁力链接或者服务器上的路径
+	Metainfo    string `json:"metainfo"` // base64 编码的 .torrent 文件
+	Paused      bool   `json:"paused"`
+	DownloadDir string `json:"download-dir"`
+}
+
+func (h *handler) add(arguments addArguments) (interface{}, error) {
+	if arguments.DownloadDir != "" && arguments.DownloadDir != h.session.DataDir() {
+		return nil, fmt.Errorf("download-dir must be %s", h.session.DataDir())
+	}
+
+	var buffer []byte
+	var err error
+	switch {
+	case arguments.Metainfo != "":
+		buffer, err = base64.StdEncoding.DecodeString(arguments.Metainfo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metainfo: %w", err)
+		}
+	case strings.HasPrefix(arguments.Filename, "magnet:"):
+		// 从磁力链接拿到 info 字典需要 BEP 9 (ut_metadata)，goMule 还没有实现
+		return nil, fmt.Errorf("adding magnet links is not supported yet, fetching metadata from peers (BEP 9) is not implemented")
+	case strings.HasPrefix(arguments.Filename, "http://") || strings.HasPrefix(arguments.Filename, "https://"):
+		buffer, err = h.fetch(arguments.Filename)
+	case arguments.Filename != "":
+		buffer, err = ioutil.ReadFile(arguments.Filename)
+	default:
+		return nil, fmt.Errorf("no filename or metainfo specified")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tf, err := torrentFile.Parse(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := h.session.Get(tf.InfoHash); ok {
+		return map[string]interface{}{"torrent-duplicate": h.addedJSON(t)}, nil
+	}
+	t, err := h.session.Add(buffer, session.AddOptions{Paused: arguments.Paused})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"torrent-added": h.addedJSON(t)}, nil
+}
+
+func (h *handler) addedJSON(t *session.Torrent) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         h.id(t.File.InfoHash),
+		"name":       t.File.Name,
+		"hashString": hex.EncodeToString(t.File.InfoHash[:]),
+	}
+}
+
+func (h *handler) fetch(url string) ([]byte, error) {
+	response, err := h.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, response.Status)
+	}
+	buffer, err := ioutil.ReadAll(io.LimitReader(response.Body, maxRequestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buffer) > maxRequestSize {
+		return nil, fmt.Errorf("torrent file is larger than %d bytes", maxRequestSize)
+	}
+	return buffer, nil
+}
+
+type getArguments struct {
+	Fields []string        `json:"fields"`
+	Ids    json.RawMessage `json:"ids"`
+}
+
+func (h *handler) get(arguments getArguments) (interface{}, error) {
+	if len(arguments.Fields) == 0 {
+		return nil, fmt.Errorf("no fields specified")
+	}
+	torrents, err := h.selectTorrents(arguments.Ids)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []map[string]interface{}{}
+	for _, t := range torrents {
+		fields := h.fields(t)
+		result := map[string]interface{}{}
+		for _, name := range arguments.Fields {
+			// 不认识的字段直接忽略，和 Transmission 一样
+			if value, ok := fields[name]; ok {
+				result[name] = value
+			}
+		}
+		list = append(list, result)
+	}
+	return map[string]interface{}{"torrents": list}, nil
+}
+
+// torrent-get 支持的所有字段
+func (h *handler) fields(t *session.Torrent) map[string]interface{} {
+	status := t.Status()
+	percentDone := 0.0
+	if status.Wanted > 0 {
+		percentDone = float64(status.Done) / float64(status.Wanted)
+	}
+	// 每个 piece 的大小一样，最后一个 piece 可能比较短
+	sizeWhenDone := int64(status.Wanted) * int64(t.File.PieceLength)
+	if sizeWhenDone > int64(status.Length) || status.Wanted == t.File.PieceCount() {
+		sizeWhenDone = int64(status.Length)
+	}
+	eta := int64(-1)
+	if status.Left == 0 {
+		eta = 0
+	} else if status.DownloadRate > 0 {
+		eta = (status.Left + status.DownloadRate - 1) / status.DownloadRate
+	}
+	errorCode, errorString := errorNone, ""
+	if status.Error != nil {
+		errorCode, errorString = errorLocal, status.Error.Error()
+	}
+	peers := []map[string]interface{}{}
+	for _, peer := range status.Peers {
+		peers = append(peers, map[string]interface{}{
+			"address":      peer.Peer.IP.String(),
+			"port":         peer.Peer.Port,
+			"isIncoming":   false,
+			"rateToClient": 0,
+		})
+	}
+	queuePosition := 0
+	for index, queued := range h.session.Torrents() {
+		if queued == t {
+			queuePosition = index
+		}
+	}
+
+	return map[string]interface{}{
+		"id":             h.id(status.InfoHash),
+		"hashString":     hex.EncodeToString(status.InfoHash[:]),
+		"name":           status.Name,
+		"status":         statusCode(status),
+		"totalSize":      status.Length,
+		"sizeWhenDone":   sizeWhenDone,
+		"leftUntilDone":  status.Left,
+		"percentDone":    percentDone,
+		"rateDownload":   status.DownloadRate,
+		"rateUpload":     status.UploadRate,
+		"eta":            eta,
+		"error":          errorCode,
+		"errorString":    errorString,
+		"downloadedEver": status.Downloaded,
+		"uploadedEver":   status.Uploaded,
+		"peersConnected": len(status.Peers),
+		"peers":          peers,
+		"addedDate":      status.AddedAt.Unix(),
+		"isFinished":     status.Left == 0 && status.State != session.StateChecking,
+		"isPrivate":      t.File.Private,
+		"downloadDir":    h.session.DataDir(),
+		"queuePosition":  queuePosition,
+		"pieceCount":     t.File.PieceCount(),
+		"pieceSize":      t.File.PieceLength,
+	}
+}
+
+func statusCode(status session.Status) int {
+	switch status.State {
+	case session.StateChecking:
+		return statusCheck
+	case session.StateDownloading:
+		return statusDownload
+	case session.StateSeeding:
+		return statusSeed
+	case session.StateQueued:
+		if status.Left == 0 {
+			return statusSeedWait
+		}
+		return statusDownloadWait
+	default:
+		return statusStopped
+	}
+}
+
+// 根据 ids 参数选出种子，ids 可以是一个 id、id 和 hash 字符串的列表，或者 "recently-active"
+// 没有 ids 时返回所有种子
+func (h *handler) selectTorrents(raw json.RawMessage) ([]*session.Torrent, error) {
+	all := h.session.Torrents()
+	if len(raw) == 0 || string(raw) == "null" {
+		return all, nil
+	}
+
+	var single int
+	if json.Unmarshal(raw, &single) == nil {
+		raw = json.RawMessage(fmt.Sprintf("[%d]", single))
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		if text != "recently-active" {
+			return nil, fmt.Errorf("invalid ids %q", text)
+		}
+		// 没有记录每个种子最后活跃的时间，返回正在传输的种子
+		var active []*session.Torrent
+		for _, t := range all {
+			state := t.Status().State
+			if state == session.StateDownloading || state == session.StateSeeding || state == session.StateChecking {
+				active = append(active, t)
+			}
+		}
+		return active, nil
+	}
+	var ids []interface{}
+	if err := json.Unmarshal(raw, &ids); err != nil {
+		return nil, fmt.Errorf("invalid ids: %w", err)
+	}
+
+	wanted := map[*session.Torrent]bool{}
+	for _, value := range ids {
+		switch id := value.(type) {
+		case float64:
+			for _, t := range all {
+				if h.id(t.File.InfoHash) == int(id) {
+					wanted[t] = true
+				}
+			}
+		case string:
+			for _, t := range all {
+				if strings.EqualFold(hex.EncodeToString(t.File.InfoHash[:]), id) {
+					wanted[t] = true
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid id %v", value)
+		}
+	}
+	var selected []*session.Torrent
+	for _, t := range all {
+		if wanted[t] {
+			selected = append(selected, t)
+		}
+	}
+	return selected, nil
+}
+
+type actionArguments struct {
+	Ids             json.RawMessage `json:"ids"`
+	DeleteLocalData bool            `json:"delete-local-data"`
+}
+
+func (h *handler) action(method string, arguments actionArguments) error {
+	torrents, err := h.selectTorrents(arguments.Ids)
+	if err != nil {
+		return err
+	}
+	for _, t := range torrents {
+		infoHash := t.File.InfoHash
+		switch method {
+		case "torrent-start", "torrent-start-now":
+			err = h.session.Resume(infoHash)
+		case "torrent-stop":
+			err = h.session.Pause(infoHash)
+		case "torrent-remove":
+			err = h.session.Remove(infoHash, arguments.DeleteLocalData)
+			if err == nil {
+				h.mutex.Lock()
+				delete(h.ids, infoHash)
+				h.mutex.Unlock()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transmission 的速度以 kB/s 为单位
+const kilo = 1000
+
+// goMule 的 disable 完全不接受加密连接，最接近 Transmission 的 tolerated
+var encryptionNames = map[mse.Policy]string{
+	mse.PolicyDisable: "tolerated",
+	mse.PolicyPrefer:  "preferred",
+	mse.PolicyRequire: "required",
+}
+
+func (h *handler) sessionGet() map[string]interface{} {
+	settings := h.session.Settings()
+	return map[string]interface{}{
+		"version":                  version,
+		"rpc-version":              rpcVersion,
+		"rpc-version-minimum":      rpcVersionMinimum,
+		"session-id":               h.sessionId,
+		"download-dir":             h.session.DataDir(),
+		"peer-port":                h.session.Port(),
+		"peer-limit-per-torrent":   settings.MaxPeers,
+		"speed-limit-down":         settings.DownloadRate / kilo,
+		"speed-limit-down-enabled": settings.DownloadRate > 0,
+		"speed-limit-up":           settings.UploadRate / kilo,
+		"speed-limit-up-enabled":   settings.UploadRate > 0,
+		"download-queue-size":      settings.MaxActiveDownloads,
+		"download-queue-enabled":   settings.MaxActiveDownloads > 0,
+		"seed-queue-size":          settings.MaxActiveSeeds,
+		"seed-queue-enabled":       settings.MaxActiveSeeds > 0,
+		"encryption":               encryptionNames[settings.Encryption],
+		"dht-enabled":              false,
+		"pex-enabled":              false,
+		"lpd-enabled":              false,
+		"utp-enabled":              false,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  kilo,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   kilo,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+}
+
+// 修改设置，不支持的字段会被忽略
+// Transmission 中限速的值和是否开启是两个字段，goMule 中 0 表示不限速
+func (h *handler) sessionSet(arguments map[string]json.RawMessage) error {
+	settings := h.session.Settings()
+	var err error
+	integer := func(name string) (int, bool) {
+		var value int
+		raw, ok := arguments[name]
+		if !ok || err != nil {
+			return 0, false
+		}
+		if e := json.Unmarshal(raw, &value); e != nil {
+			err = fmt.Errorf("invalid %s: %w", name, e)
+			return 0, false
+		}
+		return value, true
+	}
+	boolean := func(name string, current bool) bool {
+		var value bool
+		raw, ok := arguments[name]
+		if !ok || err != nil {
+			return current
+		}
+		if e := json.Unmarshal(raw, &value); e != nil {
+			err = fmt.Errorf("invalid %s: %w", name, e)
+			return current
+		}
+		return value
+	}
+	// 限速或者队列的大小和开关，关闭时值为 0
+	limit := func(current *int, unit int, valueName, enabledName string) {
+		value, ok := integer(valueName)
+		if !ok {
+			value = *current / unit
+		}
+		if boolean(enabledName, *current > 0) {
+			*current = value * unit
+		} else {
+			*current = 0
+		}
+	}
+
+	limit(&settings.DownloadRate, kilo, "speed-limit-down", "speed-limit-down-enabled")
+	limit(&settings.UploadRate, kilo, "speed-limit-up", "speed-limit-up-enabled")
+	limit(&settings.MaxActiveDownloads, 1, "download-queue-size", "download-queue-enabled")
+	limit(&settings.MaxActiveSeeds, 1, "seed-queue-size", "seed-queue-enabled")
+	if value, ok := integer("peer-limit-per-torrent"); ok {
+		settings.MaxPeers = value
+	}
+	if raw, ok := arguments["encryption"]; ok && err == nil {
+		var name string
+		json.Unmarshal(raw, &name)
+		found := false
+		for policy, policyName := range encryptionNames {
+			if policyName == name {
+				settings.Encryption, found = policy, true
+			}
+		}
+		if !found {
+			err = fmt.Errorf("invalid encryption %q", name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return h.session.SetSettings(settings)
+}
+
+func (h *handler) sessionStats() map[string]interface{} {
+	torrents := h.session.Torrents()
+	var active, paused int
+	var downloadRate, uploadRate, downloaded, uploaded int64
+	for _, t := range torrents {
+		status := t.Status()
+		if status.State == session.StatePaused || status.State == session.StateError {
+			paused++
+		} else {
+			active++
+		}
+		downloadRate += status.DownloadRate
+		uploadRate += status.UploadRate
+		downloaded += status.Downloaded
+		uploaded += status.Uploaded
+	}
+	// 没有单独记录本次启动以来的流量，current-stats 和 cumulative-stats 是一样的
+	stats := map[string]interface{}{
+		"downloadedBytes": downloaded,
+		"uploadedBytes":   uploaded,
+		"filesAdded":      len(torrents),
+	}
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(torrents),
+		"downloadSpeed":      downloadRate,
+		"uploadSpeed":        uploadRate,
+		"current-stats":      stats,
+		"cumulative-stats":   stats,
+	}
+}
@@ -0,0 +1,219 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	mse "github.com/strugglebak/goMule/mse"
+	session "github.com/strugglebak/goMule/session"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// 在 dir 下生成一个随机内容的文件，返回它的种子
+func createTorrent(t *testing.T, dir, name string) []byte {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(int64(len(name)))).Read(data)
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, data, 0644))
+
+	var buffer bytes.Buffer
+	_, err := torrentFile.Create(path, torrentFile.CreateOptions{PieceLength: 16384}, &buffer)
+	require.Nil(t, err)
+	return buffer.Bytes()
+}
+
+// 一个和 Transmission 客户端一样处理 409 的客户端
+type rpcClient struct {
+	t         *testing.T
+	url       string
+	sessionId string
+}
+
+func startServer(t *testing.T, dataDir string) (*rpcClient, *session.Session) {
+	s, err := session.New(session.Config{DataDir: dataDir, StateDir: t.TempDir(), Port: 51413})
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	server := httptest.NewServer(NewHandler(s))
+	t.Cleanup(server.Close)
+	return &rpcClient{t: t, url: server.URL + "/transmission/rpc"}, s
+}
+
+func (c *rpcClient) call(method string, arguments interface{}) (string, map[string]interface{}) {
+	body, err := json.Marshal(map[string]interface{}{"method": method, "arguments": arguments, "tag": 7})
+	require.Nil(c.t, err)
+	for {
+		request, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+		require.Nil(c.t, err)
+		request.Header.Set(SessionIdHeader, c.sessionId)
+		response, err := http.DefaultClient.Do(request)
+		require.Nil(c.t, err)
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusConflict && c.sessionId == "" {
+			c.sessionId = response.Header.Get(SessionIdHeader)
+			continue
+		}
+		require.Equal(c.t, http.StatusOK, response.StatusCode)
+
+		result := struct {
+			Result    string                 `json:"result"`
+			Arguments map[string]interface{} `json:"arguments"`
+			Tag       int                    `json:"tag"`
+		}{}
+		require.Nil(c.t, json.NewDecoder(response.Body).Decode(&result))
+		assert.Equal(c.t, 7, result.Tag)
+		return result.Result, result.Arguments
+	}
+}
+
+func (c *rpcClient) torrents(fields ...string) []map[string]interface{} {
+	result, arguments := c.call("torrent-get", map[string]interface{}{"fields": fields})
+	require.Equal(c.t, "success", result)
+	var torrents []map[string]interface{}
+	for _, torrent := range arguments["torrents"].([]interface{}) {
+		torrents = append(torrents, torrent.(map[string]interface{}))
+	}
+	return torrents
+}
+
+func TestSessionId(t *testing.T) {
+	client, _ := startServer(t, t.TempDir())
+	response, err := http.Post(client.url, "application/json", bytes.NewReader([]byte(`{"method":"session-get"}`)))
+	require.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusConflict, response.StatusCode)
+	assert.NotEmpty(t, response.Header.Get(SessionIdHeader))
+
+	request, _ := http.NewRequest(http.MethodPost, client.url, nil)
+	request.Header.Set(SessionIdHeader, "wrong")
+	response, err = http.DefaultClient.Do(request)
+	require.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusConflict, response.StatusCode)
+
+	result, _ := client.call("no-such-method", nil)
+	assert.Equal(t, "method name not recognized", result)
+}
+
+func TestTorrentLifecycle(t *testing.T) {
+	dataDir := t.TempDir()
+	client, s := startServer(t, dataDir)
+
+	// metainfo 是 base64 编码的种子，数据已经在磁盘上了，会开始做种
+	seed := createTorrent(t, dataDir, "seed")
+	result, arguments := client.call("torrent-add", map[string]interface{}{
+		"metainfo":     base64.StdEncoding.EncodeToString(seed),
+		"download-dir": dataDir,
+	})
+	require.Equal(t, "success", result)
+	added := arguments["torrent-added"].(map[string]interface{})
+	assert.Equal(t, 1.0, added["id"])
+	assert.Equal(t, "seed", added["name"])
+
+	// filename 可以是服务器上的路径
+	path := filepath.Join(t.TempDir(), "paused.torrent")
+	require.Nil(t, ioutil.WriteFile(path, createTorrent(t, t.TempDir(), "paused"), 0644))
+	result, arguments = client.call("torrent-add", map[string]interface{}{"filename": path, "paused": true})
+	require.Equal(t, "success", result)
+	assert.Equal(t, 2.0, arguments["torrent-added"].(map[string]interface{})["id"])
+
+	result, arguments = client.call("torrent-add", map[string]interface{}{"filename": path})
+	require.Equal(t, "success", result)
+	assert.Equal(t, 2.0, arguments["torrent-duplicate"].(map[string]interface{})["id"])
+
+	result, _ = client.call("torrent-add", map[string]interface{}{"filename": "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"})
+	assert.Contains(t, result, "BEP 9")
+	result, _ = client.call("torrent-add", map[string]interface{}{"filename": path, "download-dir": "/elsewhere"})
+	assert.Contains(t, result, "download-dir")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.torrents("status")[0]["status"] != float64(statusSeed) {
+		require.True(t, time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+	torrents := client.torrents("id", "name", "status", "percentDone", "totalSize", "leftUntilDone", "eta", "downloadDir", "noSuchField")
+	require.Len(t, torrents, 2)
+	assert.Equal(t, map[string]interface{}{
+		"id":            1.0,
+		"name":          "seed",
+		"status":        float64(statusSeed),
+		"percentDone":   1.0,
+		"totalSize":     100000.0,
+		"leftUntilDone": 0.0,
+		"eta":           0.0,
+		"downloadDir":   dataDir,
+	}, torrents[0])
+	assert.Equal(t, float64(statusStopped), torrents[1]["status"])
+	assert.Equal(t, 0.0, torrents[1]["percentDone"])
+
+	// 用 hash 字符串选择种子
+	hash := torrents[0]["id"]
+	_, arguments = client.call("torrent-get", map[string]interface{}{"fields": []string{"hashString"}, "ids": hash})
+	hashString := arguments["torrents"].([]interface{})[0].(map[string]interface{})["hashString"]
+	_, arguments = client.call("torrent-get", map[string]interface{}{"fields": []string{"id"}, "ids": []interface{}{hashString}})
+	assert.Equal(t, []interface{}{map[string]interface{}{"id": 1.0}}, arguments["torrents"])
+
+	result, _ = client.call("torrent-stop", map[string]interface{}{"ids": []int{1}})
+	require.Equal(t, "success", result)
+	assert.Equal(t, float64(statusStopped), client.torrents("status")[0]["status"])
+	result, _ = client.call("torrent-start", map[string]interface{}{"ids": 1})
+	require.Equal(t, "success", result)
+	assert.NotEqual(t, float64(statusStopped), client.torrents("status")[0]["status"])
+
+	result, _ = client.call("torrent-remove", map[string]interface{}{"ids": []int{2}, "delete-local-data": true})
+	require.Equal(t, "success", result)
+	require.Len(t, s.Torrents(), 1)
+	assert.Equal(t, "seed", s.Torrents()[0].File.Name)
+}
+
+func TestSessionSettings(t *testing.T) {
+	dataDir := t.TempDir()
+	client, s := startServer(t, dataDir)
+
+	result, arguments := client.call("session-get", nil)
+	require.Equal(t, "success", result)
+	assert.Equal(t, float64(rpcVersion), arguments["rpc-version"])
+	assert.Equal(t, dataDir, arguments["download-dir"])
+	assert.Equal(t, 51413.0, arguments["peer-port"])
+	assert.Equal(t, false, arguments["speed-limit-down-enabled"])
+	assert.Equal(t, "tolerated", arguments["encryption"])
+
+	result, _ = client.call("session-set", map[string]interface{}{
+		"speed-limit-down":         100,
+		"speed-limit-down-enabled": true,
+		"speed-limit-up":           50,
+		"download-queue-size":      2,
+		"download-queue-enabled":   true,
+		"peer-limit-per-torrent":   30,
+		"encryption":               "required",
+		"alt-speed-enabled":        false,
+	})
+	require.Equal(t, "success", result)
+	// speed-limit-up-enabled 还是关闭的
+	assert.Equal(t, session.Settings{
+		DownloadRate:       100000,
+		MaxActiveDownloads: 2,
+		MaxPeers:           30,
+		Encryption:         mse.PolicyRequire,
+	}, s.Settings())
+
+	result, _ = client.call("session-set", map[string]interface{}{"speed-limit-down-enabled": false})
+	require.Equal(t, "success", result)
+	assert.Equal(t, 0, s.Settings().DownloadRate)
+
+	result, _ = client.call("session-set", map[string]interface{}{"encryption": "sometimes"})
+	assert.NotEqual(t, "success", result)
+	result, _ = client.call("session-set", map[string]interface{}{"peer-limit-per-torrent": -1})
+	assert.NotEqual(t, "success", result)
+	assert.Equal(t, 30, s.Settings().MaxPeers)
+}
@@ -0,0 +1,245 @@
+package tui
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+)
+
+// 把一帧内容排成 height 行，每行正好 width 个字符
+
+const (
+	maxListRows  = 5 // 种子列表最多显示的行数，超过时跟着选中的种子滚动
+	pieceMapRows = 2
+	maxTrackers  = 2
+	reverse      = "\x1b[7m"
+	reset        = "\x1b[0m"
+)
+
+func render(f frame, width, height int) []string {
+	var lines []string
+	add := func(line string) {
+		lines = append(lines, fit(line, width))
+	}
+
+	var downloadRate, uploadRate int64
+	for _, view := range f.torrents {
+		downloadRate += view.status.DownloadRate
+		uploadRate += view.status.UploadRate
+	}
+	lines = append(lines, reverse+fit(fmt.Sprintf(" goMule  %d torrent(s)  down %s  up %s",
+		len(f.torrents), formatRate(downloadRate), formatRate(uploadRate)), width)+reset)
+
+	// 种子列表
+	nameWidth := width - 58
+	if nameWidth < 10 {
+		nameWidth = 10
+	}
+	add(fmt.Sprintf("  %-*s %-11s %7s %10s %10s %5s %8s", nameWidth, "NAME", "STATE", "DONE", "DOWN", "UP", "PEERS", "ETA"))
+	if len(f.torrents) == 0 {
+		add("  no torrents")
+	}
+	first := 0
+	if f.selected >= maxListRows {
+		first = f.selected - maxListRows + 1
+	}
+	for index := first; index < len(f.torrents) && index < first+maxListRows; index++ {
+		status := f.torrents[index].status
+		line := fit(fmt.Sprintf("  %-*s %-11s %7s %10s %10s %5d %8s", nameWidth, fit(status.Name, nameWidth), status.State,
+			formatPercent(status.Done, status.Wanted), formatRate(status.DownloadRate), formatRate(status.UploadRate),
+			len(status.Peers), formatETA(status.Left, status.DownloadRate)), width)
+		if index == f.selected {
+			line = reverse + line + reset
+		}
+		lines = append(lines, line)
+	}
+
+	// 选中的种子的详细信息
+	logRows := 3
+	if height >= 30 {
+		logRows = 6
+	}
+	if f.selected >= 0 {
+		view := f.torrents[f.selected]
+		add(title(view.status.Name+"  "+hex.EncodeToString(view.status.InfoHash[:]), width))
+		if view.status.Error != nil {
+			add(" error: " + view.status.Error.Error())
+		}
+		for _, row := range pieceMap(view.pieces, view.pieceCount, width-2, pieceMapRows) {
+			add(" " + row)
+		}
+		if len(view.trackers) == 0 {
+			add(" tracker: no announce yet")
+		}
+		for index, tracker := range view.trackers {
+			if index == maxTrackers {
+				add(fmt.Sprintf(" ... %d more tracker(s)", len(view.trackers)-maxTrackers))
+				break
+			}
+			add(" " + formatTracker(tracker))
+		}
+
+		add(fmt.Sprintf(" %-21s %-20s %10s %10s %5s %4s", "PEER", "CLIENT", "DOWN", "UP", "FLAGS", "REQS"))
+		// 剩下的行数留给 peer，日志区域、日志标题和最下面一行除外
+		peerRows := height - len(lines) - logRows - 2
+		for index, peer := range view.peers {
+			if index == peerRows-1 && len(view.peers) > peerRows {
+				add(fmt.Sprintf(" ... %d more peer(s)", len(view.peers)-index))
+				break
+			}
+			if index >= peerRows {
+				break
+			}
+			add(fmt.Sprintf(" %-21s %-20s %10s %10s %5s %4d", fit(peer.address, 21), fit(peer.client, 20),
+				formatRate(peer.downloadRate), formatRate(peer.uploadRate), peerFlags(peer), peer.backlog))
+		}
+	}
+
+	// 日志区域贴着最下面
+	for len(lines) < height-logRows-2 {
+		add("")
+	}
+	add(title("log", width))
+	logs := f.logs
+	if len(logs) > logRows {
+		logs = logs[len(logs)-logRows:]
+	}
+	for _, line := range logs {
+		add(" " + line)
+	}
+	for len(lines) < height-1 {
+		add("")
+	}
+
+	switch {
+	case f.confirm && f.selected >= 0:
+		add(fmt.Sprintf(" remove %s? the downloaded data is kept  y/n", f.torrents[f.selected].status.Name))
+	case f.message != "":
+		add(" " + f.message)
+	default:
+		add(" up/down select  p pause  r resume  x remove  q quit    flags: C choking us, I interested in us")
+	}
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	return lines
+}
+
+// 每个格子代表几个连续的 piece: 全部完成是 █，部分完成是 ▒，都没有完成是 ·
+// piece 比格子少时每个 piece 一个格子
+func pieceMap(pieces bitField.BitField, count, width, rows int) []string {
+	cells := width * rows
+	if count < cells {
+		cells = count
+	}
+	var builder strings.Builder
+	for cell := 0; cell < cells; cell++ {
+		first, last := cell*count/cells, (cell+1)*count/cells
+		done := 0
+		for index := first; index < last; index++ {
+			if pieces.HasPiece(index) {
+				done++
+			}
+		}
+		switch {
+		case done == last-first:
+			builder.WriteString("█")
+		case done > 0:
+			builder.WriteString("▒")
+		default:
+			builder.WriteString("·")
+		}
+	}
+	runes := []rune(builder.String())
+	var result []string
+	for len(runes) > 0 {
+		n := width
+		if n > len(runes) {
+			n = len(runes)
+		}
+		result = append(result, string(runes[:n]))
+		runes = runes[n:]
+	}
+	return result
+}
+
+func formatTracker(tracker trackerStatus) string {
+	ago := time.Since(tracker.Time).Round(time.Second)
+	if tracker.Err != nil {
+		return fmt.Sprintf("tracker %s  error %s ago: %s", tracker.URL, ago, tracker.Err)
+	}
+	return fmt.Sprintf("tracker %s  %d peer(s) %s ago in %s", tracker.URL, tracker.Peers, ago, tracker.Duration.Round(time.Millisecond))
+}
+
+func peerFlags(peer peerView) string {
+	flags := ""
+	if peer.choked {
+		flags += "C"
+	}
+	if peer.interested {
+		flags += "I"
+	}
+	if flags == "" {
+		return "-"
+	}
+	return flags
+}
+
+// ── text ─────
+func title(text string, width int) string {
+	line := "── " + text + " "
+	if n := width - utf8.RuneCountInString(line); n > 0 {
+		line += strings.Repeat("─", n)
+	}
+	return line
+}
+
+// 截断或者用空格补齐到 width 个字符
+func fit(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) > width {
+		if width <= 1 {
+			return string(runes[:width])
+		}
+		return string(runes[:width-1]) + "…"
+	}
+	return text + strings.Repeat(" ", width-len(runes))
+}
+
+func formatPercent(done, wanted int) string {
+	if wanted == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(done)/float64(wanted)*100)
+}
+
+func formatETA(left, rate int64) string {
+	if left <= 0 || rate <= 0 {
+		return "-"
+	}
+	return (time.Duration(left/rate) * time.Second).String()
+}
+
+func formatRate(rate int64) string {
+	return formatBytes(rate) + "/s"
+}
+
+// 把 byte 数量格式化成 1.5 MiB 这样的字符串
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	suffixes := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	index := -1
+	for value >= unit && index < len(suffixes)-1 {
+		value /= unit
+		index++
+	}
+	return fmt.Sprintf("%.1f %s", value, suffixes[index])
+}
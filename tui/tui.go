@@ -0,0 +1,389 @@
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	event "github.com/strugglebak/goMule/event"
+	peerId "github.com/strugglebak/goMule/peer_id"
+	session "github.com/strugglebak/goMule/session"
+)
+
+// 全屏的终端界面: 上面是种子列表，下面是选中的种子的 piece 分布、tracker 状态和 peer 列表，最下面是日志
+// 按键: ↑/↓ (或者 k/j) 选择种子，p 暂停，r 恢复，x 移除 (不删除数据)，q 退出
+
+const (
+	DefaultRefreshInterval = time.Second
+	MaxLogLines            = 500 // LogBuffer 保留的日志行数
+)
+
+// 输出不是终端时使用的大小
+const (
+	defaultWidth  = 100
+	defaultHeight = 30
+)
+
+// 终端的控制序列
+const (
+	enterScreen = "\x1b[?1049h\x1b[?25l" // 切换到备用屏幕并隐藏光标
+	leaveScreen = "\x1b[?25h\x1b[?1049l"
+	moveHome    = "\x1b[H"
+	clearLine   = "\x1b[K"
+	clearBelow  = "\x1b[J"
+)
+
+type UI struct {
+	ExitWhenDone    bool          // 所有种子都下载完成之后自动退出，download 命令使用
+	RefreshInterval time.Duration // 为 0 时使用 DefaultRefreshInterval
+	Log             *LogBuffer    // 显示在日志区域，界面运行时日志应该写到这里，为 nil 时日志区域是空的
+
+	session *session.Session
+	input   io.Reader
+	output  io.Writer
+	cancel  func() // 取消订阅事件
+
+	mutex    sync.Mutex
+	selected [20]byte // 选中的种子，被移除之后选中第一个
+	confirm  bool     // 正在确认是否移除选中的种子
+	message  string   // 最近一次操作的错误，显示在最下面
+	trackers map[[20]byte]map[string]trackerStatus
+	samples  map[string]peerSample // 上一次刷新时每个 peer 的流量，用来计算速度
+	sampled  time.Time
+}
+
+// 最近一次向 tracker 请求的结果
+type trackerStatus struct {
+	URL      string
+	Time     time.Time
+	Duration time.Duration
+	Peers    int
+	Err      error
+}
+
+type peerSample struct {
+	downloaded int64
+	uploaded   int64
+}
+
+// 创建之后就开始记录 tracker 的事件，最后必须调用 Run
+func New(s *session.Session, input io.Reader, output io.Writer) *UI {
+	ui := &UI{
+		session:  s,
+		input:    input,
+		output:   output,
+		trackers: map[[20]byte]map[string]trackerStatus{},
+		samples:  map[string]peerSample{},
+	}
+	ui.cancel = s.Events.Subscribe(ui.handleEvent)
+	return ui
+}
+
+func (ui *UI) handleEvent(e event.Event) {
+	if e.Type != event.TrackerAnnounced && e.Type != event.TrackerErrored {
+		return
+	}
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	if ui.trackers[e.InfoHash] == nil {
+		ui.trackers[e.InfoHash] = map[string]trackerStatus{}
+	}
+	ui.trackers[e.InfoHash][e.Tracker] = trackerStatus{
+		URL:      e.Tracker,
+		Time:     e.Time,
+		Duration: e.Duration,
+		Peers:    e.PeerCount,
+		Err:      e.Err,
+	}
+}
+
+// 显示界面直到按下 q，或者开启了 ExitWhenDone 时所有种子都下载完成
+// input 是终端时会切换到 raw 模式，返回前恢复
+func (ui *UI) Run() error {
+	defer ui.cancel()
+	if file, ok := ui.input.(*os.File); ok && term.IsTerminal(int(file.Fd())) {
+		state, err := term.MakeRaw(int(file.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(file.Fd()), state)
+	}
+	fmt.Fprint(ui.output, enterScreen)
+	defer fmt.Fprint(ui.output, leaveScreen)
+
+	// 读取输入的 goroutine 在返回之后可能还阻塞在 Read 上，进程退出时自然结束
+	keys := make(chan string)
+	go readKeys(ui.input, keys)
+
+	interval := ui.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		f := ui.snapshot()
+		width, height := ui.size()
+		ui.draw(render(f, width, height))
+		if ui.ExitWhenDone && f.done() {
+			return nil
+		}
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			if ui.handleKey(key) {
+				return nil
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ui *UI) size() (width, height int) {
+	if file, ok := ui.output.(*os.File); ok {
+		width, height, err := term.GetSize(int(file.Fd()))
+		if err == nil && width > 0 && height > 0 {
+			return width, height
+		}
+	}
+	return defaultWidth, defaultHeight
+}
+
+// raw 模式下换行需要 \r\n
+func (ui *UI) draw(lines []string) {
+	var buffer bytes.Buffer
+	buffer.WriteString(moveHome)
+	for index, line := range lines {
+		if index > 0 {
+			buffer.WriteString("\r\n")
+		}
+		buffer.WriteString(line)
+		buffer.WriteString(clearLine)
+	}
+	buffer.WriteString(clearBelow)
+	ui.output.Write(buffer.Bytes())
+}
+
+// 把输入拆成按键，方向键是 ESC [ A 这样的序列
+func readKeys(input io.Reader, keys chan<- string) {
+	defer close(keys)
+	buffer := make([]byte, 64)
+	for {
+		n, err := input.Read(buffer)
+		chunk := buffer[:n]
+		for len(chunk) > 0 {
+			if len(chunk) >= 3 && chunk[0] == 0x1b && chunk[1] == '[' {
+				switch chunk[2] {
+				case 'A':
+					keys <- "up"
+				case 'B':
+					keys <- "down"
+				}
+				chunk = chunk[3:]
+				continue
+			}
+			keys <- string(chunk[:1])
+			chunk = chunk[1:]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 处理一个按键，返回是否应该退出
+func (ui *UI) handleKey(key string) (quit bool) {
+	torrents := ui.session.Torrents()
+	ui.mutex.Lock()
+	index := selectedIndex(torrents, ui.selected)
+	confirm := ui.confirm
+	ui.confirm = false
+	ui.message = ""
+	ui.mutex.Unlock()
+
+	var err error
+	switch {
+	case confirm:
+		if key == "y" && index >= 0 {
+			err = ui.session.Remove(torrents[index].File.InfoHash, false)
+		}
+	case key == "q" || key == "\x03":
+		return true
+	case key == "up" || key == "k":
+		if index > 0 {
+			ui.selectTorrent(torrents[index-1])
+		}
+	case key == "down" || key == "j":
+		if index >= 0 && index+1 < len(torrents) {
+			ui.selectTorrent(torrents[index+1])
+		}
+	case index < 0:
+	case key == "p":
+		err = ui.session.Pause(torrents[index].File.InfoHash)
+	case key == "r":
+		err = ui.session.Resume(torrents[index].File.InfoHash)
+	case key == "x":
+		ui.mutex.Lock()
+		ui.confirm = true
+		ui.mutex.Unlock()
+	}
+	if err != nil {
+		ui.mutex.Lock()
+		ui.message = err.Error()
+		ui.mutex.Unlock()
+	}
+	return false
+}
+
+func (ui *UI) selectTorrent(t *session.Torrent) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	ui.selected = t.File.InfoHash
+}
+
+// 选中的种子在列表中的位置，没有选中或者已经被移除时是第一个，列表为空时是 -1
+func selectedIndex(torrents []*session.Torrent, selected [20]byte) int {
+	for index, t := range torrents {
+		if t.File.InfoHash == selected {
+			return index
+		}
+	}
+	if len(torrents) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// 一次刷新时界面上显示的所有内容
+type frame struct {
+	torrents []torrentView
+	selected int // 为 -1 时没有种子
+	confirm  bool
+	message  string
+	logs     []string
+}
+
+type torrentView struct {
+	status     session.Status
+	pieces     bitField.BitField
+	pieceCount int
+	trackers   []trackerStatus
+	peers      []peerView
+}
+
+type peerView struct {
+	address      string
+	client       string
+	downloadRate int64
+	uploadRate   int64
+	choked       bool
+	interested   bool
+	backlog      int
+}
+
+// 所有种子都下载完成，或者都被移除了
+func (f frame) done() bool {
+	for _, view := range f.torrents {
+		status := view.status
+		if status.State == session.StateSeeding {
+			continue
+		}
+		if status.State == session.StateQueued && status.Wanted > 0 && status.Done >= status.Wanted {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func (ui *UI) snapshot() frame {
+	torrents := ui.session.Torrents()
+	now := time.Now()
+
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	f := frame{
+		selected: selectedIndex(torrents, ui.selected),
+		confirm:  ui.confirm,
+		message:  ui.message,
+	}
+	if ui.Log != nil {
+		f.logs = ui.Log.Lines()
+	}
+	elapsed := now.Sub(ui.sampled).Seconds()
+	samples := map[string]peerSample{}
+	for _, t := range torrents {
+		status := t.Status()
+		view := torrentView{status: status, pieceCount: t.File.PieceCount()}
+		infoHashes := [][20]byte{t.File.InfoHash}
+		if t.File.IsHybrid() {
+			infoHashes = append(infoHashes, t.File.TruncatedInfoHashV2())
+		}
+		for _, infoHash := range infoHashes {
+			for _, tracker := range ui.trackers[infoHash] {
+				view.trackers = append(view.trackers, tracker)
+			}
+		}
+		sort.Slice(view.trackers, func(i, j int) bool { return view.trackers[i].URL < view.trackers[j].URL })
+		for _, peer := range status.Peers {
+			key := fmt.Sprintf("%x %s", status.InfoHash, peer.Peer)
+			sample := peerSample{downloaded: peer.Downloaded, uploaded: peer.Uploaded}
+			samples[key] = sample
+			pv := peerView{
+				address:    peer.Peer.String(),
+				client:     peerId.Describe(peer.PeerID),
+				choked:     peer.Choked,
+				interested: peer.Interested,
+				backlog:    peer.Backlog,
+			}
+			if previous, ok := ui.samples[key]; ok && elapsed > 0 {
+				pv.downloadRate = int64(float64(sample.downloaded-previous.downloaded) / elapsed)
+				pv.uploadRate = int64(float64(sample.uploaded-previous.uploaded) / elapsed)
+			}
+			view.peers = append(view.peers, pv)
+		}
+		// piece 分布只有选中的种子需要
+		if len(f.torrents) == f.selected {
+			view.pieces = t.Bitfield()
+		}
+		f.torrents = append(f.torrents, view)
+	}
+	ui.samples = samples
+	ui.sampled = now
+	return f
+}
+
+// 收集界面运行时的日志，只保留最后 MaxLogLines 行
+type LogBuffer struct {
+	mutex   sync.Mutex
+	lines   []string
+	partial string // 还没有遇到换行的部分
+}
+
+func (buffer *LogBuffer) Write(p []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	parts := strings.Split(buffer.partial+string(p), "\n")
+	buffer.partial = parts[len(parts)-1]
+	buffer.lines = append(buffer.lines, parts[:len(parts)-1]...)
+	if len(buffer.lines) > MaxLogLines {
+		buffer.lines = append([]string{}, buffer.lines[len(buffer.lines)-MaxLogLines:]...)
+	}
+	return len(p), nil
+}
+
+func (buffer *LogBuffer) Lines() []string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return append([]string{}, buffer.lines...)
+}
@@ -0,0 +1,220 @@
+package tui
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bitField "github.com/strugglebak/goMule/bit_field"
+	event "github.com/strugglebak/goMule/event"
+	p2p "github.com/strugglebak/goMule/p2p"
+	peers "github.com/strugglebak/goMule/peers"
+	session "github.com/strugglebak/goMule/session"
+	torrentFile "github.com/strugglebak/goMule/torrent_file"
+)
+
+// 在 dir 下生成一个随机内容的文件，返回它的种子
+func createTorrent(t *testing.T, dir, name string) []byte {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(int64(len(name)))).Read(data)
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, data, 0644))
+
+	var buffer bytes.Buffer
+	_, err := torrentFile.Create(path, torrentFile.CreateOptions{Announce: "http://127.0.0.1:1/announce", PieceLength: 16384}, &buffer)
+	require.Nil(t, err)
+	return buffer.Bytes()
+}
+
+func newTestSession(t *testing.T) *session.Session {
+	s, err := session.New(session.Config{DataDir: t.TempDir(), StateDir: t.TempDir()})
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// 去掉颜色之后的宽度
+func visibleWidth(line string) int {
+	line = strings.ReplaceAll(line, reverse, "")
+	line = strings.ReplaceAll(line, reset, "")
+	return utf8.RuneCountInString(line)
+}
+
+func TestRender(t *testing.T) {
+	f := frame{
+		selected: 0,
+		torrents: []torrentView{{
+			status: session.Status{
+				Name:         "debian.iso",
+				State:        session.StateDownloading,
+				Done:         5,
+				Wanted:       10,
+				DownloadRate: 2048,
+				Left:         4096,
+				Peers:        []p2p.PeerStatus{{}},
+				Error:        errors.New("disk full"),
+			},
+			pieces:     bitField.BitField{0xf8, 0},
+			pieceCount: 10,
+			trackers:   []trackerStatus{{URL: "http://tracker", Time: time.Now(), Peers: 12, Duration: 120 * time.Millisecond}},
+			peers: []peerView{{
+				address:      "192.0.2.1:6881",
+				client:       "qBittorrent 4.3.9",
+				downloadRate: 1024,
+				choked:       true,
+				interested:   true,
+				backlog:      5,
+			}},
+		}},
+		logs: []string{"first", "second"},
+	}
+	lines := render(f, 120, 30)
+	require.Len(t, lines, 30)
+	for _, line := range lines {
+		assert.Equal(t, 120, visibleWidth(line), line)
+	}
+	output := strings.Join(lines, "\n")
+	assert.Contains(t, output, "debian.iso")
+	assert.Contains(t, output, "downloading")
+	assert.Contains(t, output, "50.0%")
+	assert.Contains(t, output, "2.0 KiB/s")
+	assert.Contains(t, output, "error: disk full")
+	assert.Contains(t, output, " █████·····")
+	assert.Contains(t, output, "tracker http://tracker  12 peer(s)")
+	assert.Contains(t, output, "qBittorrent 4.3.9")
+	assert.Contains(t, output, " CI ")
+	// 日志区域在最下面 6 行
+	assert.Contains(t, lines[len(lines)-8], "── log ")
+	assert.Contains(t, lines[len(lines)-7], "first")
+	assert.Contains(t, lines[len(lines)-6], "second")
+	assert.Contains(t, lines[len(lines)-1], "q quit")
+
+	// 确认移除时最下面一行是提示
+	f.confirm = true
+	lines = render(f, 120, 30)
+	assert.Contains(t, lines[len(lines)-1], "remove debian.iso?")
+
+	// 没有种子、终端很小时也不会出错
+	lines = render(frame{selected: -1}, 20, 5)
+	assert.Len(t, lines, 5)
+	assert.Contains(t, strings.Join(lines, "\n"), "no torrents")
+}
+
+func TestPieceMap(t *testing.T) {
+	pieces := bitField.BitField{0xf0, 0x0f}
+	// piece 比格子少时每个 piece 一个格子
+	assert.Equal(t, []string{"████····", "····████"}, pieceMap(pieces, 16, 8, 4))
+	// 每个格子两个 piece
+	assert.Equal(t, []string{"██··", "··██"}, pieceMap(pieces, 16, 4, 2))
+	// 每个格子四个 piece，有的格子只完成了一部分
+	assert.Equal(t, []string{"▒▒"}, pieceMap(bitField.BitField{0x18}, 8, 2, 1))
+	assert.Empty(t, pieceMap(nil, 0, 10, 2))
+}
+
+func TestHandleKey(t *testing.T) {
+	s := newTestSession(t)
+	first, err := s.Add(createTorrent(t, t.TempDir(), "first"), session.AddOptions{Paused: true})
+	require.Nil(t, err)
+	second, err := s.Add(createTorrent(t, t.TempDir(), "second"), session.AddOptions{Paused: true})
+	require.Nil(t, err)
+	ui := New(s, strings.NewReader(""), ioutil.Discard)
+	defer ui.cancel()
+
+	assert.Equal(t, 0, ui.snapshot().selected)
+	assert.False(t, ui.handleKey("down"))
+	assert.Equal(t, 1, ui.snapshot().selected)
+	assert.False(t, ui.handleKey("down"))
+	assert.Equal(t, 1, ui.snapshot().selected)
+	assert.False(t, ui.handleKey("k"))
+	assert.Equal(t, 0, ui.snapshot().selected)
+
+	// 取消移除
+	ui.handleKey("x")
+	assert.True(t, ui.snapshot().confirm)
+	ui.handleKey("n")
+	assert.False(t, ui.snapshot().confirm)
+	assert.Len(t, s.Torrents(), 2)
+
+	// 移除之后选中剩下的种子
+	ui.handleKey("x")
+	ui.handleKey("y")
+	_, ok := s.Get(first.File.InfoHash)
+	assert.False(t, ok)
+	f := ui.snapshot()
+	assert.Equal(t, 0, f.selected)
+	assert.Equal(t, "second", f.torrents[0].status.Name)
+
+	// 已经暂停的种子再暂停没有影响
+	ui.handleKey("p")
+	assert.Equal(t, session.StatePaused, second.Status().State)
+	assert.Empty(t, ui.snapshot().message)
+
+	assert.True(t, ui.handleKey("q"))
+	assert.True(t, ui.handleKey("\x03"))
+}
+
+func TestTrackerStatus(t *testing.T) {
+	s := newTestSession(t)
+	torrent, err := s.Add(createTorrent(t, t.TempDir(), "tracked"), session.AddOptions{Paused: true})
+	require.Nil(t, err)
+	ui := New(s, strings.NewReader(""), ioutil.Discard)
+	defer ui.cancel()
+
+	s.Events.Publish(event.Event{Type: event.TrackerErrored, InfoHash: torrent.File.InfoHash, Tracker: "http://b", Err: errors.New("refused")})
+	s.Events.Publish(event.Event{Type: event.TrackerAnnounced, InfoHash: torrent.File.InfoHash, Tracker: "http://a", PeerCount: 3})
+	s.Events.Publish(event.Event{Type: event.PeerConnected, InfoHash: torrent.File.InfoHash, Peer: peers.Peer{}})
+	trackers := ui.snapshot().torrents[0].trackers
+	require.Len(t, trackers, 2)
+	assert.Equal(t, "http://a", trackers[0].URL)
+	assert.Equal(t, 3, trackers[0].Peers)
+	assert.EqualError(t, trackers[1].Err, "refused")
+}
+
+func TestRun(t *testing.T) {
+	s := newTestSession(t)
+	_, err := s.Add(createTorrent(t, s.DataDir(), "complete"), session.AddOptions{})
+	require.Nil(t, err)
+
+	// 数据已经完整，校验之后就可以退出
+	input, _ := io.Pipe()
+	var output bytes.Buffer
+	ui := New(s, input, &output)
+	ui.ExitWhenDone = true
+	ui.RefreshInterval = 10 * time.Millisecond
+	result := make(chan error)
+	go func() { result <- ui.Run() }()
+	select {
+	case err := <-result:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not exit after the download completed")
+	}
+	assert.True(t, strings.HasPrefix(output.String(), enterScreen))
+	assert.True(t, strings.HasSuffix(output.String(), leaveScreen))
+	assert.Contains(t, output.String(), "complete")
+
+	// 按 q 退出
+	ui = New(s, strings.NewReader("jq"), ioutil.Discard)
+	assert.Nil(t, ui.Run())
+}
+
+func TestLogBuffer(t *testing.T) {
+	buffer := &LogBuffer{}
+	buffer.Write([]byte("one\ntw"))
+	buffer.Write([]byte("o\n"))
+	assert.Equal(t, []string{"one", "two"}, buffer.Lines())
+	for index := 0; index < MaxLogLines+10; index++ {
+		buffer.Write([]byte("line\n"))
+	}
+	assert.Len(t, buffer.Lines(), MaxLogLines)
+}